@@ -8,7 +8,9 @@ import (
 	"github.com/pion/ion-sfu/pkg/middlewares/datachannel"
 
 	"github.com/pion/ion-sfu/cmd/signal/grpc/server"
+	hlsServer "github.com/pion/ion-sfu/cmd/signal/hls/server"
 	jsonrpcServer "github.com/pion/ion-sfu/cmd/signal/json-rpc/server"
+	whipServer "github.com/pion/ion-sfu/cmd/signal/whip/server"
 	"github.com/pion/ion-sfu/pkg/sfu"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
@@ -22,6 +24,7 @@ import (
 
 type Server struct {
 	sfu    *sfu.SFU
+	hls    *sfu.HLSServer
 	logger logr.Logger
 }
 
@@ -33,6 +36,7 @@ func New(c sfu.Config, logger logr.Logger) *Server { // Register default middlew
 	dc.Use(datachannel.SubscriberAPI)
 	return &Server{
 		sfu:    s,
+		hls:    sfu.NewHLSServer(s, c.HLS),
 		logger: logger,
 	}
 }
@@ -66,6 +70,13 @@ func (s *Server) ServeJSONRPC(jaddr, cert, key string) error {
 		<-jc.DisconnectNotify()
 	}))
 
+	wh := whipServer.NewWHIP(s.sfu, whipServer.Config{}, s.logger)
+	http.Handle(wh.Prefix(), wh)
+	we := whipServer.NewWHEP(s.sfu, whipServer.Config{}, s.logger)
+	http.Handle(we.Prefix(), we)
+	hs := hlsServer.NewHLS(s.hls, hlsServer.Config{}, s.logger)
+	http.Handle(hs.Prefix(), hs)
+
 	var err error
 	if key != "" && cert != "" {
 		s.logger.Info("JsonRPC Listening", "addr", "https://"+jaddr)
@@ -0,0 +1,70 @@
+// Package server serves the streams of the sessions with Low-Latency HLS, to
+// play them in browsers and players without WebRTC.
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pion/ion-sfu/pkg/sfu"
+)
+
+// Config of the HLS endpoint
+type Config struct {
+	// Prefix of the URL path the handler is mounted on, "/hls/" by default.
+	// Players load <prefix><session id>/<stream id>/index.m3u8.
+	Prefix string
+}
+
+// HLS serves the playlists and the segments of the session streams, a stream
+// is packaged from its first request until it is no longer requested
+type HLS struct {
+	streams *sfu.HLSServer
+	config  Config
+	logger  logr.Logger
+}
+
+// NewHLS returns a HLS handler of the streams
+func NewHLS(streams *sfu.HLSServer, c Config, l logr.Logger) *HLS {
+	if c.Prefix == "" {
+		c.Prefix = "/hls/"
+	}
+	if !strings.HasSuffix(c.Prefix, "/") {
+		c.Prefix += "/"
+	}
+	return &HLS{
+		streams: streams,
+		config:  c,
+		logger:  l,
+	}
+}
+
+// Prefix of the URL path the handler must be mounted on
+func (h *HLS) Prefix() string {
+	return h.config.Prefix
+}
+
+// ServeHTTP serves the files of <prefix><session id>/<stream id>/<file>
+func (h *HLS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, h.config.Prefix), "/")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+	case len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "":
+		http.NotFound(w, r)
+	default:
+		muxer, err := h.streams.Muxer(parts[0], parts[1])
+		if err != nil {
+			h.logger.V(1).Info("HLS stream not available", "session_id", parts[0], "stream_id", parts[1], "err", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		muxer.ServeHTTP(w, r)
+	}
+}
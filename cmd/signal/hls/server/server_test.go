@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHLS_ServeHTTP(t *testing.T) {
+	h := NewHLS(nil, Config{Prefix: "/live"}, logr.Discard())
+	assert.Equal(t, "/live/", h.Prefix())
+	assert.Equal(t, "/hls/", NewHLS(nil, Config{}, logr.Discard()).Prefix())
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{name: "options", method: http.MethodOptions, path: "/live/room/stream/index.m3u8", status: http.StatusNoContent},
+		{name: "post", method: http.MethodPost, path: "/live/room/stream/index.m3u8", status: http.StatusMethodNotAllowed},
+		{name: "no stream", method: http.MethodGet, path: "/live/room/index.m3u8", status: http.StatusNotFound},
+		{name: "no file", method: http.MethodGet, path: "/live/room/stream/", status: http.StatusNotFound},
+		{name: "too long", method: http.MethodGet, path: "/live/room/stream/a/index.m3u8", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+		})
+	}
+}
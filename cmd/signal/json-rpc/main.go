@@ -10,7 +10,9 @@ import (
 	"os"
 
 	"github.com/gorilla/websocket"
+	hls "github.com/pion/ion-sfu/cmd/signal/hls/server"
 	"github.com/pion/ion-sfu/cmd/signal/json-rpc/server"
+	whip "github.com/pion/ion-sfu/cmd/signal/whip/server"
 	log "github.com/pion/ion-sfu/pkg/logger"
 	"github.com/pion/ion-sfu/pkg/middlewares/datachannel"
 	"github.com/pion/ion-sfu/pkg/sfu"
@@ -178,6 +180,13 @@ func main() {
 		<-jc.DisconnectNotify()
 	}))
 
+	wh := whip.NewWHIP(s, whip.Config{}, logger)
+	http.Handle(wh.Prefix(), wh)
+	we := whip.NewWHEP(s, whip.Config{}, logger)
+	http.Handle(we.Prefix(), we)
+	hs := hls.NewHLS(sfu.NewHLSServer(s, conf.HLS), hls.Config{}, logger)
+	http.Handle(hs.Prefix(), hs)
+
 	go startMetrics(metricsAddr)
 
 	var err error
@@ -39,7 +39,8 @@ func NewJSONSignal(p *sfu.PeerLocal, l logr.Logger) *JSONSignal {
 	return &JSONSignal{p, l}
 }
 
-// Handle incoming RPC call events like join, answer, offer and trickle
+// Handle incoming RPC call events like join, answer, offer, trickle and the
+// session recording start and stop
 func (p *JSONSignal) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	replyError := func(err error) {
 		_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
@@ -117,6 +118,28 @@ func (p *JSONSignal) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonr
 			replyError(err)
 		}
 
+	case "startrecording":
+		if p.Session() == nil {
+			replyError(sfu.ErrNoTransportEstablished)
+			break
+		}
+		if err := p.Session().StartRecording(); err != nil {
+			replyError(err)
+			break
+		}
+		_ = conn.Reply(ctx, req.ID, nil)
+
+	case "stoprecording":
+		if p.Session() == nil {
+			replyError(sfu.ErrNoTransportEstablished)
+			break
+		}
+		if err := p.Session().StopRecording(); err != nil {
+			replyError(err)
+			break
+		}
+		_ = conn.Reply(ctx, req.ID, nil)
+
 	case "trickle":
 		var trickle Trickle
 		err := json.Unmarshal(*req.Params, &trickle)
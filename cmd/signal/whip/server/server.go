@@ -0,0 +1,290 @@
+// Package server implements the WHIP (WebRTC-HTTP ingestion protocol) and
+// WHEP (WebRTC-HTTP egress protocol) endpoints, to publish to the SFU from
+// encoders like OBS and GStreamer and to play sessions with standard players.
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/sfu"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mimeTypeSDP         = "application/sdp"
+	mimeTypeTrickleFrag = "application/trickle-ice-sdpfrag"
+
+	maxBodySize = 1 << 20
+)
+
+var (
+	errUnauthorized       = errors.New("unauthorized")
+	errICERestart         = errors.New("ice restart not supported")
+	errResourceNotFound   = errors.New("resource not found")
+	errUnsupportedMedia   = errors.New("unsupported media type")
+	errMissingSessionID   = errors.New("missing session id")
+	errMethodNotSupported = errors.New("method not supported")
+)
+
+// Config of the WHIP and WHEP endpoints
+type Config struct {
+	// Prefix of the URL path the handler is mounted on, "/whip/" or "/whep/"
+	// by default. Clients POST their offer to <prefix><session id>.
+	Prefix string
+	// Session maps the session id of the URL path and the bearer token of the
+	// request to the SFU session id, an error rejects the request. The path
+	// session id is used when nil.
+	Session func(pathID, token string) (sid string, err error)
+}
+
+// endpoint handles the peers of the WHIP and WHEP sessions, the POST of the
+// offer creates a resource that is updated with PATCH and deleted with DELETE.
+type endpoint struct {
+	sync.Mutex
+	name      string
+	provider  sfu.SessionProvider
+	config    Config
+	logger    logr.Logger
+	join      sfu.JoinConfig
+	answer    func(p *sfu.PeerLocal, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error)
+	transport func(p *sfu.PeerLocal) *webrtc.PeerConnection
+	resources map[string]*resource
+}
+
+type resource struct {
+	peer  *sfu.PeerLocal
+	token string
+}
+
+func newEndpoint(name string, provider sfu.SessionProvider, c Config, l logr.Logger) *endpoint {
+	if c.Prefix == "" {
+		c.Prefix = "/" + strings.ToLower(name) + "/"
+	}
+	if !strings.HasSuffix(c.Prefix, "/") {
+		c.Prefix += "/"
+	}
+	return &endpoint{
+		name:      name,
+		provider:  provider,
+		config:    c,
+		logger:    l,
+		resources: make(map[string]*resource),
+	}
+}
+
+// Prefix of the URL path the handler must be mounted on
+func (h *endpoint) Prefix() string {
+	return h.config.Prefix
+}
+
+// ServeHTTP routes the WHIP and WHEP requests
+func (h *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, h.config.Prefix), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+		w.Header().Set("Accept-Post", mimeTypeSDP)
+		w.WriteHeader(http.StatusNoContent)
+	case path == "":
+		http.Error(w, errMissingSessionID.Error(), http.StatusNotFound)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		h.create(w, r, parts[0])
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		h.trickle(w, r, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		h.delete(w, r, parts[1])
+	default:
+		http.Error(w, errMethodNotSupported.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// create joins a peer to the session and answers its offer, the answer has
+// all the SFU candidates for clients that do not trickle.
+func (h *endpoint) create(w http.ResponseWriter, r *http.Request, pathID string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), mimeTypeSDP) {
+		http.Error(w, errUnsupportedMedia.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	token := bearerToken(r)
+	sid := pathID
+	if h.config.Session != nil {
+		var err error
+		if sid, err = h.config.Session(pathID, token); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	offer, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := cuid.New()
+	peer := sfu.NewPeer(h.provider)
+	if err = peer.Join(sid, id, h.join); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	peer.OnICEConnectionStateChange = func(s webrtc.ICEConnectionState) {
+		if s == webrtc.ICEConnectionStateFailed || s == webrtc.ICEConnectionStateClosed {
+			h.remove(id)
+		}
+	}
+	pc := h.transport(peer)
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if _, err = h.answer(peer, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		_ = peer.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-r.Context().Done():
+		_ = peer.Close()
+		return
+	}
+
+	h.Lock()
+	h.resources[id] = &resource{peer: peer, token: token}
+	h.Unlock()
+	h.logger.V(0).Info(h.name+" peer joined", "session_id", sid, "peer_id", id)
+
+	w.Header().Set("Content-Type", mimeTypeSDP)
+	w.Header().Set("Location", h.config.Prefix+pathID+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(pc.LocalDescription().SDP))
+}
+
+// trickle adds the remote candidates of a SDP fragment
+func (h *endpoint) trickle(w http.ResponseWriter, r *http.Request, id string) {
+	res, err := h.resource(r, id)
+	if err != nil {
+		http.Error(w, err.Error(), statusCode(err))
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), mimeTypeTrickleFrag) {
+		http.Error(w, errUnsupportedMedia.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	frag, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	candidates, ufrag := parseSDPFragment(string(frag))
+	pc := h.transport(res.peer)
+	if remote := pc.RemoteDescription(); ufrag != "" && remote != nil &&
+		!strings.Contains(remote.SDP, "a=ice-ufrag:"+ufrag+"\r\n") {
+		http.Error(w, errICERestart.Error(), http.StatusNotImplemented)
+		return
+	}
+	for _, c := range candidates {
+		if err = pc.AddICECandidate(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// delete closes the peer
+func (h *endpoint) delete(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.resource(r, id); err != nil {
+		http.Error(w, err.Error(), statusCode(err))
+		return
+	}
+	h.remove(id)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *endpoint) resource(r *http.Request, id string) (*resource, error) {
+	h.Lock()
+	res, ok := h.resources[id]
+	h.Unlock()
+	if !ok {
+		return nil, errResourceNotFound
+	}
+	if res.token != "" && bearerToken(r) != res.token {
+		return nil, errUnauthorized
+	}
+	return res, nil
+}
+
+func (h *endpoint) remove(id string) {
+	h.Lock()
+	res, ok := h.resources[id]
+	delete(h.resources, id)
+	h.Unlock()
+	if !ok {
+		return
+	}
+	if err := res.peer.Close(); err != nil {
+		h.logger.Error(err, "Error closing "+h.name+" peer", "peer_id", id)
+	}
+	h.logger.V(0).Info(h.name+" peer left", "peer_id", id)
+}
+
+func statusCode(err error) int {
+	switch err {
+	case errResourceNotFound:
+		return http.StatusNotFound
+	case errUnauthorized:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// parseSDPFragment returns the candidates of a trickle SDP fragment with the
+// mid of their media section, and the ICE username fragment
+func parseSDPFragment(frag string) (candidates []webrtc.ICECandidateInit, ufrag string) {
+	var mid *string
+	var index uint16
+	first := true
+	s := bufio.NewScanner(strings.NewReader(frag))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if !first {
+				index++
+			}
+			first = false
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			i := index
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: &i,
+			})
+		}
+	}
+	return candidates, ufrag
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSDPFragment(t *testing.T) {
+	frag := "a=ice-ufrag:EsAw\r\n" +
+		"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"m=audio 9 RTP/AVP 0\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0\r\n" +
+		"m=video 9 RTP/AVP 0\r\n" +
+		"a=mid:1\r\n" +
+		"a=candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ host generation 0\r\n"
+	candidates, ufrag := parseSDPFragment(frag)
+	assert.Equal(t, "EsAw", ufrag)
+	if assert.Len(t, candidates, 2) {
+		assert.Equal(t, "candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host generation 0", candidates[0].Candidate)
+		assert.Equal(t, "0", *candidates[0].SDPMid)
+		assert.Equal(t, uint16(0), *candidates[0].SDPMLineIndex)
+		assert.Equal(t, "1", *candidates[1].SDPMid)
+		assert.Equal(t, uint16(1), *candidates[1].SDPMLineIndex)
+	}
+}
+
+func TestWHIP_resources(t *testing.T) {
+	h := NewWHIP(nil, Config{Prefix: "/whip"}, logr.Discard())
+	assert.Equal(t, "/whip/", h.Prefix())
+
+	h.resources["peer"] = &resource{token: "secret"}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "options", method: http.MethodOptions, path: "/whip/room", status: http.StatusNoContent},
+		{name: "no session", method: http.MethodPost, path: "/whip/", status: http.StatusNotFound},
+		{name: "wrong content type", method: http.MethodPost, path: "/whip/room", status: http.StatusUnsupportedMediaType},
+		{name: "unknown resource", method: http.MethodDelete, path: "/whip/room/other", status: http.StatusNotFound},
+		{name: "wrong token", method: http.MethodDelete, path: "/whip/room/peer", token: "other", status: http.StatusUnauthorized},
+		{name: "get", method: http.MethodGet, path: "/whip/room", status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestNewWHEP(t *testing.T) {
+	h := NewWHEP(nil, Config{}, logr.Discard())
+	assert.Equal(t, "/whep/", h.Prefix())
+	assert.True(t, h.join.NoPublish)
+	assert.True(t, h.join.RemoteSubscriberOffer)
+}
+
+func Test_bearerToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/whip/room", nil)
+	assert.Equal(t, "", bearerToken(r))
+	r.Header.Set("Authorization", "bearer abc ")
+	assert.Equal(t, "abc", bearerToken(r))
+}
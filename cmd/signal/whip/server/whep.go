@@ -0,0 +1,25 @@
+package server
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/pion/ion-sfu/pkg/sfu"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHEP handles the viewers, each POST joins a peer that only subscribes and
+// the SFU answers the offer of the player. The tracks are sent on the offered
+// transceivers, so players offer one per track they want to play.
+type WHEP struct {
+	*endpoint
+}
+
+// NewWHEP returns a WHEP handler playing the sessions of the provider
+func NewWHEP(provider sfu.SessionProvider, c Config, l logr.Logger) *WHEP {
+	e := newEndpoint("WHEP", provider, c, l)
+	e.join = sfu.JoinConfig{NoPublish: true, RemoteSubscriberOffer: true}
+	e.answer = (*sfu.PeerLocal).AnswerSubscriber
+	e.transport = func(p *sfu.PeerLocal) *webrtc.PeerConnection {
+		return p.Subscriber().PeerConnection()
+	}
+	return &WHEP{endpoint: e}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/pion/ion-sfu/pkg/sfu"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHIP handles the publishers, each POST joins a peer that only publishes
+type WHIP struct {
+	*endpoint
+}
+
+// NewWHIP returns a WHIP handler publishing to the sessions of the provider
+func NewWHIP(provider sfu.SessionProvider, c Config, l logr.Logger) *WHIP {
+	e := newEndpoint("WHIP", provider, c, l)
+	e.join = sfu.JoinConfig{NoSubscribe: true}
+	e.answer = (*sfu.PeerLocal).Answer
+	e.transport = func(p *sfu.PeerLocal) *webrtc.PeerConnection {
+		return p.Publisher().PeerConnection()
+	}
+	return &WHIP{endpoint: e}
+}
@@ -22,12 +22,20 @@ Bufferは着信RTPパケットのバッファリング、再送制御、統計
   - パケット損失率の計算
   - ジッター（パケット到着時間のばらつき）測定
   - ビットレートの推定
+  - SVC（VP9、AV1）の空間レイヤーごとのビットレート（下位レイヤーを含む）
   - Sender Reportデータの保存
 
 5. コーデック固有の処理
   - VP8: Temporal Layer検出、キーフレーム判定
-  - H.264: キーフレーム判定
-  - Audio: 音声レベル検出
+  - VP9: Spatial/Temporal Layer検出、キーフレーム判定
+  - AV1: キーフレーム判定、Dependency DescriptorによるSpatial/Temporal Layer検出
+  - H.264: キーフレーム判定、最新のSPS/PPSのキャッシュ
+  - H.265: キーフレーム判定（IRAP、パラメータセット）
+  - Audio: 音声レベル検出、音声活動（RFC 6464のVビット）の検出
+
+6. RTX（RFC 4588）
+  - RTXストリームのBufferを修復対象のBufferに紐付け（BindRTX）
+  - 先頭2バイトのOSN（元のシーケンス番号）を取り除き、元のパケットに復元して書き込み
 
 【アーキテクチャ】
 - Bucketを使用した循環バッファ
@@ -78,6 +86,9 @@ type ExtPacket struct {
 	Packet   rtp.Packet
 	Payload  interface{}
 	KeyFrame bool
+	// ParameterSets is a H.264 STAP-A with the last SPS/PPS of the stream,
+	// set on keyframes that do not carry them
+	ParameterSets []byte
 }
 
 // Buffer contains all packets
@@ -97,6 +108,7 @@ type Buffer struct {
 	lastReport int64
 	twccExt    uint8
 	audioExt   uint8
+	ddExt      uint8
 	bound      bool
 	closed     atomicBool
 	mime       string
@@ -107,11 +119,18 @@ type Buffer struct {
 	twcc       bool
 	audioLevel bool
 
-	minPacketProbe     int
-	lastPacketRead     int
-	maxTemporalLayer   int32
-	bitrate            uint64
-	bitrateHelper      uint64
+	minPacketProbe    int
+	lastPacketRead    int
+	maxTemporalLayer  int32
+	ddStructure       *FrameDependencyStructure
+	h264SPS           []byte
+	h264PPS           []byte
+	h264ParameterSets []byte
+	bitrate           uint64
+	bitrateHelper     uint64
+	// Bitrates of the spatial layers of a SVC stream, including the lower layers
+	spatialBitrate     [3]uint64
+	spatialBytes       [3]uint64
 	lastSRNTPTime      uint64
 	lastSRRTPTime      uint32
 	lastSRRecv         int64 // Represents wall clock of the most recent sender report arrival
@@ -127,9 +146,15 @@ type Buffer struct {
 	latestTimestamp     uint32 // latest received RTP timestamp on packet
 	latestTimestampTime int64  // Time of the latest timestamp (in nanos since unix epoch)
 
+	// RTX stream, the repaired buffer and its payload type
+	repaired   *Buffer
+	repairedPT uint8
+
 	// callbacks
 	onClose      func()
+	onPending    func(pkt []byte)
 	onAudioLevel func(level uint8)
+	onVoice      func(level uint8, voice bool)
 	feedbackCB   func([]rtcp.Packet)
 	feedbackTWCC func(sn uint16, timeNS int64, marker bool)
 
@@ -191,6 +216,11 @@ func (b *Buffer) Bind(params webrtc.RTPParameters, o Options) {
 	}
 
 	if b.codecType == webrtc.RTPCodecTypeVideo {
+		for _, ext := range params.HeaderExtensions {
+			if ext.URI == DependencyDescriptorURI {
+				b.ddExt = uint8(ext.ID)
+			}
+		}
 		for _, fb := range codec.RTCPFeedback {
 			switch fb.Type {
 			case webrtc.TypeRTCPFBGoogREMB:
@@ -226,13 +256,20 @@ func (b *Buffer) Bind(params webrtc.RTPParameters, o Options) {
 // Write adds a RTP Packet, out of order, new packet may be arrived later
 func (b *Buffer) Write(pkt []byte) (n int, err error) {
 	b.Lock()
-	defer b.Unlock()
 
 	if b.closed.get() {
+		b.Unlock()
 		err = io.EOF
 		return
 	}
 
+	if repaired := b.repaired; repaired != nil {
+		pt := b.repairedPT
+		b.Unlock()
+		b.writeRTX(repaired, pt, pkt)
+		return
+	}
+
 	if !b.bound {
 		packet := make([]byte, len(pkt))
 		copy(packet, pkt)
@@ -240,14 +277,59 @@ func (b *Buffer) Write(pkt []byte) (n int, err error) {
 			packet:      packet,
 			arrivalTime: time.Now().UnixNano(),
 		})
+		onPending := b.onPending
+		b.Unlock()
+		if onPending != nil {
+			onPending(packet)
+		}
 		return
 	}
 
 	b.calc(pkt, time.Now().UnixNano())
+	b.Unlock()
 
 	return
 }
 
+// BindRTX makes the buffer the RTX (RFC 4588) stream of the repaired buffer,
+// the packets are restored with the payload type and written to it.
+func (b *Buffer) BindRTX(repaired *Buffer, payloadType uint8) {
+	b.Lock()
+	if b.bound || b.repaired != nil {
+		b.Unlock()
+		return
+	}
+	b.repaired = repaired
+	b.repairedPT = payloadType
+	// Pending packets are kept, they are still read by the transport
+	pending := b.pPackets
+	b.Unlock()
+
+	for _, pp := range pending {
+		b.writeRTX(repaired, payloadType, pp.packet)
+	}
+}
+
+// writeRTX restores the original packet, the RTX payload starts with the
+// original sequence number
+func (b *Buffer) writeRTX(repaired *Buffer, payloadType uint8, pkt []byte) {
+	var p rtp.Packet
+	if err := p.Unmarshal(pkt); err != nil || len(p.Payload) < 2 {
+		// Padding only packets are used for probing
+		return
+	}
+	p.SequenceNumber = binary.BigEndian.Uint16(p.Payload[:2])
+	p.Payload = p.Payload[2:]
+	p.SSRC = repaired.mediaSSRC
+	p.PayloadType = payloadType
+	p.PaddingSize = 0
+	raw, err := p.Marshal()
+	if err != nil {
+		return
+	}
+	_, _ = repaired.Write(raw)
+}
+
 func (b *Buffer) Read(buff []byte) (n int, err error) {
 	for {
 		if b.closed.get() {
@@ -300,7 +382,9 @@ func (b *Buffer) Close() error {
 			b.audioPool.Put(b.bucket.src)
 		}
 		b.closed.set(true)
-		b.onClose()
+		if b.onClose != nil {
+			b.onClose()
+		}
 	})
 	return nil
 }
@@ -375,8 +459,45 @@ func (b *Buffer) calc(pkt []byte, arrivalTime int64) {
 		}
 		ep.Payload = vp8Packet
 		ep.KeyFrame = vp8Packet.IsKeyFrame
+	case "video/vp9":
+		vp9Packet := VP9{}
+		if err := vp9Packet.Unmarshal(p.Payload); err != nil {
+			return
+		}
+		ep.Payload = vp9Packet
+		ep.KeyFrame = vp9Packet.IsKeyFrame
 	case "video/h264":
 		ep.KeyFrame = isH264Keyframe(p.Payload)
+		sps, pps := getH264ParameterSets(p.Payload)
+		if sps != nil || pps != nil {
+			b.updateH264ParameterSets(sps, pps)
+		} else if ep.KeyFrame {
+			ep.ParameterSets = b.h264ParameterSets
+		}
+	case "video/h265":
+		ep.KeyFrame = isH265Keyframe(p.Payload)
+	case "video/av1":
+		ep.KeyFrame = isAV1Keyframe(p.Payload)
+		if ext := p.GetExtension(b.ddExt); b.ddExt != 0 && ext != nil {
+			dd := DependencyDescriptor{}
+			if err := dd.Unmarshal(ext, b.ddStructure); err == nil {
+				if dd.AttachedStructure != nil {
+					b.ddStructure = dd.AttachedStructure
+				}
+				ep.Payload = dd
+			}
+		}
+	}
+
+	switch pld := ep.Payload.(type) {
+	case VP9:
+		if pld.LayerIndices && pld.SID < 3 {
+			b.spatialBytes[pld.SID] += uint64(len(pkt))
+		}
+	case DependencyDescriptor:
+		if sid := pld.SpatialID(); sid >= 0 && sid < 3 {
+			b.spatialBytes[sid] += uint64(len(pkt))
+		}
 	}
 
 	if b.minPacketProbe < 25 {
@@ -384,12 +505,17 @@ func (b *Buffer) calc(pkt []byte, arrivalTime int64) {
 			b.baseSN = sn
 		}
 
-		if b.mime == "video/vp8" {
-			pld := ep.Payload.(VP8)
-			mtl := atomic.LoadInt32(&b.maxTemporalLayer)
-			if mtl < int32(pld.TID) {
-				atomic.StoreInt32(&b.maxTemporalLayer, int32(pld.TID))
-			}
+		var tid uint8
+		switch pld := ep.Payload.(type) {
+		case VP8:
+			tid = pld.TID
+		case VP9:
+			tid = pld.TID
+		case DependencyDescriptor:
+			tid = uint8(pld.TemporalID())
+		}
+		if mtl := atomic.LoadInt32(&b.maxTemporalLayer); mtl < int32(tid) {
+			atomic.StoreInt32(&b.maxTemporalLayer, int32(tid))
 		}
 
 		b.minPacketProbe++
@@ -423,10 +549,15 @@ func (b *Buffer) calc(pkt []byte, arrivalTime int64) {
 	}
 
 	if b.audioLevel {
-		if e := p.GetExtension(b.audioExt); e != nil && b.onAudioLevel != nil {
+		if e := p.GetExtension(b.audioExt); e != nil && (b.onAudioLevel != nil || b.onVoice != nil) {
 			ext := rtp.AudioLevelExtension{}
 			if err := ext.Unmarshal(e); err == nil {
-				b.onAudioLevel(ext.Level)
+				if b.onAudioLevel != nil {
+					b.onAudioLevel(ext.Level)
+				}
+				if b.onVoice != nil {
+					b.onVoice(ext.Level, ext.Voice)
+				}
 			}
 		}
 	}
@@ -442,12 +573,36 @@ func (b *Buffer) calc(pkt []byte, arrivalTime int64) {
 	if diff >= reportDelta {
 		br := (8 * b.bitrateHelper * uint64(reportDelta)) / uint64(diff)
 		atomic.StoreUint64(&b.bitrate, br)
+		var layerBytes uint64
+		for i, bytes := range b.spatialBytes {
+			layerBytes += bytes
+			br = 0
+			if bytes > 0 {
+				br = (8 * layerBytes * uint64(reportDelta)) / uint64(diff)
+			}
+			atomic.StoreUint64(&b.spatialBitrate[i], br)
+			b.spatialBytes[i] = 0
+		}
 		b.feedbackCB(b.getRTCP())
 		b.lastReport = arrivalTime
 		b.bitrateHelper = 0
 	}
 }
 
+// updateH264ParameterSets caches the last SPS/PPS, so they can be sent
+// to the subscribers that start on a keyframe without them
+func (b *Buffer) updateH264ParameterSets(sps, pps []byte) {
+	if sps != nil {
+		b.h264SPS = append([]byte(nil), sps...)
+	}
+	if pps != nil {
+		b.h264PPS = append([]byte(nil), pps...)
+	}
+	if b.h264SPS != nil && b.h264PPS != nil {
+		b.h264ParameterSets = buildH264STAPA(b.h264SPS, b.h264PPS)
+	}
+}
+
 func (b *Buffer) buildNACKPacket() []rtcp.Packet {
 	if nacks, askKeyframe := b.nacker.pairs(b.cycles | uint32(b.maxSeqNo)); (nacks != nil && len(nacks) > 0) || askKeyframe {
 		var pkts []rtcp.Packet
@@ -565,6 +720,17 @@ func (b *Buffer) Bitrate() uint64 {
 	return atomic.LoadUint64(&b.bitrate)
 }
 
+// SpatialBitrates returns the bitrates of the spatial layers of a VP9 or AV1
+// SVC stream, a layer includes the lower layers it depends on. The bitrate is
+// zero for the layers that are not received.
+func (b *Buffer) SpatialBitrates() [3]uint64 {
+	var brs [3]uint64
+	for i := range brs {
+		brs[i] = atomic.LoadUint64(&b.spatialBitrate[i])
+	}
+	return brs
+}
+
 func (b *Buffer) MaxTemporalLayer() int32 {
 	return atomic.LoadInt32(&b.maxTemporalLayer)
 }
@@ -577,10 +743,24 @@ func (b *Buffer) OnFeedback(fn func(fb []rtcp.Packet)) {
 	b.feedbackCB = fn
 }
 
+// OnPendingPacket is called with the packets written before the buffer is
+// bound, used to find the RTX streams
+func (b *Buffer) OnPendingPacket(fn func(pkt []byte)) {
+	b.Lock()
+	b.onPending = fn
+	b.Unlock()
+}
+
 func (b *Buffer) OnAudioLevel(fn func(level uint8)) {
 	b.onAudioLevel = fn
 }
 
+// OnVoiceActivity sets the handler of the audio levels in -dBov of the
+// packets, with the voice activity (V bit) of RFC 6464
+func (b *Buffer) OnVoiceActivity(fn func(level uint8, voice bool)) {
+	b.onVoice = fn
+}
+
 // GetMediaSSRC returns the associated SSRC of the RTP stream
 func (b *Buffer) GetMediaSSRC() uint32 {
 	return b.mediaSSRC
@@ -182,3 +182,98 @@ func TestNewBuffer(t *testing.T) {
 		})
 	}
 }
+
+func TestBuffer_BindRTX(t *testing.T) {
+	pool := &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, maxPktSize*25)
+			return &b
+		},
+	}
+	buff := NewBuffer(123, pool, pool, Logger)
+	buff.Bind(webrtc.RTPParameters{
+		Codecs: []webrtc.RTPCodecParameters{{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/vp8", ClockRate: 90000},
+			PayloadType:        96,
+		}},
+	}, Options{})
+	rtx := NewBuffer(456, pool, pool, Logger)
+
+	var pending [][]byte
+	rtx.OnPendingPacket(func(pkt []byte) {
+		pending = append(pending, pkt)
+	})
+	write := func(b *Buffer, p rtp.Packet) {
+		raw, err := p.Marshal()
+		assert.NoError(t, err)
+		_, err = b.Write(raw)
+		assert.NoError(t, err)
+	}
+	payload := []byte{0x10, 0x00, 0x00, 0x9d, 0x01, 0x2a}
+	write(buff, rtp.Packet{Header: rtp.Header{SequenceNumber: 10, Timestamp: 1000, SSRC: 123, PayloadType: 96}, Payload: payload})
+
+	// Retransmission of sequence number 11 received before the stream is known
+	write(rtx, rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: 500, Timestamp: 1000, SSRC: 456, PayloadType: 97},
+		Payload: append([]byte{0x00, 0x0b}, payload...),
+	})
+	assert.Len(t, pending, 1)
+	rtx.BindRTX(buff, 96)
+
+	// Padding only packets are dropped
+	write(rtx, rtp.Packet{
+		Header:      rtp.Header{SequenceNumber: 501, Timestamp: 1000, SSRC: 456, PayloadType: 97},
+		PaddingSize: 32,
+	})
+	write(rtx, rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: 502, Timestamp: 1000, SSRC: 456, PayloadType: 97},
+		Payload: append([]byte{0x00, 0x0c}, payload...),
+	})
+	assert.Len(t, pending, 1)
+
+	buf := make([]byte, 1500)
+	for _, sn := range []uint16{11, 12} {
+		n, err := buff.GetPacket(buf, sn)
+		assert.NoError(t, err)
+		var p rtp.Packet
+		assert.NoError(t, p.Unmarshal(buf[:n]))
+		assert.Equal(t, sn, p.SequenceNumber)
+		assert.Equal(t, uint32(123), p.SSRC)
+		assert.Equal(t, uint8(96), p.PayloadType)
+		assert.Equal(t, payload, p.Payload)
+	}
+	_, err := buff.GetPacket(buf, 13)
+	assert.Error(t, err)
+}
+
+func TestBuffer_SpatialBitrates(t *testing.T) {
+	pool := &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, maxPktSize*25)
+			return &b
+		},
+	}
+	buff := NewBuffer(123, pool, pool, Logger)
+	buff.Bind(webrtc.RTPParameters{
+		Codecs: []webrtc.RTPCodecParameters{{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/vp9", ClockRate: 90000},
+			PayloadType:        98,
+		}},
+	}, Options{})
+	buff.OnFeedback(func(_ []rtcp.Packet) {})
+	calc := func(sn uint16, sid byte, arrival int64) {
+		payload := make([]byte, 20)
+		// Layer indices with the start and the end of the frame
+		payload[0], payload[1] = 0x2c, sid<<1
+		raw, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: sn, SSRC: 123, PayloadType: 98}, Payload: payload}).Marshal()
+		assert.NoError(t, err)
+		buff.calc(raw, arrival)
+	}
+	calc(1, 0, 0)
+	calc(2, 1, 0)
+	assert.Equal(t, [3]uint64{}, buff.SpatialBitrates())
+	calc(3, 0, reportDelta)
+
+	// A layer includes the packets of the lower layers, 32 bytes per packet
+	assert.Equal(t, [3]uint64{8 * 64, 8 * 96, 0}, buff.SpatialBitrates())
+}
@@ -0,0 +1,306 @@
+/*
+【ファイル概要: dependencydescriptor.go】
+AV1 RTP仕様のDependency Descriptor（DD）ヘッダー拡張のパーサー。
+
+【主要な役割】
+1. フレーム情報の取得
+   - フレームの開始/終了、フレーム番号
+   - 空間レイヤーID（SpatialID）と時間レイヤーID（TemporalID）
+   - デコードターゲットごとの依存関係（DTI）、参照フレームの差分（fdiff）
+
+2. テンプレート依存構造（FrameDependencyStructure）の解析
+   - キーフレームなどで添付される構造を保持し、以降のパケットの解析に使用
+   - 各デコードターゲットの最大空間・時間レイヤーを算出
+
+【DTI（Decode Target Indication）】
+- NotPresent: フレームはデコードターゲットに含まれない
+- Discardable: 含まれるが、他のフレームから参照されない
+- Switch: このフレームからデコードターゲットへ切り替え可能
+- Required: デコードターゲットに必要
+
+【参考】
+https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension
+*/
+package buffer
+
+import (
+	"errors"
+)
+
+// DependencyDescriptorURI is the URI of the dependency descriptor RTP header extension
+const DependencyDescriptorURI = "https://aomediacodec.github.io/av1-rtp-spec/#dependency-descriptor-rtp-header-extension"
+
+var (
+	errDDNoStructure       = errors.New("dependency descriptor structure is unknown")
+	errDDInvalidTemplateID = errors.New("dependency descriptor template id is invalid")
+)
+
+// DecodeTargetIndication describes the relationship of a frame with a decode target
+type DecodeTargetIndication uint8
+
+const (
+	DTINotPresent DecodeTargetIndication = iota
+	DTIDiscardable
+	DTISwitch
+	DTIRequired
+)
+
+// FrameDependencyTemplate describes the dependencies of a frame
+type FrameDependencyTemplate struct {
+	SpatialID  int
+	TemporalID int
+	DTIs       []DecodeTargetIndication
+	Fdiffs     []int
+	Chains     []int
+}
+
+// DecodeTargetLayer is the highest layer of a decode target
+type DecodeTargetLayer struct {
+	SpatialID  int
+	TemporalID int
+}
+
+// RenderResolution of a spatial layer
+type RenderResolution struct {
+	Width  int
+	Height int
+}
+
+// FrameDependencyStructure is the template dependency structure attached to key frames
+type FrameDependencyStructure struct {
+	TemplateIDOffset        int
+	NumDecodeTargets        int
+	NumChains               int
+	DecodeTargetProtectedBy []int
+	Templates               []FrameDependencyTemplate
+	DecodeTargetLayers      []DecodeTargetLayer
+	Resolutions             []RenderResolution
+}
+
+// DependencyDescriptor is a helper to get the layer data from the AV1 dependency descriptor
+type DependencyDescriptor struct {
+	StartOfFrame bool
+	EndOfFrame   bool
+	FrameNumber  uint16
+	// FrameDependencies of the frame, resolved from the templates
+	FrameDependencies FrameDependencyTemplate
+	// ActiveDecodeTargets bitmask, all the decode targets if not present
+	ActiveDecodeTargets uint32
+	// Structure used to parse the descriptor
+	Structure *FrameDependencyStructure
+	// AttachedStructure is set when the packet carries a new structure
+	AttachedStructure *FrameDependencyStructure
+}
+
+// Unmarshal parses the passed extension payload with the last known structure
+func (d *DependencyDescriptor) Unmarshal(buf []byte, structure *FrameDependencyStructure) error {
+	if len(buf) < 3 {
+		return errShortPacket
+	}
+	r := &bitReader{buf: buf}
+	d.StartOfFrame = r.readBits(1) == 1
+	d.EndOfFrame = r.readBits(1) == 1
+	templateID := int(r.readBits(6))
+	d.FrameNumber = uint16(r.readBits(16))
+
+	var activeDecodeTargetsPresent, customDTIs, customFdiffs, customChains bool
+	if len(buf) > 3 {
+		structurePresent := r.readBits(1) == 1
+		activeDecodeTargetsPresent = r.readBits(1) == 1
+		customDTIs = r.readBits(1) == 1
+		customFdiffs = r.readBits(1) == 1
+		customChains = r.readBits(1) == 1
+		if structurePresent {
+			structure = readTemplateDependencyStructure(r)
+			d.AttachedStructure = structure
+		}
+	}
+	if structure == nil {
+		return errDDNoStructure
+	}
+	d.Structure = structure
+	d.ActiveDecodeTargets = 1<<uint(structure.NumDecodeTargets) - 1
+	if activeDecodeTargetsPresent {
+		d.ActiveDecodeTargets = uint32(r.readBits(structure.NumDecodeTargets))
+	}
+
+	idx := (templateID + 64 - structure.TemplateIDOffset) % 64
+	if idx >= len(structure.Templates) {
+		return errDDInvalidTemplateID
+	}
+	tmpl := structure.Templates[idx]
+	d.FrameDependencies = FrameDependencyTemplate{
+		SpatialID:  tmpl.SpatialID,
+		TemporalID: tmpl.TemporalID,
+		DTIs:       tmpl.DTIs,
+		Fdiffs:     tmpl.Fdiffs,
+		Chains:     tmpl.Chains,
+	}
+	if customDTIs {
+		d.FrameDependencies.DTIs = make([]DecodeTargetIndication, structure.NumDecodeTargets)
+		for i := range d.FrameDependencies.DTIs {
+			d.FrameDependencies.DTIs[i] = DecodeTargetIndication(r.readBits(2))
+		}
+	}
+	if customFdiffs {
+		d.FrameDependencies.Fdiffs = nil
+		for size := r.readBits(2); size != 0; size = r.readBits(2) {
+			d.FrameDependencies.Fdiffs = append(d.FrameDependencies.Fdiffs, int(r.readBits(4*int(size)))+1)
+		}
+	}
+	if customChains {
+		d.FrameDependencies.Chains = make([]int, structure.NumChains)
+		for i := range d.FrameDependencies.Chains {
+			d.FrameDependencies.Chains[i] = int(r.readBits(8))
+		}
+	}
+	if r.overflow {
+		return errShortPacket
+	}
+	return nil
+}
+
+// SpatialID of the frame
+func (d *DependencyDescriptor) SpatialID() int { return d.FrameDependencies.SpatialID }
+
+// TemporalID of the frame
+func (d *DependencyDescriptor) TemporalID() int { return d.FrameDependencies.TemporalID }
+
+// DecodeTargetIndication returns the indication of the frame for the decode target
+// of the spatial layer with the highest temporal layer up to temporalID.
+func (d *DependencyDescriptor) DecodeTargetIndication(spatialID, temporalID int) DecodeTargetIndication {
+	dt := d.Structure.DecodeTarget(spatialID, temporalID)
+	if dt < 0 || dt >= len(d.FrameDependencies.DTIs) {
+		return DTINotPresent
+	}
+	return d.FrameDependencies.DTIs[dt]
+}
+
+// DecodeTarget returns the decode target of the spatial layer with the highest
+// temporal layer up to temporalID, -1 if there is none.
+func (s *FrameDependencyStructure) DecodeTarget(spatialID, temporalID int) int {
+	dt := -1
+	for i, l := range s.DecodeTargetLayers {
+		if l.SpatialID == spatialID && l.TemporalID <= temporalID &&
+			(dt < 0 || l.TemporalID > s.DecodeTargetLayers[dt].TemporalID) {
+			dt = i
+		}
+	}
+	return dt
+}
+
+func readTemplateDependencyStructure(r *bitReader) *FrameDependencyStructure {
+	s := &FrameDependencyStructure{
+		TemplateIDOffset: int(r.readBits(6)),
+		NumDecodeTargets: int(r.readBits(5)) + 1,
+	}
+
+	// template_layers
+	spatialID, temporalID := 0, 0
+	for {
+		s.Templates = append(s.Templates, FrameDependencyTemplate{SpatialID: spatialID, TemporalID: temporalID})
+		next := r.readBits(2)
+		if next == 1 {
+			temporalID++
+		} else if next == 2 {
+			temporalID = 0
+			spatialID++
+		} else if next == 3 || r.overflow {
+			break
+		}
+	}
+
+	// template_dtis
+	for i := range s.Templates {
+		s.Templates[i].DTIs = make([]DecodeTargetIndication, s.NumDecodeTargets)
+		for dt := range s.Templates[i].DTIs {
+			s.Templates[i].DTIs[dt] = DecodeTargetIndication(r.readBits(2))
+		}
+	}
+
+	// template_fdiffs
+	for i := range s.Templates {
+		for r.readBits(1) == 1 && !r.overflow {
+			s.Templates[i].Fdiffs = append(s.Templates[i].Fdiffs, int(r.readBits(4))+1)
+		}
+	}
+
+	// template_chains
+	s.NumChains = int(r.readNonSymmetric(uint32(s.NumDecodeTargets) + 1))
+	if s.NumChains > 0 {
+		s.DecodeTargetProtectedBy = make([]int, s.NumDecodeTargets)
+		for dt := range s.DecodeTargetProtectedBy {
+			s.DecodeTargetProtectedBy[dt] = int(r.readNonSymmetric(uint32(s.NumChains)))
+		}
+		for i := range s.Templates {
+			s.Templates[i].Chains = make([]int, s.NumChains)
+			for c := range s.Templates[i].Chains {
+				s.Templates[i].Chains[c] = int(r.readBits(4))
+			}
+		}
+	}
+
+	// decode_target_layers
+	s.DecodeTargetLayers = make([]DecodeTargetLayer, s.NumDecodeTargets)
+	for dt := range s.DecodeTargetLayers {
+		for _, t := range s.Templates {
+			if t.DTIs[dt] == DTINotPresent {
+				continue
+			}
+			if t.SpatialID > s.DecodeTargetLayers[dt].SpatialID {
+				s.DecodeTargetLayers[dt].SpatialID = t.SpatialID
+			}
+			if t.TemporalID > s.DecodeTargetLayers[dt].TemporalID {
+				s.DecodeTargetLayers[dt].TemporalID = t.TemporalID
+			}
+		}
+	}
+
+	// render_resolutions
+	if r.readBits(1) == 1 {
+		s.Resolutions = make([]RenderResolution, spatialID+1)
+		for i := range s.Resolutions {
+			s.Resolutions[i].Width = int(r.readBits(16)) + 1
+			s.Resolutions[i].Height = int(r.readBits(16)) + 1
+		}
+	}
+	return s
+}
+
+// bitReader reads MSB first bit fields, reading past the end returns zeros
+type bitReader struct {
+	buf      []byte
+	pos      int
+	overflow bool
+}
+
+func (r *bitReader) readBits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if r.pos >= len(r.buf)*8 {
+			r.overflow = true
+			continue
+		}
+		v |= uint32(r.buf[r.pos/8]>>(7-uint(r.pos%8))) & 0x01
+		r.pos++
+	}
+	return v
+}
+
+// readNonSymmetric reads a ns(n) value
+func (r *bitReader) readNonSymmetric(n uint32) uint32 {
+	w := 0
+	for x := n; x != 0; x >>= 1 {
+		w++
+	}
+	if w == 0 {
+		return 0
+	}
+	m := uint32(1<<uint(w)) - n
+	v := r.readBits(w - 1)
+	if v < m {
+		return v
+	}
+	return v<<1 - m + r.readBits(1)
+}
@@ -0,0 +1,124 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ddTestWriter struct {
+	buf []byte
+	pos int
+}
+
+func (w *ddTestWriter) write(n int, v uint32) *ddTestWriter {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[w.pos/8] |= byte(v>>uint(i)&0x01) << (7 - uint(w.pos%8))
+		w.pos++
+	}
+	return w
+}
+
+// L1T2 structure: templates S0T0 (key), S0T0, S0T1 and decode targets T0, T1
+func ddTestStructure() []byte {
+	w := &ddTestWriter{}
+	w.write(1, 1).write(1, 1).write(6, 0).write(16, 1)
+	w.write(1, 1).write(1, 0).write(1, 0).write(1, 0).write(1, 0)
+	// template_id_offset, dt_cnt_minus_one
+	w.write(6, 0).write(5, 1)
+	// template_layers
+	w.write(2, 0).write(2, 1).write(2, 3)
+	// template_dtis
+	w.write(2, 2).write(2, 2)
+	w.write(2, 3).write(2, 3)
+	w.write(2, 0).write(2, 2)
+	// template_fdiffs
+	w.write(1, 0)
+	w.write(1, 1).write(4, 1).write(1, 0)
+	w.write(1, 1).write(4, 0).write(1, 0)
+	// template_chains: chain_cnt ns(3) = 1, protected_by ns(1) takes no bits
+	w.write(1, 1).write(1, 0)
+	w.write(4, 0).write(4, 2).write(4, 1)
+	// render_resolutions
+	w.write(1, 1).write(16, 639).write(16, 359)
+	return w.buf
+}
+
+func TestDependencyDescriptor_Unmarshal(t *testing.T) {
+	key := DependencyDescriptor{}
+	assert.NoError(t, key.Unmarshal(ddTestStructure(), nil))
+	s := key.AttachedStructure
+	assert.NotNil(t, s)
+	assert.Equal(t, 2, s.NumDecodeTargets)
+	assert.Equal(t, 1, s.NumChains)
+	assert.Len(t, s.Templates, 3)
+	assert.Equal(t, []DecodeTargetLayer{{0, 0}, {0, 1}}, s.DecodeTargetLayers)
+	assert.Equal(t, []RenderResolution{{640, 360}}, s.Resolutions)
+	assert.Equal(t, []int{2}, s.Templates[1].Fdiffs)
+	assert.Equal(t, []int{1}, s.Templates[2].Chains)
+	assert.True(t, key.StartOfFrame)
+	assert.Equal(t, uint16(1), key.FrameNumber)
+	assert.Equal(t, uint32(3), key.ActiveDecodeTargets)
+	assert.Equal(t, DTISwitch, key.DecodeTargetIndication(0, 1))
+
+	tests := []struct {
+		name     string
+		buf      []byte
+		wantErr  bool
+		temporal int
+		dti      DecodeTargetIndication
+		fdiffs   []int
+		active   uint32
+	}{
+		{
+			name:     "Mandatory fields must use the structure templates",
+			buf:      (&ddTestWriter{}).write(1, 1).write(1, 0).write(6, 2).write(16, 2).buf,
+			temporal: 1,
+			dti:      DTISwitch,
+			fdiffs:   []int{1},
+			active:   3,
+		},
+		{
+			name: "Extended fields must override fdiffs and active decode targets",
+			buf: (&ddTestWriter{}).write(1, 1).write(1, 1).write(6, 1).write(16, 3).
+				write(1, 0).write(1, 1).write(1, 0).write(1, 1).write(1, 0).
+				write(2, 1).write(2, 1).write(4, 3).write(2, 0).buf,
+			dti:    DTIRequired,
+			fdiffs: []int{4},
+			active: 1,
+		},
+		{
+			name:    "Unknown template must return error",
+			buf:     (&ddTestWriter{}).write(1, 1).write(1, 0).write(6, 5).write(16, 2).buf,
+			wantErr: true,
+		},
+		{
+			name:    "Short descriptor must return error",
+			buf:     []byte{0x80, 0x00},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dd := DependencyDescriptor{}
+			err := dd.Unmarshal(tt.buf, s)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Nil(t, dd.AttachedStructure)
+			assert.Equal(t, tt.temporal, dd.TemporalID())
+			assert.Equal(t, tt.dti, dd.DecodeTargetIndication(0, 1))
+			assert.Equal(t, tt.fdiffs, dd.FrameDependencies.Fdiffs)
+			assert.Equal(t, tt.active, dd.ActiveDecodeTargets)
+		})
+	}
+
+	dd := DependencyDescriptor{}
+	assert.Error(t, dd.Unmarshal([]byte{0x80, 0x00, 0x01}, nil))
+}
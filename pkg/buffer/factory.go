@@ -17,6 +17,7 @@ FactoryはBufferとRTCPReaderの集中管理とプーリングを提供します
   - GetOrNew: 既存オブジェクトの取得または新規作成
   - OnCloseコールバックによる自動クリーンアップ
   - Bufferが閉じられると自動的にマップから削除
+  - NewBuffer: ピア接続を使わないトラック用に、マップに登録しないBufferを作成
 
 4. ペアアクセス
   - GetBufferPair: BufferとRTCPReaderを同時取得
@@ -126,6 +127,12 @@ func (f *Factory) GetOrNew(packetType packetio.BufferPacketType, ssrc uint32) io
 	return nil
 }
 
+// NewBuffer returns a buffer that is not tracked by its SSRC, for the tracks
+// received outside of the peer connections
+func (f *Factory) NewBuffer(ssrc uint32) *Buffer {
+	return NewBuffer(ssrc, f.videoPool, f.audioPool, f.logger)
+}
+
 func (f *Factory) GetBufferPair(ssrc uint32) (*Buffer, *RTCPReader) {
 	f.RLock()
 	defer f.RUnlock()
@@ -14,10 +14,31 @@
   - Picture ID、TL0PICIDX、TIDの取得
   - キーフレーム検出
 
-3. H.264キーフレーム検出
+3. VP9ペイロード解析
+  - VP9 RTPペイロード記述子のパース（フレキシブル・非フレキシブルモード）
+  - Spatial Layer（SID）とTemporal Layer（TID）の取得
+  - スイッチングアップポイント（U）とレイヤー間依存（D）の取得
+  - Scalability Structure（SS）からの空間レイヤー数の取得
+  - キーフレーム検出
+
+4. AV1キーフレーム検出
+  - 集約ヘッダーのNビット（新しい符号化ビデオシーケンスの開始）で判定
+  - レイヤー情報はDependency Descriptor（dependencydescriptor.go）から取得
+
+5. H.264キーフレーム検出
   - H.264 NALUタイプの判定
   - IDR（Instantaneous Decoder Refresh）フレームの検出
   - STAP-A/B、MTAP、FU-A/Bの処理
+  - SPS/PPSの抽出とSTAP-Aの生成（キーフレーム前への挿入用）
+
+6. H.265キーフレーム検出
+  - H.265 NALUタイプの判定（RFC 7798）
+  - IRAP（IDR/CRA/BLA）とVPSの検出
+  - 単一NALU、AP（集約パケット）、FU（分割ユニット）の処理
+
+7. IsKeyFrame
+  - MIMEタイプに応じたキーフレーム検出
+  - バッファを通らないパケット（ローカルサブスクライバーなど）の判定に使用
 
 【VP8ペイロード記述子】
 RFC 7741で定義されたVP8 RTPペイロード形式:
@@ -47,6 +68,33 @@ RFC 7741で定義されたVP8 RTPペイロード形式:
 - TL0PICIDX: Temporal layer 0のインデックス
 - TID: Temporal layer ID（0-3）
 
+【VP9ペイロード記述子】
+RFC 9628で定義されたVP9 RTPペイロード形式:
+
+	0 1 2 3 4 5 6 7
+	+-+-+-+-+-+-+-+-+
+	|I|P|L|F|B|E|V|Z| (REQUIRED)
+	+-+-+-+-+-+-+-+-+
+	|M| PICTURE ID  | (OPTIONAL, I=1)
+	+-+-+-+-+-+-+-+-+
+	| EXTENDED PID  | (OPTIONAL, M=1)
+	+-+-+-+-+-+-+-+-+
+	| TID |U| SID |D| (OPTIONAL, L=1)
+	+-+-+-+-+-+-+-+-+
+	|   TL0PICIDX   | (OPTIONAL, L=1かつF=0)
+	+-+-+-+-+-+-+-+-+
+	| P_DIFF      |N| (OPTIONAL, F=1かつP=1、最大3回)
+	+-+-+-+-+-+-+-+-+
+	|      SS       | (OPTIONAL, V=1)
+	+-+-+-+-+-+-+-+-+
+
+フィールド説明:
+- P: インターピクチャ予測（0=同じ空間レイヤーの過去フレームを参照しない）
+- F: フレキシブルモード
+- B/E: レイヤーフレームの開始/終了
+- U: スイッチングアップポイント（上位Temporal Layerへ切り替え可能）
+- D: 1つ下の空間レイヤーに依存
+
 【H.264 NALUタイプ】
 NALUタイプ（下位5ビット）:
 - 1-23: 単一NALUパケット
@@ -58,6 +106,13 @@ NALUタイプ（下位5ビット）:
 - 28: FU-A（分割ユニット）
 - 29: FU-B
 
+【H.265 NALUタイプ】
+NALUヘッダー（2バイト）の2-7ビット目:
+- 16-23: IRAP（BLA、IDR、CRA）
+- 32: VPS（パラメータセットはIRAPの前に送信される）
+- 48: AP（集約パケット）
+- 49: FU（分割ユニット）
+
 【タイムスタンプ処理】
 RTPタイムスタンプは32ビットでラップアラウンドします:
 - IsTimestampWrapAround: ラップアラウンド検出
@@ -74,6 +129,7 @@ package buffer
 import (
 	"encoding/binary"
 	"errors"
+	"strings"
 	"sync/atomic"
 )
 
@@ -214,6 +270,178 @@ func (p *VP8) Unmarshal(payload []byte) error {
 	return nil
 }
 
+// VP9 is a helper to get the layer data from VP9 packet header
+/*
+	VP9 Payload Descriptor
+			0 1 2 3 4 5 6 7
+			+-+-+-+-+-+-+-+-+
+			|I|P|L|F|B|E|V|Z| (REQUIRED)
+			+-+-+-+-+-+-+-+-+
+		I:  |M| PICTURE ID  | (RECOMMENDED)
+			+-+-+-+-+-+-+-+-+
+		M:  | EXTENDED PID  | (RECOMMENDED)
+			+-+-+-+-+-+-+-+-+
+		L:  | TID |U| SID |D| (CONDITIONALLY RECOMMENDED)
+			+-+-+-+-+-+-+-+-+
+			|   TL0PICIDX   | (CONDITIONALLY REQUIRED, non-flexible mode only)
+			+-+-+-+-+-+-+-+-+
+		P,F:| P_DIFF      |N| (CONDITIONALLY REQUIRED, up to 3 times)
+			+-+-+-+-+-+-+-+-+
+		V:  | SS            |
+			| ..            |
+			+-+-+-+-+-+-+-+-+
+*/
+type VP9 struct {
+	PictureID uint16 /* 7 or 15 bits, picture ID */
+	PicIDIdx  int
+	MBit      bool
+
+	// Layer indices, present if the L bit is set
+	LayerIndices bool
+	TID          uint8 /* 3 bits temporal layer idx */
+	U            bool  /* switching up point */
+	SID          uint8 /* 3 bits spatial layer idx */
+	D            bool  /* inter-layer dependency */
+	TL0PICIDX    uint8 /* 8 bits temporal level zero index, non-flexible mode only */
+
+	Flexible bool
+	// InterPicturePredicted is set when the frame depends on previous
+	// frames of the same spatial layer
+	InterPicturePredicted bool
+	BeginOfFrame          bool
+	EndOfFrame            bool
+	// PDiff are the reference picture ID differences, flexible mode only
+	PDiff []uint8
+
+	// NumSpatialLayers is set from the scalability structure, zero if not present
+	NumSpatialLayers uint8
+	// HeaderSize is the size of the payload descriptor
+	HeaderSize int
+	// IsKeyFrame is a helper to detect if current packet is a keyframe
+	IsKeyFrame bool
+}
+
+// Unmarshal parses the passed byte slice and stores the result in the VP9 this method is called upon
+func (p *VP9) Unmarshal(payload []byte) error {
+	if payload == nil {
+		return errNilPacket
+	}
+
+	payloadLen := len(payload)
+
+	if payloadLen < 1 {
+		return errShortPacket
+	}
+
+	I := payload[0]&0x80 > 0
+	p.InterPicturePredicted = payload[0]&0x40 > 0
+	p.LayerIndices = payload[0]&0x20 > 0
+	p.Flexible = payload[0]&0x10 > 0
+	p.BeginOfFrame = payload[0]&0x08 > 0
+	p.EndOfFrame = payload[0]&0x04 > 0
+	V := payload[0]&0x02 > 0
+
+	idx := 1
+	// Check for PictureID
+	if I {
+		if payloadLen < idx+1 {
+			return errShortPacket
+		}
+		p.PicIDIdx = idx
+		pid := payload[idx] & 0x7f
+		// Check if m is 1, then Picture ID is 15 bits
+		if payload[idx]&0x80 > 0 {
+			idx++
+			if payloadLen < idx+1 {
+				return errShortPacket
+			}
+			p.MBit = true
+			p.PictureID = binary.BigEndian.Uint16([]byte{pid, payload[idx]})
+		} else {
+			p.PictureID = uint16(pid)
+		}
+		idx++
+	}
+	// Check for layer indices
+	if p.LayerIndices {
+		if payloadLen < idx+1 {
+			return errShortPacket
+		}
+		p.TID = payload[idx] >> 5
+		p.U = payload[idx]&0x10 > 0
+		p.SID = (payload[idx] >> 1) & 0x07
+		p.D = payload[idx]&0x01 > 0
+		idx++
+		if !p.Flexible {
+			if payloadLen < idx+1 {
+				return errShortPacket
+			}
+			p.TL0PICIDX = payload[idx]
+			idx++
+		}
+	}
+	// Check for reference indices
+	if p.Flexible && p.InterPicturePredicted {
+		for {
+			if payloadLen < idx+1 || len(p.PDiff) == 3 {
+				return errShortPacket
+			}
+			p.PDiff = append(p.PDiff, payload[idx]>>1)
+			idx++
+			if payload[idx-1]&0x01 == 0 {
+				break
+			}
+		}
+	}
+	// Check for scalability structure
+	if V {
+		if payloadLen < idx+1 {
+			return errShortPacket
+		}
+		p.NumSpatialLayers = payload[idx]>>5 + 1
+		Y := payload[idx]&0x10 > 0
+		G := payload[idx]&0x08 > 0
+		idx++
+		if Y {
+			idx += 4 * int(p.NumSpatialLayers)
+		}
+		if G {
+			if payloadLen < idx+1 {
+				return errShortPacket
+			}
+			ng := int(payload[idx])
+			idx++
+			for i := 0; i < ng; i++ {
+				if payloadLen < idx+1 {
+					return errShortPacket
+				}
+				idx += 1 + int(payload[idx]>>2&0x03)
+			}
+		}
+		if payloadLen < idx {
+			return errShortPacket
+		}
+	}
+	p.HeaderSize = idx
+	p.IsKeyFrame = !p.InterPicturePredicted && p.BeginOfFrame && p.SID == 0
+	return nil
+}
+
+// isAV1Keyframe detects if av1 payload is the first packet of a coded video sequence
+/*
+	AV1 Aggregation Header
+			0 1 2 3 4 5 6 7
+			+-+-+-+-+-+-+-+-+
+			|Z|Y| W |N|-|-|-|
+			+-+-+-+-+-+-+-+-+
+*/
+func isAV1Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x08 > 0
+}
+
 // isH264Keyframe detects if h264 payload is a keyframe
 // this code was taken from https://github.com/jech/galene/blob/codecs/rtpconn/rtpreader.go#L45
 // all credits belongs to Juliusz Chroboczek @jech and the awesome Galene SFU
@@ -280,3 +508,109 @@ func isH264Keyframe(payload []byte) bool {
 	}
 	return false
 }
+
+// getH264ParameterSets returns the SPS and PPS of a single NALU or STAP-A payload
+func getH264ParameterSets(payload []byte) (sps, pps []byte) {
+	if len(payload) < 1 {
+		return
+	}
+	switch nalu := payload[0] & 0x1F; nalu {
+	case 7:
+		sps = payload
+	case 8:
+		pps = payload
+	case 24:
+		for i := 1; i+2 < len(payload); {
+			length := int(binary.BigEndian.Uint16(payload[i : i+2]))
+			i += 2
+			if length < 1 || i+length > len(payload) {
+				return
+			}
+			switch payload[i] & 0x1F {
+			case 7:
+				sps = payload[i : i+length]
+			case 8:
+				pps = payload[i : i+length]
+			}
+			i += length
+		}
+	}
+	return
+}
+
+// buildH264STAPA aggregates the NALUs in a STAP-A payload
+func buildH264STAPA(nalus ...[]byte) []byte {
+	size := 1
+	var nri byte
+	for _, n := range nalus {
+		size += 2 + len(n)
+		if n[0]&0x60 > nri {
+			nri = n[0] & 0x60
+		}
+	}
+	buf := make([]byte, 1, size)
+	buf[0] = nri | 24
+	for _, n := range nalus {
+		buf = append(buf, byte(len(n)>>8), byte(len(n)))
+		buf = append(buf, n...)
+	}
+	return buf
+}
+
+// isH265Keyframe detects if h265 payload is a keyframe, the parameter sets
+// sent before an IRAP picture are detected as the keyframe start
+func isH265Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	switch nalu := (payload[0] >> 1) & 0x3F; nalu {
+	case 48:
+		// AP, NALUs are prefixed by their 16 bits size
+		i := 2
+		for i+2 < len(payload) {
+			length := int(binary.BigEndian.Uint16(payload[i : i+2]))
+			i += 2
+			if length < 1 || i+length > len(payload) {
+				return false
+			}
+			if isH265KeyNALU((payload[i] >> 1) & 0x3F) {
+				return true
+			}
+			i += length
+		}
+		return false
+	case 49:
+		// FU, only the starting fragment is checked
+		if len(payload) < 3 || payload[2]&0x80 == 0 {
+			return false
+		}
+		return isH265KeyNALU(payload[2] & 0x3F)
+	default:
+		return isH265KeyNALU(nalu)
+	}
+}
+
+func isH265KeyNALU(nalu uint8) bool {
+	// IRAP pictures (16-23) or VPS
+	return (nalu >= 16 && nalu <= 23) || nalu == 32
+}
+
+// IsKeyFrame reports if a RTP payload of the codec is a packet of a keyframe,
+// like the KeyFrame of the extended packets
+func IsKeyFrame(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case "video/vp8":
+		var p VP8
+		return p.Unmarshal(payload) == nil && p.IsKeyFrame
+	case "video/vp9":
+		var p VP9
+		return p.Unmarshal(payload) == nil && p.IsKeyFrame
+	case "video/h264":
+		return isH264Keyframe(payload)
+	case "video/h265":
+		return isH265Keyframe(payload)
+	case "video/av1":
+		return isAV1Keyframe(payload)
+	}
+	return false
+}
@@ -92,3 +92,144 @@ func TestVP8Helper_Unmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestVP9Helper_Unmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+		want    VP9
+	}{
+		{
+			name:    "Empty or nil payload must return error",
+			payload: []byte{},
+			wantErr: true,
+		},
+		{
+			name:    "Truncated picture ID must return error",
+			payload: []byte{0x80},
+			wantErr: true,
+		},
+		{
+			name:    "Non flexible mode must read layer indices and TL0PICIDX",
+			payload: []byte{0xac, 0x92, 0x67, 0x53, 0xb4, 0x00},
+			want: VP9{
+				PictureID: 4711, PicIDIdx: 1, MBit: true,
+				LayerIndices: true, TID: 2, U: true, SID: 1, D: true, TL0PICIDX: 180,
+				BeginOfFrame: true, EndOfFrame: true, HeaderSize: 5,
+			},
+		},
+		{
+			name: "Keyframe must read the scalability structure",
+			payload: []byte{0xaa, 0x05, 0x00, 0x01, 0x58,
+				0x01, 0x40, 0x00, 0xb4, 0x02, 0x80, 0x01, 0x68, 0x05, 0x00, 0x02, 0xd0,
+				0x01, 0x04, 0x01, 0x00},
+			want: VP9{
+				PictureID: 5, PicIDIdx: 1, LayerIndices: true, TL0PICIDX: 1,
+				BeginOfFrame: true, NumSpatialLayers: 3, HeaderSize: 20, IsKeyFrame: true,
+			},
+		},
+		{
+			name:    "Flexible mode must read reference indices",
+			payload: []byte{0xf8, 0x05, 0x20, 0x03, 0x04, 0x00},
+			want: VP9{
+				PictureID: 5, PicIDIdx: 1, LayerIndices: true, TID: 1, Flexible: true,
+				InterPicturePredicted: true, BeginOfFrame: true, PDiff: []uint8{1, 2}, HeaderSize: 5,
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := VP9{}
+			err := p.Unmarshal(tt.payload)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, p)
+		})
+	}
+}
+
+func Test_isH265Keyframe(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{name: "Short payload must not be a keyframe", payload: []byte{0x26}},
+		{name: "IDR NALU must be a keyframe", payload: []byte{0x26, 0x01, 0xaf}, want: true},
+		{name: "CRA NALU must be a keyframe", payload: []byte{0x2a, 0x01, 0xaf}, want: true},
+		{name: "VPS NALU must be a keyframe", payload: []byte{0x40, 0x01, 0x0c}, want: true},
+		{name: "Trailing picture must not be a keyframe", payload: []byte{0x02, 0x01, 0xd0}},
+		{
+			name:    "AP with an IDR must be a keyframe",
+			payload: []byte{0x60, 0x01, 0x00, 0x02, 0x44, 0x01, 0x00, 0x02, 0x26, 0x01},
+			want:    true,
+		},
+		{
+			name:    "AP without an IRAP or VPS must not be a keyframe",
+			payload: []byte{0x60, 0x01, 0x00, 0x02, 0x44, 0x01, 0x00, 0x02, 0x02, 0x01},
+		},
+		{name: "Malformed AP must not be a keyframe", payload: []byte{0x60, 0x01, 0x00, 0x09, 0x26, 0x01}},
+		{name: "Starting FU of an IDR must be a keyframe", payload: []byte{0x62, 0x01, 0x93, 0xaf}, want: true},
+		{name: "Continuation FU of an IDR must not be a keyframe", payload: []byte{0x62, 0x01, 0x13, 0xaf}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isH265Keyframe(tt.payload))
+		})
+	}
+}
+
+func Test_getH264ParameterSets(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	stapA := buildH264STAPA(sps, pps)
+	assert.Equal(t, []byte{0x78, 0x00, 0x04, 0x67, 0x42, 0x00, 0x1f, 0x00, 0x04, 0x68, 0xce, 0x3c, 0x80}, stapA)
+
+	tests := []struct {
+		name    string
+		payload []byte
+		sps     []byte
+		pps     []byte
+	}{
+		{name: "Empty payload must not return parameter sets"},
+		{name: "SPS NALU must return the SPS", payload: sps, sps: sps},
+		{name: "PPS NALU must return the PPS", payload: pps, pps: pps},
+		{name: "STAP-A must return the SPS and PPS", payload: stapA, sps: sps, pps: pps},
+		{name: "IDR NALU must not return parameter sets", payload: []byte{0x65, 0x88, 0x84}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sps, pps := getH264ParameterSets(tt.payload)
+			assert.Equal(t, tt.sps, sps)
+			assert.Equal(t, tt.pps, pps)
+		})
+	}
+}
+
+func TestIsKeyFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{name: "VP8 keyframe", mimeType: "video/VP8", payload: []byte{0x10, 0x00, 0x00, 0x9d, 0x01, 0x2a}, want: true},
+		{name: "VP8 interframe", mimeType: "video/VP8", payload: []byte{0x10, 0x01, 0x00, 0x00}},
+		{name: "H264 IDR", mimeType: "video/H264", payload: []byte{0x65, 0x88, 0x84}, want: true},
+		{name: "H265 IDR", mimeType: "video/H265", payload: []byte{0x26, 0x01, 0xaf}, want: true},
+		{name: "Opus", mimeType: "audio/opus", payload: []byte{0xfc, 0x01}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsKeyFrame(tt.mimeType, tt.payload))
+		})
+	}
+}
@@ -0,0 +1,410 @@
+/*
+【ファイル概要: codec.go】
+H.264/H.265のパラメータセットの解析と、fMP4・HLSに必要なコーデック情報の生成。
+
+【主要な役割】
+1. SPSの解析
+   - エミュレーション防止バイトを取り除いたRBSPを指数ゴロム符号で読み取り
+   - 解像度（クロッピング、コンフォーマンスウィンドウを適用）とプロファイル、
+     レベル、クロマフォーマット、ビット深度を取得
+
+2. デコーダー設定
+   - H.264: avcC（AVCDecoderConfigurationRecord）
+   - H.265: hvcC（HEVCDecoderConfigurationRecord、VPS/SPS/PPSの配列）
+
+3. コーデック文字列
+   - マルチバリアントプレイリストのCODECS属性（avc1.PPCCLL、hvc1.x.x.Lxx、opus）
+*/
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errInvalidParameterSet = errors.New("invalid parameter set")
+
+// H.264 and H.265 NAL unit types
+const (
+	h264NALUSPS = 7
+	h264NALUPPS = 8
+	h264NALUAUD = 9
+	h265NALUVPS = 32
+	h265NALUSPS = 33
+	h265NALUPPS = 34
+	h265NALUAUD = 35
+)
+
+// videoConfig is the decoder configuration of a H.264 or H.265 track
+type videoConfig struct {
+	width  int
+	height int
+	// record is the avcC or hvcC box content
+	record []byte
+	codec  string
+}
+
+// bitReader reads the bits of a RBSP
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errInvalidParameterSet
+	}
+	b := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint32(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) skip(n int) error {
+	if r.pos+n > len(r.data)*8 {
+		return errInvalidParameterSet
+	}
+	r.pos += n
+	return nil
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errInvalidParameterSet
+		}
+	}
+	v, err := r.bits(zeros)
+	return 1<<uint(zeros) - 1 + v, err
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1), err
+	}
+	return -int32(v / 2), err
+}
+
+// rbsp removes the emulation prevention bytes of a NAL unit
+func rbsp(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// newH264Config returns the configuration of the SPS and PPS of a H.264 track
+func newH264Config(sps, pps []byte) (*videoConfig, error) {
+	if len(sps) < 4 || len(pps) < 1 {
+		return nil, errInvalidParameterSet
+	}
+	width, height, err := parseH264SPS(sps)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1})
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(sps)))
+	b.Write(sps)
+	b.WriteByte(1)
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(pps)))
+	b.Write(pps)
+	return &videoConfig{
+		width:  width,
+		height: height,
+		record: b.Bytes(),
+		codec:  fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3]),
+	}, nil
+}
+
+// parseH264SPS returns the cropped resolution of a H.264 SPS
+func parseH264SPS(sps []byte) (int, int, error) {
+	r := &bitReader{data: rbsp(sps)}
+	if err := r.skip(8); err != nil {
+		return 0, 0, err
+	}
+	profile, _ := r.bits(8)
+	_ = r.skip(16)
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint32(1)
+	separateColourPlane := uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat, _ = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane, _ = r.bit()
+		}
+		_, _ = r.ue() // bit_depth_luma_minus8
+		_, _ = r.ue() // bit_depth_chroma_minus8
+		_ = r.skip(1)
+		if scaling, _ := r.bit(); scaling == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if present, _ := r.bit(); present == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					if err := skipScalingList(r, size); err != nil {
+						return 0, 0, err
+					}
+				}
+			}
+		}
+	}
+
+	_, _ = r.ue() // log2_max_frame_num_minus4
+	pocType, _ := r.ue()
+	switch pocType {
+	case 0:
+		_, _ = r.ue()
+	case 1:
+		_ = r.skip(1)
+		_, _ = r.se()
+		_, _ = r.se()
+		cycle, _ := r.ue()
+		for i := uint32(0); i < cycle; i++ {
+			_, _ = r.se()
+		}
+	}
+	_, _ = r.ue() // max_num_ref_frames
+	_ = r.skip(1)
+	widthMbs, _ := r.ue()
+	heightMapUnits, _ := r.ue()
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		_ = r.skip(1)
+	}
+	_ = r.skip(1)
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if cropping, _ := r.bit(); cropping == 1 {
+		cropLeft, _ = r.ue()
+		cropRight, _ = r.ue()
+		cropTop, _ = r.ue()
+		cropBottom, err = r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	if chromaFormat != 0 && separateColourPlane == 0 {
+		subWidth, subHeight := uint32(2), uint32(2)
+		if chromaFormat == 2 {
+			subHeight = 1
+		} else if chromaFormat == 3 {
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX, cropUnitY = subWidth, subHeight*(2-frameMbsOnly)
+	}
+	width := (widthMbs+1)*16 - cropUnitX*(cropLeft+cropRight)
+	height := (2-frameMbsOnly)*(heightMapUnits+1)*16 - cropUnitY*(cropTop+cropBottom)
+	return int(width), int(height), nil
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// h265SPS is the part of a H.265 SPS used by the decoder configuration
+type h265SPS struct {
+	width, height        int
+	profileTierLevel     []byte
+	maxSubLayers         uint8
+	temporalIDNesting    bool
+	chromaFormat         uint8
+	bitDepthLumaMinus8   uint8
+	bitDepthChromaMinus8 uint8
+}
+
+// newH265Config returns the configuration of the VPS, SPS and PPS of a H.265 track
+func newH265Config(vps, sps, pps []byte) (*videoConfig, error) {
+	if len(vps) < 2 || len(pps) < 2 {
+		return nil, errInvalidParameterSet
+	}
+	s, err := parseH265SPS(sps)
+	if err != nil {
+		return nil, err
+	}
+	ptl := s.profileTierLevel
+
+	var b bytes.Buffer
+	b.WriteByte(1)
+	b.Write(ptl)
+	b.Write([]byte{0xf0, 0x00, 0xfc, 0xfc | s.chromaFormat, 0xf8 | s.bitDepthLumaMinus8, 0xf8 | s.bitDepthChromaMinus8, 0, 0})
+	nesting := byte(0)
+	if s.temporalIDNesting {
+		nesting = 1
+	}
+	b.WriteByte(s.maxSubLayers<<3 | nesting<<2 | 3)
+	b.WriteByte(3)
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		b.WriteByte(0x80 | nalu[0]>>1&0x3f)
+		_ = binary.Write(&b, binary.BigEndian, uint16(1))
+		_ = binary.Write(&b, binary.BigEndian, uint16(len(nalu)))
+		b.Write(nalu)
+	}
+	return &videoConfig{
+		width:  s.width,
+		height: s.height,
+		record: b.Bytes(),
+		codec:  h265CodecString(ptl),
+	}, nil
+}
+
+func parseH265SPS(sps []byte) (*h265SPS, error) {
+	data := rbsp(sps)
+	if len(data) < 15 {
+		return nil, errInvalidParameterSet
+	}
+	s := &h265SPS{
+		maxSubLayers:      data[2]>>1&0x07 + 1,
+		temporalIDNesting: data[2]&1 == 1,
+		profileTierLevel:  data[3:15],
+	}
+	r := &bitReader{data: data, pos: 15 * 8}
+	subLayers := int(s.maxSubLayers) - 1
+	profilePresent := make([]uint32, subLayers)
+	levelPresent := make([]uint32, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i], _ = r.bit()
+		levelPresent[i], _ = r.bit()
+	}
+	if subLayers > 0 {
+		_ = r.skip(2 * (8 - subLayers))
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] == 1 {
+			_ = r.skip(88)
+		}
+		if levelPresent[i] == 1 {
+			_ = r.skip(8)
+		}
+	}
+
+	_, _ = r.ue() // sps_seq_parameter_set_id
+	chromaFormat, _ := r.ue()
+	if chromaFormat == 3 {
+		_ = r.skip(1)
+	}
+	width, _ := r.ue()
+	height, _ := r.ue()
+	window, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	if window == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, _ := r.ue()
+		subWidth, subHeight := uint32(1), uint32(1)
+		if chromaFormat == 1 || chromaFormat == 2 {
+			subWidth = 2
+		}
+		if chromaFormat == 1 {
+			subHeight = 2
+		}
+		width -= subWidth * (left + right)
+		height -= subHeight * (top + bottom)
+	}
+	luma, _ := r.ue()
+	chroma, err := r.ue()
+	if err != nil || chromaFormat > 3 || luma > 7 || chroma > 7 {
+		return nil, errInvalidParameterSet
+	}
+	s.width, s.height = int(width), int(height)
+	s.chromaFormat = uint8(chromaFormat)
+	s.bitDepthLumaMinus8, s.bitDepthChromaMinus8 = uint8(luma), uint8(chroma)
+	return s, nil
+}
+
+// h265CodecString returns the hvc1 codec string of a profile_tier_level (ISO/IEC 14496-15 E.3)
+func h265CodecString(ptl []byte) string {
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if space := ptl[0] >> 6; space > 0 {
+		b.WriteByte('A' + space - 1)
+	}
+	fmt.Fprintf(&b, "%d.", ptl[0]&0x1f)
+	flags := binary.BigEndian.Uint32(ptl[1:5])
+	var reversed uint32
+	for i := 0; i < 32; i++ {
+		reversed |= (flags >> uint(i) & 1) << uint(31-i)
+	}
+	fmt.Fprintf(&b, "%X.", reversed)
+	if ptl[0]&0x20 != 0 {
+		b.WriteByte('H')
+	} else {
+		b.WriteByte('L')
+	}
+	fmt.Fprintf(&b, "%d", ptl[11])
+	constraints := ptl[5:11]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package hls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	// Baseline 1920x1080 (1088 lines cropped by 8)
+	testH264SPS = []byte{0x67, 0x42, 0xc0, 0x28, 0xda, 0x01, 0xe0, 0x08, 0x9f, 0x95}
+	testH264PPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	// Main 1920x1080 level 3.1, with emulation prevention bytes
+	testH265VPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0xb0, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xac, 0x09}
+	testH265SPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0xb0, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x03, 0xc0, 0x80, 0x10, 0xe5, 0xc0}
+	testH265PPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+func Test_newH264Config(t *testing.T) {
+	c, err := newH264Config(testH264SPS, testH264PPS)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1920, c.width)
+	assert.Equal(t, 1080, c.height)
+	assert.Equal(t, "avc1.42c028", c.codec)
+	assert.Equal(t, []byte{1, 0x42, 0xc0, 0x28, 0xff, 0xe1, 0, byte(len(testH264SPS))}, c.record[:8])
+	assert.Len(t, c.record, 8+len(testH264SPS)+3+len(testH264PPS))
+
+	_, err = newH264Config(testH264SPS[:3], testH264PPS)
+	assert.Error(t, err)
+	_, err = newH264Config(testH264SPS[:5], testH264PPS)
+	assert.Error(t, err)
+}
+
+func Test_newH265Config(t *testing.T) {
+	c, err := newH265Config(testH265VPS, testH265SPS, testH265PPS)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1920, c.width)
+	assert.Equal(t, 1080, c.height)
+	assert.Equal(t, "hvc1.1.6.L93.B0", c.codec)
+	// Version, profile_tier_level without the emulation prevention bytes
+	assert.Equal(t, []byte{1, 0x01, 0x60, 0, 0, 0, 0xb0, 0, 0, 0, 0, 0, 0x5d}, c.record[:13])
+	// Chroma format and bit depths
+	assert.Equal(t, []byte{0xfd, 0xf8, 0xf8}, c.record[16:19])
+	// Three arrays of one NAL unit
+	assert.Equal(t, byte(3), c.record[22])
+	assert.Len(t, c.record, 23+3*5+len(testH265VPS)+len(testH265SPS)+len(testH265PPS))
+
+	_, err = newH265Config(testH265VPS, testH265SPS[:10], testH265PPS)
+	assert.Error(t, err)
+}
+
+func Test_rbsp(t *testing.T) {
+	tests := []struct {
+		in  []byte
+		out []byte
+	}{
+		{in: []byte{1, 2, 3}, out: []byte{1, 2, 3}},
+		{in: []byte{0, 0, 3, 1}, out: []byte{0, 0, 1}},
+		{in: []byte{0, 0, 3, 0, 0, 3}, out: []byte{0, 0, 0, 0}},
+		{in: []byte{0, 3, 0}, out: []byte{0, 3, 0}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.out, rbsp(tt.in))
+	}
+}
@@ -0,0 +1,299 @@
+/*
+【ファイル概要: fmp4.go】
+フラグメント化MP4（ISO BMFF、CMAF）の初期化セグメントとフラグメントの書き込み。
+
+【主要な役割】
+1. 初期化セグメント
+   - ftyp、moov（mvhd、トラックごとのtrak、mvex/trex）
+   - サンプルエントリ: avc1（avcC）、hvc1（hvcC）、Opus（dOps）
+   - サンプルテーブルは空（サンプルはフラグメントに格納）
+
+2. フラグメント
+   - moof（mfhd、トラックごとのtraf: tfhd、tfdt、trun）とmdat
+   - trunにサンプルごとの長さ、サイズ、フラグ（キーフレームか）を記述
+   - データオフセットはmoofの先頭から（default-base-is-moof）
+*/
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	sampleFlagsKey    = 0x02000000
+	sampleFlagsNonKey = 0x01010000
+)
+
+// fmp4Track describes a track of the initialization segment
+type fmp4Track struct {
+	id        uint32
+	timescale uint32
+	video     *videoConfig
+	// hevc selects the hvc1 sample entry of the video config
+	hevc     bool
+	channels uint16
+}
+
+// fmp4Sample is a sample of a fragment
+type fmp4Sample struct {
+	duration uint32
+	keyFrame bool
+	data     []byte
+}
+
+type boxWriter struct {
+	bytes.Buffer
+}
+
+func (w *boxWriter) box(typ string, content func()) {
+	start := w.Len()
+	w.Write([]byte{0, 0, 0, 0})
+	w.WriteString(typ)
+	content()
+	binary.BigEndian.PutUint32(w.Bytes()[start:], uint32(w.Len()-start))
+}
+
+func (w *boxWriter) fullBox(typ string, version uint8, flags uint32, content func()) {
+	w.box(typ, func() {
+		w.u32(uint32(version)<<24 | flags)
+		content()
+	})
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *boxWriter) u32(v uint32) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *boxWriter) u64(v uint64) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *boxWriter) zeros(n int) {
+	w.Write(make([]byte, n))
+}
+
+// matrix writes the unity transformation matrix
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+// initSegment returns the initialization segment of the tracks
+func initSegment(tracks []fmp4Track) []byte {
+	w := &boxWriter{}
+	w.box("ftyp", func() {
+		w.WriteString("iso5")
+		w.u32(512)
+		w.WriteString("iso5iso6mp41")
+	})
+	w.box("moov", func() {
+		w.fullBox("mvhd", 0, 0, func() {
+			w.zeros(8)
+			w.u32(1000)
+			w.u32(0)
+			w.u32(0x00010000)
+			w.u16(0x0100)
+			w.zeros(10)
+			w.matrix()
+			w.zeros(24)
+			w.u32(uint32(len(tracks) + 1))
+		})
+		for _, t := range tracks {
+			w.trak(t)
+		}
+		w.box("mvex", func() {
+			for _, t := range tracks {
+				w.fullBox("trex", 0, 0, func() {
+					w.u32(t.id)
+					w.u32(1)
+					w.zeros(12)
+				})
+			}
+		})
+	})
+	return w.Bytes()
+}
+
+func (w *boxWriter) trak(t fmp4Track) {
+	w.box("trak", func() {
+		w.fullBox("tkhd", 0, 3, func() {
+			w.zeros(8)
+			w.u32(t.id)
+			w.zeros(4 + 4 + 8 + 2 + 2)
+			if t.video == nil {
+				w.u16(0x0100)
+			} else {
+				w.u16(0)
+			}
+			w.zeros(2)
+			w.matrix()
+			if t.video != nil {
+				w.u32(uint32(t.video.width) << 16)
+				w.u32(uint32(t.video.height) << 16)
+			} else {
+				w.zeros(8)
+			}
+		})
+		w.box("mdia", func() {
+			w.fullBox("mdhd", 0, 0, func() {
+				w.zeros(8)
+				w.u32(t.timescale)
+				w.u32(0)
+				// "und" language
+				w.u16(0x55c4)
+				w.u16(0)
+			})
+			w.fullBox("hdlr", 0, 0, func() {
+				w.u32(0)
+				if t.video != nil {
+					w.WriteString("vide")
+				} else {
+					w.WriteString("soun")
+				}
+				w.zeros(12)
+				if t.video != nil {
+					w.WriteString("VideoHandler\x00")
+				} else {
+					w.WriteString("SoundHandler\x00")
+				}
+			})
+			w.box("minf", func() {
+				if t.video != nil {
+					w.fullBox("vmhd", 0, 1, func() { w.zeros(8) })
+				} else {
+					w.fullBox("smhd", 0, 0, func() { w.zeros(4) })
+				}
+				w.box("dinf", func() {
+					w.fullBox("dref", 0, 0, func() {
+						w.u32(1)
+						w.fullBox("url ", 0, 1, func() {})
+					})
+				})
+				w.box("stbl", func() {
+					w.fullBox("stsd", 0, 0, func() {
+						w.u32(1)
+						w.sampleEntry(t)
+					})
+					w.fullBox("stts", 0, 0, func() { w.u32(0) })
+					w.fullBox("stsc", 0, 0, func() { w.u32(0) })
+					w.fullBox("stsz", 0, 0, func() { w.zeros(8) })
+					w.fullBox("stco", 0, 0, func() { w.u32(0) })
+				})
+			})
+		})
+	})
+}
+
+func (w *boxWriter) sampleEntry(t fmp4Track) {
+	if t.video == nil {
+		w.box("Opus", func() {
+			w.zeros(6)
+			w.u16(1)
+			w.zeros(8)
+			w.u16(t.channels)
+			w.u16(16)
+			w.zeros(4)
+			w.u32(t.timescale << 16)
+			w.box("dOps", func() {
+				w.u8(0)
+				w.u8(uint8(t.channels))
+				// Pre-skip
+				w.u16(0)
+				w.u32(t.timescale)
+				// Output gain
+				w.u16(0)
+				// Channel mapping family
+				w.u8(0)
+			})
+		})
+		return
+	}
+
+	typ, config := "avc1", "avcC"
+	if t.hevc {
+		typ, config = "hvc1", "hvcC"
+	}
+	w.box(typ, func() {
+		w.zeros(6)
+		w.u16(1)
+		w.zeros(16)
+		w.u16(uint16(t.video.width))
+		w.u16(uint16(t.video.height))
+		w.u32(0x00480000)
+		w.u32(0x00480000)
+		w.u32(0)
+		w.u16(1)
+		w.zeros(32)
+		w.u16(0x0018)
+		w.u16(0xffff)
+		w.box(config, func() { w.Write(t.video.record) })
+	})
+}
+
+// fragment returns a moof and mdat with the samples of the tracks, the
+// samples of a track start at its decode time
+func fragment(sequence uint32, tracks []fmp4Track, decodeTimes []uint64, samples [][]fmp4Sample) []byte {
+	moof := func(dataOffsets []uint32) []byte {
+		w := &boxWriter{}
+		w.box("moof", func() {
+			w.fullBox("mfhd", 0, 0, func() { w.u32(sequence) })
+			for i, t := range tracks {
+				if len(samples[i]) == 0 {
+					continue
+				}
+				w.box("traf", func() {
+					// default-base-is-moof
+					w.fullBox("tfhd", 0, 0x020000, func() { w.u32(t.id) })
+					w.fullBox("tfdt", 1, 0, func() { w.u64(decodeTimes[i]) })
+					// data offset, sample duration, size and flags
+					w.fullBox("trun", 0, 0x000701, func() {
+						w.u32(uint32(len(samples[i])))
+						w.u32(dataOffsets[i])
+						for _, s := range samples[i] {
+							w.u32(s.duration)
+							w.u32(uint32(len(s.data)))
+							if s.keyFrame {
+								w.u32(sampleFlagsKey)
+							} else {
+								w.u32(sampleFlagsNonKey)
+							}
+						}
+					})
+				})
+			}
+		})
+		return w.Bytes()
+	}
+
+	offsets := make([]uint32, len(tracks))
+	size := uint32(len(moof(offsets))) + 8
+	mdatSize := uint32(8)
+	for i := range tracks {
+		offsets[i] = size
+		for _, s := range samples[i] {
+			size += uint32(len(s.data))
+			mdatSize += uint32(len(s.data))
+		}
+	}
+
+	w := &boxWriter{}
+	w.Write(moof(offsets))
+	w.u32(mdatSize)
+	w.WriteString("mdat")
+	for i := range tracks {
+		for _, s := range samples[i] {
+			w.Write(s.data)
+		}
+	}
+	return w.Bytes()
+}
@@ -0,0 +1,788 @@
+/*
+【ファイル概要: muxer.go】
+RTPのトラックをLow-Latency HLS（fMP4）にパッケージングするマルチプレクサー。
+
+【処理の流れ】
+RTPパケット → 並べ替え → フレームの組み立て → サンプル（次のフレームで長さが決定）
+→ パーシャルセグメント（moof+mdat） → セグメント（パーシャルセグメントの連結）
+
+並べ替えとフレームの組み立ては録画と共通（recorder.JitterBuffer、recorder.FrameAssembler）。
+損失のあったフレームと、映像は次のキーフレームまでのフレームを破棄します。
+サンプルはNALユニットを4バイトの長さ付き（AVCC形式）にしたもので、AUDは取り除きます。
+
+【セグメント分割】
+- 映像（H.264/H.265）があるストリームは映像のキーフレームでセグメントを開始し、
+  SegmentDurationを超えた後の最初のキーフレームで次のセグメントに切り替える
+- SegmentDurationを超えるとOnKeyframeRequestでキーフレームを要求する
+- パーシャルセグメントはPartDurationごとにフレームの境界で分割
+- SPSなどのパラメータセットが変わった場合は新しい初期化セグメントで
+  セグメントを開始（EXT-X-DISCONTINUITY）
+- 音声のみのストリームは音声のフレームで分割
+
+【タイムライン】
+各トラックの最初のフレームの到着時刻を共通のタイムラインに対応付け、
+以降はRTPタイムスタンプの差分でデコード時刻を求めます（Bフレームは想定しない）。
+
+【プレイリスト】
+- ローリングウィンドウ（SegmentCount個のセグメント）のメディアプレイリスト
+- 末尾のセグメントのEXT-X-PARTとEXT-X-PRELOAD-HINT
+- ブロッキングリロード（_HLS_msn、_HLS_part）とプリロードヒントの
+  パーシャルセグメントの要求は生成されるまで待機
+*/
+package hls
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/ion-sfu/pkg/recorder"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	codecH264 = "h264"
+	codecH265 = "h265"
+	codecOpus = "opus"
+
+	defaultSegmentDuration = 2 * time.Second
+	defaultPartDuration    = 200 * time.Millisecond
+	defaultSegmentCount    = 7
+
+	// reorderWindow is the number of packets to wait for a missing packet
+	reorderWindow = 64
+
+	keyframeRequestInterval = 500 * time.Millisecond
+
+	mimeTypePlaylist = "application/vnd.apple.mpegurl"
+	mimeTypeMP4      = "video/mp4"
+)
+
+var (
+	// ErrUnsupportedCodec is returned for the codecs other than H.264, H.265 and Opus
+	ErrUnsupportedCodec = errors.New("codec not supported by hls")
+	// ErrNoTrack is returned when a muxer has no track
+	ErrNoTrack = errors.New("no hls track")
+
+	errMuxerClosed = errors.New("hls muxer closed")
+)
+
+// Config of a muxer
+type Config struct {
+	// SegmentDuration is the target duration of the segments, 2s when zero
+	SegmentDuration time.Duration
+	// PartDuration is the target duration of the partial segments, 200ms when zero
+	PartDuration time.Duration
+	// SegmentCount is the number of segments of the playlist, 7 when zero
+	SegmentCount int
+}
+
+// Muxer packages the RTP packets of a video and an audio track to LL-HLS,
+// and serves the playlists and the segments
+type Muxer struct {
+	sync.Mutex
+	config  Config
+	tracks  []*track
+	primary *track
+
+	start    time.Time
+	started  bool
+	initID   int
+	inits    map[int][]byte
+	sequence uint32
+
+	segments      []*segment
+	current       *segment
+	discontinuity int
+	lastKeyReq    time.Time
+	maxPart       time.Duration
+	maxSegment    time.Duration
+
+	onKeyframeRequest func()
+	// changed is closed and replaced when a part is added
+	changed chan struct{}
+	closed  bool
+}
+
+type track struct {
+	codec     string
+	timescale uint32
+	channels  uint16
+	jitter    *recorder.JitterBuffer
+	assembler *recorder.FrameAssembler
+	config    *videoConfig
+
+	// dts is the decode time of the RTP timestamp lastTS
+	started bool
+	lastTS  uint32
+	dts     int64
+	pending *pendingSample
+	ready   []fmp4Sample
+	// readyDTS is the decode time of the first ready sample
+	readyDTS int64
+}
+
+type pendingSample struct {
+	dts      int64
+	keyFrame bool
+	data     []byte
+}
+
+type segment struct {
+	msn           uint64
+	initID        int
+	discontinuity bool
+	start         time.Duration
+	duration      time.Duration
+	programTime   time.Time
+	parts         []*part
+	complete      bool
+	size          int
+}
+
+type part struct {
+	start       time.Duration
+	duration    time.Duration
+	independent bool
+	data        []byte
+}
+
+// NewMuxer returns a muxer of tracks with H.264, H.265 and Opus codecs, the
+// first video track drives the segmentation
+func NewMuxer(c Config, codecs []webrtc.RTPCodecCapability) (*Muxer, error) {
+	if c.SegmentDuration <= 0 {
+		c.SegmentDuration = defaultSegmentDuration
+	}
+	if c.PartDuration <= 0 {
+		c.PartDuration = defaultPartDuration
+	}
+	if c.SegmentCount <= 0 {
+		c.SegmentCount = defaultSegmentCount
+	}
+	if len(codecs) == 0 {
+		return nil, ErrNoTrack
+	}
+	m := &Muxer{
+		config:  c,
+		inits:   make(map[int][]byte),
+		changed: make(chan struct{}),
+	}
+	for _, codec := range codecs {
+		t := &track{timescale: codec.ClockRate, jitter: recorder.NewJitterBuffer(reorderWindow)}
+		switch strings.ToLower(codec.MimeType) {
+		case strings.ToLower(webrtc.MimeTypeH264):
+			t.codec = codecH264
+		case strings.ToLower(webrtc.MimeTypeH265):
+			t.codec = codecH265
+		case strings.ToLower(webrtc.MimeTypeOpus):
+			t.codec = codecOpus
+			t.timescale = 48000
+			t.channels = codec.Channels
+			if t.channels == 0 {
+				t.channels = 2
+			}
+		default:
+			return nil, ErrUnsupportedCodec
+		}
+		if t.timescale == 0 {
+			t.timescale = 90000
+		}
+		a, err := recorder.NewFrameAssembler(codec)
+		if err != nil {
+			return nil, err
+		}
+		t.assembler = a
+		if m.primary == nil && t.codec != codecOpus {
+			m.primary = t
+		}
+		m.tracks = append(m.tracks, t)
+	}
+	if m.primary == nil {
+		m.primary = m.tracks[0]
+	}
+	return m, nil
+}
+
+// OnKeyframeRequest sets the handler called when the muxer needs a keyframe
+// of the video track, to start a segment or after packet loss
+func (m *Muxer) OnKeyframeRequest(fn func()) {
+	m.Lock()
+	m.onKeyframeRequest = fn
+	m.Unlock()
+}
+
+// WriteRTP adds a packet of a track, the payload is copied
+func (m *Muxer) WriteRTP(index int, hdr *rtp.Header, payload []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return errMuxerClosed
+	}
+	if index < 0 || index >= len(m.tracks) {
+		return ErrNoTrack
+	}
+	t := m.tracks[index]
+	pkt := &buffer.ExtPacket{Packet: rtp.Packet{Header: *hdr, Payload: append([]byte(nil), payload...)}}
+	t.jitter.Push(pkt, func(pkt *buffer.ExtPacket, lost bool) {
+		t.assembler.Push(&pkt.Packet, lost, func(f recorder.Frame) { m.writeFrame(t, f) })
+	})
+	if t.assembler.WaitingKeyFrame() && t.config != nil {
+		m.requestKeyframe()
+	}
+	return nil
+}
+
+// Close ends the playlist, the pending requests fail
+func (m *Muxer) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.changed)
+	}
+	return nil
+}
+
+func (m *Muxer) requestKeyframe() {
+	if m.onKeyframeRequest == nil || time.Since(m.lastKeyReq) < keyframeRequestInterval {
+		return
+	}
+	m.lastKeyReq = time.Now()
+	go m.onKeyframeRequest()
+}
+
+func (m *Muxer) writeFrame(t *track, f recorder.Frame) {
+	now := time.Now()
+	changed := false
+	if t.codec != codecOpus && f.KeyFrame {
+		changed = m.updateConfig(t, f)
+	}
+	if !m.started {
+		if t != m.primary || !f.KeyFrame || (t.codec != codecOpus && t.config == nil) {
+			if t == m.primary && t.codec != codecOpus {
+				m.requestKeyframe()
+			}
+			return
+		}
+		m.started = true
+		m.start = now
+		m.writeInit()
+	}
+	if !t.started {
+		t.started = true
+		t.lastTS = f.Timestamp
+		t.dts = int64(now.Sub(m.start)) * int64(t.timescale) / int64(time.Second)
+	}
+	dts := t.dts + int64(int32(f.Timestamp-t.lastTS))
+	if t.pending != nil && dts <= t.pending.dts {
+		// Same or older timestamp, the frame is dropped
+		return
+	}
+	t.dts, t.lastTS = dts, f.Timestamp
+
+	if t.pending != nil {
+		duration := t.dts - t.pending.dts
+		if len(t.ready) == 0 {
+			t.readyDTS = t.pending.dts
+		}
+		t.ready = append(t.ready, fmp4Sample{duration: uint32(duration), keyFrame: t.pending.keyFrame, data: t.pending.data})
+	}
+	t.pending = &pendingSample{dts: t.dts, keyFrame: f.KeyFrame, data: t.sample(f)}
+
+	if t == m.primary {
+		m.cut(m.trackTime(t, t.dts), f.KeyFrame, changed)
+	}
+}
+
+// sample returns the fMP4 sample of a frame, the Opus packet or the length
+// prefixed NAL units without the access unit delimiters
+func (t *track) sample(f recorder.Frame) []byte {
+	if t.codec == codecOpus {
+		return f.Data
+	}
+	var data []byte
+	for _, nalu := range f.NALUs {
+		if t.codec == codecH265 && nalu[0]>>1&0x3f == h265NALUAUD || t.codec == codecH264 && nalu[0]&0x1f == h264NALUAUD {
+			continue
+		}
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(nalu)))
+		data = append(append(data, size[:]...), nalu...)
+	}
+	return data
+}
+
+// updateConfig updates the decoder configuration of a video track with the
+// parameter sets of a keyframe, and reports if it changed
+func (m *Muxer) updateConfig(t *track, f recorder.Frame) bool {
+	var vps, sps, pps []byte
+	for _, nalu := range f.NALUs {
+		if t.codec == codecH265 {
+			switch nalu[0] >> 1 & 0x3f {
+			case h265NALUVPS:
+				vps = nalu
+			case h265NALUSPS:
+				sps = nalu
+			case h265NALUPPS:
+				pps = nalu
+			}
+		} else {
+			switch nalu[0] & 0x1f {
+			case h264NALUSPS:
+				sps = nalu
+			case h264NALUPPS:
+				pps = nalu
+			}
+		}
+	}
+	if sps == nil || pps == nil {
+		return false
+	}
+	var config *videoConfig
+	var err error
+	if t.codec == codecH265 {
+		if vps == nil {
+			return false
+		}
+		config, err = newH265Config(vps, sps, pps)
+	} else {
+		config, err = newH264Config(sps, pps)
+	}
+	if err != nil || t.config != nil && string(t.config.record) == string(config.record) {
+		return false
+	}
+	t.config = config
+	if m.started {
+		m.writeInit()
+	}
+	return m.started
+}
+
+func (m *Muxer) writeInit() {
+	m.initID++
+	m.inits[m.initID] = initSegment(m.fmp4Tracks())
+}
+
+func (m *Muxer) fmp4Tracks() []fmp4Track {
+	tracks := make([]fmp4Track, len(m.tracks))
+	for i, t := range m.tracks {
+		tracks[i] = fmp4Track{
+			id:        uint32(i + 1),
+			timescale: t.timescale,
+			video:     t.config,
+			hevc:      t.codec == codecH265,
+			channels:  t.channels,
+		}
+		if t.codec != codecOpus && t.config == nil {
+			tracks[i].video = &videoConfig{}
+		}
+	}
+	return tracks
+}
+
+func (m *Muxer) trackTime(t *track, dts int64) time.Duration {
+	return time.Duration(dts * int64(time.Second) / int64(t.timescale))
+}
+
+// cut closes the part or the segment before a frame of the primary track at
+// time at, a keyframe with new parameter sets starts a segment
+func (m *Muxer) cut(at time.Duration, keyFrame, configChanged bool) {
+	seg := m.current
+	if seg == nil {
+		m.startSegment(at)
+		return
+	}
+	if configChanged {
+		m.finishSegment(at)
+		return
+	}
+	elapsed := at - seg.start
+	if elapsed >= m.config.SegmentDuration {
+		if keyFrame {
+			m.finishSegment(at)
+			return
+		}
+		m.requestKeyframe()
+	}
+	partStart := seg.start
+	if len(seg.parts) > 0 {
+		last := seg.parts[len(seg.parts)-1]
+		partStart = last.start + last.duration
+	}
+	if at-partStart >= m.config.PartDuration {
+		m.finishPart(at)
+	}
+}
+
+func (m *Muxer) startSegment(at time.Duration) {
+	seg := &segment{
+		initID:      m.initID,
+		start:       at,
+		programTime: m.start.Add(at),
+	}
+	if m.current != nil {
+		seg.msn = m.current.msn + 1
+		seg.discontinuity = m.current.initID != m.initID
+	}
+	m.current = seg
+}
+
+func (m *Muxer) finishSegment(at time.Duration) {
+	m.finishPart(at)
+	seg := m.current
+	seg.duration = at - seg.start
+	seg.complete = true
+	if seg.duration > m.maxSegment {
+		m.maxSegment = seg.duration
+	}
+	m.segments = append(m.segments, seg)
+	if len(m.segments) > m.config.SegmentCount {
+		if m.segments[0].discontinuity {
+			m.discontinuity++
+		}
+		m.segments[0] = nil
+		m.segments = m.segments[1:]
+		for id := range m.inits {
+			if id < m.segments[0].initID {
+				delete(m.inits, id)
+			}
+		}
+	}
+	m.startSegment(at)
+	m.notify()
+}
+
+// finishPart writes the ready samples of the tracks to a part ending at time at
+func (m *Muxer) finishPart(at time.Duration) {
+	seg := m.current
+	start := seg.start
+	if len(seg.parts) > 0 {
+		last := seg.parts[len(seg.parts)-1]
+		start = last.start + last.duration
+	}
+	if at <= start {
+		return
+	}
+
+	decodeTimes := make([]uint64, len(m.tracks))
+	samples := make([][]fmp4Sample, len(m.tracks))
+	empty := true
+	for i, t := range m.tracks {
+		decodeTimes[i] = uint64(t.readyDTS)
+		samples[i] = t.ready
+		t.ready = nil
+		empty = empty && len(samples[i]) == 0
+	}
+	p := &part{start: start, duration: at - start}
+	if !empty {
+		m.sequence++
+		p.data = fragment(m.sequence, m.fmp4Tracks(), decodeTimes, samples)
+		primary := samples[m.primaryIndex()]
+		p.independent = len(primary) > 0 && primary[0].keyFrame
+	}
+	seg.parts = append(seg.parts, p)
+	seg.size += len(p.data)
+	if p.duration > m.maxPart {
+		m.maxPart = p.duration
+	}
+	m.notify()
+}
+
+func (m *Muxer) primaryIndex() int {
+	for i, t := range m.tracks {
+		if t == m.primary {
+			return i
+		}
+	}
+	return 0
+}
+
+func (m *Muxer) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// wait blocks until ready returns true, the muxer is closed or the timeout
+func (m *Muxer) wait(ready func() bool, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	m.Lock()
+	for !ready() {
+		if m.closed {
+			m.Unlock()
+			return false
+		}
+		changed := m.changed
+		m.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+		m.Lock()
+	}
+	m.Unlock()
+	return true
+}
+
+// ServeHTTP serves the files of the stream by name: index.m3u8 (multivariant
+// playlist), stream.m3u8 (media playlist), init<N>.mp4, seg<N>.mp4 and part<N>.<I>.mp4
+func (m *Muxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	timeout := 3 * m.config.SegmentDuration
+	switch {
+	case name == "index.m3u8":
+		if !m.wait(m.hasSegments, timeout) {
+			http.Error(w, "stream not available", http.StatusServiceUnavailable)
+			return
+		}
+		m.serve(w, mimeTypePlaylist, m.multivariantPlaylist())
+	case name == "stream.m3u8":
+		m.servePlaylist(w, r, timeout)
+	case strings.HasPrefix(name, "init") && strings.HasSuffix(name, ".mp4"):
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "init"), ".mp4"))
+		m.Lock()
+		data, ok := m.inits[id]
+		m.Unlock()
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		m.serve(w, mimeTypeMP4, data)
+	case strings.HasPrefix(name, "seg") && strings.HasSuffix(name, ".mp4"):
+		msn, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "seg"), ".mp4"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		m.Lock()
+		data := m.segmentData(msn)
+		m.Unlock()
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+		m.serve(w, mimeTypeMP4, data)
+	case strings.HasPrefix(name, "part") && strings.HasSuffix(name, ".mp4"):
+		var msn uint64
+		var index int
+		if _, err := fmt.Sscanf(name, "part%d.%d.mp4", &msn, &index); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// The preload hint is requested before the part is complete
+		m.Lock()
+		hinted := m.current != nil && (msn == m.current.msn && index <= len(m.current.parts) || msn == m.current.msn+1 && index == 0)
+		m.Unlock()
+		if hinted {
+			m.wait(func() bool { return m.partData(msn, index) != nil }, timeout)
+		}
+		m.Lock()
+		data := m.partData(msn, index)
+		m.Unlock()
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+		m.serve(w, mimeTypeMP4, data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *Muxer) serve(w http.ResponseWriter, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	if contentType == mimeTypePlaylist {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "max-age=60")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
+
+func (m *Muxer) servePlaylist(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	query := r.URL.Query()
+	ready := m.hasSegments
+	if v := query.Get("_HLS_msn"); v != "" {
+		msn, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		index := -1
+		if v := query.Get("_HLS_part"); v != "" {
+			if index, err = strconv.Atoi(v); err != nil || index < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		m.Lock()
+		next := uint64(0)
+		if m.current != nil {
+			next = m.current.msn
+		}
+		m.Unlock()
+		if msn > next+2 {
+			http.Error(w, "_HLS_msn too far in the future", http.StatusBadRequest)
+			return
+		}
+		ready = func() bool { return m.hasPart(msn, index) }
+	}
+	if !m.wait(ready, timeout) {
+		http.Error(w, "stream not available", http.StatusServiceUnavailable)
+		return
+	}
+	m.serve(w, mimeTypePlaylist, m.mediaPlaylist())
+}
+
+// hasSegments reports if the playlist has a complete segment, the lock must be held
+func (m *Muxer) hasSegments() bool {
+	return len(m.segments) > 0
+}
+
+// hasPart reports if a part, or the segment when index is negative, is
+// complete, the lock must be held
+func (m *Muxer) hasPart(msn uint64, index int) bool {
+	if m.current == nil || len(m.segments) == 0 {
+		return false
+	}
+	if msn < m.current.msn {
+		return true
+	}
+	return msn == m.current.msn && index >= 0 && index < len(m.current.parts)
+}
+
+// segmentData returns the parts of a complete segment, the lock must be held
+func (m *Muxer) segmentData(msn uint64) []byte {
+	for _, seg := range m.segments {
+		if seg.msn != msn {
+			continue
+		}
+		data := make([]byte, 0, seg.size)
+		for _, p := range seg.parts {
+			data = append(data, p.data...)
+		}
+		return data
+	}
+	return nil
+}
+
+// partData returns the data of a part, the lock must be held
+func (m *Muxer) partData(msn uint64, index int) []byte {
+	segs := m.segments
+	if m.current != nil {
+		segs = append(segs[:len(segs):len(segs)], m.current)
+	}
+	for _, seg := range segs {
+		if seg.msn == msn && index >= 0 && index < len(seg.parts) {
+			// Empty parts are served as empty files
+			if seg.parts[index].data == nil {
+				return []byte{}
+			}
+			return seg.parts[index].data
+		}
+	}
+	return nil
+}
+
+func (m *Muxer) multivariantPlaylist() []byte {
+	m.Lock()
+	defer m.Unlock()
+	var codecs []string
+	resolution := ""
+	for _, t := range m.tracks {
+		switch {
+		case t.codec == codecOpus:
+			codecs = append(codecs, "opus")
+		case t.config != nil:
+			codecs = append(codecs, t.config.codec)
+			resolution = fmt.Sprintf(",RESOLUTION=%dx%d", t.config.width, t.config.height)
+		}
+	}
+	bandwidth := 0
+	for _, seg := range m.segments {
+		if seg.duration > 0 {
+			if bw := int(float64(seg.size*8) / seg.duration.Seconds()); bw > bandwidth {
+				bandwidth = bw
+			}
+		}
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"%s\n", bandwidth, strings.Join(codecs, ","), resolution)
+	b.WriteString("stream.m3u8\n")
+	return []byte(b.String())
+}
+
+func (m *Muxer) mediaPlaylist() []byte {
+	m.Lock()
+	defer m.Unlock()
+	targetDuration := int(math.Ceil(m.config.SegmentDuration.Seconds()))
+	if d := int(math.Round(m.maxSegment.Seconds())); d > targetDuration {
+		targetDuration = d
+	}
+	partTarget := m.config.PartDuration
+	if m.maxPart > partTarget {
+		partTarget = m.maxPart
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.segments[0].msn)
+	if m.discontinuity > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", m.discontinuity)
+	}
+
+	// The parts are listed for the segments of the last three target durations
+	partsFrom := len(m.segments)
+	var recent time.Duration
+	for partsFrom > 0 && recent < 3*time.Duration(targetDuration)*time.Second {
+		partsFrom--
+		recent += m.segments[partsFrom].duration
+	}
+	initID := 0
+	segs := append(m.segments[:len(m.segments):len(m.segments)], m.current)
+	for i, seg := range segs {
+		if seg.initID != initID {
+			if initID != 0 && seg.discontinuity {
+				b.WriteString("#EXT-X-DISCONTINUITY\n")
+			}
+			initID = seg.initID
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", initID)
+		}
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.programTime.UTC().Format("2006-01-02T15:04:05.000Z"))
+		if i >= partsFrom {
+			for j, p := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.mp4\"", p.duration.Seconds(), seg.msn, j)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				if p.data == nil {
+					b.WriteString(",GAP=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if seg.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.5f,\nseg%d.mp4\n", seg.duration.Seconds(), seg.msn)
+		}
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.mp4\"\n", m.current.msn, len(m.current.parts))
+	return []byte(b.String())
+}
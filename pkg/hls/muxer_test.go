@@ -0,0 +1,211 @@
+package hls
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/recorder"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testH264Codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}
+	testOpusCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+)
+
+// testSource writes 30fps H.264 frames, and 20ms Opus frames to the second
+// track when audio is set
+type testSource struct {
+	m       *Muxer
+	sps     []byte
+	audio   bool
+	frame   int
+	videoSN uint16
+	audioSN uint16
+	audioTS uint32
+}
+
+func (s *testSource) write(t *testing.T, keyFrame bool) {
+	ts := uint32(s.frame * 3000)
+	payloads := [][]byte{{0x41, 0x9a, byte(s.frame)}}
+	if keyFrame {
+		stapA := []byte{0x78}
+		for _, nalu := range [][]byte{s.sps, testH264PPS} {
+			stapA = append(append(stapA, 0, byte(len(nalu))), nalu...)
+		}
+		payloads = [][]byte{stapA, {0x65, 0x88, byte(s.frame)}}
+	}
+	for i, p := range payloads {
+		hdr := &rtp.Header{SequenceNumber: s.videoSN, Timestamp: ts, Marker: i == len(payloads)-1}
+		assert.NoError(t, s.m.WriteRTP(0, hdr, p))
+		s.videoSN++
+	}
+	for s.audio && uint64(s.audioTS)*90000 <= uint64(ts)*48000 {
+		hdr := &rtp.Header{SequenceNumber: s.audioSN, Timestamp: s.audioTS, Marker: true}
+		assert.NoError(t, s.m.WriteRTP(1, hdr, []byte{0xfc, byte(s.audioSN)}))
+		s.audioSN++
+		s.audioTS += 960
+	}
+	s.frame++
+}
+
+func get(t *testing.T, h http.Handler, target string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/hls/session/stream/"+target, nil))
+	body, err := ioutil.ReadAll(w.Result().Body)
+	assert.NoError(t, err)
+	return w.Code, string(body)
+}
+
+func TestNewMuxer(t *testing.T) {
+	_, err := NewMuxer(Config{}, nil)
+	assert.Equal(t, ErrNoTrack, err)
+	_, err = NewMuxer(Config{}, []webrtc.RTPCodecCapability{{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}})
+	assert.Equal(t, ErrUnsupportedCodec, err)
+
+	m, err := NewMuxer(Config{}, []webrtc.RTPCodecCapability{testOpusCodec, testH264Codec})
+	assert.NoError(t, err)
+	assert.Equal(t, m.tracks[1], m.primary)
+	assert.Equal(t, 2*time.Second, m.config.SegmentDuration)
+	assert.Equal(t, ErrNoTrack, m.WriteRTP(2, &rtp.Header{}, nil))
+	assert.NoError(t, m.Close())
+	assert.Equal(t, errMuxerClosed, m.WriteRTP(0, &rtp.Header{}, nil))
+}
+
+func Test_trackSample(t *testing.T) {
+	f := recorder.Frame{NALUs: [][]byte{{0x09, 0xf0}, testH264SPS, {0x65, 1, 2}}}
+	// The access unit delimiter is removed
+	data := (&track{codec: codecH264}).sample(f)
+	assert.Equal(t, 4+len(testH264SPS)+4+3, len(data))
+	assert.Equal(t, []byte{0, 0, 0, byte(len(testH264SPS))}, data[:4])
+	assert.Equal(t, []byte{0, 0, 0, 3, 0x65, 1, 2}, data[4+len(testH264SPS):])
+
+	f = recorder.Frame{NALUs: [][]byte{{0x46, 0x01, 0x10}, {0x26, 0x01, 1}}}
+	assert.Equal(t, []byte{0, 0, 0, 3, 0x26, 0x01, 1}, (&track{codec: codecH265}).sample(f))
+	assert.Equal(t, []byte{0xfc}, (&track{codec: codecOpus}).sample(recorder.Frame{Data: []byte{0xfc}}))
+}
+
+func TestMuxer_Playlist(t *testing.T) {
+	m, err := NewMuxer(Config{
+		SegmentDuration: 200 * time.Millisecond,
+		PartDuration:    50 * time.Millisecond,
+		SegmentCount:    3,
+	}, []webrtc.RTPCodecCapability{testH264Codec, testOpusCodec})
+	if !assert.NoError(t, err) {
+		return
+	}
+	keyframe := make(chan struct{}, 1)
+	m.OnKeyframeRequest(func() {
+		select {
+		case keyframe <- struct{}{}:
+		default:
+		}
+	})
+
+	// A keyframe is requested until the stream starts
+	src := &testSource{m: m, sps: testH264SPS, audio: true}
+	src.write(t, false)
+	select {
+	case <-keyframe:
+	case <-time.After(time.Second):
+		t.Fatal("keyframe not requested")
+	}
+
+	// A keyframe every 10 frames, segments of 333ms
+	src.frame = 0
+	for i := 0; i < 40; i++ {
+		src.write(t, i%10 == 0)
+	}
+	code, playlist := get(t, m, "stream.m3u8")
+	assert.Equal(t, http.StatusOK, code)
+	// The parts of two frames are longer than the part duration
+	assert.Contains(t, playlist, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.200\n")
+	assert.Contains(t, playlist, "#EXT-X-PART-INF:PART-TARGET=0.067\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA-SEQUENCE:0\n")
+	assert.Contains(t, playlist, "#EXT-X-MAP:URI=\"init1.mp4\"\n")
+	assert.Contains(t, playlist, "#EXT-X-PART:DURATION=0.06667,URI=\"part3.0.mp4\",INDEPENDENT=YES\n")
+	assert.Contains(t, playlist, "#EXTINF:0.33333,\nseg2.mp4\n")
+	assert.NotContains(t, playlist, "seg3.mp4")
+	assert.True(t, strings.HasSuffix(playlist, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part3.4.mp4\"\n"), playlist)
+
+	code, index := get(t, m, "index.m3u8")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, index, "CODECS=\"avc1.42c028,opus\",RESOLUTION=1920x1080\nstream.m3u8\n")
+
+	code, init := get(t, m, "init1.mp4")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ftyp", init[4:8])
+	for _, box := range []string{"moov", "avc1", "avcC", "Opus", "dOps", "trex"} {
+		assert.Contains(t, init, box)
+	}
+	code, seg := get(t, m, "seg1.mp4")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "moof", seg[4:8])
+	code, part := get(t, m, "part1.0.mp4")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, strings.HasPrefix(seg, part))
+	code, _ = get(t, m, "seg3.mp4")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, m, "init2.mp4")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Blocking playlist reload
+	code, _ = get(t, m, "stream.m3u8?_HLS_msn=6")
+	assert.Equal(t, http.StatusBadRequest, code)
+	reload := make(chan string)
+	go func() {
+		_, playlist := get(t, m, "stream.m3u8?_HLS_msn=4&_HLS_part=0")
+		reload <- playlist
+	}()
+	hint := make(chan string)
+	go func() {
+		_, part := get(t, m, "part4.0.mp4")
+		hint <- part
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		src.write(t, i == 0)
+	}
+	select {
+	case playlist = <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("playlist not reloaded")
+	}
+	assert.Contains(t, playlist, "#EXT-X-MEDIA-SEQUENCE:1\n")
+	assert.Contains(t, playlist, "URI=\"part4.0.mp4\",INDEPENDENT=YES\n")
+	assert.Equal(t, "moof", (<-hint)[4:8])
+
+	assert.NoError(t, m.Close())
+	code, _ = get(t, m, "stream.m3u8?_HLS_msn=5")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestMuxer_ParameterSetChange(t *testing.T) {
+	m, err := NewMuxer(Config{
+		SegmentDuration: 200 * time.Millisecond,
+		PartDuration:    50 * time.Millisecond,
+	}, []webrtc.RTPCodecCapability{testH264Codec})
+	if !assert.NoError(t, err) {
+		return
+	}
+	src := &testSource{m: m, sps: testH264SPS}
+	for i := 0; i < 5; i++ {
+		src.write(t, i == 0)
+	}
+	// A keyframe with a new SPS starts a segment with a new initialization segment
+	src.sps = append([]byte{0x67, 0x4d}, testH264SPS[2:]...)
+	for i := 0; i < 10; i++ {
+		src.write(t, i == 0)
+	}
+	_, playlist := get(t, m, "stream.m3u8")
+	assert.Contains(t, playlist, "#EXT-X-MAP:URI=\"init1.mp4\"\n")
+	assert.Contains(t, playlist, "#EXTINF:0.16667,\nseg0.mp4\n#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init2.mp4\"\n")
+	_, index := get(t, m, "index.m3u8")
+	assert.Contains(t, index, "CODECS=\"avc1.4dc028\"")
+}
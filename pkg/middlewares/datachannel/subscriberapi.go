@@ -14,6 +14,8 @@ const (
 	mediumValue       = "medium"
 	lowValue          = "low"
 	mutedValue        = "none"
+	screenValue       = "screen"
+	normalValue       = "normal"
 	ActiveLayerMethod = "activeLayer"
 )
 
@@ -23,6 +25,10 @@ type setRemoteMedia struct {
 	Framerate string   `json:"framerate"`
 	Audio     bool     `json:"audio"`
 	Layers    []string `json:"layers"`
+	Priority  string   `json:"priority"`
+	// LastN and Pinned configure the Last-N video forwarding of the subscriber
+	LastN  *int     `json:"lastN"`
+	Pinned []string `json:"pinned"`
 }
 
 type activeLayerMessage struct {
@@ -120,6 +126,12 @@ func SubscriberAPI(next sfu.MessageProcessor) sfu.MessageProcessor {
 				}
 			}
 		} else {
+			if srm.LastN != nil {
+				args.Peer.Subscriber().SetLastN(*srm.LastN)
+			}
+			if srm.Pinned != nil {
+				args.Peer.Subscriber().SetPinnedStreams(srm.Pinned)
+			}
 			downTracks := args.Peer.Subscriber().GetDownTracks(srm.StreamID)
 			for _, dt := range downTracks {
 				switch dt.Kind() {
@@ -147,6 +159,12 @@ func SubscriberAPI(next sfu.MessageProcessor) sfu.MessageProcessor {
 					case lowValue:
 						dt.SwitchTemporalLayer(0, true)
 					}
+					switch srm.Priority {
+					case screenValue:
+						dt.SetPriority(sfu.TrackPriorityScreen)
+					case normalValue:
+						dt.SetPriority(sfu.TrackPriorityNormal)
+					}
 				}
 
 			}
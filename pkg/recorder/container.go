@@ -0,0 +1,195 @@
+/*
+【ファイル概要: container.go】
+録画ファイルのコンテナの書き込み。
+
+【コンテナ】
+- IVF: VP8、VP9、AV1
+- Annex-B: H.264（スタートコード付きのNALユニット列）
+- Ogg: Opus（pionのoggwriterを使用）
+- WebM: VP8、VP9、AV1（webm.go）
+
+【IVF形式】
+  ファイルヘッダー（32バイト）: DKIF、バージョン、ヘッダーサイズ、FourCC、幅、高さ、
+                              タイムベース（分母・分子）、フレーム数
+  フレームヘッダー（12バイト）: フレームサイズ、PTS（タイムベース単位）
+  タイムベースはRTPのクロックレートとし、PTSは最初のフレームからのRTPタイムスタンプの差分
+  幅と高さは最初のキーフレームから取得（AV1は0）
+  AV1の各フレームはテンポラルデリミタOBUから開始
+*/
+package recorder
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// containerWriter writes the frames of a track to a file
+type containerWriter interface {
+	// writeFrame writes a frame, pts is in clock rate units since the first frame
+	writeFrame(f frame, pts int64) error
+	Close() error
+}
+
+type ivfWriter struct {
+	file  *os.File
+	count uint32
+	// av1 temporal units start with a temporal delimiter in IVF files
+	av1 bool
+}
+
+func newIVFWriter(file *os.File, fourcc string, clockRate uint32, key frame) (*ivfWriter, error) {
+	var width, height uint16
+	switch fourcc {
+	case "VP80":
+		width, height = vp8Dimensions(key.data)
+	case "VP90":
+		width, height = vp9Dimensions(key.data)
+	}
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], width)
+	binary.LittleEndian.PutUint16(header[14:], height)
+	binary.LittleEndian.PutUint32(header[16:], clockRate)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	if _, err := file.Write(header); err != nil {
+		return nil, err
+	}
+	return &ivfWriter{file: file, av1: fourcc == "AV01"}, nil
+}
+
+func (w *ivfWriter) writeFrame(f frame, pts int64) error {
+	if w.av1 {
+		f.data = append([]byte{av1OBUTemporalDelimiter<<3 | 0x02, 0x00}, f.data...)
+	}
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(f.data)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(pts))
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(f.data); err != nil {
+		return err
+	}
+	w.count++
+	return nil
+}
+
+// Close updates the frame count of the header
+func (w *ivfWriter) Close() error {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.count)
+	if _, err := w.file.WriteAt(count, 24); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// vp8Dimensions reads the frame size of a VP8 keyframe
+func vp8Dimensions(data []byte) (width, height uint16) {
+	if len(data) < 10 || data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+		return 0, 0
+	}
+	return binary.LittleEndian.Uint16(data[6:]) & 0x3fff, binary.LittleEndian.Uint16(data[8:]) & 0x3fff
+}
+
+// vp9Dimensions reads the frame size of the uncompressed header of a VP9
+// keyframe, the first frame of a superframe.
+func vp9Dimensions(data []byte) (width, height uint16) {
+	r := bitReader{data: data}
+	if r.read(2) != 2 {
+		return 0, 0
+	}
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1)
+	}
+	// show_existing_frame, frame_type, show_frame, error_resilient_mode
+	if r.read(1) != 0 || r.read(1) != 0 {
+		return 0, 0
+	}
+	r.read(2)
+	if r.read(24) != 0x498342 {
+		return 0, 0
+	}
+	if profile >= 2 {
+		r.read(1)
+	}
+	if colorSpace := r.read(3); colorSpace != 7 {
+		r.read(1)
+		if profile == 1 || profile == 3 {
+			r.read(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1)
+	}
+	width, height = uint16(r.read(16)+1), uint16(r.read(16)+1)
+	if r.overflow {
+		return 0, 0
+	}
+	return width, height
+}
+
+type bitReader struct {
+	data     []byte
+	offset   int
+	overflow bool
+}
+
+func (r *bitReader) read(bits int) uint32 {
+	var v uint32
+	for i := 0; i < bits; i++ {
+		if r.offset >= len(r.data)*8 {
+			r.overflow = true
+			return 0
+		}
+		v = v<<1 | uint32(r.data[r.offset/8]>>(7-r.offset%8)&1)
+		r.offset++
+	}
+	return v
+}
+
+// annexBWriter writes H.264 access units, the frames are already in Annex-B format
+type annexBWriter struct {
+	file io.WriteCloser
+}
+
+func (w *annexBWriter) writeFrame(f frame, _ int64) error {
+	_, err := w.file.Write(f.data)
+	return err
+}
+
+func (w *annexBWriter) Close() error {
+	return w.file.Close()
+}
+
+// oggWriter writes Opus packets in an Ogg file
+type oggWriter struct {
+	ogg *oggwriter.OggWriter
+}
+
+func newOggWriter(path string, clockRate uint32, channels uint16) (*oggWriter, error) {
+	if channels == 0 {
+		channels = 2
+	}
+	ogg, err := oggwriter.New(path, clockRate, channels)
+	if err != nil {
+		return nil, err
+	}
+	return &oggWriter{ogg: ogg}, nil
+}
+
+func (w *oggWriter) writeFrame(f frame, _ int64) error {
+	return w.ogg.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: f.timestamp}, Payload: f.data})
+}
+
+func (w *oggWriter) Close() error {
+	return w.ogg.Close()
+}
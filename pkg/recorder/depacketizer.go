@@ -0,0 +1,517 @@
+/*
+【ファイル概要: depacketizer.go】
+RTPパケットからメディアフレームへの組み立て（デパケット化）。
+
+【主要な役割】
+1. フレームの組み立て
+   - 同じタイムスタンプのパケットをマーカービットまで集めて1フレームとする
+   - パケットの損失やマーカービットの欠落があったフレームは破棄
+   - 音声は1パケットを1フレームとする
+   - FrameAssemblerの映像は、損失や破棄の後のフレームを次のキーフレームまで破棄
+
+2. コーデックごとのペイロード処理
+   - VP8: ペイロード記述子を取り除く
+   - VP9: ペイロード記述子を取り除き、複数の空間レイヤーはスーパーフレームにまとめる
+   - AV1: 集約ヘッダーとOBUの断片化を解除し、サイズフィールド付きのOBU列に変換
+   - H.264: STAP-A・FU-Aを解除してAnnex-B形式（スタートコード付き）に変換
+   - H.265: AP・FUを解除してAnnex-B形式に変換（PACIは破棄）
+   - Opus: ペイロードをそのまま使用
+
+3. FrameAssembler
+   - 録画と同じ形式のフレームを録画以外の用途（HLS、ローカルサブスクライバーなど）に提供
+   - H.264/H.265はスタートコードを除いたNALユニットの一覧も提供
+*/
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+var errIncompleteFrame = errors.New("incomplete frame")
+
+// frame is a media frame depacketized from the packets with the same timestamp
+type frame struct {
+	timestamp uint32
+	keyFrame  bool
+	data      []byte
+}
+
+// Frame is a media frame depacketized from the RTP packets with the same timestamp
+type Frame struct {
+	Timestamp uint32
+	KeyFrame  bool
+	// Data is the frame in the format of the recordings: VP8 and VP9 frames,
+	// AV1 OBUs with size fields, H.264 and H.265 Annex-B access units and
+	// Opus packets
+	Data []byte
+	// NALUs are the NAL units of a H.264 or H.265 access unit, without start codes
+	NALUs [][]byte
+}
+
+// FrameAssembler depacketizes the RTP packets of a track to frames
+type FrameAssembler struct {
+	assembler assembler
+	nalus     bool
+}
+
+// NewFrameAssembler returns an assembler of the VP8, VP9, AV1, H.264, H.265
+// and Opus packets. The video frames following a lost or a dropped frame are
+// dropped until the next keyframe.
+func NewFrameAssembler(codec webrtc.RTPCodecCapability) (*FrameAssembler, error) {
+	a, err := newAssembler(codec.MimeType)
+	if err != nil {
+		return nil, err
+	}
+	a.waitKeyFrame = !a.audio
+	switch a.depacketizer.(type) {
+	case *h264Depacketizer, h265Depacketizer:
+		return &FrameAssembler{assembler: a, nalus: true}, nil
+	}
+	return &FrameAssembler{assembler: a}, nil
+}
+
+// Push adds a packet in sequence number order, with lost set when packets are
+// missing before it. The payload must not be modified until the frame is
+// emitted, the frames with missing packets are dropped.
+func (a *FrameAssembler) Push(pkt *rtp.Packet, lost bool, emit func(f Frame)) {
+	_ = a.assembler.push(pkt, lost, func(f frame) error {
+		out := Frame{Timestamp: f.timestamp, KeyFrame: f.keyFrame, Data: f.data}
+		if a.nalus {
+			out.NALUs = annexBNALUs(f.data)
+		}
+		emit(out)
+		return nil
+	})
+}
+
+// WaitingKeyFrame reports if the video frames are dropped until a keyframe
+func (a *FrameAssembler) WaitingKeyFrame() bool {
+	return a.assembler.waiting
+}
+
+type depacketizer interface {
+	// build returns the frame data of the payloads of the packets of a frame
+	build(payloads [][]byte) (data []byte, keyFrame bool, err error)
+	reset()
+}
+
+type assembler struct {
+	depacketizer depacketizer
+	audio        bool
+	timestamp    uint32
+	payloads     [][]byte
+	// waitKeyFrame drops the frames after a lost or a dropped frame until the
+	// next keyframe, waiting is set meanwhile
+	waitKeyFrame bool
+	waiting      bool
+}
+
+// newAssembler returns the assembler of a codec
+func newAssembler(mimeType string) (assembler, error) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return assembler{depacketizer: vp8Depacketizer{}}, nil
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return assembler{depacketizer: vp9Depacketizer{}}, nil
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return assembler{depacketizer: av1Depacketizer{}}, nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return assembler{depacketizer: &h264Depacketizer{}}, nil
+	case strings.ToLower(webrtc.MimeTypeH265):
+		return assembler{depacketizer: h265Depacketizer{}}, nil
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return assembler{depacketizer: opusDepacketizer{}, audio: true}, nil
+	}
+	return assembler{}, ErrUnsupportedCodec
+}
+
+// push adds a packet popped from the jitter buffer, emit is called with the
+// completed frames.
+func (a *assembler) push(pkt *rtp.Packet, lost bool, emit func(f frame) error) error {
+	if lost || len(a.payloads) > 0 && pkt.Timestamp != a.timestamp {
+		a.drop()
+	}
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+	a.timestamp = pkt.Timestamp
+	a.payloads = append(a.payloads, pkt.Payload)
+	if !a.audio && !pkt.Marker {
+		return nil
+	}
+
+	data, keyFrame, err := a.depacketizer.build(a.payloads)
+	a.payloads = a.payloads[:0]
+	if err != nil {
+		a.depacketizer.reset()
+		a.waiting = a.waitKeyFrame
+		return nil
+	}
+	if a.waiting {
+		if !keyFrame {
+			return nil
+		}
+		a.waiting = false
+	}
+	return emit(frame{timestamp: pkt.Timestamp, keyFrame: keyFrame, data: data})
+}
+
+// drop discards the incomplete frame
+func (a *assembler) drop() {
+	a.payloads = a.payloads[:0]
+	a.depacketizer.reset()
+	a.waiting = a.waitKeyFrame
+}
+
+type vp8Depacketizer struct{}
+
+func (vp8Depacketizer) build(payloads [][]byte) ([]byte, bool, error) {
+	var data []byte
+	var keyFrame bool
+	for i, p := range payloads {
+		var pkt codecs.VP8Packet
+		if _, err := pkt.Unmarshal(p); err != nil {
+			return nil, false, err
+		}
+		if i == 0 {
+			if pkt.S != 1 || pkt.PID != 0 || len(pkt.Payload) == 0 {
+				return nil, false, errIncompleteFrame
+			}
+			keyFrame = pkt.Payload[0]&0x01 == 0
+		}
+		data = append(data, pkt.Payload...)
+	}
+	return data, keyFrame, nil
+}
+
+func (vp8Depacketizer) reset() {}
+
+type vp9Depacketizer struct{}
+
+func (vp9Depacketizer) build(payloads [][]byte) ([]byte, bool, error) {
+	var layers [][]byte
+	var keyFrame bool
+	for i, p := range payloads {
+		var pkt codecs.VP9Packet
+		if _, err := pkt.Unmarshal(p); err != nil {
+			return nil, false, err
+		}
+		switch {
+		case pkt.B:
+			if i == 0 {
+				keyFrame = !pkt.P
+			}
+			layers = append(layers, append([]byte(nil), pkt.Payload...))
+		case len(layers) == 0:
+			return nil, false, errIncompleteFrame
+		default:
+			layers[len(layers)-1] = append(layers[len(layers)-1], pkt.Payload...)
+		}
+	}
+	return vp9SuperFrame(layers), keyFrame, nil
+}
+
+func (vp9Depacketizer) reset() {}
+
+// vp9SuperFrame joins the frames of the spatial layers of a picture with a
+// superframe index
+func vp9SuperFrame(layers [][]byte) []byte {
+	if len(layers) == 1 {
+		return layers[0]
+	}
+	size := 0
+	for _, l := range layers {
+		if len(l) > size {
+			size = len(l)
+		}
+	}
+	mag := 1
+	for mag < 4 && size >= 1<<(8*mag) {
+		mag++
+	}
+	marker := byte(0xc0) | byte(mag-1)<<3 | byte(len(layers)-1)
+
+	var b bytes.Buffer
+	for _, l := range layers {
+		b.Write(l)
+	}
+	b.WriteByte(marker)
+	for _, l := range layers {
+		for i := 0; i < mag; i++ {
+			b.WriteByte(byte(len(l) >> (8 * i)))
+		}
+	}
+	b.WriteByte(marker)
+	return b.Bytes()
+}
+
+const (
+	av1OBUSequenceHeader    = 1
+	av1OBUTemporalDelimiter = 2
+	av1OBUTileList          = 8
+)
+
+type av1Depacketizer struct{}
+
+// build returns the OBUs of the temporal unit in the low overhead bitstream
+// format, every OBU with a size field.
+func (av1Depacketizer) build(payloads [][]byte) ([]byte, bool, error) {
+	var obus [][]byte
+	var keyFrame, fragmented bool
+	for i, p := range payloads {
+		if len(p) < 1 {
+			return nil, false, errIncompleteFrame
+		}
+		z, y, w, n := p[0]&0x80 != 0, p[0]&0x40 != 0, int(p[0]>>4&0x03), p[0]&0x08 != 0
+		if i == 0 {
+			if z {
+				return nil, false, errIncompleteFrame
+			}
+			keyFrame = n
+		}
+		if z != fragmented {
+			return nil, false, errIncompleteFrame
+		}
+		offset := 1
+		for e := 0; offset < len(p); e++ {
+			length := len(p) - offset
+			if w == 0 || e < w-1 {
+				size, m := readLEB128(p[offset:])
+				if m == 0 || offset+m+int(size) > len(p) {
+					return nil, false, errIncompleteFrame
+				}
+				offset += m
+				length = int(size)
+			}
+			element := p[offset : offset+length]
+			offset += length
+			if e == 0 && z {
+				obus[len(obus)-1] = append(obus[len(obus)-1], element...)
+			} else {
+				obus = append(obus, append([]byte(nil), element...))
+			}
+		}
+		fragmented = y
+	}
+	if fragmented {
+		return nil, false, errIncompleteFrame
+	}
+
+	var b bytes.Buffer
+	for _, obu := range obus {
+		if len(obu) == 0 {
+			continue
+		}
+		obuType := obu[0] >> 3 & 0x0f
+		if obuType == av1OBUTemporalDelimiter || obuType == av1OBUTileList {
+			continue
+		}
+		headerSize := 1
+		if obu[0]&0x04 != 0 {
+			headerSize = 2
+		}
+		if len(obu) < headerSize {
+			return nil, false, errIncompleteFrame
+		}
+		if obu[0]&0x02 != 0 {
+			// Already has a size field
+			b.Write(obu)
+			continue
+		}
+		b.WriteByte(obu[0] | 0x02)
+		b.Write(obu[1:headerSize])
+		b.Write(writeLEB128(uint64(len(obu) - headerSize)))
+		b.Write(obu[headerSize:])
+	}
+	return b.Bytes(), keyFrame, nil
+}
+
+func (av1Depacketizer) reset() {}
+
+// av1SequenceHeader returns the sequence header OBU of a temporal unit
+func av1SequenceHeader(data []byte) []byte {
+	for len(data) > 0 {
+		headerSize := 1
+		if data[0]&0x04 != 0 {
+			headerSize = 2
+		}
+		if len(data) < headerSize || data[0]&0x02 == 0 {
+			return nil
+		}
+		size, n := readLEB128(data[headerSize:])
+		end := headerSize + n + int(size)
+		if n == 0 || end > len(data) {
+			return nil
+		}
+		if data[0]>>3&0x0f == av1OBUSequenceHeader {
+			return data[:end]
+		}
+		data = data[end:]
+	}
+	return nil
+}
+
+func readLEB128(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 8; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func writeLEB128(v uint64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b = append(b, c|0x80)
+			continue
+		}
+		return append(b, c)
+	}
+}
+
+type h264Depacketizer struct {
+	pkt codecs.H264Packet
+}
+
+// build returns the NAL units of the access unit in Annex-B format
+func (d *h264Depacketizer) build(payloads [][]byte) ([]byte, bool, error) {
+	const fuA = 28
+	if len(payloads[0]) > 1 && payloads[0][0]&0x1f == fuA && payloads[0][1]&0x80 == 0 {
+		return nil, false, errIncompleteFrame
+	}
+	var data []byte
+	for _, p := range payloads {
+		nalus, err := d.pkt.Unmarshal(p)
+		if err != nil {
+			return nil, false, err
+		}
+		data = append(data, nalus...)
+	}
+	if len(data) == 0 {
+		return nil, false, errIncompleteFrame
+	}
+	return data, h264KeyFrame(data), nil
+}
+
+func (d *h264Depacketizer) reset() {
+	d.pkt = codecs.H264Packet{}
+}
+
+// h264KeyFrame reports if the Annex-B access unit has an IDR slice
+func h264KeyFrame(data []byte) bool {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 && data[i+3]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// H.265 NAL unit types
+const (
+	h265NALUIRAPLo = 16
+	h265NALUIRAPHi = 21
+	h265NALUAP     = 48
+	h265NALUFU     = 49
+	h265NALUPACI   = 50
+)
+
+type h265Depacketizer struct{}
+
+// build returns the NAL units of the access unit in Annex-B format, the PACI
+// packets are dropped
+func (h265Depacketizer) build(payloads [][]byte) ([]byte, bool, error) {
+	var data, fragment []byte
+	var keyFrame bool
+	add := func(nalu []byte) {
+		t := nalu[0] >> 1 & 0x3f
+		keyFrame = keyFrame || t >= h265NALUIRAPLo && t <= h265NALUIRAPHi
+		data = append(append(data, 0, 0, 0, 1), nalu...)
+	}
+	for _, p := range payloads {
+		if len(p) < 2 {
+			return nil, false, errIncompleteFrame
+		}
+		switch t := p[0] >> 1 & 0x3f; {
+		case t < h265NALUAP:
+			add(p)
+		case t == h265NALUAP:
+			for p = p[2:]; len(p) > 2; {
+				size := int(binary.BigEndian.Uint16(p))
+				if size < 2 || 2+size > len(p) {
+					return nil, false, errIncompleteFrame
+				}
+				add(p[2 : 2+size])
+				p = p[2+size:]
+			}
+		case t == h265NALUFU:
+			if len(p) < 3 {
+				return nil, false, errIncompleteFrame
+			}
+			switch {
+			case p[2]&0x80 != 0:
+				fragment = append([]byte{p[0]&0x81 | (p[2]&0x3f)<<1, p[1]}, p[3:]...)
+			case fragment == nil:
+				return nil, false, errIncompleteFrame
+			default:
+				fragment = append(fragment, p[3:]...)
+			}
+			if p[2]&0x40 != 0 {
+				add(fragment)
+				fragment = nil
+			}
+		case t == h265NALUPACI:
+		default:
+			return nil, false, errIncompleteFrame
+		}
+	}
+	if fragment != nil || len(data) == 0 {
+		return nil, false, errIncompleteFrame
+	}
+	return data, keyFrame, nil
+}
+
+func (h265Depacketizer) reset() {}
+
+// annexBNALUs returns the NAL units of an Annex-B access unit
+func annexBNALUs(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			if nalu := bytes.TrimRight(data[start:i], "\x00"); len(nalu) > 0 {
+				nalus = append(nalus, nalu)
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+type opusDepacketizer struct{}
+
+func (opusDepacketizer) build(payloads [][]byte) ([]byte, bool, error) {
+	return payloads[0], true, nil
+}
+
+func (opusDepacketizer) reset() {}
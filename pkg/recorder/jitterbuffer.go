@@ -0,0 +1,109 @@
+/*
+【ファイル概要: jitterbuffer.go】
+ジッターバッファ（シーケンス番号による並べ替え）。
+録画、HLS、ローカルサブスクライバーで共通に使用します。
+
+【主要な役割】
+1. 並べ替え
+   - 到着順のパケットをシーケンス番号順に並べ替えて出力
+   - NACKによる再送など、遅れて到着したパケットを元の位置に戻す
+   - 受信済みのパケットより新しいパケットにHeadを設定
+
+2. 損失の判定
+   - 欠けているパケットより maxLate 以上新しいパケットが到着した場合は損失と判断
+   - OnMissingで損失と分かっているパケット（キューで破棄したものなど）は待たない
+   - 欠けたパケットを飛ばし、損失フラグを付けて次のパケットを出力
+   - 出力済みの位置より古いパケットは破棄
+*/
+package recorder
+
+import "github.com/pion/ion-sfu/pkg/buffer"
+
+// JitterBuffer reorders the packets of a track by sequence number
+type JitterBuffer struct {
+	maxLate uint16
+	packets map[uint16]*buffer.ExtPacket
+	missing func(sn uint16) bool
+	// next is the sequence number of the next packet to pop
+	next    uint16
+	newest  uint16
+	started bool
+	lost    bool
+}
+
+// NewJitterBuffer returns a buffer waiting for a missing packet until maxLate
+// newer packets are received
+func NewJitterBuffer(maxLate uint16) *JitterBuffer {
+	return &JitterBuffer{
+		maxLate: maxLate,
+		packets: make(map[uint16]*buffer.ExtPacket),
+	}
+}
+
+// OnMissing sets the handler reporting if a missing packet is known to be
+// lost, it is skipped without waiting for newer packets
+func (j *JitterBuffer) OnMissing(fn func(sn uint16) bool) {
+	j.missing = fn
+}
+
+// Push adds a packet, the packets that can be popped in order are passed to
+// emit with lost set when packets are missing before them. The Head of the
+// packet is set when it is the newest one.
+func (j *JitterBuffer) Push(pkt *buffer.ExtPacket, emit func(pkt *buffer.ExtPacket, lost bool)) {
+	sn := pkt.Packet.SequenceNumber
+	if !j.started {
+		j.started = true
+		j.next, j.newest = sn, sn
+	}
+	if sn-j.next >= 0x8000 {
+		// Already popped or skipped
+		return
+	}
+	j.packets[sn] = pkt
+	if pkt.Head = sn-j.newest < 0x8000; pkt.Head {
+		j.newest = sn
+	}
+	for len(j.packets) > 0 {
+		if _, ok := j.packets[j.next]; ok {
+			j.pop(emit)
+			continue
+		}
+		if j.newest-j.next < j.maxLate && (j.missing == nil || !j.missing(j.next)) {
+			return
+		}
+		j.next++
+		j.lost = true
+	}
+}
+
+// Flush pops all the packets left
+func (j *JitterBuffer) Flush(emit func(pkt *buffer.ExtPacket, lost bool)) {
+	for len(j.packets) > 0 {
+		j.skip()
+		j.pop(emit)
+	}
+}
+
+func (j *JitterBuffer) pop(emit func(pkt *buffer.ExtPacket, lost bool)) {
+	for {
+		pkt, ok := j.packets[j.next]
+		if !ok {
+			return
+		}
+		delete(j.packets, j.next)
+		j.next++
+		emit(pkt, j.lost)
+		j.lost = false
+	}
+}
+
+// skip moves to the oldest packet buffered
+func (j *JitterBuffer) skip() {
+	for {
+		if _, ok := j.packets[j.next]; ok {
+			return
+		}
+		j.next++
+		j.lost = true
+	}
+}
@@ -0,0 +1,252 @@
+/*
+【ファイル概要: recorder.go】
+トラックのRTPパケットをファイルに録画するTrackWriterの実装。
+
+【主要な役割】
+1. 録画パイプライン
+   - RTPパケット → ジッターバッファ（並べ替え） → フレームの組み立て → コンテナへの書き込み
+   - webrtc.TrackLocalWriterを実装し、ダウントラックの書き込み先として使用できる
+
+2. コーデックとコンテナ
+   - VP8、VP9、AV1: IVF（デフォルト）またはWebM
+   - H.264: Annex-B
+   - Opus: Ogg
+
+3. キーフレームからの開始
+   - 映像は最初のキーフレームまでのフレームを破棄し、キーフレームでファイルを作成
+   - ファイルのタイムスタンプは最初のフレームからのRTPタイムスタンプの差分
+
+4. サイドカー
+   - 録画したトラックの情報と開始時刻をJSONで書き込み（WriteMetadata）
+   - 開始時刻はパブリッシャーのSender Reportから求めた壁時計時刻で、
+     セッション内のトラックの音声・映像の同期に使用する
+*/
+package recorder
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	ContainerIVF  = "ivf"
+	ContainerWebM = "webm"
+
+	defaultMaxLate = 100
+)
+
+var (
+	ErrUnsupportedCodec     = errors.New("codec not supported by the recorder")
+	ErrUnsupportedContainer = errors.New("container not supported by the recorder")
+	errWriterClosed         = errors.New("track writer closed")
+)
+
+// Options of the track recordings
+type Options struct {
+	// VideoContainer of the VP8, VP9 and AV1 tracks, ContainerIVF by default
+	VideoContainer string
+	// MaxLate is the number of packets to wait for a missing packet, zero means default
+	MaxLate uint16
+}
+
+// TrackWriter records the RTP packets of a track to a file
+type TrackWriter struct {
+	sync.Mutex
+	path      string
+	clockRate uint32
+	video     bool
+	create    func(key frame) (containerWriter, error)
+	jitter    *JitterBuffer
+	assembler assembler
+	container containerWriter
+	lastTS    uint32
+	pts       int64
+	err       error
+	closed    bool
+}
+
+// NewTrackWriter returns a writer of the track codec to the file at the base
+// path, with the extension of the container. The file is created with the
+// first frame, the first keyframe for video.
+func NewTrackWriter(basePath string, codec webrtc.RTPCodecCapability, opts Options) (*TrackWriter, error) {
+	if opts.MaxLate == 0 {
+		opts.MaxLate = defaultMaxLate
+	}
+	if opts.VideoContainer == "" {
+		opts.VideoContainer = ContainerIVF
+	}
+	if opts.VideoContainer != ContainerIVF && opts.VideoContainer != ContainerWebM {
+		return nil, ErrUnsupportedContainer
+	}
+	a, err := newAssembler(codec.MimeType)
+	if err != nil {
+		return nil, err
+	}
+	w := &TrackWriter{
+		clockRate: codec.ClockRate,
+		video:     strings.HasPrefix(strings.ToLower(codec.MimeType), "video/"),
+		jitter:    NewJitterBuffer(opts.MaxLate),
+		assembler: a,
+	}
+
+	var fourcc, codecID string
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		fourcc, codecID = "VP80", "V_VP8"
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		fourcc, codecID = "VP90", "V_VP9"
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		fourcc, codecID = "AV01", "V_AV1"
+	case strings.ToLower(webrtc.MimeTypeH264):
+		w.path = basePath + ".h264"
+		w.create = func(frame) (containerWriter, error) {
+			file, err := os.Create(w.path)
+			if err != nil {
+				return nil, err
+			}
+			return &annexBWriter{file: file}, nil
+		}
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		w.path = basePath + ".ogg"
+		w.create = func(frame) (containerWriter, error) {
+			return newOggWriter(w.path, codec.ClockRate, codec.Channels)
+		}
+	}
+
+	if fourcc != "" {
+		w.path = basePath + "." + opts.VideoContainer
+		w.create = func(key frame) (containerWriter, error) {
+			file, err := os.Create(w.path)
+			if err != nil {
+				return nil, err
+			}
+			var c containerWriter
+			if opts.VideoContainer == ContainerWebM {
+				c, err = newWebMWriter(file, codecID, codec.ClockRate, key)
+			} else {
+				c, err = newIVFWriter(file, fourcc, codec.ClockRate, key)
+			}
+			if err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+	if w.create == nil {
+		return nil, ErrUnsupportedCodec
+	}
+	return w, nil
+}
+
+// Path of the recording file
+func (w *TrackWriter) Path() string {
+	return w.path
+}
+
+// WriteRTP records a packet, the payload is copied
+func (w *TrackWriter) WriteRTP(hdr *rtp.Header, payload []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return 0, errWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	pkt := &buffer.ExtPacket{Packet: rtp.Packet{Header: *hdr, Payload: append([]byte(nil), payload...)}}
+	w.jitter.Push(pkt, w.assemble)
+	return len(payload), w.err
+}
+
+// Write records a marshaled RTP packet
+func (w *TrackWriter) Write(b []byte) (int, error) {
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	if _, err := w.WriteRTP(&pkt.Header, pkt.Payload); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close writes the packets left in the jitter buffer and closes the file
+func (w *TrackWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.jitter.Flush(w.assemble)
+	if w.container == nil {
+		return w.err
+	}
+	if err := w.container.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func (w *TrackWriter) assemble(pkt *buffer.ExtPacket, lost bool) {
+	if w.err != nil {
+		return
+	}
+	w.err = w.assembler.push(&pkt.Packet, lost, w.writeFrame)
+}
+
+func (w *TrackWriter) writeFrame(f frame) error {
+	if w.container == nil {
+		if w.video && !f.keyFrame {
+			return nil
+		}
+		c, err := w.create(f)
+		if err != nil {
+			return err
+		}
+		w.container = c
+		w.lastTS = f.timestamp
+	}
+	w.pts += int64(int32(f.timestamp - w.lastTS))
+	w.lastTS = f.timestamp
+	return w.container.writeFrame(f, w.pts)
+}
+
+// Metadata is the sidecar of a track recording, to align the tracks of a session
+type Metadata struct {
+	SessionID string `json:"session_id"`
+	PeerID    string `json:"peer_id"`
+	StreamID  string `json:"stream_id"`
+	TrackID   string `json:"track_id"`
+	Kind      string `json:"kind"`
+	MimeType  string `json:"mime_type"`
+	ClockRate uint32 `json:"clock_rate"`
+	File      string `json:"file"`
+	// FirstTimestamp is the RTP timestamp of the first packet, the file timestamps start from it
+	FirstTimestamp uint32 `json:"first_rtp_timestamp"`
+	// StartTime is the wall clock time of the first packet at the publisher, from
+	// its sender reports. Nil when no sender report was received.
+	StartTime *time.Time `json:"start_time,omitempty"`
+	// ArrivalTime of the first packet at the SFU
+	ArrivalTime time.Time `json:"arrival_time"`
+	EndTime     time.Time `json:"end_time"`
+}
+
+// WriteMetadata writes the sidecar JSON of a track recording
+func WriteMetadata(path string, m Metadata) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,286 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitterBuffer(t *testing.T) {
+	type popped struct {
+		sn   uint16
+		lost bool
+	}
+	var out []popped
+	var heads []bool
+	emit := func(pkt *buffer.ExtPacket, lost bool) {
+		out = append(out, popped{pkt.Packet.SequenceNumber, lost})
+		heads = append(heads, pkt.Head)
+	}
+	push := func(j *JitterBuffer, sn uint16) {
+		j.Push(&buffer.ExtPacket{Packet: rtp.Packet{Header: rtp.Header{SequenceNumber: sn}}}, emit)
+	}
+	j := NewJitterBuffer(4)
+	for _, sn := range []uint16{65534, 0, 65535, 2, 3, 4, 5, 1, 6} {
+		push(j, sn)
+	}
+	push(j, 8)
+	j.Flush(emit)
+
+	// 1 is given up when 5 arrives and dropped when it arrives late
+	assert.Equal(t, []popped{
+		{65534, false}, {65535, false}, {0, false},
+		{2, true}, {3, false}, {4, false}, {5, false}, {6, false},
+		{8, true},
+	}, out)
+	assert.Equal(t, []bool{true, false, true, true, true, true, true, true, true}, heads)
+
+	// A missing packet known to be lost is not waited for
+	out = nil
+	j = NewJitterBuffer(4)
+	j.OnMissing(func(sn uint16) bool { return sn == 11 })
+	for _, sn := range []uint16{10, 12, 14, 13} {
+		push(j, sn)
+	}
+	assert.Equal(t, []popped{{10, false}, {12, true}, {13, false}, {14, false}}, out)
+}
+
+func vp8TestPacket(sn uint16, ts uint32, start, marker, keyFrame bool) *rtp.Packet {
+	payload := []byte{0x00, 0x01, 0x02, 0x03}
+	if start {
+		payload[0] = 0x10
+		if !keyFrame {
+			payload[1] = 0x01
+		}
+	}
+	if keyFrame && start {
+		// Frame tag, start code and 640x480
+		payload = []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}
+	}
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: sn, Timestamp: ts, Marker: marker}, Payload: payload}
+}
+
+func TestTrackWriter_IVF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewTrackWriter(filepath.Join(dir, "track"), webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "track.ivf"), w.Path())
+
+	packets := []*rtp.Packet{
+		// Delta frame before the keyframe is dropped
+		vp8TestPacket(9, 0, true, true, false),
+		vp8TestPacket(10, 3000, true, false, true),
+		vp8TestPacket(12, 6000, true, true, false),
+		vp8TestPacket(11, 3000, false, true, true),
+		// Frame missing its first packet is dropped
+		vp8TestPacket(14, 9000, false, true, false),
+		vp8TestPacket(15, 12000, true, true, false),
+	}
+	for _, pkt := range packets {
+		_, err = w.WriteRTP(&pkt.Header, pkt.Payload)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+
+	b, err := ioutil.ReadFile(w.Path())
+	assert.NoError(t, err)
+	assert.Equal(t, "DKIF", string(b[:4]))
+	assert.Equal(t, "VP80", string(b[8:12]))
+	assert.Equal(t, uint16(640), binary.LittleEndian.Uint16(b[12:]))
+	assert.Equal(t, uint16(480), binary.LittleEndian.Uint16(b[14:]))
+	assert.Equal(t, uint32(90000), binary.LittleEndian.Uint32(b[16:]))
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(b[24:]))
+
+	var pts []uint64
+	for offset := 32; offset < len(b); {
+		size := int(binary.LittleEndian.Uint32(b[offset:]))
+		pts = append(pts, binary.LittleEndian.Uint64(b[offset+4:]))
+		offset += 12 + size
+	}
+	assert.Equal(t, []uint64{0, 3000, 9000}, pts)
+}
+
+func TestTrackWriter_unsupported(t *testing.T) {
+	_, err := NewTrackWriter("track", webrtc.RTPCodecCapability{MimeType: "video/H265"}, Options{})
+	assert.Equal(t, ErrUnsupportedCodec, err)
+	_, err = NewTrackWriter("track", webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, Options{VideoContainer: "mp4"})
+	assert.Equal(t, ErrUnsupportedContainer, err)
+}
+
+func TestFrameAssembler(t *testing.T) {
+	a, err := NewFrameAssembler(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var frames []Frame
+	emit := func(f Frame) { frames = append(frames, f) }
+	// A keyframe in two packets
+	a.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1, Timestamp: 3000}, Payload: []byte{0x10, 0x00, 0x00, 0x9d}}, false, emit)
+	a.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2, Timestamp: 3000, Marker: true}, Payload: []byte{0x00, 0x01, 0x2a, 0x03}}, false, emit)
+	assert.Equal(t, []Frame{{Timestamp: 3000, KeyFrame: true, Data: []byte{0x00, 0x00, 0x9d, 0x01, 0x2a, 0x03}}}, frames)
+
+	// A lost packet drops the frames until the next keyframe
+	frames = nil
+	a.Push(vp8TestPacket(4, 9000, true, true, false), true, emit)
+	assert.True(t, a.WaitingKeyFrame())
+	a.Push(vp8TestPacket(5, 12000, true, true, true), false, emit)
+	assert.False(t, a.WaitingKeyFrame())
+	if assert.Len(t, frames, 1) {
+		assert.Equal(t, uint32(12000), frames[0].Timestamp)
+	}
+
+	// The NAL units of the H.264 and H.265 frames
+	a, err = NewFrameAssembler(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264})
+	if !assert.NoError(t, err) {
+		return
+	}
+	frames = nil
+	a.Push(&rtp.Packet{Header: rtp.Header{Marker: true}, Payload: []byte{0x78, 0x00, 0x02, 0x09, 0xf0, 0x00, 0x02, 0x65, 0x01}}, false, emit)
+	if assert.Len(t, frames, 1) {
+		assert.True(t, frames[0].KeyFrame)
+		assert.Equal(t, [][]byte{{0x09, 0xf0}, {0x65, 0x01}}, frames[0].NALUs)
+	}
+
+	_, err = NewFrameAssembler(webrtc.RTPCodecCapability{MimeType: "audio/PCMU"})
+	assert.Equal(t, ErrUnsupportedCodec, err)
+}
+
+func Test_vp9Depacketizer(t *testing.T) {
+	// Two spatial layers of a key picture, the second layer in two packets
+	payloads := [][]byte{
+		{0x08, 0xaa},
+		{0x08, 0xbb},
+		{0x00, 0xcc},
+	}
+	data, keyFrame, err := vp9Depacketizer{}.build(payloads)
+	assert.NoError(t, err)
+	assert.True(t, keyFrame)
+	assert.Equal(t, []byte{0xaa, 0xbb, 0xcc, 0xc1, 0x01, 0x02, 0xc1}, data)
+
+	_, _, err = vp9Depacketizer{}.build(payloads[2:])
+	assert.Equal(t, errIncompleteFrame, err)
+}
+
+func Test_av1Depacketizer(t *testing.T) {
+	seq := []byte{0x08, 0x00, 0x00}
+	// New sequence with a sequence header, and a frame OBU fragmented over two packets
+	payloads := [][]byte{
+		append(append([]byte{0x68, byte(len(seq))}, seq...), 0x30, 0x01),
+		{0x90, 0x02, 0x03},
+	}
+	data, keyFrame, err := av1Depacketizer{}.build(payloads)
+	assert.NoError(t, err)
+	assert.True(t, keyFrame)
+	assert.Equal(t, []byte{0x0a, 0x02, 0x00, 0x00, 0x32, 0x03, 0x01, 0x02, 0x03}, data)
+	assert.Equal(t, []byte{0x0a, 0x02, 0x00, 0x00}, av1SequenceHeader(data))
+
+	// Continuation without the first fragment
+	_, _, err = av1Depacketizer{}.build(payloads[1:])
+	assert.Equal(t, errIncompleteFrame, err)
+}
+
+func Test_h264Depacketizer(t *testing.T) {
+	d := &h264Depacketizer{}
+	// STAP-A with SPS and PPS, and an IDR slice in two FU-A fragments
+	payloads := [][]byte{
+		{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce},
+		{0x7c, 0x85, 0x01},
+		{0x7c, 0x45, 0x02},
+	}
+	data, keyFrame, err := d.build(payloads)
+	assert.NoError(t, err)
+	assert.True(t, keyFrame)
+	assert.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x01, 0x67, 0x42,
+		0x00, 0x00, 0x00, 0x01, 0x68, 0xce,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x01, 0x02,
+	}, data)
+
+	_, _, err = d.build(payloads[2:])
+	assert.Equal(t, errIncompleteFrame, err)
+}
+
+func Test_h265Depacketizer(t *testing.T) {
+	// AP with a VPS and a SPS, a PACI, and an IDR_W_RADL in two FU fragments
+	payloads := [][]byte{
+		{0x60, 0x01, 0x00, 0x03, 0x40, 0x01, 0x0c, 0x00, 0x02, 0x42, 0x01},
+		{0x64, 0x01, 0x00, 0x00},
+		{0x62, 0x01, 0x93, 0x01},
+		{0x62, 0x01, 0x53, 0x02},
+	}
+	data, keyFrame, err := h265Depacketizer{}.build(payloads)
+	assert.NoError(t, err)
+	assert.True(t, keyFrame)
+	assert.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x01, 0x40, 0x01, 0x0c,
+		0x00, 0x00, 0x00, 0x01, 0x42, 0x01,
+		0x00, 0x00, 0x00, 0x01, 0x26, 0x01, 0x01, 0x02,
+	}, data)
+	assert.Equal(t, [][]byte{{0x40, 0x01, 0x0c}, {0x42, 0x01}, {0x26, 0x01, 0x01, 0x02}}, annexBNALUs(data))
+
+	// FU continuation without the start
+	_, _, err = h265Depacketizer{}.build(payloads[3:])
+	assert.Equal(t, errIncompleteFrame, err)
+}
+
+func TestTrackWriter_WebM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewTrackWriter(filepath.Join(dir, "track"), webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, Options{VideoContainer: ContainerWebM})
+	assert.NoError(t, err)
+	for _, pkt := range []*rtp.Packet{
+		vp8TestPacket(10, 0, true, true, true),
+		vp8TestPacket(11, 9000, true, true, false),
+	} {
+		_, err = w.WriteRTP(&pkt.Header, pkt.Payload)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "track.webm"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x1a, 0x45, 0xdf, 0xa3}, b[:4])
+
+	// The segment size is the rest of the file
+	header := int(b[4]&0x7f) + 5
+	assert.Equal(t, []byte{0x18, 0x53, 0x80, 0x67}, b[header:header+4])
+	size := binary.BigEndian.Uint64(b[header+4:]) & 0x00ffffffffffffff
+	assert.Equal(t, uint64(len(b)-header-12), size)
+
+	// Single cluster with the keyframe block and a block 100ms later
+	cluster := indexOf(b, []byte{0x1f, 0x43, 0xb6, 0x75})
+	assert.NotEqual(t, -1, cluster)
+	blocks := b[cluster:]
+	first := indexOf(blocks, []byte{0xa3})
+	assert.Equal(t, []byte{0x81, 0x00, 0x00, 0x80}, blocks[first+2:first+6])
+	second := first + 2 + int(blocks[first+1]&0x7f)
+	assert.Equal(t, byte(0xa3), blocks[second])
+	assert.Equal(t, []byte{0x81, 0x00, 0x64, 0x00}, blocks[second+2:second+6])
+}
+
+func indexOf(b, sub []byte) int {
+	for i := 0; i+len(sub) <= len(b); i++ {
+		if string(b[i:i+len(sub)]) == string(sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+func Test_ebmlSize(t *testing.T) {
+	assert.Equal(t, []byte{0x81}, ebmlSize(1))
+	assert.Equal(t, []byte{0x40, 0x7f}, ebmlSize(127))
+	assert.Equal(t, []byte{0x41, 0x00}, ebmlSize(256))
+}
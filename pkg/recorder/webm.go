@@ -0,0 +1,252 @@
+/*
+【ファイル概要: webm.go】
+WebM（Matroska）コンテナの書き込み（VP8、VP9、AV1の映像トラック1本）。
+
+【構成】
+  EBMLヘッダー
+  Segment（サイズ不明で開始し、クローズ時にファイルがシーク可能ならサイズを書き込み）
+    Info: TimecodeScale（1ms）、MuxingApp、WritingApp
+    Tracks: TrackEntry（コーデックID、AV1はav1C形式のCodecPrivate、幅と高さ）
+    Cluster: キーフレームごと、または約30秒ごとに開始
+      Timecode、SimpleBlock（Clusterからの相対タイムコード、キーフレームフラグ）
+
+シークに必要なCuesは書き込みません（録画後の再多重化で生成する想定）。
+*/
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+)
+
+const (
+	ebmlIDHeader             = 0x1a45dfa3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42f7
+	ebmlIDMaxIDLength        = 0x42f2
+	ebmlIDMaxSizeLength      = 0x42f3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	mkvIDSegment       = 0x18538067
+	mkvIDInfo          = 0x1549a966
+	mkvIDTimecodeScale = 0x2ad7b1
+	mkvIDMuxingApp     = 0x4d80
+	mkvIDWritingApp    = 0x5741
+	mkvIDTracks        = 0x1654ae6b
+	mkvIDTrackEntry    = 0xae
+	mkvIDTrackNumber   = 0xd7
+	mkvIDTrackUID      = 0x73c5
+	mkvIDTrackType     = 0x83
+	mkvIDCodecID       = 0x86
+	mkvIDCodecPrivate  = 0x63a2
+	mkvIDVideo         = 0xe0
+	mkvIDPixelWidth    = 0xb0
+	mkvIDPixelHeight   = 0xba
+	mkvIDCluster       = 0x1f43b675
+	mkvIDTimecode      = 0xe7
+	mkvIDSimpleBlock   = 0xa3
+
+	mkvTrackTypeVideo = 1
+	// maxClusterDuration in milliseconds, block timecodes are 16 bits relative to the cluster
+	maxClusterDuration = 30000
+	muxingApp          = "ion-sfu"
+)
+
+type webmWriter struct {
+	file      *os.File
+	clockRate uint32
+	// segmentOffset is the offset of the segment size
+	segmentOffset int64
+	size          int64
+	cluster       bytes.Buffer
+	clusterTime   int64
+	clusterOpen   bool
+}
+
+func newWebMWriter(file *os.File, codecID string, clockRate uint32, key frame) (*webmWriter, error) {
+	w := &webmWriter{file: file, clockRate: clockRate}
+
+	header := ebmlElement(ebmlIDHeader, concat(
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlElement(ebmlIDDocType, []byte("webm")),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	))
+	w.segmentOffset = int64(len(header)) + 4
+	segment := append(ebmlID(mkvIDSegment), 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+
+	entry := [][]byte{
+		ebmlUint(mkvIDTrackNumber, 1),
+		ebmlUint(mkvIDTrackUID, uint64(rand.Uint32())),
+		ebmlUint(mkvIDTrackType, mkvTrackTypeVideo),
+		ebmlElement(mkvIDCodecID, []byte(codecID)),
+	}
+	var width, height uint16
+	switch codecID {
+	case "V_VP8":
+		width, height = vp8Dimensions(key.data)
+	case "V_VP9":
+		width, height = vp9Dimensions(key.data)
+	case "V_AV1":
+		if seq := av1SequenceHeader(key.data); seq != nil {
+			entry = append(entry, ebmlElement(mkvIDCodecPrivate, av1CodecConfiguration(seq)))
+		}
+	}
+	if width != 0 && height != 0 {
+		entry = append(entry, ebmlElement(mkvIDVideo, concat(
+			ebmlUint(mkvIDPixelWidth, uint64(width)),
+			ebmlUint(mkvIDPixelHeight, uint64(height)),
+		)))
+	}
+
+	info := ebmlElement(mkvIDInfo, concat(
+		ebmlUint(mkvIDTimecodeScale, 1000000),
+		ebmlElement(mkvIDMuxingApp, []byte(muxingApp)),
+		ebmlElement(mkvIDWritingApp, []byte(muxingApp)),
+	))
+	tracks := ebmlElement(mkvIDTracks, ebmlElement(mkvIDTrackEntry, concat(entry...)))
+	if err := w.write(concat(header, segment, info, tracks)); err != nil {
+		return nil, err
+	}
+	// The segment size counts from the end of the segment header
+	w.size = int64(len(info) + len(tracks))
+	return w, nil
+}
+
+func (w *webmWriter) writeFrame(f frame, pts int64) error {
+	timecode := pts * 1000 / int64(w.clockRate)
+	if w.clusterOpen && (f.keyFrame || timecode-w.clusterTime > maxClusterDuration || timecode < w.clusterTime) {
+		if err := w.flushCluster(); err != nil {
+			return err
+		}
+	}
+	if !w.clusterOpen {
+		w.clusterOpen = true
+		w.clusterTime = timecode
+		w.cluster.Write(ebmlUint(mkvIDTimecode, uint64(timecode)))
+	}
+
+	block := make([]byte, 4, 4+len(f.data))
+	// Track number 1 as a one byte vint
+	block[0] = 0x81
+	binary.BigEndian.PutUint16(block[1:], uint16(int16(timecode-w.clusterTime)))
+	if f.keyFrame {
+		block[3] = 0x80
+	}
+	w.cluster.Write(ebmlElement(mkvIDSimpleBlock, append(block, f.data...)))
+	return nil
+}
+
+func (w *webmWriter) flushCluster() error {
+	cluster := ebmlElement(mkvIDCluster, w.cluster.Bytes())
+	w.cluster.Reset()
+	w.clusterOpen = false
+	w.size += int64(len(cluster))
+	return w.write(cluster)
+}
+
+// Close writes the last cluster and the segment size
+func (w *webmWriter) Close() error {
+	if w.clusterOpen {
+		if err := w.flushCluster(); err != nil {
+			_ = w.file.Close()
+			return err
+		}
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(w.size))
+	size[0] = 0x01
+	if _, err := w.file.WriteAt(size, w.segmentOffset); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *webmWriter) write(b []byte) error {
+	_, err := w.file.Write(b)
+	return err
+}
+
+// av1CodecConfiguration returns the AV1CodecConfigurationRecord of a sequence
+// header OBU, the level and tier of the first operating point are read when
+// the header has no timing info.
+func av1CodecConfiguration(seq []byte) []byte {
+	headerSize := 1
+	if seq[0]&0x04 != 0 {
+		headerSize = 2
+	}
+	_, n := readLEB128(seq[headerSize:])
+	r := bitReader{data: seq[headerSize+n:]}
+	profile := byte(r.read(3))
+	r.read(1)
+	var level, tier byte
+	if r.read(1) == 1 {
+		// reduced_still_picture_header
+		level = byte(r.read(5))
+	} else if r.read(1) == 0 {
+		// No timing info, initial_display_delay_present_flag and operating_points_cnt_minus_1
+		r.read(1)
+		r.read(5)
+		r.read(12)
+		if level = byte(r.read(5)); level > 7 {
+			tier = byte(r.read(1))
+		}
+	}
+	if r.overflow {
+		level, tier = 0, 0
+	}
+	// 4:2:0 chroma subsampling
+	return append([]byte{0x81, profile<<5 | level, tier<<7 | 0x0c, 0x00}, seq...)
+}
+
+func ebmlID(id uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func ebmlSize(size uint64) []byte {
+	n := 1
+	for n < 8 && size >= 1<<(7*uint(n))-1 {
+		n++
+	}
+	b := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		b[i] = byte(size)
+		size >>= 8
+	}
+	b[0] |= 1 << uint(8-n)
+	return b
+}
+
+func ebmlElement(id uint32, data []byte) []byte {
+	return concat(ebmlID(id), ebmlSize(uint64(len(data))), data)
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return ebmlElement(id, b)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
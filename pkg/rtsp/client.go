@@ -0,0 +1,470 @@
+/*
+【ファイル概要: client.go】
+カメラなどのRTSPサーバーからメディアを受信するクライアント。
+
+【処理の流れ】
+1. Dial: RTSP（TCP）またはRTSPS（TLS）で接続
+2. Describe: SDPを取得してメディアを読み取り（401の場合は認証して再送）
+3. Setup: メディアごとにトランスポートを設定
+   - TCP: RTSP接続上のインターリーブチャネル（RTPは2n、RTCPは2n+1）
+   - UDP: 連続するRTP/RTCPのポートのペアで受信
+4. Play: 再生を開始し、受信したRTP/RTCPをコールバックに渡す
+5. Close: TEARDOWNを送信して切断
+
+【接続の維持】
+- セッションのタイムアウトの半分の間隔でOPTIONSを送信
+- どのメディアもTimeoutの間受信しない場合は切断してDoneを閉じる
+  （UDPでパケットを送らないトラックがあっても、他のトラックを受信していれば維持）
+*/
+package rtsp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transports of the media
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+)
+
+const (
+	defaultTimeout        = 10 * time.Second
+	defaultSessionTimeout = 60 * time.Second
+	defaultUserAgent      = "ion-sfu"
+	receiveMTU            = 1500
+)
+
+var (
+	ErrClientClosed       = errors.New("rtsp client closed")
+	errUnsupportedScheme  = errors.New("unsupported rtsp url scheme")
+	errUnexpectedStatus   = errors.New("unexpected rtsp response status")
+	errMissingTransport   = errors.New("rtsp server did not accept the transport")
+	errInvalidTrack       = errors.New("invalid rtsp track")
+	errUDPPortUnavailable = errors.New("no udp port pair available")
+)
+
+// ClientConfig defines a RTSP client
+type ClientConfig struct {
+	// Transport of the media, TransportTCP by default
+	Transport string
+	// Timeout of the requests and of the reception of media, 10s by default
+	Timeout time.Duration
+	// UserAgent of the requests
+	UserAgent string
+}
+
+// StatusError is returned when the server answers a request with an unexpected status
+type StatusError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return errUnexpectedStatus.Error() + ": " + e.Method + " " + strconv.Itoa(e.StatusCode)
+}
+
+// Client receives the media of a RTSP server
+type Client struct {
+	// lastMedia is the time of the last RTP packet received on UDP, in [ns]
+	lastMedia int64
+
+	config ClientConfig
+	url    *url.URL
+	conn   net.Conn
+	br     *bufio.Reader
+
+	writeMu        sync.Mutex
+	cseq           int
+	auth           *authenticator
+	session        string
+	sessionTimeout time.Duration
+
+	tracks   []*clientTrack
+	channels map[uint8]int
+	onPacket func(track int, isRTCP bool, pkt []byte)
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+type clientTrack struct {
+	media      Media
+	transport  Transport
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+	serverRTCP *net.UDPAddr
+}
+
+// Dial connects to the server of a rtsp:// or rtsps:// URL, the credentials
+// of the URL are used when the server requires them
+func Dial(rawURL string, c ClientConfig) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.Transport == "" {
+		c.Transport = TransportTCP
+	}
+	if c.UserAgent == "" {
+		c.UserAgent = defaultUserAgent
+	}
+
+	host := u.Host
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	switch u.Scheme {
+	case "rtsp":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "554")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "rtsps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "322")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, errUnsupportedScheme
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		config:         c,
+		url:            u,
+		conn:           conn,
+		br:             bufio.NewReaderSize(conn, receiveMTU*4),
+		sessionTimeout: defaultSessionTimeout,
+		channels:       make(map[uint8]int),
+		done:           make(chan struct{}),
+	}, nil
+}
+
+// Describe returns the audio and video media of the URL
+func (c *Client) Describe() ([]Media, error) {
+	req := NewRequest(MethodDescribe, c.url)
+	req.Header.Set("Accept", "application/sdp")
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	base := c.url
+	for _, h := range []string{"Content-Base", "Content-Location"} {
+		if v := res.Header.Get(h); v != "" {
+			if u, err := url.Parse(v); err == nil && u.IsAbs() {
+				u.User = c.url.User
+				base = u
+				break
+			}
+		}
+	}
+	return ParseMedia(res.Body, base)
+}
+
+// Setup sets up the transport of a media, the tracks are numbered in the
+// order of setup
+func (c *Client) Setup(m Media) error {
+	n := len(c.tracks)
+	t := &clientTrack{media: m}
+	offer := Transport{}
+	if c.config.Transport == TransportUDP {
+		var err error
+		if t.rtpConn, t.rtcpConn, err = listenUDPPair(); err != nil {
+			return err
+		}
+		offer.ClientPort = [2]int{t.rtpConn.LocalAddr().(*net.UDPAddr).Port, t.rtcpConn.LocalAddr().(*net.UDPAddr).Port}
+	} else {
+		offer.TCP = true
+		offer.Interleaved = [2]int{2 * n, 2*n + 1}
+	}
+
+	req := NewRequest(MethodSetup, m.Control)
+	req.Header.Set("Transport", offer.String())
+	res, err := c.do(req)
+	if err != nil {
+		t.close()
+		return err
+	}
+	transports, err := ParseTransports(res.Header.Get("Transport"))
+	if err != nil || len(transports) == 0 || transports[0].TCP != offer.TCP {
+		t.close()
+		return errMissingTransport
+	}
+	t.transport = transports[0]
+	if session := res.Header.Get("Session"); session != "" {
+		var timeout int
+		c.session, timeout = SessionID(session)
+		if timeout > 0 {
+			c.sessionTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+
+	if t.transport.TCP {
+		c.channels[uint8(t.transport.Interleaved[0])] = n
+		c.channels[uint8(t.transport.Interleaved[1])] = n
+	} else if port := t.transport.ServerPort[1]; port != 0 {
+		ip := c.conn.RemoteAddr().(*net.TCPAddr).IP
+		t.serverRTCP = &net.UDPAddr{IP: ip, Port: port}
+	}
+	c.tracks = append(c.tracks, t)
+	return nil
+}
+
+// Play starts the media, the packets of the tracks are passed to onPacket
+// until the client is closed or fails
+func (c *Client) Play(onPacket func(track int, isRTCP bool, pkt []byte)) error {
+	if len(c.tracks) == 0 {
+		return errInvalidTrack
+	}
+	req := NewRequest(MethodPlay, c.url)
+	req.Header.Set("Range", "npt=0.000-")
+	if _, err := c.do(req); err != nil {
+		return err
+	}
+	c.onPacket = onPacket
+	_ = c.conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	atomic.StoreInt64(&c.lastMedia, time.Now().UnixNano())
+	for i, t := range c.tracks {
+		if t.rtpConn != nil {
+			go c.readUDP(i, t.rtpConn, false)
+			go c.readUDP(i, t.rtcpConn, true)
+		}
+	}
+	go c.keepAlive()
+	return nil
+}
+
+// WriteRTCP sends a RTCP packet of a track to the server
+func (c *Client) WriteRTCP(track int, pkt []byte) error {
+	if track < 0 || track >= len(c.tracks) {
+		return errInvalidTrack
+	}
+	t := c.tracks[track]
+	if t.transport.TCP {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		return WriteInterleavedFrame(c.conn, uint8(t.transport.Interleaved[1]), pkt)
+	}
+	if t.serverRTCP == nil {
+		return nil
+	}
+	_, err := t.rtcpConn.WriteToUDP(pkt, t.serverRTCP)
+	return err
+}
+
+// Done is closed when the client is closed or fails
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that closed the client
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close tears down the session and closes the connection
+func (c *Client) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	if c.session != "" {
+		req := NewRequest(MethodTeardown, c.url)
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.config.Timeout))
+		_ = c.write(req)
+	}
+	c.fail(ErrClientClosed)
+	return nil
+}
+
+// do sends a request and reads its response, before the media is played
+func (c *Client) do(req *Request) (*Response, error) {
+	for retry := true; ; retry = false {
+		_ = c.conn.SetDeadline(time.Now().Add(c.config.Timeout))
+		if err := c.write(req); err != nil {
+			return nil, err
+		}
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == StatusUnauthorized && retry {
+			password, _ := c.url.User.Password()
+			if c.auth, err = newAuthenticator(c.url.User.Username(), password, res.Header.Values("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res.StatusCode != StatusOK {
+			return nil, &StatusError{Method: req.Method, StatusCode: res.StatusCode}
+		}
+		return res, nil
+	}
+}
+
+// write sends a request with the headers of the client
+func (c *Client) write(req *Request) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.cseq++
+	req.Header.Set("CSeq", strconv.Itoa(c.cseq))
+	req.Header.Set("User-Agent", c.config.UserAgent)
+	if c.session != "" {
+		req.Header.Set("Session", c.session)
+	}
+	if c.auth != nil {
+		u := *req.URL
+		u.User = nil
+		req.Header.Set("Authorization", c.auth.authorization(req.Method, u.String()))
+	}
+	return req.Write(c.conn)
+}
+
+// readResponse reads the next response, skipping the interleaved frames
+// sent before it
+func (c *Client) readResponse() (*Response, error) {
+	buf := make([]byte, receiveMTU)
+	for {
+		interleaved, err := IsInterleaved(c.br)
+		if err != nil {
+			return nil, err
+		}
+		if !interleaved {
+			return ReadResponse(c.br)
+		}
+		if _, _, err = ReadInterleavedFrame(c.br, buf); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLoop reads the interleaved packets, and the responses of the keep alive requests
+func (c *Client) readLoop() {
+	buf := make([]byte, receiveMTU)
+	tcp := c.tracks[0].transport.TCP
+	for {
+		if tcp {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+		}
+		interleaved, err := IsInterleaved(c.br)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if !interleaved {
+			if _, err = ReadResponse(c.br); err != nil {
+				c.fail(err)
+				return
+			}
+			continue
+		}
+		channel, pkt, err := ReadInterleavedFrame(c.br, buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		track, ok := c.channels[channel]
+		if !ok {
+			continue
+		}
+		c.onPacket(track, int(channel) == c.tracks[track].transport.Interleaved[1], pkt)
+	}
+}
+
+// readUDP reads the packets of a track. The media timeout applies to all the
+// tracks, a track without packets keeps waiting while the others receive.
+func (c *Client) readUDP(track int, conn *net.UDPConn, isRTCP bool) {
+	buf := make([]byte, receiveMTU)
+	for {
+		if !isRTCP {
+			_ = conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+		}
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&c.lastMedia))) < c.config.Timeout {
+				continue
+			}
+			c.fail(err)
+			return
+		}
+		if !isRTCP {
+			atomic.StoreInt64(&c.lastMedia, time.Now().UnixNano())
+		}
+		c.onPacket(track, isRTCP, buf[:n])
+	}
+}
+
+// keepAlive refreshes the session before its timeout
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.sessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(NewRequest(MethodOptions, c.url)); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		_ = c.conn.Close()
+		for _, t := range c.tracks {
+			t.close()
+		}
+	})
+}
+
+func (t *clientTrack) close() {
+	if t.rtpConn != nil {
+		_ = t.rtpConn.Close()
+		_ = t.rtcpConn.Close()
+	}
+}
+
+// listenUDPPair listens on an even RTP port and the following RTCP port
+func listenUDPPair() (*net.UDPConn, *net.UDPConn, error) {
+	for i := 0; i < 20; i++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				return rtpConn, rtcpConn, nil
+			}
+		}
+		_ = rtpConn.Close()
+	}
+	return nil, nil, errUDPPortUnavailable
+}
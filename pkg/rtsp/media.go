@@ -0,0 +1,135 @@
+/*
+【ファイル概要: media.go】
+DESCRIBEで取得したSDPのメディアの読み取り。
+
+各メディアセクションの最初のペイロードタイプについて、コーデック名、
+クロックレート、チャネル数、fmtpのパラメータ、SETUPに使用する
+コントロールURL（Content-Baseからの相対URLを解決）を返します。
+rtpmapのない静的ペイロードタイプ（PCMU、PCMA）はRFC 3551の値を使用します。
+*/
+package rtsp
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+var errNoMedia = errors.New("no media in the session description")
+
+// Media is a media section of a session description
+type Media struct {
+	// Type is "audio" or "video"
+	Type string
+	// Control is the URL of the SETUP request of the media
+	Control     *url.URL
+	PayloadType uint8
+	// Codec is the upper case encoding name, like H264 or PCMU
+	Codec     string
+	ClockRate uint32
+	Channels  uint16
+	// Fmtp are the format parameters of the payload type, with lower case names
+	Fmtp map[string]string
+	// TrackID identifies the media for a server Handler, it is not described to the clients
+	TrackID string
+}
+
+var staticPayloadTypes = map[uint8]Media{
+	0: {Codec: "PCMU", ClockRate: 8000, Channels: 1},
+	8: {Codec: "PCMA", ClockRate: 8000, Channels: 1},
+}
+
+// ParseMedia returns the audio and video media of a session description, the
+// controls are resolved against the base URL
+func ParseMedia(b []byte, base *url.URL) ([]Media, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	for _, a := range desc.Attributes {
+		if a.Key == "control" {
+			base = resolveControl(base, a.Value)
+		}
+	}
+
+	var medias []Media
+	for _, md := range desc.MediaDescriptions {
+		if md.MediaName.Media != "audio" && md.MediaName.Media != "video" || len(md.MediaName.Formats) == 0 {
+			continue
+		}
+		pt, err := strconv.Atoi(md.MediaName.Formats[0])
+		if err != nil || pt < 0 || pt > 127 {
+			continue
+		}
+		m := staticPayloadTypes[uint8(pt)]
+		m.Type = md.MediaName.Media
+		m.PayloadType = uint8(pt)
+		m.Control = base
+		m.Fmtp = make(map[string]string)
+		prefix := md.MediaName.Formats[0] + " "
+		for _, a := range md.Attributes {
+			switch {
+			case a.Key == "control":
+				m.Control = resolveControl(base, a.Value)
+			case a.Key == "rtpmap" && strings.HasPrefix(a.Value, prefix):
+				parseRtpmap(&m, strings.TrimPrefix(a.Value, prefix))
+			case a.Key == "fmtp" && strings.HasPrefix(a.Value, prefix):
+				for _, p := range strings.Split(strings.TrimPrefix(a.Value, prefix), ";") {
+					if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 {
+						m.Fmtp[strings.ToLower(kv[0])] = kv[1]
+					}
+				}
+			}
+		}
+		if m.Codec != "" {
+			medias = append(medias, m)
+		}
+	}
+	if len(medias) == 0 {
+		return nil, errNoMedia
+	}
+	return medias, nil
+}
+
+// parseRtpmap reads the "<encoding name>/<clock rate>[/<channels>]" of a rtpmap
+func parseRtpmap(m *Media, v string) {
+	parts := strings.Split(strings.TrimSpace(v), "/")
+	m.Codec = strings.ToUpper(parts[0])
+	if len(parts) > 1 {
+		if rate, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+			m.ClockRate = uint32(rate)
+		}
+	}
+	m.Channels = 1
+	if len(parts) > 2 {
+		if channels, err := strconv.ParseUint(parts[2], 10, 16); err == nil {
+			m.Channels = uint16(channels)
+		}
+	}
+}
+
+func resolveControl(base *url.URL, control string) *url.URL {
+	if control == "" || control == "*" {
+		return base
+	}
+	if u, err := url.Parse(control); err == nil && u.IsAbs() {
+		if u.User == nil {
+			u.User = base.User
+		}
+		return u
+	}
+	// Relative controls are appended to the base, with its query like most
+	// servers expect
+	s := base.String()
+	if !strings.HasSuffix(s, "/") {
+		s += "/"
+	}
+	u, err := url.Parse(s + control)
+	if err != nil {
+		return base
+	}
+	return u
+}
@@ -0,0 +1,424 @@
+/*
+【ファイル概要: message.go】
+RTSP 1.0（RFC 2326）のメッセージの読み書き。
+
+【主要な役割】
+1. リクエストとレスポンス
+   - リクエスト行・ステータス行、ヘッダー、Content-Lengthのボディ
+   - ヘッダー名は大文字小文字を区別せずに扱い、CSeqなどRTSP固有の表記で書き込み
+
+2. インターリーブフレーム
+   - TCP接続上のRTP/RTCP（'$'、チャネル番号、16ビット長、データ）
+   - 受信側は先頭バイトでRTSPメッセージと区別する
+
+3. Transportヘッダー
+   - RTP/AVP（UDP）のclient_port/server_port、RTP/AVP/TCPのinterleaved
+*/
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtspVersion = "RTSP/1.0"
+	// maxBodySize of the messages, the SDP of a DESCRIBE is a few KB
+	maxBodySize = 1 << 16
+	// InterleavedMagic starts the interleaved frames on TCP connections
+	InterleavedMagic = '$'
+)
+
+// Methods of the RTSP requests
+const (
+	MethodOptions      = "OPTIONS"
+	MethodDescribe     = "DESCRIBE"
+	MethodSetup        = "SETUP"
+	MethodPlay         = "PLAY"
+	MethodPause        = "PAUSE"
+	MethodTeardown     = "TEARDOWN"
+	MethodGetParameter = "GET_PARAMETER"
+)
+
+// Status codes of the RTSP responses
+const (
+	StatusOK                     = 200
+	StatusBadRequest             = 400
+	StatusUnauthorized           = 401
+	StatusNotFound               = 404
+	StatusMethodNotAllowed       = 405
+	StatusSessionNotFound        = 454
+	StatusMethodNotValidInState  = 455
+	StatusUnsupportedTransport   = 461
+	StatusInternalServerError    = 500
+	StatusNotImplemented         = 501
+	StatusRTSPVersionUnsupported = 505
+)
+
+var (
+	errMalformedMessage   = errors.New("malformed rtsp message")
+	errMessageTooLarge    = errors.New("rtsp message body too large")
+	errNotInterleaved     = errors.New("not an interleaved frame")
+	errMalformedTransport = errors.New("malformed transport header")
+)
+
+var statusText = map[int]string{
+	StatusOK:                     "OK",
+	StatusBadRequest:             "Bad Request",
+	StatusUnauthorized:           "Unauthorized",
+	StatusNotFound:               "Not Found",
+	StatusMethodNotAllowed:       "Method Not Allowed",
+	StatusSessionNotFound:        "Session Not Found",
+	StatusMethodNotValidInState:  "Method Not Valid in This State",
+	StatusUnsupportedTransport:   "Unsupported Transport",
+	StatusInternalServerError:    "Internal Server Error",
+	StatusNotImplemented:         "Not Implemented",
+	StatusRTSPVersionUnsupported: "RTSP Version Not Supported",
+}
+
+// StatusText returns the reason phrase of a status code
+func StatusText(code int) string {
+	return statusText[code]
+}
+
+// headerNames are the RTSP headers not written in the MIME canonical form
+var headerNames = map[string]string{
+	"Cseq":             "CSeq",
+	"Www-Authenticate": "WWW-Authenticate",
+	"Rtp-Info":         "RTP-Info",
+}
+
+// CanonicalHeaderKey returns the form of a header name written in the messages
+func CanonicalHeaderKey(s string) string {
+	s = textproto.CanonicalMIMEHeaderKey(s)
+	if name, ok := headerNames[s]; ok {
+		return name
+	}
+	return s
+}
+
+// Header of a RTSP message
+type Header map[string][]string
+
+// Get returns the first value of a header
+func (h Header) Get(key string) string {
+	if v := h[CanonicalHeaderKey(key)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Values returns all the values of a header
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+// Set replaces the values of a header
+func (h Header) Set(key, value string) {
+	h[CanonicalHeaderKey(key)] = []string{value}
+}
+
+// Add appends a value to a header
+func (h Header) Add(key, value string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Del removes a header
+func (h Header) Del(key string) {
+	delete(h, CanonicalHeaderKey(key))
+}
+
+func (h Header) write(w *bytes.Buffer, body []byte) {
+	for key, values := range h {
+		if key == "Content-Length" {
+			continue
+		}
+		for _, v := range values {
+			fmt.Fprintf(w, "%s: %s\r\n", key, v)
+		}
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(w, "Content-Length: %d\r\n", len(body))
+	}
+	w.WriteString("\r\n")
+	w.Write(body)
+}
+
+// Request is a RTSP request
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header Header
+	Body   []byte
+}
+
+// NewRequest creates a request with an empty header
+func NewRequest(method string, u *url.URL) *Request {
+	return &Request{Method: method, URL: u, Header: make(Header)}
+}
+
+// Write writes the request, the credentials of the URL are not written
+func (r *Request) Write(w io.Writer) error {
+	u := *r.URL
+	u.User = nil
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s %s\r\n", r.Method, u.String(), rtspVersion)
+	r.Header.write(&b, r.Body)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Response is a RTSP response
+type Response struct {
+	StatusCode int
+	Header     Header
+	Body       []byte
+}
+
+// NewResponse creates a response to a request, with its CSeq
+func NewResponse(code int, req *Request) *Response {
+	res := &Response{StatusCode: code, Header: make(Header)}
+	if req != nil {
+		if cseq := req.Header.Get("CSeq"); cseq != "" {
+			res.Header.Set("CSeq", cseq)
+		}
+	}
+	return res
+}
+
+// Write writes the response
+func (r *Response) Write(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d %s\r\n", rtspVersion, r.StatusCode, StatusText(r.StatusCode))
+	r.Header.write(&b, r.Body)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ReadRequest reads a request
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, errMalformedMessage
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{Method: parts[0], URL: u}
+	if req.Header, req.Body, err = readHeaderAndBody(tp, r); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ReadResponse reads a response
+func ReadResponse(r *bufio.Reader) (*Response, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, errMalformedMessage
+	}
+	res := &Response{}
+	if res.StatusCode, err = strconv.Atoi(parts[1]); err != nil {
+		return nil, errMalformedMessage
+	}
+	if res.Header, res.Body, err = readHeaderAndBody(tp, r); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func readHeaderAndBody(tp *textproto.Reader, r *bufio.Reader) (Header, []byte, error) {
+	mime, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	h := make(Header, len(mime))
+	for key, values := range mime {
+		h[CanonicalHeaderKey(key)] = values
+	}
+	length, _ := strconv.Atoi(h.Get("Content-Length"))
+	if length <= 0 {
+		return h, nil, nil
+	}
+	if length > maxBodySize {
+		return nil, nil, errMessageTooLarge
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	return h, body, nil
+}
+
+// IsInterleaved reports whether the next data of the reader is an interleaved frame
+func IsInterleaved(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == InterleavedMagic, nil
+}
+
+// ReadInterleavedFrame reads an interleaved frame, the returned payload is
+// valid until the next read
+func ReadInterleavedFrame(r *bufio.Reader, buf []byte) (channel uint8, payload []byte, err error) {
+	var hdr [4]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[0] != InterleavedMagic {
+		return 0, nil, errNotInterleaved
+	}
+	size := int(binary.BigEndian.Uint16(hdr[2:]))
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return hdr[1], buf, nil
+}
+
+// WriteInterleavedFrame writes a packet on an interleaved channel
+func WriteInterleavedFrame(w io.Writer, channel uint8, payload []byte) error {
+	b := make([]byte, 4+len(payload))
+	b[0] = InterleavedMagic
+	b[1] = channel
+	binary.BigEndian.PutUint16(b[2:], uint16(len(payload)))
+	copy(b[4:], payload)
+	_, err := w.Write(b)
+	return err
+}
+
+// Transport is a transport specification of the Transport header
+type Transport struct {
+	// TCP is RTP/AVP/TCP with interleaved channels, RTP/AVP on UDP otherwise
+	TCP         bool
+	Interleaved [2]int
+	ClientPort  [2]int
+	ServerPort  [2]int
+	// SSRC of the packets sent by the server, zero when unknown
+	SSRC uint32
+	Mode string
+}
+
+// ParseTransports parses the transport specifications of a Transport header,
+// ordered by preference. The multicast and unknown transports are skipped.
+func ParseTransports(header string) ([]Transport, error) {
+	var transports []Transport
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		t := Transport{}
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			t.TCP = true
+		default:
+			continue
+		}
+		multicast := false
+		for _, p := range params[1:] {
+			kv := strings.SplitN(p, "=", 2)
+			key := strings.ToLower(strings.TrimSpace(kv[0]))
+			value := ""
+			if len(kv) == 2 {
+				value = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+			}
+			var err error
+			switch key {
+			case "multicast":
+				multicast = true
+			case "interleaved":
+				t.Interleaved, err = parseRange(value)
+			case "client_port":
+				t.ClientPort, err = parseRange(value)
+			case "server_port":
+				t.ServerPort, err = parseRange(value)
+			case "ssrc":
+				var ssrc uint64
+				ssrc, err = strconv.ParseUint(value, 16, 32)
+				t.SSRC = uint32(ssrc)
+			case "mode":
+				t.Mode = strings.ToUpper(value)
+			}
+			if err != nil {
+				return nil, errMalformedTransport
+			}
+		}
+		if !multicast {
+			transports = append(transports, t)
+		}
+	}
+	return transports, nil
+}
+
+// String returns the transport specification
+func (t Transport) String() string {
+	var b strings.Builder
+	if t.TCP {
+		fmt.Fprintf(&b, "RTP/AVP/TCP;unicast;interleaved=%d-%d", t.Interleaved[0], t.Interleaved[1])
+	} else {
+		b.WriteString("RTP/AVP;unicast")
+		if t.ClientPort[0] != 0 {
+			fmt.Fprintf(&b, ";client_port=%d-%d", t.ClientPort[0], t.ClientPort[1])
+		}
+		if t.ServerPort[0] != 0 {
+			fmt.Fprintf(&b, ";server_port=%d-%d", t.ServerPort[0], t.ServerPort[1])
+		}
+	}
+	if t.SSRC != 0 {
+		fmt.Fprintf(&b, ";ssrc=%08X", t.SSRC)
+	}
+	if t.Mode != "" {
+		fmt.Fprintf(&b, ";mode=%s", t.Mode)
+	}
+	return b.String()
+}
+
+// parseRange parses a "a-b" range, a single value "a" is the range a to a+1
+func parseRange(s string) ([2]int, error) {
+	var r [2]int
+	parts := strings.SplitN(s, "-", 2)
+	var err error
+	if r[0], err = strconv.Atoi(parts[0]); err != nil {
+		return r, err
+	}
+	r[1] = r[0] + 1
+	if len(parts) == 2 {
+		r[1], err = strconv.Atoi(parts[1])
+	}
+	return r, err
+}
+
+// SessionID returns the id of a Session header without its timeout, and the timeout in seconds
+func SessionID(header string) (id string, timeout int) {
+	parts := strings.Split(header, ";")
+	id = strings.TrimSpace(parts[0])
+	for _, p := range parts[1:] {
+		if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "timeout") {
+			timeout, _ = strconv.Atoi(kv[1])
+		}
+	}
+	return id, timeout
+}
@@ -0,0 +1,606 @@
+/*
+【ファイル概要: server.go】
+RTSPクライアント（VMS、ffplayなど）にストリームを送信するサーバー。
+
+【処理の流れ】
+1. DESCRIBE: HandlerのDescribeでURLのストリームのメディアを取得し、SDPで返す
+   （SETUPに使用するコントロールURLは絶対URLで記述）
+2. SETUP: メディアごとにトランスポートを設定し、接続ごとに1つのセッションを作成
+   - TCP: RTSP接続上のインターリーブチャネル
+   - UDP: メディアごとのRTP/RTCPのポートのペアからクライアントのポートへ送信
+3. PLAY: HandlerのPlayでPlayerを作成し、ServerSessionへの書き込みを送信
+4. TEARDOWN、または接続の切断でPlayerを閉じる
+
+【送信キュー】
+ServerSessionへの書き込みはキューに入れて別のゴルーチンで送信し、
+キューがいっぱいの場合は破棄します（遅いクライアントが送信元をブロックしない）。
+*/
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	serverSessionTimeout = 60
+	serverQueueSize      = 512
+	controlPrefix        = "trackID="
+)
+
+var (
+	// ErrStreamNotFound is returned by the handlers when the URL has no stream
+	ErrStreamNotFound = errors.New("rtsp stream not found")
+	// ErrInvalidURL is returned by the handlers when the URL is malformed
+	ErrInvalidURL = errors.New("invalid rtsp url")
+
+	errServerClosed         = errors.New("rtsp server closed")
+	errSessionClosed        = errors.New("rtsp session closed")
+	errSessionPlaying       = errors.New("rtsp session is playing")
+	errSessionNotSetup      = errors.New("rtsp session has no media set up")
+	errUnsupportedTransport = errors.New("unsupported rtsp transport")
+)
+
+// Handler provides the streams of a Server
+type Handler interface {
+	// Describe returns the media of the stream of a URL
+	Describe(u *url.URL) ([]Media, error)
+	// Play starts writing the media of a session, until the player is closed
+	Play(u *url.URL, s *ServerSession) (Player, error)
+}
+
+// Player writes the media of a session
+type Player interface {
+	// HandleRTCP handles a RTCP packet of the client for a media
+	HandleRTCP(media int, pkt []byte)
+	Close() error
+}
+
+// Server serves the streams of a Handler to RTSP clients
+type Server struct {
+	sync.Mutex
+	handler   Handler
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	closed    bool
+}
+
+// NewServer creates a server of the streams of a handler
+func NewServer(h Handler) *Server {
+	return &Server{
+		handler:   h,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+	}
+}
+
+// Serve accepts the connections of a listener until the server is closed
+func (s *Server) Serve(ln net.Listener) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return errServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.Lock()
+			closed := s.closed
+			delete(s.listeners, ln)
+			s.Unlock()
+			if closed {
+				return errServerClosed
+			}
+			return err
+		}
+		c := &serverConn{server: s, conn: conn, br: bufio.NewReaderSize(conn, receiveMTU*4)}
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			_ = conn.Close()
+			return errServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.Unlock()
+		go c.serve()
+	}
+}
+
+// Close stops the listeners and closes the sessions
+func (s *Server) Close() error {
+	s.Lock()
+	s.closed = true
+	listeners := s.listeners
+	conns := s.conns
+	s.listeners = make(map[net.Listener]struct{})
+	s.conns = make(map[*serverConn]struct{})
+	s.Unlock()
+
+	for ln := range listeners {
+		_ = ln.Close()
+	}
+	for c := range conns {
+		_ = c.conn.Close()
+	}
+	return nil
+}
+
+type serverConn struct {
+	server  *Server
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+	session *ServerSession
+}
+
+func (c *serverConn) serve() {
+	defer func() {
+		if c.session != nil {
+			c.session.close()
+		}
+		_ = c.conn.Close()
+		c.server.Lock()
+		delete(c.server.conns, c)
+		c.server.Unlock()
+	}()
+
+	buf := make([]byte, receiveMTU)
+	for {
+		interleaved, err := IsInterleaved(c.br)
+		if err != nil {
+			return
+		}
+		if interleaved {
+			channel, pkt, err := ReadInterleavedFrame(c.br, buf)
+			if err != nil {
+				return
+			}
+			if c.session != nil {
+				c.session.handleInterleaved(channel, pkt)
+			}
+			continue
+		}
+		req, err := ReadRequest(c.br)
+		if err != nil {
+			return
+		}
+		res := c.handle(req)
+		c.writeMu.Lock()
+		err = res.Write(c.conn)
+		c.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *serverConn) handle(req *Request) *Response {
+	if req.Header.Get("CSeq") == "" {
+		return NewResponse(StatusBadRequest, req)
+	}
+	if c.session != nil && req.Method != MethodOptions && req.Method != MethodDescribe {
+		if id, _ := SessionID(req.Header.Get("Session")); id != c.session.id {
+			return NewResponse(StatusSessionNotFound, req)
+		}
+	}
+
+	switch req.Method {
+	case MethodOptions:
+		res := NewResponse(StatusOK, req)
+		res.Header.Set("Public", strings.Join([]string{MethodOptions, MethodDescribe, MethodSetup, MethodPlay, MethodTeardown, MethodGetParameter}, ", "))
+		return res
+	case MethodDescribe:
+		return c.describe(req)
+	case MethodSetup:
+		return c.setup(req)
+	case MethodPlay:
+		return c.play(req)
+	case MethodTeardown:
+		if c.session != nil {
+			c.session.close()
+			c.session = nil
+		}
+		return NewResponse(StatusOK, req)
+	case MethodGetParameter:
+		return c.sessionResponse(req)
+	}
+	return NewResponse(StatusNotImplemented, req)
+}
+
+func (c *serverConn) describe(req *Request) *Response {
+	medias, err := c.server.handler.Describe(req.URL)
+	if err != nil {
+		return errorResponse(err, req)
+	}
+	res := NewResponse(StatusOK, req)
+	res.Header.Set("Content-Type", "application/sdp")
+	base := *req.URL
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	base.RawPath = ""
+	res.Header.Set("Content-Base", base.String())
+	res.Body = marshalSessionDescription(medias, req.URL, c.conn.LocalAddr())
+	return res
+}
+
+func (c *serverConn) setup(req *Request) *Response {
+	base, media, ok := splitControl(req.URL)
+	if !ok {
+		return NewResponse(StatusNotFound, req)
+	}
+	if c.session == nil {
+		medias, err := c.server.handler.Describe(base)
+		if err != nil {
+			return errorResponse(err, req)
+		}
+		c.session = newServerSession(c, base, medias)
+	}
+	s := c.session
+	if s.url.String() != base.String() {
+		return NewResponse(StatusMethodNotValidInState, req)
+	}
+	if media >= len(s.medias) {
+		return NewResponse(StatusNotFound, req)
+	}
+
+	transports, err := ParseTransports(req.Header.Get("Transport"))
+	if err != nil || len(transports) == 0 {
+		return NewResponse(StatusUnsupportedTransport, req)
+	}
+	tr := transports[0]
+	if err = s.setupTransport(media, &tr); err != nil {
+		if err == errSessionPlaying {
+			return NewResponse(StatusMethodNotValidInState, req)
+		}
+		return NewResponse(StatusUnsupportedTransport, req)
+	}
+	res := c.sessionResponse(req)
+	res.Header.Set("Transport", tr.String())
+	return res
+}
+
+func (c *serverConn) play(req *Request) *Response {
+	s := c.session
+	if s == nil {
+		return NewResponse(StatusSessionNotFound, req)
+	}
+	if err := s.play(); err != nil {
+		return errorResponse(err, req)
+	}
+	res := c.sessionResponse(req)
+	res.Header.Set("Range", "npt=now-")
+	return res
+}
+
+func (c *serverConn) sessionResponse(req *Request) *Response {
+	res := NewResponse(StatusOK, req)
+	if c.session != nil {
+		res.Header.Set("Session", c.session.id+";timeout="+strconv.Itoa(serverSessionTimeout))
+	}
+	return res
+}
+
+func errorResponse(err error, req *Request) *Response {
+	switch err {
+	case ErrStreamNotFound:
+		return NewResponse(StatusNotFound, req)
+	case ErrInvalidURL:
+		return NewResponse(StatusBadRequest, req)
+	case errSessionNotSetup:
+		return NewResponse(StatusMethodNotValidInState, req)
+	}
+	return NewResponse(StatusInternalServerError, req)
+}
+
+// ServerSession is the session of a client, the media set up by the client
+// are written by the Player of the session
+type ServerSession struct {
+	sync.Mutex
+	id         string
+	conn       *serverConn
+	url        *url.URL
+	medias     []Media
+	transports map[int]*serverTransport
+	player     Player
+	queue      chan serverPacket
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+type serverTransport struct {
+	Transport
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+	clientRTP  *net.UDPAddr
+	clientRTCP *net.UDPAddr
+}
+
+type serverPacket struct {
+	media  int
+	isRTCP bool
+	data   []byte
+}
+
+func newServerSession(c *serverConn, u *url.URL, medias []Media) *ServerSession {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &ServerSession{
+		id:         hex.EncodeToString(id),
+		conn:       c,
+		url:        u,
+		medias:     medias,
+		transports: make(map[int]*serverTransport),
+		queue:      make(chan serverPacket, serverQueueSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// Medias returns the media described to the client
+func (s *ServerSession) Medias() []Media {
+	return s.medias
+}
+
+// IsSetup reports whether the client set up a media
+func (s *ServerSession) IsSetup(media int) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.transports[media]
+	return ok
+}
+
+// WriteRTP sends a RTP packet of a media, the packet must not be modified
+// after the call. Packets are dropped when the client does not keep up.
+func (s *ServerSession) WriteRTP(media int, pkt []byte) error {
+	return s.enqueue(serverPacket{media: media, data: pkt})
+}
+
+// WriteRTCP sends a RTCP packet of a media, the packet must not be modified after the call
+func (s *ServerSession) WriteRTCP(media int, pkt []byte) error {
+	return s.enqueue(serverPacket{media: media, isRTCP: true, data: pkt})
+}
+
+func (s *ServerSession) enqueue(p serverPacket) error {
+	select {
+	case <-s.done:
+		return errSessionClosed
+	default:
+	}
+	select {
+	case s.queue <- p:
+	default:
+	}
+	return nil
+}
+
+// Close ends the session and closes the connection of the client
+func (s *ServerSession) Close() error {
+	return s.conn.conn.Close()
+}
+
+func (s *ServerSession) setupTransport(media int, tr *Transport) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.player != nil {
+		return errSessionPlaying
+	}
+	t := &serverTransport{}
+	if tr.TCP {
+		if tr.Interleaved == [2]int{} {
+			tr.Interleaved = [2]int{2 * media, 2*media + 1}
+		}
+		for m, other := range s.transports {
+			if m != media && other.TCP && (other.Interleaved[0] == tr.Interleaved[0] || other.Interleaved[1] == tr.Interleaved[1]) {
+				return errUnsupportedTransport
+			}
+		}
+	} else {
+		if tr.ClientPort[0] == 0 {
+			return errUnsupportedTransport
+		}
+		var err error
+		if t.rtpConn, t.rtcpConn, err = listenUDPPair(); err != nil {
+			return err
+		}
+		ip := s.conn.conn.RemoteAddr().(*net.TCPAddr).IP
+		t.clientRTP = &net.UDPAddr{IP: ip, Port: tr.ClientPort[0]}
+		t.clientRTCP = &net.UDPAddr{IP: ip, Port: tr.ClientPort[1]}
+		tr.ServerPort = [2]int{t.rtpConn.LocalAddr().(*net.UDPAddr).Port, t.rtcpConn.LocalAddr().(*net.UDPAddr).Port}
+	}
+	tr.Mode = ""
+	t.Transport = *tr
+	if old, ok := s.transports[media]; ok {
+		old.close()
+	}
+	s.transports[media] = t
+	return nil
+}
+
+func (s *ServerSession) play() error {
+	s.Lock()
+	if s.player != nil {
+		s.Unlock()
+		return nil
+	}
+	if len(s.transports) == 0 {
+		s.Unlock()
+		return errSessionNotSetup
+	}
+	s.Unlock()
+
+	player, err := s.conn.server.handler.Play(s.url, s)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.player = player
+	for media, t := range s.transports {
+		if t.rtcpConn != nil {
+			go s.readRTCP(media, t.rtcpConn)
+		}
+	}
+	s.Unlock()
+	go s.writeLoop()
+	return nil
+}
+
+func (s *ServerSession) writeLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case p := <-s.queue:
+			s.Lock()
+			t := s.transports[p.media]
+			s.Unlock()
+			if t == nil {
+				continue
+			}
+			var err error
+			switch {
+			case t.TCP && p.isRTCP:
+				err = s.conn.writeInterleaved(uint8(t.Interleaved[1]), p.data)
+			case t.TCP:
+				err = s.conn.writeInterleaved(uint8(t.Interleaved[0]), p.data)
+			case p.isRTCP:
+				_, err = t.rtcpConn.WriteToUDP(p.data, t.clientRTCP)
+			default:
+				_, err = t.rtpConn.WriteToUDP(p.data, t.clientRTP)
+			}
+			if err != nil && t.TCP {
+				// The connection is closed by its read loop
+				_ = s.conn.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *serverConn) writeInterleaved(channel uint8, pkt []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return WriteInterleavedFrame(c.conn, channel, pkt)
+}
+
+// handleInterleaved passes the RTCP packets of the client to the player
+func (s *ServerSession) handleInterleaved(channel uint8, pkt []byte) {
+	s.Lock()
+	player := s.player
+	media := -1
+	for m, t := range s.transports {
+		if t.TCP && t.Interleaved[1] == int(channel) {
+			media = m
+		}
+	}
+	s.Unlock()
+	if player != nil && media >= 0 {
+		player.HandleRTCP(media, pkt)
+	}
+}
+
+func (s *ServerSession) readRTCP(media int, conn *net.UDPConn) {
+	buf := make([]byte, receiveMTU)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.player.HandleRTCP(media, buf[:n])
+	}
+}
+
+func (s *ServerSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Lock()
+		player := s.player
+		for _, t := range s.transports {
+			t.close()
+		}
+		s.Unlock()
+		if player != nil {
+			_ = player.Close()
+		}
+	})
+}
+
+func (t *serverTransport) close() {
+	if t.rtpConn != nil {
+		_ = t.rtpConn.Close()
+		_ = t.rtcpConn.Close()
+	}
+}
+
+// splitControl returns the stream URL and the media index of a control URL,
+// the control may be appended to the path or to the query of the stream URL
+func splitControl(u *url.URL) (*url.URL, int, bool) {
+	base := *u
+	var control string
+	if i := strings.LastIndex(base.RawQuery, "/"+controlPrefix); i >= 0 {
+		control = base.RawQuery[i+1:]
+		base.RawQuery = base.RawQuery[:i]
+	} else if i := strings.LastIndex(base.Path, "/"+controlPrefix); i >= 0 {
+		control = base.Path[i+1:]
+		base.Path = base.Path[:i]
+		base.RawPath = ""
+	} else {
+		return nil, 0, false
+	}
+	media, err := strconv.Atoi(strings.TrimPrefix(control, controlPrefix))
+	if err != nil || media < 0 {
+		return nil, 0, false
+	}
+	return &base, media, true
+}
+
+// controlURL returns the absolute control URL of a media of a stream
+func controlURL(u *url.URL, media int) string {
+	c := *u
+	c.User = nil
+	c.Path = strings.TrimSuffix(c.Path, "/") + "/" + controlPrefix + strconv.Itoa(media)
+	c.RawPath = ""
+	return c.String()
+}
+
+func marshalSessionDescription(medias []Media, u *url.URL, local net.Addr) []byte {
+	ip := "0.0.0.0"
+	if addr, ok := local.(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		ip = addr.IP.String()
+	}
+	var b bytes.Buffer
+	b.WriteString("v=0\r\n")
+	fmt.Fprintf(&b, "o=- 0 0 IN IP4 %s\r\n", ip)
+	b.WriteString("s=ion-sfu\r\n")
+	b.WriteString("c=IN IP4 0.0.0.0\r\n")
+	b.WriteString("t=0 0\r\n")
+	b.WriteString("a=range:npt=now-\r\n")
+	for i, m := range medias {
+		fmt.Fprintf(&b, "m=%s 0 RTP/AVP %d\r\n", m.Type, m.PayloadType)
+		rtpmap := fmt.Sprintf("%s/%d", m.Codec, m.ClockRate)
+		if m.Channels > 1 {
+			rtpmap += "/" + strconv.Itoa(int(m.Channels))
+		}
+		fmt.Fprintf(&b, "a=rtpmap:%d %s\r\n", m.PayloadType, rtpmap)
+		if len(m.Fmtp) > 0 {
+			params := make([]string, 0, len(m.Fmtp))
+			for k, v := range m.Fmtp {
+				params = append(params, k+"="+v)
+			}
+			sort.Strings(params)
+			fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", m.PayloadType, strings.Join(params, ";"))
+		}
+		fmt.Fprintf(&b, "a=control:%s\r\n", controlURL(u, i))
+	}
+	return b.Bytes()
+}
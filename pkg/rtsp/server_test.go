@@ -0,0 +1,248 @@
+package rtsp
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandler struct {
+	sync.Mutex
+	players []*testPlayer
+}
+
+type testPlayer struct {
+	sync.Mutex
+	session *ServerSession
+	rtcp    [][]byte
+	closed  bool
+	done    chan struct{}
+}
+
+func (h *testHandler) Describe(u *url.URL) ([]Media, error) {
+	switch u.Path {
+	case "/session/stream":
+		return []Media{
+			{Type: "video", PayloadType: 96, Codec: "H264", ClockRate: 90000, Fmtp: map[string]string{"packetization-mode": "1"}},
+			{Type: "audio", PayloadType: 111, Codec: "OPUS", ClockRate: 48000, Channels: 2},
+		}, nil
+	case "/session/invalid":
+		return nil, ErrInvalidURL
+	}
+	return nil, ErrStreamNotFound
+}
+
+func (h *testHandler) Play(_ *url.URL, s *ServerSession) (Player, error) {
+	p := &testPlayer{session: s, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				for i := range s.Medias() {
+					if s.IsSetup(i) {
+						_ = s.WriteRTP(i, []byte{0x80, byte(i)})
+					}
+				}
+			}
+		}
+	}()
+	h.Lock()
+	h.players = append(h.players, p)
+	h.Unlock()
+	return p, nil
+}
+
+func (p *testPlayer) HandleRTCP(media int, pkt []byte) {
+	p.Lock()
+	defer p.Unlock()
+	p.rtcp = append(p.rtcp, append([]byte{byte(media)}, pkt...))
+}
+
+func (p *testPlayer) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	close(p.done)
+	return nil
+}
+
+func (h *testHandler) player() *testPlayer {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.players) == 0 {
+		return nil
+	}
+	return h.players[len(h.players)-1]
+}
+
+func TestServer_Play(t *testing.T) {
+	for _, transport := range []string{TransportTCP, TransportUDP} {
+		transport := transport
+		t.Run(transport, func(t *testing.T) {
+			h := &testHandler{}
+			s := NewServer(h)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NoError(t, err)
+			go func() { _ = s.Serve(ln) }()
+			defer s.Close()
+
+			c, err := Dial("rtsp://"+ln.Addr().String()+"/session/stream", ClientConfig{Transport: transport, Timeout: time.Second})
+			assert.NoError(t, err)
+			medias, err := c.Describe()
+			assert.NoError(t, err)
+			if !assert.Len(t, medias, 2) {
+				return
+			}
+			assert.Equal(t, "H264", medias[0].Codec)
+			assert.Equal(t, "1", medias[0].Fmtp["packetization-mode"])
+			assert.Equal(t, uint16(2), medias[1].Channels)
+			assert.Equal(t, "rtsp://"+ln.Addr().String()+"/session/stream/trackID=1", medias[1].Control.String())
+
+			// Only the audio is set up
+			assert.NoError(t, c.Setup(medias[1]))
+			received := make(chan []byte, 10)
+			assert.NoError(t, c.Play(func(track int, isRTCP bool, pkt []byte) {
+				if !isRTCP {
+					select {
+					case received <- append([]byte{}, pkt...):
+					default:
+					}
+				}
+			}))
+			select {
+			case pkt := <-received:
+				assert.Equal(t, []byte{0x80, 1}, pkt)
+			case <-time.After(time.Second):
+				t.Fatal("no packet received")
+			}
+
+			assert.NoError(t, c.WriteRTCP(0, []byte{0x81, 0xc9}))
+			p := h.player()
+			assert.Eventually(t, func() bool {
+				p.Lock()
+				defer p.Unlock()
+				return len(p.rtcp) == 1
+			}, time.Second, 10*time.Millisecond)
+			assert.Equal(t, []byte{1, 0x81, 0xc9}, p.rtcp[0])
+
+			assert.NoError(t, c.Close())
+			assert.Eventually(t, func() bool {
+				p.Lock()
+				defer p.Unlock()
+				return p.closed
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestServer_Errors(t *testing.T) {
+	h := &testHandler{}
+	s := NewServer(h)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.Serve(ln) }()
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{name: "not found", path: "/session/missing", status: StatusNotFound},
+		{name: "invalid", path: "/session/invalid", status: StatusBadRequest},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Dial("rtsp://"+ln.Addr().String()+tt.path, ClientConfig{Timeout: time.Second})
+			assert.NoError(t, err)
+			defer c.Close()
+			_, err = c.Describe()
+			if assert.IsType(t, &StatusError{}, err) {
+				assert.Equal(t, tt.status, err.(*StatusError).StatusCode)
+			}
+		})
+	}
+
+	c, err := Dial("rtsp://"+ln.Addr().String()+"/session/stream", ClientConfig{Timeout: time.Second})
+	assert.NoError(t, err)
+	defer c.Close()
+	err = c.Play(nil)
+	assert.Equal(t, errInvalidTrack, err)
+	u, _ := url.Parse("rtsp://" + ln.Addr().String() + "/session/stream/trackID=5")
+	err = c.Setup(Media{Control: u})
+	if assert.IsType(t, &StatusError{}, err) {
+		assert.Equal(t, StatusNotFound, err.(*StatusError).StatusCode)
+	}
+}
+
+func TestSplitControl(t *testing.T) {
+	tests := []struct {
+		control string
+		base    string
+		media   int
+		ok      bool
+	}{
+		{control: "rtsp://host/session/stream/trackID=1", base: "rtsp://host/session/stream", media: 1, ok: true},
+		{control: "rtsp://host/session/stream/trackID=0?layer=2", base: "rtsp://host/session/stream?layer=2", media: 0, ok: true},
+		{control: "rtsp://host/session/stream?layer=2/trackID=1", base: "rtsp://host/session/stream?layer=2", media: 1, ok: true},
+		{control: "rtsp://host/session/stream"},
+		{control: "rtsp://host/session/stream/trackID=x"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.control)
+		base, media, ok := splitControl(u)
+		assert.Equal(t, tt.ok, ok, tt.control)
+		if ok {
+			assert.Equal(t, tt.base, base.String())
+			assert.Equal(t, tt.media, media)
+		}
+	}
+}
+
+func TestClient_readUDP(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c := &Client{
+		config:   ClientConfig{Timeout: 200 * time.Millisecond},
+		conn:     conn,
+		done:     make(chan struct{}),
+		onPacket: func(int, bool, []byte) {},
+	}
+	c.lastMedia = time.Now().UnixNano()
+
+	var conns []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		defer udp.Close()
+		conns = append(conns, udp)
+		go c.readUDP(i, udp, false)
+	}
+	sender, err := net.DialUDP("udp", nil, conns[0].LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+	defer sender.Close()
+
+	// The silent track does not fail the client while the other receives
+	for i := 0; i < 10; i++ {
+		_, err = sender.Write([]byte{0x80})
+		assert.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NoError(t, c.Err())
+
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not time out")
+	}
+	assert.Error(t, c.Err())
+}
@@ -0,0 +1,205 @@
+/*
+【ファイル概要: allocator.go】
+サブスクライバー単位の帯域配分（ビットレートアロケーター）。
+
+【主要な役割】
+1. 下り帯域推定値の配分
+   - 送信側帯域推定（transport-cc）またはREMBによる推定値を入力とする
+   - サブスクライバーが持つすべてのSimulcast・SVCダウントラックに配分
+   - SVCの空間レイヤーのビットレートは下位レイヤーを含む
+
+2. 優先度
+   - 画面共有 > アクティブスピーカー > その他 の順に帯域を割り当てる
+   - アクティブスピーカーはセッションのAudioObserverから自動的に設定される
+   - 画面共有はDownTrack.SetPriorityまたはサブスクライバーAPIで指定する
+
+3. レイヤーの一括制御
+   - 各トラックのmaxSpatialLayer/maxTemporalLayerの上限を考慮
+   - 配分が現在のレイヤーを明らかに下回る状態が続いた場合にダウングレード
+   - アップグレードはLayerSelectorの判定に従う
+
+【配分アルゴリズム】
+1. 優先度順に、各トラックへ最低レイヤー分のビットレートを割り当てる
+2. 優先度順に、上限レイヤーへ切り替えられるだけのビットレートを追加で割り当てる
+3. 残りは全トラックに均等に割り当てる
+*/
+package sfu
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The budget of a track is short when it covers less than this ratio of the
+	// current layer bitrate, the layer goes down when it stays short for
+	// allocDowngradeDelay
+	allocDowngradeRatio = 0.8
+	allocDowngradeDelay = 2 * time.Second
+)
+
+// TrackPriority defines the priority of a down track when the subscriber
+// bandwidth is allocated
+type TrackPriority int32
+
+const (
+	TrackPriorityNormal TrackPriority = iota
+	TrackPrioritySpeaker
+	TrackPriorityScreen
+)
+
+// SetPriority sets the priority used by the subscriber bitrate allocator
+func (d *DownTrack) SetPriority(p TrackPriority) {
+	atomic.StoreInt32(&d.priority, int32(p))
+}
+
+// Priority returns the priority set on the down track
+func (d *DownTrack) Priority() TrackPriority {
+	return TrackPriority(atomic.LoadInt32(&d.priority))
+}
+
+// minLayerBitrate returns the bitrate of the lowest available layer
+func (d *DownTrack) minLayerBitrate(brs [3]uint64) uint64 {
+	for _, br := range brs {
+		if br != 0 {
+			return br
+		}
+	}
+	return 0
+}
+
+// desiredBitrate returns the bitrate required to reach the highest layer
+// allowed for the down track
+func (d *DownTrack) desiredBitrate(brs [3]uint64) uint64 {
+	maxLayer := atomic.LoadInt32(&d.maxSpatialLayer)
+	for l := maxLayer; l >= 0; l-- {
+		if l < 3 && brs[l] != 0 {
+			return 3 * brs[l] / 2
+		}
+	}
+	return 0
+}
+
+// SetActiveSpeakers updates the stream ids of the current active speakers
+func (s *Subscriber) SetActiveSpeakers(streamIDs []string) {
+	speakers := make(map[string]struct{}, len(streamIDs))
+	for _, id := range streamIDs {
+		speakers[id] = struct{}{}
+	}
+	s.allocMu.Lock()
+	s.speakers = speakers
+	s.allocMu.Unlock()
+}
+
+// handleReceiverFeedback is called by the down tracks with the receiver
+// estimated bitrate and loss reported by the subscriber.
+func (s *Subscriber) handleReceiverFeedback(maxRatePacketLoss uint8, expectedMinBitrate uint64) {
+	if expectedMinBitrate == 0 {
+		expectedMinBitrate = atomic.LoadUint64(&s.lastREMB)
+	} else {
+		atomic.StoreUint64(&s.lastREMB, expectedMinBitrate)
+	}
+	// Nothing to allocate until the bitrate is known
+	if expectedMinBitrate == 0 {
+		return
+	}
+	s.allocateBitrate(expectedMinBitrate, maxRatePacketLoss)
+}
+
+func (s *Subscriber) trackPriority(dt *DownTrack) TrackPriority {
+	p := dt.Priority()
+	if _, ok := s.speakers[dt.StreamID()]; ok && p < TrackPrioritySpeaker {
+		p = TrackPrioritySpeaker
+	}
+	return p
+}
+
+// allocateBitrate splits the estimated available bitrate of the subscriber
+// transport between its simulcast and SVC down tracks and adjusts their layers.
+func (s *Subscriber) allocateBitrate(bitrate uint64, fractionLost uint8) {
+	s.allocMu.Lock()
+	defer s.allocMu.Unlock()
+
+	var tracks []*DownTrack
+	for _, dt := range s.DownTracks() {
+		if dt.trackType != SimulcastDownTrack && dt.trackType != SVCDownTrack || !dt.bound.get() || !dt.Enabled() ||
+			!strings.HasPrefix(dt.mime, "video/") {
+			continue
+		}
+		tracks = append(tracks, dt)
+	}
+	if len(tracks) == 0 {
+		return
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return s.trackPriority(tracks[i]) > s.trackPriority(tracks[j])
+	})
+
+	brs := make([][3]uint64, len(tracks))
+	budgets := make([]uint64, len(tracks))
+	remaining := bitrate
+	for i, dt := range tracks {
+		brs[i] = dt.receiver.GetBitrate()
+		b := dt.minLayerBitrate(brs[i])
+		if b > remaining {
+			b = remaining
+		}
+		budgets[i] = b
+		remaining -= b
+	}
+	for i, dt := range tracks {
+		if want := dt.desiredBitrate(brs[i]); want > budgets[i] {
+			b := want - budgets[i]
+			if b > remaining {
+				b = remaining
+			}
+			budgets[i] += b
+			remaining -= b
+		}
+	}
+	if remaining > 0 {
+		extra := remaining / uint64(len(tracks))
+		for i := range budgets {
+			budgets[i] += extra
+		}
+	}
+
+	now := time.Now()
+	for i, dt := range tracks {
+		csl := atomic.LoadInt32(&dt.currentSpatialLayer)
+		if csl != atomic.LoadInt32(&dt.targetSpatialLayer) {
+			continue
+		}
+		if float64(budgets[i]) >= allocDowngradeRatio*float64(brs[i][csl]) {
+			dt.allocShortSince = time.Time{}
+			dt.handleLayerChange(fractionLost, budgets[i])
+			continue
+		}
+		// Downgrade when the budget stays short of the current layer
+		if dt.allocShortSince.IsZero() {
+			dt.allocShortSince = now
+		}
+		if now.Sub(dt.allocShortSince) < allocDowngradeDelay || !now.After(dt.simulcast.switchDelay) {
+			continue
+		}
+		target := csl
+		for target > 0 && (brs[i][target] == 0 || brs[i][target] > budgets[i]) {
+			target--
+		}
+		if target < csl && brs[i][target] != 0 {
+			if err := dt.SwitchSpatialLayer(target, false); err == nil {
+				tl := dt.receiver.GetMaxTemporalLayer()[target]
+				if mtl := atomic.LoadInt32(&dt.maxTemporalLayer); tl > mtl {
+					tl = mtl
+				}
+				dt.SwitchTemporalLayer(tl, false)
+			}
+			dt.allocShortSince = time.Time{}
+			dt.simulcast.switchDelay = now.Add(5 * time.Second)
+			continue
+		}
+		dt.handleLayerChange(fractionLost, budgets[i])
+	}
+}
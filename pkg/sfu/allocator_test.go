@@ -0,0 +1,123 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAllocatorTestTrack(streamID string, layer int32) *DownTrack {
+	dt := newTestDownTrack(streamID, webrtc.MimeTypeVP8)
+	r := dt.receiver.(*testReceiver)
+	r.bitrate = [3]uint64{150000, 500000, 1500000}
+	r.maxTemporalLayer = [3]int32{2, 2, 2}
+	dt.trackType = SimulcastDownTrack
+	dt.maxSpatialLayer = 2
+	dt.maxTemporalLayer = 2
+	dt.SetInitialLayers(layer, 2)
+	return dt
+}
+
+func TestSubscriber_allocateBitrate(t *testing.T) {
+	tests := []struct {
+		name       string
+		bitrate    uint64
+		screen     string
+		speaker    string
+		wantLayers map[string]int32
+	}{
+		{
+			name:    "Must keep the screen share on the highest layer",
+			bitrate: 2000000,
+			screen:  "b",
+			wantLayers: map[string]int32{
+				"a": 0,
+				"b": 2,
+				"c": 0,
+			},
+		},
+		{
+			name:    "Must prefer the active speaker over other tracks",
+			bitrate: 1200000,
+			speaker: "c",
+			wantLayers: map[string]int32{
+				"a": 0,
+				"b": 0,
+				"c": 1,
+			},
+		},
+		{
+			name:    "Must keep all the tracks when bandwidth is enough",
+			bitrate: 8000000,
+			wantLayers: map[string]int32{
+				"a": 2,
+				"b": 2,
+				"c": 2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Subscriber{tracks: make(map[string][]*DownTrack)}
+			for _, id := range []string{"a", "b", "c"} {
+				dt := newAllocatorTestTrack(id, 2)
+				if id == tt.screen {
+					dt.SetPriority(TrackPriorityScreen)
+				}
+				s.AddDownTrack(id, dt)
+			}
+			if tt.speaker != "" {
+				s.SetActiveSpeakers([]string{tt.speaker})
+			}
+			s.allocateBitrate(tt.bitrate, 0)
+			// The layers go down when the bitrate stays short
+			for _, id := range []string{"a", "b", "c"} {
+				dt := s.GetDownTracks(id)[0]
+				assert.Equal(t, int32(2), dt.targetSpatialLayer, id)
+				if !dt.allocShortSince.IsZero() {
+					dt.allocShortSince = dt.allocShortSince.Add(-allocDowngradeDelay)
+				}
+			}
+			s.allocateBitrate(tt.bitrate, 0)
+			for id, layer := range tt.wantLayers {
+				dt := s.GetDownTracks(id)[0]
+				assert.Equal(t, layer, dt.targetSpatialLayer, id)
+			}
+		})
+	}
+}
+
+func TestSubscriber_allocateBitrateSVC(t *testing.T) {
+	s := &Subscriber{tracks: make(map[string][]*DownTrack)}
+	dt := newAllocatorTestTrack("a", 2)
+	dt.mime = "video/vp9"
+	dt.trackType = SVCDownTrack
+	// The spatial layers of a SVC stream include the lower layers
+	dt.receiver.(*testReceiver).bitrate = [3]uint64{150000, 650000, 2150000}
+	s.AddDownTrack("a", dt)
+
+	s.allocateBitrate(1000000, 0)
+	assert.Equal(t, int32(2), dt.targetSpatialLayer)
+	dt.allocShortSince = dt.allocShortSince.Add(-allocDowngradeDelay)
+	s.allocateBitrate(1000000, 0)
+	// The layer is switched by the packet writer
+	assert.Equal(t, int32(1), dt.targetSpatialLayer)
+	assert.Equal(t, int32(2), dt.currentSpatialLayer)
+}
+
+func TestSubscriber_handleReceiverFeedback(t *testing.T) {
+	s := &Subscriber{tracks: make(map[string][]*DownTrack)}
+	dt := newAllocatorTestTrack("a", 2)
+	s.AddDownTrack("a", dt)
+
+	// Loss without a known bitrate does not drop the layers
+	s.handleReceiverFeedback(100, 0)
+	assert.Equal(t, int32(2), dt.targetSpatialLayer)
+	assert.True(t, dt.allocShortSince.IsZero())
+
+	s.handleReceiverFeedback(0, 100000)
+	assert.False(t, dt.allocShortSince.IsZero())
+	assert.Equal(t, uint64(100000), s.lastREMB)
+}
@@ -68,6 +68,17 @@ func (a *AudioObserver) removeStream(streamID string) {
 	a.streams = a.streams[:len(a.streams)-1]
 }
 
+func (a *AudioObserver) hasStream(streamID string) bool {
+	a.RLock()
+	defer a.RUnlock()
+	for _, s := range a.streams {
+		if s.id == streamID {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *AudioObserver) observe(streamID string, dBov uint8) {
 	a.RLock()
 	defer a.RUnlock()
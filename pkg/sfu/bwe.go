@@ -0,0 +1,49 @@
+/*
+【ファイル概要: bwe.go】
+サブスクライバー向けの送信側帯域推定（BWE）の設定と配分処理。
+
+【主要な役割】
+1. 送信側帯域推定の設定
+   - 推定の有効化
+   - 推定値の初期値・下限・上限
+
+2. 推定値の配分
+   - サブスクライバーのtransport-ccフィードバックから得た推定値を
+     ビットレートアロケーター（allocator.go）に渡す
+
+【REMBとの関係】
+送信側帯域推定が有効でtransport-cc拡張ヘッダがネゴシエーションされた場合、
+ダウントラックはREMB/ReceiverReportによるレイヤー調整を行わず、
+推定器の推定値のみに従ってレイヤーを切り替えます。
+*/
+package sfu
+
+import (
+	"github.com/pion/ion-sfu/pkg/twcc"
+)
+
+const (
+	defaultBWEInitialBitrate = 1000000
+	defaultBWEMinBitrate     = 100000
+)
+
+// BWEConfig defines send side bandwidth estimation configurations
+type BWEConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// InitialBitrate, MinBitrate and MaxBitrate are in kbps, zero means default
+	// for InitialBitrate and MinBitrate, and no limits for MaxBitrate
+	InitialBitrate uint64 `mapstructure:"initialbitrate"`
+	MinBitrate     uint64 `mapstructure:"minbitrate"`
+	MaxBitrate     uint64 `mapstructure:"maxbitrate"`
+}
+
+func newSendSideEstimator(c BWEConfig) *twcc.Estimator {
+	initial, min := uint64(defaultBWEInitialBitrate), uint64(defaultBWEMinBitrate)
+	if c.InitialBitrate > 0 {
+		initial = c.InitialBitrate * 1000
+	}
+	if c.MinBitrate > 0 {
+		min = c.MinBitrate * 1000
+	}
+	return twcc.NewSendSideEstimator(initial, min, c.MaxBitrate*1000)
+}
@@ -0,0 +1,314 @@
+/*
+【ファイル概要: dominantspeaker.go】
+セッションのドミナントスピーカー（主に話している参加者）の検出。
+
+【主要な役割】
+1. 音声レベルの記録
+   - ストリームごとに音声レベル（RFC 6464）の履歴を保持
+   - Vビットが立っていないパケットは無音として扱う
+   - 一定時間パケットが届かないストリームも無音として扱う（DTX）
+   - 背景雑音のレベルを追跡し、それ以下のレベルを無音として扱う
+
+2. 発話スコア
+   - Volfin/Cohenの3つの時間スケール（immediate、medium、long）の
+     発話スコアを計算
+
+3. 判定
+   - 一定間隔で、すべての時間スケールで現在のドミナントスピーカーを
+     十分に上回るストリームに切り替え（ヒステリシス）
+   - 変更をコールバック（OnDominantSpeakerChanged）で通知
+*/
+package sfu
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Parameters of Volfin and Cohen, "Dominant Speaker Identification for
+// Multipoint Videoconferencing"
+const (
+	dominantSpeakerInterval = 300 * time.Millisecond
+	// A missing level is silence after this time
+	dominantLevelIdleTimeout = 40 * time.Millisecond
+
+	dominantMaxLevel = 127
+	dominantMinLevel = 0
+	// Levels in a 15s window raise the noise floor, a level every 20ms
+	dominantMinLevelWindow = 15 * 1000 / 20
+
+	// Sub-bands of the immediates, and the number of immediates of a medium
+	// and of mediums of a long
+	dominantN1 = 13
+	dominantN2 = 5
+	dominantN3 = 10
+	// Immediates and mediums above these thresholds are active
+	dominantN1Threshold = dominantN1/2 - 1
+	dominantN2Threshold = dominantN2 - 1
+	dominantSubunit     = (dominantMaxLevel - dominantMinLevel + dominantN1 - 1) / dominantN1
+
+	// Speech activity ratios over the dominant speaker required to replace it
+	dominantC1 = 3
+	dominantC2 = 2
+	dominantC3 = 0
+
+	dominantMinScore = 1e-10
+)
+
+// dominantSpeaker is the speech activity of a stream
+type dominantSpeaker struct {
+	// The audio tracks of the stream
+	refs int
+	// levels[0] is the last level
+	levels     [dominantN2 * dominantN3]uint8
+	immediates [dominantN2 * dominantN3]uint8
+	mediums    [dominantN3]uint8
+	longs      [1]uint8
+	// Scores of the immediate, medium and long time scales
+	scores [3]float64
+
+	minLevel           uint8
+	nextMinLevel       uint8
+	nextMinLevelWindow int
+	lastLevel          time.Time
+}
+
+func newDominantSpeaker(now time.Time) *dominantSpeaker {
+	return &dominantSpeaker{
+		scores:    [3]float64{dominantMinScore, dominantMinScore, dominantMinScore},
+		lastLevel: now,
+	}
+}
+
+func (s *dominantSpeaker) levelChanged(level uint8, now time.Time) {
+	if now.Before(s.lastLevel) {
+		return
+	}
+	s.lastLevel = now
+	copy(s.levels[1:], s.levels[:len(s.levels)-1])
+	s.levels[0] = level
+	s.updateMinLevel(level)
+}
+
+// updateMinLevel tracks the noise floor, it drops to the lowest level and
+// rises to the lowest level of a window
+func (s *dominantSpeaker) updateMinLevel(level uint8) {
+	if level == dominantMinLevel {
+		return
+	}
+	if s.minLevel == dominantMinLevel || s.minLevel > level {
+		s.minLevel = level
+		s.nextMinLevel = dominantMinLevel
+		s.nextMinLevelWindow = 0
+		return
+	}
+	if s.nextMinLevel == dominantMinLevel || s.nextMinLevel > level {
+		s.nextMinLevel = level
+	}
+	s.nextMinLevelWindow++
+	if s.nextMinLevelWindow >= dominantMinLevelWindow {
+		s.minLevel = uint8(math.Sqrt(float64(s.minLevel) * float64(s.nextMinLevel)))
+		s.nextMinLevel = dominantMinLevel
+		s.nextMinLevelWindow = 0
+	}
+}
+
+// evaluate updates the scores, a longer time scale changes only when the
+// shorter one does
+func (s *dominantSpeaker) evaluate() {
+	if !s.computeImmediates() {
+		return
+	}
+	s.scores[0] = speechActivityScore(s.immediates[0], dominantN1, 0.5, 0.78)
+	if !computeBigs(s.immediates[:], s.mediums[:], dominantN1Threshold) {
+		return
+	}
+	s.scores[1] = speechActivityScore(s.mediums[0], dominantN2, 0.5, 24)
+	if !computeBigs(s.mediums[:], s.longs[:], dominantN2Threshold) {
+		return
+	}
+	s.scores[2] = speechActivityScore(s.longs[0], dominantN3, 0.5, 47)
+}
+
+// computeImmediates quantizes the levels above the noise floor in sub-bands
+func (s *dominantSpeaker) computeImmediates() bool {
+	minLevel := int(s.minLevel) + dominantSubunit
+	changed := false
+	for i, level := range s.levels {
+		if int(level) < minLevel {
+			level = dominantMinLevel
+		}
+		if immediate := level / dominantSubunit; s.immediates[i] != immediate {
+			s.immediates[i] = immediate
+			changed = true
+		}
+	}
+	return changed
+}
+
+// computeBigs counts the active littles of each big
+func computeBigs(littles, bigs []uint8, threshold uint8) bool {
+	perBig := len(littles) / len(bigs)
+	changed := false
+	for b := range bigs {
+		var sum uint8
+		for _, l := range littles[b*perBig : (b+1)*perBig] {
+			if l > threshold {
+				sum++
+			}
+		}
+		if bigs[b] != sum {
+			bigs[b] = sum
+			changed = true
+		}
+	}
+	return changed
+}
+
+// speechActivityScore is the likelihood ratio of speech of v active
+// sub-units out of n
+func speechActivityScore(v uint8, n int, p, lambda float64) float64 {
+	k := float64(v)
+	lnBinomial := 0.0
+	for i := 1; i <= int(v); i++ {
+		lnBinomial += math.Log(float64(n-int(v)+i) / float64(i))
+	}
+	score := lnBinomial + k*math.Log(p) + (float64(n)-k)*math.Log(1-p) - math.Log(lambda) + lambda*k
+	if score < dominantMinScore {
+		return dominantMinScore
+	}
+	return score
+}
+
+// DominantSpeakerDetector identifies the dominant speaker of a session from
+// the audio levels of its streams
+type DominantSpeakerDetector struct {
+	sync.Mutex
+	speakers map[string]*dominantSpeaker
+	dominant string
+	onChange func(streamID string)
+}
+
+// NewDominantSpeakerDetector creates a dominant speaker detector
+func NewDominantSpeakerDetector() *DominantSpeakerDetector {
+	return &DominantSpeakerDetector{
+		speakers: make(map[string]*dominantSpeaker),
+	}
+}
+
+// OnDominantSpeakerChanged sets the handler called with the stream id of the
+// new dominant speaker, empty when the dominant speaker leaves
+func (d *DominantSpeakerDetector) OnDominantSpeakerChanged(f func(streamID string)) {
+	d.Lock()
+	d.onChange = f
+	d.Unlock()
+}
+
+// DominantSpeaker returns the stream id of the dominant speaker, empty when
+// there is none
+func (d *DominantSpeakerDetector) DominantSpeaker() string {
+	d.Lock()
+	defer d.Unlock()
+	return d.dominant
+}
+
+func (d *DominantSpeakerDetector) addStream(streamID string) {
+	d.Lock()
+	defer d.Unlock()
+	s := d.speakers[streamID]
+	if s == nil {
+		s = newDominantSpeaker(time.Now())
+		d.speakers[streamID] = s
+	}
+	s.refs++
+}
+
+func (d *DominantSpeakerDetector) removeStream(streamID string) {
+	d.Lock()
+	defer d.Unlock()
+	s := d.speakers[streamID]
+	if s == nil {
+		return
+	}
+	if s.refs--; s.refs <= 0 {
+		delete(d.speakers, streamID)
+	}
+}
+
+// observe records the audio level in -dBov of a packet
+func (d *DominantSpeakerDetector) observe(streamID string, dBov uint8, voice bool) {
+	d.Lock()
+	defer d.Unlock()
+	if s := d.speakers[streamID]; s != nil {
+		s.levelChanged(dominantLevel(dBov, voice), time.Now())
+	}
+}
+
+// dominantLevel converts an audio level in -dBov to a level increasing with
+// the volume, the packets without voice activity are silence
+func dominantLevel(dBov uint8, voice bool) uint8 {
+	if !voice || dBov > dominantMaxLevel {
+		return dominantMinLevel
+	}
+	return dominantMaxLevel - dBov
+}
+
+// decide updates the dominant speaker, the handler is called when it changes
+func (d *DominantSpeakerDetector) decide(now time.Time) (string, bool) {
+	d.Lock()
+	for _, s := range d.speakers {
+		if now.Sub(s.lastLevel) >= dominantLevelIdleTimeout {
+			s.levelChanged(dominantMinLevel, now)
+		}
+		s.evaluate()
+	}
+
+	next := d.dominant
+	if current := d.speakers[d.dominant]; current == nil {
+		// The most active speaker, if any speaks
+		next = ""
+		for id, s := range d.speakers {
+			if s.scores[0] <= dominantMinScore {
+				continue
+			}
+			if best := d.speakers[next]; best == nil || moreActive(s, best) || !moreActive(best, s) && id < next {
+				next = id
+			}
+		}
+	} else {
+		bestC2 := float64(dominantC2)
+		for id, s := range d.speakers {
+			if s == current {
+				continue
+			}
+			c1 := math.Log(s.scores[0] / current.scores[0])
+			c2 := math.Log(s.scores[1] / current.scores[1])
+			c3 := math.Log(s.scores[2] / current.scores[2])
+			if c1 > dominantC1 && c2 > bestC2 && c3 > dominantC3 {
+				bestC2 = c2
+				next = id
+			}
+		}
+	}
+
+	changed := next != d.dominant
+	d.dominant = next
+	handler := d.onChange
+	d.Unlock()
+
+	if changed && handler != nil {
+		handler(next)
+	}
+	return next, changed
+}
+
+// moreActive compares the scores from the longest time scale
+func moreActive(a, b *dominantSpeaker) bool {
+	for i := len(a.scores) - 1; i >= 0; i-- {
+		if a.scores[i] != b.scores[i] {
+			return a.scores[i] > b.scores[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_speechActivityScore(t *testing.T) {
+	assert.Equal(t, dominantMinScore, speechActivityScore(0, dominantN1, 0.5, 0.78))
+	assert.Greater(t, speechActivityScore(6, dominantN1, 0.5, 0.78), speechActivityScore(1, dominantN1, 0.5, 0.78))
+	assert.Greater(t, speechActivityScore(5, dominantN2, 0.5, 24), speechActivityScore(1, dominantN2, 0.5, 24))
+}
+
+func Test_dominantLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		dBov  uint8
+		voice bool
+		want  uint8
+	}{
+		{name: "Loudest voice must be the maximum level", dBov: 0, voice: true, want: dominantMaxLevel},
+		{name: "Voice must be inverted", dBov: 30, voice: true, want: 97},
+		{name: "Packet without voice must be silence", dBov: 10},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dominantLevel(tt.dBov, tt.voice))
+		})
+	}
+}
+
+func TestDominantSpeakerDetector(t *testing.T) {
+	d := NewDominantSpeakerDetector()
+	d.addStream("a")
+	d.addStream("b")
+	var changes []string
+	d.OnDominantSpeakerChanged(func(streamID string) {
+		changes = append(changes, streamID)
+	})
+
+	now := time.Now()
+	n := 0
+	// speak plays 20ms packets, speech is loud with quiet packets setting the
+	// noise floor, and the decisions are made every 300ms
+	speak := func(duration time.Duration, speakers ...string) {
+		for end := now.Add(duration); now.Before(end); {
+			now = now.Add(20 * time.Millisecond)
+			n++
+			d.Lock()
+			for id, s := range d.speakers {
+				level := dominantLevel(127, false)
+				for _, speaker := range speakers {
+					if speaker == id && n%10 == 0 {
+						level = dominantLevel(80, true)
+					} else if speaker == id {
+						level = dominantLevel(30, true)
+					}
+				}
+				s.levelChanged(level, now)
+			}
+			d.Unlock()
+			if n%15 == 0 {
+				d.decide(now)
+			}
+		}
+	}
+
+	speak(time.Second)
+	assert.Empty(t, d.DominantSpeaker())
+	speak(2*time.Second, "a")
+	assert.Equal(t, "a", d.DominantSpeaker())
+
+	// A short interruption does not replace the dominant speaker
+	speak(300*time.Millisecond, "a", "b")
+	speak(300*time.Millisecond, "b")
+	assert.Equal(t, "a", d.DominantSpeaker())
+	speak(3*time.Second, "b")
+	assert.Equal(t, "b", d.DominantSpeaker())
+
+	// The tracks of a stream are counted
+	d.addStream("b")
+	d.removeStream("b")
+	speak(300*time.Millisecond, "b")
+	assert.Equal(t, "b", d.DominantSpeaker())
+	d.removeStream("b")
+	speak(300 * time.Millisecond)
+	assert.Empty(t, d.DominantSpeaker())
+	assert.Equal(t, []string{"a", "b", ""}, changes)
+}
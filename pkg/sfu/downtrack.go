@@ -7,38 +7,52 @@
    - Receiverからのパケット受信
    - シーケンス番号とタイムスタンプの調整
    - SSRCの書き換え
+   - H.264キーフレームにSPS/PPSが無い場合、キャッシュしたSPS/PPSを前に挿入
+   - 同期待ちの間はキャッシュしたGOPを先に送信（gopcache.go）
 
-2. Simulcast処理
+2. Simulcast/SVC処理
    - 空間レイヤー切り替え（キーフレーム待機）
    - 時間レイヤーフィルタリング（VP8）
+   - VP9 SVCの空間・時間レイヤーの破棄（svc.go）
+   - AV1の空間・時間レイヤーの破棄（Dependency Descriptorを使用）
    - レイヤー切り替え時の同期
 
 3. 適応的ビットレート制御
    - パケットロスの監視
-   - REMB/REPORTに基づくレイヤー調整
+   - REMB/REPORTに基づくレイヤー調整（SimulcastとSVC）
+   - transport-ccによる送信側帯域推定（有効時はREMB/REPORTの代わりに使用）
+   - サブスクライバー単位のアロケーターによる帯域配分
+   - アップグレード前のパディングによる帯域プローブ
    - 自動的な品質アップ/ダウン
 
 4. RTCP処理
    - クライアントからのPLI/FIRの転送
-   - NACKによる再送要求の処理
+   - NACKによる再送要求の処理（RTXがネゴシエーションされた場合は専用のRTX SSRCで再送、rtx.go）
    - Sender Reportの生成
+   - Receiver Reportの損失率に応じたFlexFECの生成（fec.go）
+   - Receiver Reportの損失率に応じたOpus REDのカプセル化（red.go）
 
 【レイヤー切り替え戦略】
-- 高パケットロス（>25%）: より低いレイヤーに切り替え
-- 低パケットロス（<5%）かつ十分な帯域幅: より高いレイヤーに切り替え
+LayerSelector（layerselector.go）に従って切り替えます。デフォルトのポリシーは:
+- 高パケットロス（>10%）: より低いレイヤーに切り替え
+- 低パケットロス（<2%）かつ十分な帯域幅: より高いレイヤーに切り替え
 - スイッチディレイ: 頻繁な切り替えを防ぐための遅延
 */
 package sfu
 
 import (
 	"fmt"
+	"math/rand"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/ion-sfu/pkg/twcc"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/transport/packetio"
 	"github.com/pion/webrtc/v3"
 )
@@ -49,6 +63,8 @@ type DownTrackType int
 const (
 	SimpleDownTrack DownTrackType = iota + 1
 	SimulcastDownTrack
+	// SVCDownTrack forwards a subset of the layers of a single VP9 SVC stream
+	SVCDownTrack
 )
 
 // DownTrack  implements TrackLocal, is the track used to write packets
@@ -72,8 +88,19 @@ type DownTrack struct {
 	targetSpatialLayer  int32
 	temporalLayer       int32
 
-	enabled  atomicBool
-	reSync   atomicBool
+	// enabled is off when muted by the subscriber or paused by Last-N
+	enabled     atomicBool
+	reSync      atomicBool
+	muteMu      sync.Mutex
+	muted       bool
+	lastNPaused bool
+	// The first resync of the track was primed from the GOP cache
+	gopPrimed atomicBool
+	// Last H.264 parameter sets injected, for their retransmission
+	parameterSets atomic.Value // []byte
+	// Last PLI sent for a pending SVC spatial layer upgrade
+	svcPLI time.Time
+
 	snOffset uint16
 	tsOffset uint32
 	lastSSRC uint32
@@ -92,6 +119,44 @@ type DownTrack struct {
 	onBind         func()
 	closeOnce      sync.Once
 
+	// Send side bandwidth estimation, shared by all the down tracks of a subscriber
+	bwe           *twcc.Estimator
+	transportCCID uint8
+
+	// RTX stream of the retransmissions, rtxPayloadType is 0 when RTX is not negotiated
+	rtxSSRC        uint32
+	rtxPayloadType uint8
+	rtxSN          uint32
+
+	// FlexFEC stream protecting the packets sent, fec is nil when FEC is not negotiated
+	fecSSRC        uint32
+	fec            *flexFECEncoder
+	fecMaxOverhead int
+
+	// Opus RED encoder for lossy subscribers, redUnwrap is set when the
+	// publisher sends RED and the subscriber only negotiated Opus
+	red              *redEncoder
+	redLossThreshold uint8
+	redUnwrap        bool
+
+	// egress processes the packets written with the packet middlewares
+	egress PacketProcessor
+
+	// AV1 dependency descriptor extension ids of the subscriber and the publisher
+	ddExtID         uint8
+	ddUpstreamExtID uint8
+
+	// Subscriber bitrate allocation
+	priority           int32
+	onReceiverFeedback func(maxRatePacketLoss uint8, expectedMinBitrate uint64)
+	// Since when the allocated bitrate is short of the current layer, guarded
+	// by the allocMu of the subscriber
+	allocShortSince time.Time
+	layerSelector   atomic.Value // *LayerSelector
+	// routerSelector is the selector of the router, used without override
+	routerSelector LayerSelector
+	prober         *bandwidthProber
+
 	// Report helpers
 	octetCount  uint32
 	packetCount uint32
@@ -100,7 +165,7 @@ type DownTrack struct {
 
 // NewDownTrack returns a DownTrack.
 func NewDownTrack(c webrtc.RTPCodecCapability, r Receiver, bf *buffer.Factory, peerID string, mt int) (*DownTrack, error) {
-	return &DownTrack{
+	d := &DownTrack{
 		id:            r.TrackID(),
 		peerID:        peerID,
 		maxTrack:      mt,
@@ -108,7 +173,12 @@ func NewDownTrack(c webrtc.RTPCodecCapability, r Receiver, bf *buffer.Factory, p
 		bufferFactory: bf,
 		receiver:      r,
 		codec:         c,
-	}, nil
+	}
+	if strings.HasPrefix(c.MimeType, "video/") {
+		d.rtxSSRC = rand.Uint32()
+		d.rtxSN = rand.Uint32()
+	}
+	return d, nil
 }
 
 // Bind is called by the PeerConnection after negotiation is complete
@@ -116,13 +186,46 @@ func NewDownTrack(c webrtc.RTPCodecCapability, r Receiver, bf *buffer.Factory, p
 // If so it setups all the state (SSRC and PayloadType) to have a call
 func (d *DownTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
 	parameters := webrtc.RTPCodecParameters{RTPCodecCapability: d.codec}
-	if codec, err := codecParametersFuzzySearch(parameters, t.CodecParameters()); err == nil {
+	codec, err := codecParametersFuzzySearch(parameters, t.CodecParameters())
+	if err != nil && strings.EqualFold(d.codec.MimeType, mimeTypeRED) {
+		// RED of the publisher is unwrapped for subscribers with plain Opus only
+		parameters.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}
+		codec, err = codecParametersFuzzySearch(parameters, t.CodecParameters())
+		d.redUnwrap = err == nil
+	}
+	if err == nil {
 		d.ssrc = uint32(t.SSRC())
 		d.payloadType = uint8(codec.PayloadType)
 		d.writeStream = t.WriteStream()
 		d.mime = strings.ToLower(codec.MimeType)
+		if pt, ok := getRTXPayloadType(t.CodecParameters(), codec.PayloadType); ok && d.rtxSSRC != 0 {
+			d.rtxPayloadType = uint8(pt)
+		}
+		if d.fecSSRC != 0 {
+			for _, c := range t.CodecParameters() {
+				if strings.EqualFold(c.MimeType, mimeTypeFlexFEC) {
+					d.fec = newFlexFECEncoder(d.fecSSRC, d.ssrc, uint8(c.PayloadType), d.fecMaxOverhead)
+					break
+				}
+			}
+		}
+		if d.redLossThreshold != 0 && strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+			if pt, ok := getREDPayloadType(t.CodecParameters(), codec.PayloadType); ok {
+				d.red = newREDEncoder(uint8(pt), d.redLossThreshold)
+			}
+		}
+		for _, ext := range t.HeaderExtensions() {
+			switch {
+			case ext.URI == sdp.TransportCCURI && d.bwe != nil:
+				d.transportCCID = uint8(ext.ID)
+			case ext.URI == buffer.DependencyDescriptorURI:
+				d.ddExtID = uint8(ext.ID)
+			}
+		}
 		d.reSync.set(true)
-		d.enabled.set(true)
+		d.muteMu.Lock()
+		d.updateEnabled()
+		d.muteMu.Unlock()
 		if rr := d.bufferFactory.GetOrNew(packetio.RTCPBufferPacket, uint32(t.SSRC())).(*buffer.RTCPReader); rr != nil {
 			rr.OnPacket(func(pkt []byte) {
 				d.handleRTCP(pkt)
@@ -140,6 +243,61 @@ func (d *DownTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameters,
 	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
 }
 
+// bindLocal binds the down track to a writer of the SFU process instead of a
+// peer connection, the codec of the receiver is forwarded. Video packets are
+// kept for retransmissions when the down track tracks packets.
+func (d *DownTrack) bindLocal(w webrtc.TrackLocalWriter) {
+	d.ssrc = rand.Uint32()
+	d.payloadType = uint8(d.receiver.Codec().PayloadType)
+	d.writeStream = w
+	d.mime = strings.ToLower(d.codec.MimeType)
+	if d.mime == mimeTypeRED {
+		d.redUnwrap = true
+		d.mime = strings.ToLower(webrtc.MimeTypeOpus)
+	}
+	if d.maxTrack > 0 && strings.HasPrefix(d.codec.MimeType, "video/") {
+		d.sequencer = newSequencer(d.maxTrack)
+	}
+	d.reSync.set(true)
+	d.muteMu.Lock()
+	d.updateEnabled()
+	d.muteMu.Unlock()
+	d.bound.set(true)
+}
+
+// newLocalDownTrack creates a down track of the receiver bound to a writer of
+// the SFU process. Down tracks are deleted from the receivers by id, the id of
+// the owner keeps it apart from the down tracks of the subscribers.
+func newLocalDownTrack(recv Receiver, w webrtc.TrackLocalWriter, ownerID string, maxTrack int, onClose func()) (*DownTrack, error) {
+	codec := recv.Codec()
+	d, err := NewDownTrack(webrtc.RTPCodecCapability{
+		MimeType:    codec.MimeType,
+		ClockRate:   codec.ClockRate,
+		Channels:    codec.Channels,
+		SDPFmtpLine: codec.SDPFmtpLine,
+	}, recv, nil, ownerID, maxTrack)
+	if err != nil {
+		return nil, err
+	}
+	d.id = recv.TrackID() + "-" + ownerID
+	d.OnCloseHandler(onClose)
+	d.bindLocal(w)
+	return d, nil
+}
+
+// requestKeyFrame sends a PLI to the publisher of a video down track, for the
+// spatial layer it is switching to
+func (d *DownTrack) requestKeyFrame() {
+	if d.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	layer := 0
+	if d.trackType == SimulcastDownTrack {
+		layer = int(atomic.LoadInt32(&d.targetSpatialLayer))
+	}
+	d.receiver.SendRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{SenderSSRC: d.ssrc, MediaSSRC: d.receiver.SSRC(layer)}})
+}
+
 // Unbind implements the teardown logic when the track is no longer needed. This happens
 // because a track has been stopped.
 func (d *DownTrack) Unbind(_ webrtc.TrackLocalContext) error {
@@ -194,22 +352,56 @@ func (d *DownTrack) WriteRTP(p *buffer.ExtPacket, layer int) error {
 		return d.writeSimpleRTP(p)
 	case SimulcastDownTrack:
 		return d.writeSimulcastRTP(p, layer)
+	case SVCDownTrack:
+		return d.writeSVCRTP(p)
 	}
 	return nil
 }
 
+// skipRTP shifts the sequence numbers over a packet of the layer that is not
+// forwarded to any down track, so the subscriber does not see a gap
+func (d *DownTrack) skipRTP(extPkt *buffer.ExtPacket, layer int) {
+	if !extPkt.Head || !d.enabled.get() || !d.bound.get() || d.reSync.get() {
+		return
+	}
+	if d.trackType == SimulcastDownTrack && d.CurrentSpatialLayer() != layer {
+		return
+	}
+	d.snOffset++
+}
+
 func (d *DownTrack) Enabled() bool {
 	return d.enabled.get()
 }
 
 // Mute enables or disables media forwarding
 func (d *DownTrack) Mute(val bool) {
-	if d.enabled.get() != val {
+	d.muteMu.Lock()
+	defer d.muteMu.Unlock()
+	if d.muted == val {
+		return
+	}
+	d.muted = val
+	d.updateEnabled()
+}
+
+// setLastNPaused pauses the track when it is not in the last N speakers, a
+// track muted by the subscriber stays muted when resumed
+func (d *DownTrack) setLastNPaused(val bool) {
+	d.muteMu.Lock()
+	defer d.muteMu.Unlock()
+	if d.lastNPaused == val {
 		return
 	}
-	d.enabled.set(!val)
-	if val {
-		d.reSync.set(val)
+	d.lastNPaused = val
+	d.updateEnabled()
+}
+
+// updateEnabled must be called with muteMu held
+func (d *DownTrack) updateEnabled() {
+	enabled := !d.muted && !d.lastNPaused
+	if d.enabled.set(enabled) && !enabled {
+		d.reSync.set(true)
 	}
 }
 
@@ -251,6 +443,20 @@ func (d *DownTrack) SwitchSpatialLayer(targetLayer int32, setAsMax bool) error {
 		}
 		return nil
 	}
+	if d.trackType == SVCDownTrack {
+		// Switch is done by the packet writer at the next switching point
+		if targetLayer < 0 || targetLayer > 2 {
+			return ErrSpatialNotSupported
+		}
+		if atomic.LoadInt32(&d.currentSpatialLayer) != atomic.LoadInt32(&d.targetSpatialLayer) {
+			return ErrSpatialLayerBusy
+		}
+		atomic.StoreInt32(&d.targetSpatialLayer, targetLayer)
+		if setAsMax {
+			atomic.StoreInt32(&d.maxSpatialLayer, targetLayer)
+		}
+		return nil
+	}
 	return ErrSpatialNotSupported
 }
 
@@ -295,7 +501,7 @@ func (d *DownTrack) UptrackLayersChange(availableLayers []uint16) (int64, error)
 }
 
 func (d *DownTrack) SwitchTemporalLayer(targetLayer int32, setAsMax bool) {
-	if d.trackType == SimulcastDownTrack {
+	if d.trackType == SimulcastDownTrack || d.trackType == SVCDownTrack {
 		layer := atomic.LoadInt32(&d.temporalLayer)
 		currentLayer := uint16(layer)
 		currentTargetLayer := uint16(layer >> 16)
@@ -345,7 +551,12 @@ func (d *DownTrack) CreateSenderReport() *rtcp.SenderReport {
 	if !d.bound.get() {
 		return nil
 	}
-	srRTP, srNTP := d.receiver.GetSenderReportTime(int(atomic.LoadInt32(&d.currentSpatialLayer)))
+	layer := int(atomic.LoadInt32(&d.currentSpatialLayer))
+	if d.trackType == SVCDownTrack {
+		// All the spatial layers share the same upstream SSRC
+		layer = 0
+	}
+	srRTP, srNTP := d.receiver.GetSenderReportTime(layer)
 	if srRTP == 0 {
 		return nil
 	}
@@ -374,7 +585,13 @@ func (d *DownTrack) UpdateStats(packetLen uint32) {
 }
 
 func (d *DownTrack) writeSimpleRTP(extPkt *buffer.ExtPacket) error {
-	if d.reSync.get() {
+	if d.reSync.get() && !extPkt.KeyFrame && d.Kind() == webrtc.RTPCodecTypeVideo {
+		if err := d.primeFromGOPCache(0, d.writeSimpleRTP); err != nil {
+			return err
+		}
+	}
+	reSync := d.reSync.get()
+	if reSync {
 		if d.Kind() == webrtc.RTPCodecTypeVideo {
 			if !extPkt.KeyFrame {
 				d.receiver.SendRTCP([]rtcp.Packet{
@@ -396,6 +613,12 @@ func (d *DownTrack) writeSimpleRTP(extPkt *buffer.ExtPacket) error {
 
 	newSN := extPkt.Packet.SequenceNumber - d.snOffset
 	newTS := extPkt.Packet.Timestamp - d.tsOffset
+	if reSync && extPkt.ParameterSets != nil && extPkt.Head {
+		if err := d.writeParameterSets(extPkt, newSN, newTS); err != nil {
+			return err
+		}
+		newSN = extPkt.Packet.SequenceNumber - d.snOffset
+	}
 	if d.sequencer != nil {
 		d.sequencer.push(extPkt.Packet.SequenceNumber, newSN, newTS, 0, extPkt.Head)
 	}
@@ -409,22 +632,33 @@ func (d *DownTrack) writeSimpleRTP(extPkt *buffer.ExtPacket) error {
 	hdr.SequenceNumber = newSN
 	hdr.SSRC = d.ssrc
 
-	_, err := d.writeStream.WriteRTP(&hdr, extPkt.Packet.Payload)
-	return err
+	if d.red != nil || d.redUnwrap {
+		return d.writeRED(&hdr, extPkt.Packet.Payload)
+	}
+	return d.writeRTP(&hdr, extPkt.Packet.Payload)
 }
 
 func (d *DownTrack) writeSimulcastRTP(extPkt *buffer.ExtPacket, layer int) error {
 	// Check if packet SSRC is different from before
 	// if true, the video source changed
-	reSync := d.reSync.get()
 	csl := d.CurrentSpatialLayer()
 
 	if csl != layer {
 		return nil
 	}
 
+	if d.reSync.get() && !extPkt.KeyFrame {
+		if err := d.primeFromGOPCache(layer, func(p *buffer.ExtPacket) error {
+			return d.writeSimulcastRTP(p, layer)
+		}); err != nil {
+			return err
+		}
+	}
+	reSync := d.reSync.get()
+
 	lastSSRC := atomic.LoadUint32(&d.lastSSRC)
-	if lastSSRC != extPkt.Packet.SSRC || reSync {
+	switched := lastSSRC != extPkt.Packet.SSRC || reSync
+	if switched {
 		// Wait for a keyframe to sync new source
 		if reSync && !extPkt.KeyFrame {
 			// Packet is not a keyframe, discard it
@@ -487,6 +721,17 @@ func (d *DownTrack) writeSimulcastRTP(extPkt *buffer.ExtPacket, layer int) error
 			}
 		}
 	}
+	if d.mime == "video/av1" && setAV1TemporalLayer(extPkt, d) {
+		// Frame over the temporal layer, update sequence number offset to avoid gaps
+		d.snOffset++
+		return nil
+	}
+	if switched && extPkt.ParameterSets != nil && extPkt.Head {
+		if err := d.writeParameterSets(extPkt, newSN, newTS); err != nil {
+			return err
+		}
+		newSN = extPkt.Packet.SequenceNumber - d.snOffset
+	}
 
 	if d.sequencer != nil {
 		if meta := d.sequencer.push(extPkt.Packet.SequenceNumber, newSN, newTS, uint8(csl), extPkt.Head); meta != nil &&
@@ -511,20 +756,147 @@ func (d *DownTrack) writeSimulcastRTP(extPkt *buffer.ExtPacket, layer int) error
 	hdr.SSRC = d.ssrc
 	hdr.PayloadType = d.payloadType
 
-	_, err := d.writeStream.WriteRTP(&hdr, payload)
+	if err := d.writeRTP(&hdr, payload); err != nil {
+		return err
+	}
+	if d.prober != nil && extPkt.Head && hdr.Marker {
+		d.writePadding()
+	}
+	return nil
+}
+
+// writeParameterSets writes the cached H.264 SPS/PPS with the sequence number of
+// the keyframe they precede, moving the keyframe and following packets one
+// sequence number forward. A copy is kept to retransmit them.
+func (d *DownTrack) writeParameterSets(extPkt *buffer.ExtPacket, sn uint16, ts uint32) error {
+	d.parameterSets.Store(extPkt.ParameterSets)
+	if d.sequencer != nil {
+		if meta := d.sequencer.push(extPkt.Packet.SequenceNumber, sn, ts, 0, true); meta != nil {
+			meta.parameterSets = true
+		}
+	}
+	hdr := extPkt.Packet.Header
+	hdr.Marker = false
+	hdr.PayloadType = d.payloadType
+	hdr.SequenceNumber = sn
+	hdr.Timestamp = ts
+	hdr.SSRC = d.ssrc
+	if err := d.writeRTP(&hdr, extPkt.ParameterSets); err != nil {
+		return err
+	}
+	d.snOffset--
+	return nil
+}
+
+// retransmitParameterSets resends the parameter sets of a sequencer entry
+func (d *DownTrack) retransmitParameterSets(meta packetMeta) error {
+	ps, ok := d.parameterSets.Load().([]byte)
+	if !ok || ps == nil {
+		return nil
+	}
+	hdr := rtp.Header{
+		Version:        2,
+		PayloadType:    d.payloadType,
+		SequenceNumber: meta.targetSeqNo,
+		Timestamp:      meta.timestamp,
+		SSRC:           d.ssrc,
+	}
+	return d.writeRTX(&hdr, ps)
+}
+
+// writeRTP writes a packet with a new sequence number of the down track. When
+// a packet middleware drops it, the following packets are shifted back so the
+// subscriber does not see a gap.
+func (d *DownTrack) writeRTP(hdr *rtp.Header, payload []byte) error {
+	written, err := d.processRTP(hdr, payload)
+	if err == nil && !written {
+		d.dropRTP(hdr)
+	}
 	return err
 }
 
-func (d *DownTrack) handleRTCP(bytes []byte) {
-	if !d.enabled.get() {
-		return
+// dropRTP shifts the sequence numbers over a rewritten packet that is not
+// sent, so the subscriber does not see a gap
+func (d *DownTrack) dropRTP(hdr *rtp.Header) {
+	if hdr.SequenceNumber == d.lastSN {
+		d.lastSN--
+	}
+	d.snOffset++
+}
+
+// processRTP writes the rewritten packet to the subscriber transport, stamping
+// the transport wide sequence number when send side BWE is negotiated. It
+// returns false when a packet middleware dropped the packet.
+func (d *DownTrack) processRTP(hdr *rtp.Header, payload []byte) (bool, error) {
+	if d.ddUpstreamExtID != 0 {
+		// Forward the dependency descriptor with the subscriber extension id,
+		// other publisher extensions are not negotiated with the subscriber
+		dd := hdr.GetExtension(d.ddUpstreamExtID)
+		hdr.Extension, hdr.ExtensionProfile, hdr.Extensions = false, 0, nil
+		if dd != nil && d.ddExtID != 0 {
+			if err := hdr.SetExtension(d.ddExtID, dd); err != nil {
+				return false, err
+			}
+		}
+	}
+	if d.egress != nil {
+		written := false
+		err := d.egress.ProcessPacket(PacketArgs{Receiver: d.receiver, DownTrack: d, Header: hdr, Payload: payload, written: &written})
+		return written, err
+	}
+	return true, d.sendRTP(PacketArgs{Header: hdr, Payload: payload})
+}
+
+// sendRTP writes a packet to the subscriber, after the packet middlewares
+func (d *DownTrack) sendRTP(args PacketArgs) error {
+	if args.written != nil {
+		*args.written = true
+	}
+	hdr, payload := args.Header, args.Payload
+	if err := d.setTransportCC(hdr, len(payload)); err != nil {
+		return err
 	}
+	if _, err := d.writeStream.WriteRTP(hdr, payload); err != nil {
+		return err
+	}
+	// Retransmissions and padding are not protected
+	if d.fec != nil && hdr.SSRC == d.ssrc && !hdr.Padding {
+		return d.protect(hdr, payload)
+	}
+	return nil
+}
 
+// setTransportCC sets the transport wide sequence number of the packet
+func (d *DownTrack) setTransportCC(hdr *rtp.Header, payloadSize int) error {
+	if d.transportCCID == 0 {
+		return nil
+	}
+	// The extensions are shared with the packet forwarded to other down tracks
+	hdr.Extensions = append([]rtp.Extension(nil), hdr.Extensions...)
+	sn := d.bwe.OnPacketSent(hdr.MarshalSize()+payloadSize, time.Now().UnixNano())
+	return hdr.SetExtension(d.transportCCID, []byte{byte(sn >> 8), byte(sn)})
+}
+
+func (d *DownTrack) handleRTCP(bytes []byte) {
 	pkts, err := rtcp.Unmarshal(bytes)
 	if err != nil {
 		Logger.Error(err, "Unmarshal rtcp receiver packets err")
 	}
 
+	// Transport wide feedback covers the whole subscriber transport, so it is
+	// handled even when this track is muted.
+	if d.transportCCID != 0 {
+		for _, pkt := range pkts {
+			if fb, ok := pkt.(*rtcp.TransportLayerCC); ok {
+				d.bwe.HandleFeedback(fb, time.Now().UnixNano())
+			}
+		}
+	}
+
+	if !d.enabled.get() {
+		return
+	}
+
 	var fwdPkts []rtcp.Packet
 	pliOnce := true
 	firOnce := true
@@ -563,6 +935,12 @@ func (d *DownTrack) handleRTCP(bytes []byte) {
 				if maxRatePacketLoss == 0 || maxRatePacketLoss < r.FractionLost {
 					maxRatePacketLoss = r.FractionLost
 				}
+				if d.fec != nil && r.SSRC == d.ssrc {
+					d.fec.setLossFraction(r.FractionLost)
+				}
+				if d.red != nil && r.SSRC == d.ssrc {
+					d.red.setLossFraction(r.FractionLost)
+				}
 			}
 		case *rtcp.TransportLayerNack:
 			if d.sequencer != nil {
@@ -576,8 +954,14 @@ func (d *DownTrack) handleRTCP(bytes []byte) {
 			}
 		}
 	}
-	if d.trackType == SimulcastDownTrack && (maxRatePacketLoss != 0 || expectedMinBitrate != 0) {
-		d.handleLayerChange(maxRatePacketLoss, expectedMinBitrate)
+	// Layers are driven by the send side estimator when transport-cc is negotiated
+	if (d.trackType == SimulcastDownTrack || d.trackType == SVCDownTrack) && d.transportCCID == 0 &&
+		(maxRatePacketLoss != 0 || expectedMinBitrate != 0) {
+		if d.onReceiverFeedback != nil {
+			d.onReceiverFeedback(maxRatePacketLoss, expectedMinBitrate)
+		} else {
+			d.handleLayerChange(maxRatePacketLoss, expectedMinBitrate)
+		}
 	}
 
 	if len(fwdPkts) > 0 {
@@ -593,43 +977,62 @@ func (d *DownTrack) handleLayerChange(maxRatePacketLoss uint8, expectedMinBitrat
 	currentTemporalLayer := temporalLayer & 0x0f
 	targetTemporalLayer := temporalLayer >> 16
 
-	if targetSpatialLayer == currentSpatialLayer && currentTemporalLayer == targetTemporalLayer {
-		if time.Now().After(d.simulcast.switchDelay) {
-			brs := d.receiver.GetBitrate()
-			cbr := brs[currentSpatialLayer]
-			mtl := d.receiver.GetMaxTemporalLayer()
-			mctl := mtl[currentSpatialLayer]
-
-			if maxRatePacketLoss <= 5 {
-				if currentTemporalLayer < mctl && currentTemporalLayer+1 <= atomic.LoadInt32(&d.maxTemporalLayer) &&
-					expectedMinBitrate >= 3*cbr/4 {
-					d.SwitchTemporalLayer(currentTemporalLayer+1, false)
-					d.simulcast.switchDelay = time.Now().Add(3 * time.Second)
-				}
-				if currentTemporalLayer >= mctl && expectedMinBitrate >= 3*cbr/2 && currentSpatialLayer+1 <= atomic.LoadInt32(&d.maxSpatialLayer) &&
-					currentSpatialLayer+1 <= 2 {
-					if err := d.SwitchSpatialLayer(currentSpatialLayer+1, false); err == nil {
-						d.SwitchTemporalLayer(0, false)
-					}
-					d.simulcast.switchDelay = time.Now().Add(5 * time.Second)
-				}
-			}
-			if maxRatePacketLoss >= 25 {
-				if (expectedMinBitrate <= 5*cbr/8 || currentTemporalLayer == 0) &&
-					currentSpatialLayer > 0 &&
-					brs[currentSpatialLayer-1] != 0 {
-					if err := d.SwitchSpatialLayer(currentSpatialLayer-1, false); err != nil {
-						d.SwitchTemporalLayer(mtl[currentSpatialLayer-1], false)
-					}
-					d.simulcast.switchDelay = time.Now().Add(10 * time.Second)
-				} else {
-					d.SwitchTemporalLayer(currentTemporalLayer-1, false)
-					d.simulcast.switchDelay = time.Now().Add(5 * time.Second)
-				}
-			}
+	if targetSpatialLayer != currentSpatialLayer || currentTemporalLayer != targetTemporalLayer ||
+		!time.Now().After(d.simulcast.switchDelay) {
+		return
+	}
+
+	selector := d.LayerSelector()
+	if selector == nil {
+		selector = &DefaultLayerSelector{}
+	}
+	state := LayerState{
+		SpatialLayer:      currentSpatialLayer,
+		TemporalLayer:     currentTemporalLayer,
+		MaxSpatialLayer:   atomic.LoadInt32(&d.maxSpatialLayer),
+		MaxTemporalLayer:  atomic.LoadInt32(&d.maxTemporalLayer),
+		Bitrates:          d.receiver.GetBitrate(),
+		MaxTemporalLayers: d.receiver.GetMaxTemporalLayer(),
+		FractionLost:      maxRatePacketLoss,
+		AvailableBitrate:  expectedMinBitrate,
+	}
+	decision := selector.SelectLayer(state)
+	if d.probeLayer(state, decision) {
+		return
+	}
+
+	switch {
+	case decision.SpatialLayer != currentSpatialLayer:
+		if decision.SpatialLayer < 0 || decision.SpatialLayer > 2 {
+			return
 		}
+		if err := d.SwitchSpatialLayer(decision.SpatialLayer, false); err == nil &&
+			decision.TemporalLayer != currentTemporalLayer {
+			d.SwitchTemporalLayer(decision.TemporalLayer, false)
+		}
+	case decision.TemporalLayer != currentTemporalLayer:
+		if decision.TemporalLayer < 0 {
+			return
+		}
+		d.SwitchTemporalLayer(decision.TemporalLayer, false)
+	default:
+		return
 	}
+	d.simulcast.switchDelay = time.Now().Add(decision.SwitchDelay)
+}
+
+// SetLayerSelector sets the policy used to switch simulcast layers, nil
+// restores the policy of the router
+func (d *DownTrack) SetLayerSelector(s LayerSelector) {
+	d.layerSelector.Store(&s)
+}
 
+// LayerSelector returns the policy used to switch simulcast layers
+func (d *DownTrack) LayerSelector() LayerSelector {
+	if s, ok := d.layerSelector.Load().(*LayerSelector); ok && s != nil && *s != nil {
+		return *s
+	}
+	return d.routerSelector
 }
 
 func (d *DownTrack) getSRStats() (octets, packets uint32) {
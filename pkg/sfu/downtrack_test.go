@@ -0,0 +1,74 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownTrack_writeParameterSets(t *testing.T) {
+	w := &probeTestWriter{}
+	d := &DownTrack{
+		ssrc:        1234,
+		payloadType: 102,
+		mime:        "video/h264",
+		writeStream: w,
+		sequencer:   newSequencer(500),
+		trackType:   SimpleDownTrack,
+		codec:       webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+		lastSN:      50,
+		lastTS:      9000,
+	}
+	d.bound.set(true)
+	d.enabled.set(true)
+	d.reSync.set(true)
+
+	pkt := func(sn uint16, keyFrame bool, ps []byte) *buffer.ExtPacket {
+		return &buffer.ExtPacket{
+			Head:          true,
+			KeyFrame:      keyFrame,
+			ParameterSets: ps,
+			Packet: rtp.Packet{
+				Header:  rtp.Header{SequenceNumber: sn, Timestamp: 3000, SSRC: 5678},
+				Payload: []byte{0x65},
+			},
+		}
+	}
+	ps := []byte{0x78, 0x00, 0x01, 0x67, 0x00, 0x01, 0x68}
+	assert.NoError(t, d.WriteRTP(pkt(100, true, ps), 0))
+	// Parameter sets are only sent on resync
+	assert.NoError(t, d.WriteRTP(pkt(101, true, ps), 0))
+
+	assert.Len(t, w.headers, 3)
+	for i, hdr := range w.headers {
+		assert.Equal(t, uint16(51+i), hdr.SequenceNumber)
+		assert.Equal(t, uint32(1234), hdr.SSRC)
+	}
+	assert.Equal(t, uint16(53), d.lastSN)
+	// Keyframe is retransmitted with its new sequence number
+	metas := d.sequencer.getSeqNoPairs([]uint16{52})
+	assert.Len(t, metas, 1)
+	assert.Equal(t, uint16(100), metas[0].sourceSeqNo)
+	assert.Equal(t, uint16(52), metas[0].targetSeqNo)
+
+	// So are the parameter sets
+	recv := &WebRTCReceiver{nackWorker: workerpool.New(1)}
+	d.receiver = recv
+	nack, err := (&rtcp.TransportLayerNack{
+		MediaSSRC: 1234,
+		Nacks:     rtcp.NackPairsFromSequenceNumbers([]uint16{51}),
+	}).Marshal()
+	assert.NoError(t, err)
+	d.handleRTCP(nack)
+	recv.nackWorker.StopWait()
+	if assert.Len(t, w.headers, 4) {
+		assert.Equal(t, uint16(51), w.headers[3].SequenceNumber)
+		assert.Equal(t, uint32(1234), w.headers[3].SSRC)
+		assert.Equal(t, ps, w.payloads[3])
+	}
+}
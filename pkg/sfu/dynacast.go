@@ -0,0 +1,161 @@
+/*
+【ファイル概要: dynacast.go】
+Dynacast: 購読されていない上りSimulcastレイヤーをパブリッシャー側で停止する機能。
+
+【主要な役割】
+1. レイヤーごとの需要の追跡
+   - 各レイヤーに接続されているダウントラック（サブスクライバー・リレー）を集計
+   - ミュート中のダウントラックは需要に含めない
+   - 切り替え待ち（pending）のダウントラックは切り替え先レイヤーの需要に含める
+
+2. パブリッシャーへの通知
+   - 需要が変化した時に、有効にすべきレイヤーの一覧をAPIデータチャネルで送信
+   - 需要が無くなったレイヤーは一定時間後に停止（頻繁な停止・再開を防ぐ）
+   - 需要が発生したレイヤーは即座に再開
+
+【メッセージ形式】
+{"method": "dynacast", "params": {"streamId": "...", "trackId": "...", "activeLayers": ["q", "h"]}}
+クライアントは該当トラックのRTCRtpSenderのエンコーディングのうち、
+activeLayersに含まれるridのみをactiveにします。
+*/
+package sfu
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	DynacastMethod = "dynacast"
+
+	dynacastInterval     = 500 * time.Millisecond
+	dynacastDisableDelay = 3 * time.Second
+)
+
+var layerRIDs = [3]string{quarterResolution, halfResolution, fullResolution}
+
+type dynacastMessage struct {
+	StreamID     string   `json:"streamId"`
+	TrackID      string   `json:"trackId"`
+	ActiveLayers []string `json:"activeLayers"`
+}
+
+type dynacastState struct {
+	known      [3]bool
+	active     [3]bool
+	lastDemand [3]time.Time
+	bitrate    [3]uint64
+}
+
+// EnableDynacast starts tracking the demand of every simulcast layer, fn is
+// called with the layers the publisher must send every time they change.
+func (w *WebRTCReceiver) EnableDynacast(fn func(active [3]bool)) {
+	if !w.isSimulcast {
+		return
+	}
+	w.Lock()
+	w.dynacast = &dynacastState{}
+	w.Unlock()
+	go func() {
+		ticker := time.NewTicker(dynacastInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if w.closed.get() {
+				return
+			}
+			if active, changed := w.updateDynacast(time.Now()); changed {
+				fn(active)
+			}
+		}
+	}()
+}
+
+// layerDemand returns the layers with at least one enabled down track
+func (w *WebRTCReceiver) layerDemand() [3]bool {
+	var demand [3]bool
+	for l := range w.downTracks {
+		dts, _ := w.downTracks[l].Load().([]*DownTrack)
+		for _, dt := range dts {
+			if dt.Enabled() {
+				demand[l] = true
+				break
+			}
+		}
+		for _, dt := range w.pendingTracks[l] {
+			if dt != nil && dt.Enabled() {
+				demand[l] = true
+				break
+			}
+		}
+	}
+	return demand
+}
+
+func (w *WebRTCReceiver) updateDynacast(now time.Time) (active [3]bool, changed bool) {
+	w.Lock()
+	defer w.Unlock()
+	ds := w.dynacast
+	demand := w.layerDemand()
+	for l := range demand {
+		if !w.available[l].get() {
+			continue
+		}
+		if !ds.known[l] {
+			// Publisher sends every layer until told otherwise
+			ds.known[l] = true
+			ds.active[l] = true
+			ds.lastDemand[l] = now
+		}
+		if demand[l] {
+			ds.lastDemand[l] = now
+		}
+		a := demand[l] || now.Sub(ds.lastDemand[l]) < dynacastDisableDelay
+		if a != ds.active[l] {
+			if !a && w.buffers[l] != nil {
+				// Keep the last bitrate, so the layer can be selected again
+				ds.bitrate[l] = w.buffers[l].Bitrate()
+			}
+			ds.active[l] = a
+			changed = true
+		}
+	}
+	return ds.active, changed
+}
+
+// pausedBitrate returns the bitrate of a layer before it was paused
+func (w *WebRTCReceiver) pausedBitrate(layer int) (uint64, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.dynacast == nil || !w.dynacast.known[layer] || w.dynacast.active[layer] {
+		return 0, false
+	}
+	return w.dynacast.bitrate[layer], true
+}
+
+func (r *router) sendDynacast(recv Receiver, active [3]bool) {
+	peer := r.session.GetPeer(r.id)
+	if peer == nil {
+		return
+	}
+	msg := dynacastMessage{
+		StreamID:     recv.StreamID(),
+		TrackID:      recv.TrackID(),
+		ActiveLayers: make([]string, 0, 3),
+	}
+	for l, a := range active {
+		if a {
+			msg.ActiveLayers = append(msg.ActiveLayers, layerRIDs[l])
+		}
+	}
+	b, err := json.Marshal(ChannelAPIMessage{
+		Method: DynacastMethod,
+		Params: msg,
+	})
+	if err != nil {
+		Logger.Error(err, "Marshaling dynacast message err")
+		return
+	}
+	if err = peer.SendDCMessage(APIChannelLabel, b); err != nil {
+		Logger.Error(err, "Sending dynacast message err", "peer_id", r.id)
+	}
+}
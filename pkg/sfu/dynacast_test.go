@@ -0,0 +1,47 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebRTCReceiver_updateDynacast(t *testing.T) {
+	w := &WebRTCReceiver{isSimulcast: true, dynacast: &dynacastState{}}
+	for l := range w.downTracks {
+		w.available[l].set(true)
+		w.downTracks[l].Store(make([]*DownTrack, 0))
+	}
+	dt := &DownTrack{}
+	dt.enabled.set(true)
+	w.downTracks[1].Store([]*DownTrack{dt})
+
+	now := time.Now()
+	active, changed := w.updateDynacast(now)
+	assert.False(t, changed)
+	assert.Equal(t, [3]bool{true, true, true}, active)
+
+	// Unused layers are paused after the disable delay
+	now = now.Add(dynacastDisableDelay)
+	active, changed = w.updateDynacast(now)
+	assert.True(t, changed)
+	assert.Equal(t, [3]bool{false, true, false}, active)
+	_, paused := w.pausedBitrate(2)
+	assert.True(t, paused)
+	_, paused = w.pausedBitrate(1)
+	assert.False(t, paused)
+
+	// Pending switches resume the layer at once
+	w.pendingTracks[2] = []*DownTrack{dt}
+	active, changed = w.updateDynacast(now.Add(dynacastInterval))
+	assert.True(t, changed)
+	assert.Equal(t, [3]bool{false, true, true}, active)
+
+	// Muted down tracks are not a demand
+	dt.enabled.set(false)
+	w.pendingTracks[2] = nil
+	active, changed = w.updateDynacast(now.Add(2 * dynacastDisableDelay))
+	assert.True(t, changed)
+	assert.Equal(t, [3]bool{false, false, false}, active)
+}
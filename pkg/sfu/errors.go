@@ -14,7 +14,9 @@ var (
 	errPeerConnectionInitFailed = errors.New("pc init failed")
 	errCreatingDataChannel      = errors.New("failed to create data channel")
 	// router errors
-	errNoReceiverFound = errors.New("no receiver found")
+	errNoReceiverFound      = errors.New("no receiver found")
+	errTrackExists          = errors.New("track already published")
+	errUnsupportedTrackKind = errors.New("track codec is neither audio nor video")
 	// Helpers errors
 	errShortPacket = errors.New("packet is not large enough")
 	errNilPacket   = errors.New("invalid nil packet")
@@ -0,0 +1,204 @@
+/*
+【ファイル概要: fec.go】
+サブスクライバー向けのFlexFEC（draft-ietf-payload-flexible-fec-scheme-03）の生成。
+
+【主要な役割】
+1. FECパケットの生成
+   - ダウントラックが送信したパケット（SSRC・シーケンス番号の書き換え後）をグループ化
+   - グループ内のパケットのXORからFECパケットを生成し、専用のFEC SSRCで送信
+   - 受信側はグループ内の1パケットの損失をNACKの往復を待たずに復元できる
+
+2. オーバーヘッドの適応
+   - Receiver Reportのパケット損失率からグループサイズを決定
+   - 損失率の2倍程度のオーバーヘッド（最大はMaxOverhead）
+   - 損失が無い場合はFECを送信しない
+
+3. シグナリング
+   - flexfec-03コーデックをサブスクライバーのMediaEngineに登録
+   - OfferにFEC SSRCとssrc-group:FEC-FRを追加（rtx.goと同じ仕組み）
+
+【FlexFECヘッダー（フレキシブルマスク、SSRC 1つ、マスク15ビット）】
+  R|F|P|X|CC|M|PT recovery|length recovery|TS recovery|SSRCCount|reserved|SSRC|SN base|k|mask
+*/
+package sfu
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mimeTypeFlexFEC    = "video/flexfec-03"
+	flexFECPayloadType = 62
+
+	flexFECHeaderSize   = 20
+	flexFECMaxGroupSize = 15
+	rtpFixedHeaderSize  = 12
+
+	defaultFECMaxOverhead = 50
+)
+
+// FECConfig defines the forward error correction sent to subscribers
+type FECConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxOverhead in percent of the media packets, zero means default
+	MaxOverhead int `mapstructure:"maxoverhead"`
+}
+
+func flexFECCodec() webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeFlexFEC, ClockRate: 90000, SDPFmtpLine: "repair-window=10000000"},
+		PayloadType:        flexFECPayloadType,
+	}
+}
+
+type flexFECEncoder struct {
+	sync.Mutex
+	ssrc         uint32
+	mediaSSRC    uint32
+	payloadType  uint8
+	sn           uint16
+	minGroupSize int
+	// groupSize is the number of packets protected by a FEC packet, zero disables FEC
+	groupSize int
+	baseSN    uint16
+	packets   [][]byte
+}
+
+func newFlexFECEncoder(ssrc, mediaSSRC uint32, payloadType uint8, maxOverhead int) *flexFECEncoder {
+	if maxOverhead <= 0 {
+		maxOverhead = defaultFECMaxOverhead
+	}
+	minGroupSize := (100 + maxOverhead - 1) / maxOverhead
+	if minGroupSize < 2 {
+		minGroupSize = 2
+	}
+	if minGroupSize > flexFECMaxGroupSize {
+		minGroupSize = flexFECMaxGroupSize
+	}
+	return &flexFECEncoder{
+		ssrc:         ssrc,
+		mediaSSRC:    mediaSSRC,
+		payloadType:  payloadType,
+		sn:           uint16(rand.Uint32()),
+		minGroupSize: minGroupSize,
+	}
+}
+
+// setLossFraction adapts the protection to the loss fraction of a receiver report,
+// the overhead is about twice the loss.
+func (e *flexFECEncoder) setLossFraction(fractionLost uint8) {
+	e.Lock()
+	defer e.Unlock()
+	if fractionLost == 0 {
+		e.groupSize = 0
+		return
+	}
+	size := 256 / (2 * int(fractionLost))
+	if size < e.minGroupSize {
+		size = e.minGroupSize
+	}
+	if size > flexFECMaxGroupSize {
+		size = flexFECMaxGroupSize
+	}
+	e.groupSize = size
+}
+
+// push adds a packet sent to the subscriber, the FEC packet is returned when
+// the group is completed.
+func (e *flexFECEncoder) push(pkt []byte) (*rtp.Header, []byte) {
+	e.Lock()
+	defer e.Unlock()
+	if e.groupSize == 0 || len(pkt) < rtpFixedHeaderSize {
+		e.packets = e.packets[:0]
+		return nil, nil
+	}
+	sn := binary.BigEndian.Uint16(pkt[2:4])
+
+	var hdr *rtp.Header
+	var payload []byte
+	if len(e.packets) > 0 {
+		diff := sn - binary.BigEndian.Uint16(e.packets[len(e.packets)-1][2:4])
+		// Out of the mask or not after the last packet, protect what the group has
+		if sn-e.baseSN >= flexFECMaxGroupSize || diff == 0 || diff >= 0x8000 {
+			hdr, payload = e.encode()
+		}
+	}
+	if len(e.packets) == 0 {
+		e.baseSN = sn
+	}
+	e.packets = append(e.packets, pkt)
+	if len(e.packets) >= e.groupSize {
+		hdr, payload = e.encode()
+	}
+	return hdr, payload
+}
+
+func (e *flexFECEncoder) encode() (*rtp.Header, []byte) {
+	size := 0
+	for _, p := range e.packets {
+		if len(p)-rtpFixedHeaderSize > size {
+			size = len(p) - rtpFixedHeaderSize
+		}
+	}
+	payload := make([]byte, flexFECHeaderSize+size)
+	var lengthRecovery, mask uint16
+	for _, p := range e.packets {
+		payload[0] ^= p[0]
+		payload[1] ^= p[1]
+		lengthRecovery ^= uint16(len(p) - rtpFixedHeaderSize)
+		for i := 4; i < 8; i++ {
+			payload[i] ^= p[i]
+		}
+		for i, b := range p[rtpFixedHeaderSize:] {
+			payload[flexFECHeaderSize+i] ^= b
+		}
+		mask |= 0x4000 >> (binary.BigEndian.Uint16(p[2:4]) - e.baseSN)
+	}
+	// R and F bits are zero with a flexible mask
+	payload[0] &= 0x3f
+	binary.BigEndian.PutUint16(payload[2:4], lengthRecovery)
+	payload[8] = 1
+	binary.BigEndian.PutUint32(payload[12:16], e.mediaSSRC)
+	binary.BigEndian.PutUint16(payload[16:18], e.baseSN)
+	// k bit set, the mask has a single part
+	binary.BigEndian.PutUint16(payload[18:20], 0x8000|mask)
+
+	e.sn++
+	hdr := &rtp.Header{
+		Version:        2,
+		PayloadType:    e.payloadType,
+		SequenceNumber: e.sn,
+		Timestamp:      binary.BigEndian.Uint32(e.packets[len(e.packets)-1][4:8]),
+		SSRC:           e.ssrc,
+	}
+	for i := range e.packets {
+		e.packets[i] = nil
+	}
+	e.packets = e.packets[:0]
+	return hdr, payload
+}
+
+// protect adds a packet written to the subscriber to the FEC group, and writes
+// the FEC packet when the group is completed.
+func (d *DownTrack) protect(hdr *rtp.Header, payload []byte) error {
+	pkt := make([]byte, hdr.MarshalSize()+len(payload))
+	n, err := hdr.MarshalTo(pkt)
+	if err != nil {
+		return err
+	}
+	copy(pkt[n:], payload)
+	fecHdr, fecPayload := d.fec.push(pkt)
+	if fecHdr == nil {
+		return nil
+	}
+	if err = d.setTransportCC(fecHdr, len(fecPayload)); err != nil {
+		return err
+	}
+	_, err = d.writeStream.WriteRTP(fecHdr, fecPayload)
+	return err
+}
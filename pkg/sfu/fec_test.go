@@ -0,0 +1,90 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlexFECEncoder_setLossFraction(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxOverhead  int
+		fractionLost uint8
+		want         int
+	}{
+		{name: "Must not protect without losses", fractionLost: 0, want: 0},
+		{name: "Must use the largest group on low losses", fractionLost: 2, want: flexFECMaxGroupSize},
+		{name: "Must use twice the loss", fractionLost: 26, want: 4},
+		{name: "Must not go over the max overhead", fractionLost: 128, want: 2},
+		{name: "Must follow the configured max overhead", maxOverhead: 20, fractionLost: 128, want: 5},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			e := newFlexFECEncoder(1, 2, 63, tt.maxOverhead)
+			e.setLossFraction(tt.fractionLost)
+			assert.Equal(t, tt.want, e.groupSize)
+		})
+	}
+}
+
+func TestFlexFECEncoder_push(t *testing.T) {
+	e := newFlexFECEncoder(5678, 1234, 63, 0)
+	e.setLossFraction(64)
+	assert.Equal(t, 2, e.groupSize)
+
+	var packets [][]byte
+	for i, payload := range [][]byte{{0x01, 0x02, 0x03}, {0x04, 0x05, 0x06, 0x07, 0x08}} {
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == 1,
+				PayloadType:    96,
+				SequenceNumber: uint16(65535 + i),
+				Timestamp:      9000,
+				SSRC:           1234,
+			},
+			Payload: payload,
+		}
+		raw, err := p.Marshal()
+		assert.NoError(t, err)
+		packets = append(packets, raw)
+	}
+	hdr, payload := e.push(packets[0])
+	assert.Nil(t, hdr)
+	hdr, payload = e.push(packets[1])
+	assert.NotNil(t, hdr)
+	assert.Equal(t, uint32(5678), hdr.SSRC)
+	assert.Equal(t, uint8(63), hdr.PayloadType)
+	assert.Equal(t, uint32(1234), binary.BigEndian.Uint32(payload[12:16]))
+	assert.Equal(t, uint16(65535), binary.BigEndian.Uint16(payload[16:18]))
+	assert.Equal(t, uint16(0x8000|0x4000|0x2000), binary.BigEndian.Uint16(payload[18:20]))
+
+	// Recover the first packet from the second one
+	lost := packets[0]
+	recovered := make([]byte, rtpFixedHeaderSize+int(binary.BigEndian.Uint16(payload[2:4])^uint16(len(packets[1])-rtpFixedHeaderSize)))
+	recovered[0] = (payload[0] ^ packets[1][0]) | 0x80
+	recovered[1] = payload[1] ^ packets[1][1]
+	binary.BigEndian.PutUint16(recovered[2:4], 65535)
+	for i := 4; i < 8; i++ {
+		recovered[i] = payload[i] ^ packets[1][i]
+	}
+	copy(recovered[8:12], lost[8:12])
+	for i := rtpFixedHeaderSize; i < len(recovered); i++ {
+		recovered[i] = payload[flexFECHeaderSize+i-rtpFixedHeaderSize] ^ packets[1][i]
+	}
+	assert.Equal(t, lost, recovered)
+
+	// Packets out of the mask start a new group
+	hdr, _ = e.push(packets[0])
+	assert.Nil(t, hdr)
+	skipped := append([]byte(nil), packets[1]...)
+	binary.BigEndian.PutUint16(skipped[2:4], 20)
+	hdr, payload = e.push(skipped)
+	assert.NotNil(t, hdr)
+	assert.Equal(t, uint16(0x8000|0x4000), binary.BigEndian.Uint16(payload[18:20]))
+	assert.Len(t, e.packets, 1)
+}
@@ -0,0 +1,371 @@
+/*
+【ファイル概要: filesource.go】
+ローカルパブリッシャーのトラックとしてメディアファイルを再生するファイルソース。
+
+【主要な役割】
+1. ファイルの読み込み
+   - IVF（VP8、VP9）のフレームとタイムスタンプ
+   - Ogg（Opus）のページからパケットを取り出し、TOCバイトからパケットの長さを計算
+
+2. 再生
+   - フレームのタイムスタンプに合わせて実時間でサンプルを書き込み
+   - Loopでは最後まで再生したら先頭に戻る（保留音など）
+   - 再生が終わるとトラックを削除
+*/
+package sfu
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	med "github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+var (
+	errUnsupportedFile = errors.New("unsupported media file")
+	errInvalidOggPage  = errors.New("invalid ogg page")
+)
+
+// FileSourceConfig defines the track of a file source
+type FileSourceConfig struct {
+	// TrackID of the track, the file name when empty
+	TrackID string
+	// StreamID of the track, the publisher id when empty
+	StreamID string
+	// Loop restarts the playback at the end of the file
+	Loop bool
+}
+
+// FileSource plays an IVF (VP8, VP9) or Ogg (Opus) file on a track of a
+// local publisher, in real time
+type FileSource struct {
+	track   *LocalTrack
+	file    *os.File
+	reader  fileReader
+	loop    bool
+	err     error
+	closeCh chan struct{}
+	done    chan struct{}
+	closed  atomicBool
+}
+
+// PublishFile publishes a track playing a media file
+func (p *LocalPublisher) PublishFile(path string, c FileSourceConfig) (*FileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, codec, err := newFileReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if c.TrackID == "" {
+		c.TrackID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if c.StreamID == "" {
+		c.StreamID = p.id
+	}
+	track, err := p.AddTrack(TrackParams{TrackID: c.TrackID, StreamID: c.StreamID, Codec: codec})
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	s := &FileSource{
+		track:   track,
+		file:    file,
+		reader:  reader,
+		loop:    c.Loop,
+		closeCh: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Track played by the source
+func (s *FileSource) Track() *LocalTrack {
+	return s.track
+}
+
+// Done is closed when the playback ends, at the end of the file without
+// Loop, on a read error or when the source is closed
+func (s *FileSource) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the read error that ended the playback
+func (s *FileSource) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Close stops the playback and removes the track
+func (s *FileSource) Close() {
+	if s.closed.set(true) {
+		close(s.closeCh)
+	}
+	<-s.done
+}
+
+func (s *FileSource) run() {
+	defer func() {
+		_ = s.file.Close()
+		s.track.Close()
+		close(s.done)
+	}()
+
+	start := time.Now()
+	var pts time.Duration
+	for {
+		data, duration, err := s.reader.next()
+		if err == io.EOF && s.loop && pts > 0 {
+			if _, err = s.file.Seek(0, io.SeekStart); err != nil {
+				s.err = err
+				return
+			}
+			if s.reader, _, err = newFileReader(s.file); err != nil {
+				s.err = err
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			return
+		}
+
+		select {
+		case <-s.closeCh:
+			return
+		case <-time.After(time.Until(start.Add(pts))):
+		}
+		if err = s.track.WriteSample(med.Sample{Data: data, Duration: duration}); err != nil {
+			if err != errLocalTrackClosed {
+				s.err = err
+			}
+			return
+		}
+		pts += duration
+	}
+}
+
+// fileReader returns the frames of a media file and their duration
+type fileReader interface {
+	next() ([]byte, time.Duration, error)
+}
+
+// newFileReader detects the container of a file
+func newFileReader(r io.Reader) (fileReader, webrtc.RTPCodecParameters, error) {
+	br := bufio.NewReader(r)
+	sig, err := br.Peek(4)
+	if err != nil {
+		return nil, webrtc.RTPCodecParameters{}, errUnsupportedFile
+	}
+	switch string(sig) {
+	case "DKIF":
+		return newIVFFileReader(br)
+	case "OggS":
+		return newOggFileReader(br)
+	}
+	return nil, webrtc.RTPCodecParameters{}, errUnsupportedFile
+}
+
+type ivfFileReader struct {
+	reader   *ivfreader.IVFReader
+	timebase time.Duration
+	// The frame read ahead, its duration is known with the next frame
+	frame     []byte
+	timestamp uint64
+	duration  time.Duration
+}
+
+func newIVFFileReader(r io.Reader) (fileReader, webrtc.RTPCodecParameters, error) {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, webrtc.RTPCodecParameters{}, err
+	}
+	codec := webrtc.RTPCodecParameters{PayloadType: 96}
+	switch header.FourCC {
+	case "VP80":
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	case "VP90":
+		codec.PayloadType = 98
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}
+	default:
+		return nil, codec, errUnsupportedFile
+	}
+	if header.TimebaseDenominator == 0 {
+		return nil, codec, errUnsupportedFile
+	}
+	timebase := time.Duration(header.TimebaseNumerator) * time.Second / time.Duration(header.TimebaseDenominator)
+	return &ivfFileReader{reader: reader, timebase: timebase, duration: timebase}, codec, nil
+}
+
+func (r *ivfFileReader) next() ([]byte, time.Duration, error) {
+	if r.frame == nil {
+		frame, header, err := r.reader.ParseNextFrame()
+		if err != nil {
+			return nil, 0, err
+		}
+		r.frame, r.timestamp = frame, header.Timestamp
+	}
+	frame, header, err := r.reader.ParseNextFrame()
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	// The last frame lasts as long as the one before it
+	data, duration := r.frame, r.duration
+	if err == nil {
+		if header.Timestamp > r.timestamp {
+			duration = time.Duration(header.Timestamp-r.timestamp) * r.timebase
+			r.duration = duration
+		}
+		r.frame, r.timestamp = frame, header.Timestamp
+	} else {
+		r.frame = nil
+	}
+	if data == nil {
+		return nil, 0, io.EOF
+	}
+	return data, duration, nil
+}
+
+// oggFileReader returns the Opus packets of the first logical stream of an
+// Ogg file, the packets span the segments of the pages (RFC 3533)
+type oggFileReader struct {
+	r       io.Reader
+	serial  uint32
+	started bool
+	packets [][]byte
+	partial []byte
+}
+
+func newOggFileReader(r io.Reader) (fileReader, webrtc.RTPCodecParameters, error) {
+	o := &oggFileReader{r: r}
+	codec := webrtc.RTPCodecParameters{PayloadType: 111}
+	head, err := o.packet()
+	if err != nil {
+		return nil, codec, err
+	}
+	if len(head) < 19 || string(head[:8]) != "OpusHead" {
+		return nil, codec, errUnsupportedFile
+	}
+	// OpusTags
+	if _, err = o.packet(); err != nil {
+		return nil, codec, err
+	}
+	// Opus is always negotiated with two channels, mono is signaled in band
+	codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+	return o, codec, nil
+}
+
+func (o *oggFileReader) next() ([]byte, time.Duration, error) {
+	for {
+		pkt, err := o.packet()
+		if err != nil {
+			return nil, 0, err
+		}
+		if duration := opusPacketDuration(pkt); duration > 0 {
+			return pkt, duration, nil
+		}
+	}
+}
+
+// packet returns the next packet of the stream
+func (o *oggFileReader) packet() ([]byte, error) {
+	for len(o.packets) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	pkt := o.packets[0]
+	o.packets = o.packets[1:]
+	return pkt, nil
+}
+
+func (o *oggFileReader) readPage() error {
+	var h [27]byte
+	if _, err := io.ReadFull(o.r, h[:]); err != nil {
+		return err
+	}
+	if string(h[:4]) != "OggS" {
+		return errInvalidOggPage
+	}
+	segments := make([]byte, h[26])
+	if _, err := io.ReadFull(o.r, segments); err != nil {
+		return err
+	}
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(o.r, payload); err != nil {
+		return err
+	}
+
+	serial := binary.LittleEndian.Uint32(h[14:18])
+	if h[5]&0x02 != 0 && !o.started {
+		// Beginning of the first stream
+		o.serial, o.started = serial, true
+	}
+	if !o.started || serial != o.serial {
+		return nil
+	}
+	if h[5]&0x01 == 0 {
+		// The page does not continue the packet of the previous page
+		o.partial = nil
+	}
+	offset := 0
+	for _, s := range segments {
+		o.partial = append(o.partial, payload[offset:offset+int(s)]...)
+		offset += int(s)
+		if s < 255 {
+			o.packets = append(o.packets, o.partial)
+			o.partial = nil
+		}
+	}
+	return nil
+}
+
+// opusPacketDuration returns the duration of an Opus packet from its TOC
+// byte (RFC 6716 3.1), zero when the packet is invalid
+func opusPacketDuration(pkt []byte) time.Duration {
+	if len(pkt) == 0 {
+		return 0
+	}
+	config := pkt[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12:
+		// SILK 10, 20, 40 and 60ms
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		// Hybrid 10 and 20ms
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// CELT 2.5, 5, 10 and 20ms
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+	switch pkt[0] & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	}
+	if len(pkt) < 2 {
+		return 0
+	}
+	return time.Duration(pkt[1]&0x3f) * frame
+}
@@ -0,0 +1,155 @@
+/*
+【ファイル概要: gopcache.go】
+キーフレームキャッシュ（GOPキャッシュ）による新規サブスクライバーの即時開始。
+
+【主要な役割】
+1. GOPのキャッシュ
+   - レイヤーごとに、最後のキーフレーム以降のパケット（現在のGOP）のメタデータを保持
+   - パケットの内容はコピーせず、プライミング時にバッファから読み直す
+   - 新しいキーフレームを受信するとキャッシュをリセット
+   - 最大パケット数を超えた場合は次のキーフレームまでキャッシュを無効化
+   - パケットミドルウェアを使うレシーバーでは無効（バッファから読み直すパケットには
+     ミドルウェアの変更・破棄が反映されないため）
+
+2. ダウントラックのプライミング
+   - 新しいダウントラックの最初の同期待ち（reSync）でのみ、キャッシュしたGOPを先に送信
+     （ミュート解除やLast-Nの再開では古いフレームを送らずキーフレームを待つ）
+   - 一度に送るパケット数（MaxBurst）を超えるGOP、バッファから消えたGOPは送らない
+   - シーケンス番号・タイムスタンプは通常の転送と同じオフセットで書き換え
+   - パブリッシャーへのPLIが不要になり、多数の視聴者の同時参加時のPLIストームを防止
+
+【スレッドセーフティ】
+キャッシュはレイヤーごとのパケット書き込みゴルーチンからのみアクセスされます。
+（ダウントラックのWriteRTPも同じゴルーチンから呼ばれる）
+*/
+package sfu
+
+import (
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// defaultGOPCacheSize in packets
+	defaultGOPCacheSize = 1024
+	// defaultGOPMaxBurst in packets written at once to a new down track
+	defaultGOPMaxBurst = 256
+	gopMaxPacketSize   = 1500
+)
+
+// GOPCacheConfig defines the keyframe cache configurations
+type GOPCacheConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MaxPackets cached per layer, GOPs over this size are not cached
+	MaxPackets int `mapstructure:"maxpackets"`
+	// MaxBurst of packets written at once to a new down track, the down
+	// tracks wait for a keyframe when the cached GOP is longer
+	MaxBurst int `mapstructure:"maxburst"`
+}
+
+// gopCache keeps the metadata of the packets of the current GOP, the packets
+// are read again from the buffer when a down track is primed
+type gopCache struct {
+	maxPackets int
+	maxBurst   int
+	timestamp  uint32
+	packets    []buffer.ExtPacket
+	overflow   bool
+}
+
+func newGOPCache(c GOPCacheConfig) *gopCache {
+	if c.MaxPackets <= 0 {
+		c.MaxPackets = defaultGOPCacheSize
+	}
+	if c.MaxBurst <= 0 {
+		c.MaxBurst = defaultGOPMaxBurst
+	}
+	return &gopCache{maxPackets: c.MaxPackets, maxBurst: c.MaxBurst}
+}
+
+// push adds the metadata of the packet, the bucket memory of its payload is
+// reused by the buffer
+func (g *gopCache) push(pkt *buffer.ExtPacket) {
+	if pkt.KeyFrame && pkt.Head && (len(g.packets) == 0 || g.timestamp != pkt.Packet.Timestamp) {
+		g.reset()
+		g.timestamp = pkt.Packet.Timestamp
+	} else if len(g.packets) == 0 || g.overflow {
+		return
+	}
+	if len(g.packets) >= g.maxPackets {
+		g.reset()
+		g.overflow = true
+		return
+	}
+
+	g.packets = append(g.packets, *pkt)
+	cp := &g.packets[len(g.packets)-1]
+	cp.Packet = rtp.Packet{Header: rtp.Header{SequenceNumber: pkt.Packet.SequenceNumber}}
+}
+
+func (g *gopCache) reset() {
+	for i := range g.packets {
+		g.packets[i] = buffer.ExtPacket{}
+	}
+	g.packets = g.packets[:0]
+	g.overflow = false
+}
+
+// EnableGOPCache keeps the packets since the last keyframe of every layer,
+// to start new down tracks without requesting a keyframe. The cache is not
+// used with packet middlewares, the cached packets are read from the buffer
+// without their changes.
+func (w *WebRTCReceiver) EnableGOPCache(c GOPCacheConfig) {
+	if w.kind != webrtc.RTPCodecTypeVideo || w.ingress != nil {
+		return
+	}
+	for i := range w.gopCaches {
+		w.gopCaches[i] = newGOPCache(c)
+	}
+}
+
+// getGOP reads the cached GOP of the layer from the buffer, nil when it is
+// longer than the max burst or its packets are no longer buffered
+func (w *WebRTCReceiver) getGOP(layer int) []*buffer.ExtPacket {
+	g := w.gopCaches[layer]
+	if g == nil || len(g.packets) == 0 || len(g.packets) > g.maxBurst || w.buffers[layer] == nil {
+		return nil
+	}
+	pkts := make([]*buffer.ExtPacket, 0, len(g.packets))
+	raw := make([]byte, len(g.packets)*gopMaxPacketSize)
+	for i := range g.packets {
+		buf := raw[i*gopMaxPacketSize : (i+1)*gopMaxPacketSize]
+		n, err := w.buffers[layer].GetPacket(buf, g.packets[i].Packet.SequenceNumber)
+		if err != nil {
+			return nil
+		}
+		pkt := g.packets[i]
+		if err = pkt.Packet.Unmarshal(buf[:n]); err != nil {
+			return nil
+		}
+		pkts = append(pkts, &pkt)
+	}
+	return pkts
+}
+
+// primeFromGOPCache writes the cached GOP of the layer to a new down track
+// waiting for its first keyframe, the later resyncs wait for a keyframe. Must
+// be called from the layer writer goroutine.
+func (d *DownTrack) primeFromGOPCache(layer int, write func(*buffer.ExtPacket) error) error {
+	if !d.gopPrimed.set(true) {
+		return nil
+	}
+	r, ok := d.receiver.(interface {
+		getGOP(layer int) []*buffer.ExtPacket
+	})
+	if !ok {
+		return nil
+	}
+	for _, pkt := range r.getGOP(layer) {
+		if err := write(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package sfu
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func gopTestPacket(sn uint16, ts uint32, keyFrame bool) *buffer.ExtPacket {
+	return &buffer.ExtPacket{
+		Head:     true,
+		KeyFrame: keyFrame,
+		Packet: rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: sn, Timestamp: ts, SSRC: 5678},
+			Payload: []byte{byte(sn)},
+		},
+	}
+}
+
+func Test_gopCache_push(t *testing.T) {
+	g := newGOPCache(GOPCacheConfig{MaxPackets: 3})
+	// Packets before the first keyframe are not cached
+	g.push(gopTestPacket(1, 1000, false))
+	assert.Empty(t, g.packets)
+
+	pkt := gopTestPacket(2, 2000, true)
+	g.push(pkt)
+	g.push(gopTestPacket(3, 2000, true))
+	g.push(gopTestPacket(4, 3000, false))
+	assert.Len(t, g.packets, 3)
+	// The payloads in the buffer memory are not kept
+	assert.Nil(t, g.packets[0].Packet.Payload)
+	assert.Equal(t, uint16(2), g.packets[0].Packet.SequenceNumber)
+	assert.True(t, g.packets[0].KeyFrame)
+
+	// GOPs over the max size are not cached
+	g.push(gopTestPacket(5, 4000, false))
+	assert.Empty(t, g.packets)
+	g.push(gopTestPacket(6, 5000, false))
+	assert.Empty(t, g.packets)
+
+	g.push(gopTestPacket(7, 6000, true))
+	assert.Len(t, g.packets, 1)
+	assert.Equal(t, uint16(7), g.packets[0].Packet.SequenceNumber)
+}
+
+func TestDownTrack_primeFromGOPCache(t *testing.T) {
+	w := &probeTestWriter{}
+	pool := &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, 1500*25)
+			return &b
+		},
+	}
+	buff := buffer.NewBuffer(5678, pool, pool, Logger)
+	buff.Bind(webrtc.RTPParameters{
+		Codecs: []webrtc.RTPCodecParameters{{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			PayloadType:        96,
+		}},
+	}, buffer.Options{})
+	r := &WebRTCReceiver{kind: webrtc.RTPCodecTypeVideo}
+	r.buffers[0] = buff
+	r.EnableGOPCache(GOPCacheConfig{})
+	for _, p := range []*buffer.ExtPacket{
+		gopTestPacket(10, 3000, true),
+		gopTestPacket(11, 3000, false),
+		gopTestPacket(12, 6000, false),
+	} {
+		raw, err := p.Packet.Marshal()
+		assert.NoError(t, err)
+		_, err = buff.Write(raw)
+		assert.NoError(t, err)
+		r.gopCaches[0].push(p)
+	}
+	d := &DownTrack{
+		ssrc:        1234,
+		payloadType: 96,
+		writeStream: w,
+		receiver:    r,
+		trackType:   SimpleDownTrack,
+		codec:       webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+		lastSN:      100,
+		lastTS:      90000,
+	}
+	d.bound.set(true)
+	d.enabled.set(true)
+	d.reSync.set(true)
+
+	assert.NoError(t, d.WriteRTP(gopTestPacket(13, 9000, false), 0))
+	assert.False(t, d.reSync.get())
+	assert.Len(t, w.headers, 4)
+	for i, hdr := range w.headers {
+		assert.Equal(t, uint16(101+i), hdr.SequenceNumber)
+	}
+	assert.Equal(t, uint32(90001), w.headers[0].Timestamp)
+	assert.Equal(t, uint32(96001), w.headers[3].Timestamp)
+	// The cached packets are read from the buffer
+	assert.Equal(t, []byte{10}, w.payloads[0])
+
+	// Later resyncs wait for a keyframe instead of replaying the GOP
+	d.Mute(true)
+	d.Mute(false)
+	assert.True(t, d.reSync.get())
+	assert.NoError(t, d.primeFromGOPCache(0, d.writeSimpleRTP))
+	assert.Len(t, w.headers, 4)
+}
+
+func TestWebRTCReceiver_getGOP(t *testing.T) {
+	r := &WebRTCReceiver{kind: webrtc.RTPCodecTypeVideo}
+	r.EnableGOPCache(GOPCacheConfig{MaxBurst: 1})
+	r.gopCaches[0].push(gopTestPacket(10, 3000, true))
+	r.gopCaches[0].push(gopTestPacket(11, 3000, false))
+	// GOPs longer than the burst are not written
+	assert.Nil(t, r.getGOP(0))
+}
+
+func TestWebRTCReceiver_GOPCacheMiddlewares(t *testing.T) {
+	mw := PacketMiddlewareFuncs{}
+	r := &WebRTCReceiver{kind: webrtc.RTPCodecTypeVideo}
+	r.UsePacketMiddlewares(mw)
+	r.EnableGOPCache(GOPCacheConfig{})
+	// The buffered packets do not have the changes of the middlewares
+	assert.Nil(t, r.gopCaches[0])
+
+	r = &WebRTCReceiver{kind: webrtc.RTPCodecTypeVideo}
+	r.EnableGOPCache(GOPCacheConfig{})
+	r.UsePacketMiddlewares(mw)
+	assert.Nil(t, r.gopCaches[0])
+	assert.Nil(t, r.getGOP(0))
+}
@@ -2,7 +2,7 @@
 【ファイル概要: helpers.go】
 ヘルパー関数とユーティリティ。
 
-アトミックブール、NTP時間変換、VP8ペイロード操作、
+アトミックブール、NTP時間変換、VP8ペイロード操作、AV1の時間レイヤー選択、
 コーデック検索など、SFU全体で使用される補助機能を提供します。
 */
 package sfu
@@ -74,6 +74,27 @@ func setVP8TemporalLayer(p *buffer.ExtPacket, d *DownTrack) (buf []byte, picID u
 	return
 }
 
+// setAV1TemporalLayer is a helper to drop the av1 frames over the temporal layer
+// of the down track, using the dependency descriptor of the packet. Temporal
+// layers go down at the start of a frame, and up on switch indications.
+func setAV1TemporalLayer(p *buffer.ExtPacket, d *DownTrack) (drop bool) {
+	dd, ok := p.Payload.(buffer.DependencyDescriptor)
+	if !ok {
+		return
+	}
+
+	layer := atomic.LoadInt32(&d.temporalLayer)
+	currentLayer := int(uint16(layer))
+	currentTargetLayer := int(uint16(layer >> 16))
+	if currentTargetLayer != currentLayer && dd.StartOfFrame &&
+		(currentTargetLayer < currentLayer || p.KeyFrame ||
+			dd.DecodeTargetIndication(dd.SpatialID(), currentTargetLayer) == buffer.DTISwitch) {
+		currentLayer = currentTargetLayer
+		atomic.StoreInt32(&d.temporalLayer, int32(currentTargetLayer)<<16|int32(currentTargetLayer))
+	}
+	return dd.TemporalID() > currentLayer
+}
+
 func modifyVP8TemporalPayload(payload []byte, picIDIdx, tlz0Idx int, picID uint16, tlz0ID uint8, mBit bool) {
 	pid := make([]byte, 2)
 	binary.BigEndian.PutUint16(pid, picID)
@@ -3,6 +3,9 @@ package sfu
 import (
 	"testing"
 	"time"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/stretchr/testify/assert"
 )
 
 func Test_timeToNtp(t *testing.T) {
@@ -32,3 +35,34 @@ func Test_timeToNtp(t *testing.T) {
 		})
 	}
 }
+
+func Test_setAV1TemporalLayer(t *testing.T) {
+	structure := &buffer.FrameDependencyStructure{
+		NumDecodeTargets:   2,
+		DecodeTargetLayers: []buffer.DecodeTargetLayer{{SpatialID: 0, TemporalID: 0}, {SpatialID: 0, TemporalID: 1}},
+	}
+	pkt := func(tid int, dti buffer.DecodeTargetIndication) *buffer.ExtPacket {
+		return &buffer.ExtPacket{Payload: buffer.DependencyDescriptor{
+			StartOfFrame: true,
+			Structure:    structure,
+			FrameDependencies: buffer.FrameDependencyTemplate{
+				TemporalID: tid,
+				DTIs:       []buffer.DecodeTargetIndication{buffer.DTIRequired, dti},
+			},
+		}}
+	}
+	d := &DownTrack{}
+	d.SetInitialLayers(0, 1)
+	assert.False(t, setAV1TemporalLayer(pkt(1, buffer.DTIDiscardable), d))
+
+	// Going down drops the upper layer at once
+	d.temporalLayer = 0<<16 | 1
+	assert.True(t, setAV1TemporalLayer(pkt(1, buffer.DTIDiscardable), d))
+	assert.False(t, setAV1TemporalLayer(pkt(0, buffer.DTIRequired), d))
+
+	// Going up waits for a switch indication
+	d.temporalLayer = 1<<16 | 0
+	assert.True(t, setAV1TemporalLayer(pkt(1, buffer.DTIDiscardable), d))
+	assert.False(t, setAV1TemporalLayer(pkt(1, buffer.DTISwitch), d))
+	assert.Equal(t, int32(1<<16|1), d.temporalLayer)
+}
@@ -0,0 +1,281 @@
+/*
+【ファイル概要: hls.go】
+セッションで公開されたストリームをLow-Latency HLS（fMP4）で配信するためのストリーム管理。
+HTTPのハンドラーはシグナルサーバー（cmd/signal/hls）が提供します。
+
+【主要な役割】
+1. ストリームの開始
+   - プレイリストなどが最初に要求されたときに、ストリームIDのレシーバーから
+     最初のH.264/H.265の映像と最初のOpus（RED）の音声を選択
+   - レシーバーごとにダウントラックを作成し、RTPパケットをマルチプレクサーに書き込む
+   - サイマルキャストは最も高い空間レイヤーに固定
+
+2. キーフレームの要求
+   - マルチプレクサーがセグメントの開始や損失の後にキーフレームを必要とすると、
+     レシーバーにPLIを送信
+
+3. ストリームの停止
+   - IdleTimeoutの間要求がない場合、またはトラックの公開が終了した場合に
+     ダウントラックを削除し、マルチプレクサーを閉じる
+*/
+package sfu
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/hls"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const defaultHLSIdleTimeout = 30 * time.Second
+
+// ErrHLSStreamNotFound is returned when a stream has no H.264, H.265 or Opus track
+var ErrHLSStreamNotFound = errors.New("hls stream not found")
+
+// HLSConfig defines the LL-HLS streams of the sessions
+type HLSConfig struct {
+	// SegmentDuration in [ms] of the segments, cut at the next keyframe, 2s when zero
+	SegmentDuration int `mapstructure:"segmentduration"`
+	// PartDuration in [ms] of the partial segments, 200ms when zero
+	PartDuration int `mapstructure:"partduration"`
+	// SegmentCount of the playlist window, 7 when zero
+	SegmentCount int `mapstructure:"segmentcount"`
+	// IdleTimeout in [ms] without request before a stream is stopped, 30s when zero
+	IdleTimeout int `mapstructure:"idletimeout"`
+}
+
+// HLSServer packages the streams of the sessions to LL-HLS, a stream is
+// started on its first request and stopped when it is no longer requested
+type HLSServer struct {
+	sync.Mutex
+	sfu     *SFU
+	config  HLSConfig
+	streams map[string]*hlsStream
+	closed  bool
+}
+
+// NewHLSServer returns the LL-HLS streams of the sessions of the SFU
+func NewHLSServer(s *SFU, c HLSConfig) *HLSServer {
+	return &HLSServer{
+		sfu:     s,
+		config:  c,
+		streams: make(map[string]*hlsStream),
+	}
+}
+
+// Muxer returns the muxer of a stream of a session, the stream is started
+// when it is not playing
+func (s *HLSServer) Muxer(sessionID, streamID string) (*hls.Muxer, error) {
+	key := sessionID + "/" + streamID
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, ErrHLSStreamNotFound
+	}
+	if st, ok := s.streams[key]; ok {
+		st.touch()
+		return st.muxer, nil
+	}
+
+	session := s.sfu.getSession(sessionID)
+	if session == nil {
+		return nil, ErrHLSStreamNotFound
+	}
+	var video, audio Receiver
+	for _, recv := range streamReceivers(session, streamID) {
+		switch mime := strings.ToLower(recv.Codec().MimeType); {
+		case video == nil && (mime == strings.ToLower(webrtc.MimeTypeH264) || mime == strings.ToLower(webrtc.MimeTypeH265)):
+			video = recv
+		case audio == nil && (mime == strings.ToLower(webrtc.MimeTypeOpus) || mime == mimeTypeRED):
+			audio = recv
+		}
+	}
+	st, err := s.startStream(key, video, audio)
+	if err != nil {
+		return nil, err
+	}
+	s.streams[key] = st
+	Logger.V(0).Info("HLS stream started", "session_id", sessionID, "stream_id", streamID, "tracks", len(st.downTracks))
+	return st.muxer, nil
+}
+
+// Close stops the streams
+func (s *HLSServer) Close() error {
+	s.Lock()
+	s.closed = true
+	streams := make([]*hlsStream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.Unlock()
+	for _, st := range streams {
+		st.close()
+	}
+	return nil
+}
+
+func (s *HLSServer) startStream(key string, receivers ...Receiver) (*hlsStream, error) {
+	var codecs []webrtc.RTPCodecCapability
+	var tracks []Receiver
+	for _, recv := range receivers {
+		if recv == nil {
+			continue
+		}
+		codec := recv.Codec()
+		capability := webrtc.RTPCodecCapability{MimeType: codec.MimeType, ClockRate: codec.ClockRate, Channels: codec.Channels}
+		if strings.EqualFold(codec.MimeType, mimeTypeRED) {
+			// The down track unwraps the primary Opus encoding
+			capability.MimeType = webrtc.MimeTypeOpus
+		}
+		codecs = append(codecs, capability)
+		tracks = append(tracks, recv)
+	}
+	if len(tracks) == 0 {
+		return nil, ErrHLSStreamNotFound
+	}
+	muxer, err := hls.NewMuxer(hls.Config{
+		SegmentDuration: time.Duration(s.config.SegmentDuration) * time.Millisecond,
+		PartDuration:    time.Duration(s.config.PartDuration) * time.Millisecond,
+		SegmentCount:    s.config.SegmentCount,
+	}, codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &hlsStream{
+		id:      cuid.New(),
+		key:     key,
+		server:  s,
+		muxer:   muxer,
+		closeCh: make(chan struct{}),
+	}
+	st.touch()
+	for i, recv := range tracks {
+		if err = st.addDownTrack(recv, i); err != nil {
+			st.release()
+			return nil, err
+		}
+	}
+	muxer.OnKeyframeRequest(st.requestKeyframe)
+	st.requestKeyframe()
+
+	idle := time.Duration(s.config.IdleTimeout) * time.Millisecond
+	if idle <= 0 {
+		idle = defaultHLSIdleTimeout
+	}
+	go st.watch(idle)
+	return st, nil
+}
+
+// hlsStream forwards the tracks of a stream to a muxer
+type hlsStream struct {
+	sync.Mutex
+	id         string
+	key        string
+	server     *HLSServer
+	muxer      *hls.Muxer
+	downTracks []*DownTrack
+	lastAccess int64
+	closeCh    chan struct{}
+	closed     atomicBool
+}
+
+func (st *hlsStream) addDownTrack(recv Receiver, index int) error {
+	// The stream ends when a track is unpublished
+	downTrack, err := newLocalDownTrack(recv, hlsTrackWriter{muxer: st.muxer, index: index}, "hls-"+st.id, 0, st.close)
+	if err != nil {
+		return err
+	}
+	st.Lock()
+	st.downTracks = append(st.downTracks, downTrack)
+	st.Unlock()
+
+	// The stream has no receiver report, the highest spatial layer is kept
+	recv.AddDownTrack(downTrack, true)
+	return nil
+}
+
+// requestKeyframe sends a PLI to the publisher of the video track
+func (st *hlsStream) requestKeyframe() {
+	st.Lock()
+	defer st.Unlock()
+	for _, dt := range st.downTracks {
+		dt.requestKeyFrame()
+	}
+}
+
+func (st *hlsStream) touch() {
+	atomic.StoreInt64(&st.lastAccess, time.Now().UnixNano())
+}
+
+// watch stops the stream when it is not requested for the idle timeout
+func (st *hlsStream) watch(idle time.Duration) {
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.closeCh:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&st.lastAccess))) >= idle {
+				st.close()
+				return
+			}
+		}
+	}
+}
+
+func (st *hlsStream) close() {
+	if st.closed.get() {
+		// Called back by the down tracks deleted by release
+		return
+	}
+	s := st.server
+	s.Lock()
+	if s.streams[st.key] == st {
+		delete(s.streams, st.key)
+	}
+	s.Unlock()
+	st.release()
+}
+
+// release deletes the down tracks and closes the muxer
+func (st *hlsStream) release() {
+	if !st.closed.set(true) {
+		return
+	}
+	close(st.closeCh)
+	st.Lock()
+	downTracks := st.downTracks
+	st.downTracks = nil
+	st.Unlock()
+	for _, dt := range downTracks {
+		dt.receiver.DeleteDownTrack(dt.CurrentSpatialLayer(), dt.id)
+	}
+	_ = st.muxer.Close()
+	Logger.V(0).Info("HLS stream stopped", "stream", st.key)
+}
+
+// hlsTrackWriter writes the packets of a down track to a track of a muxer
+type hlsTrackWriter struct {
+	muxer *hls.Muxer
+	index int
+}
+
+func (w hlsTrackWriter) WriteRTP(hdr *rtp.Header, payload []byte) (int, error) {
+	return len(payload), w.muxer.WriteRTP(w.index, hdr, payload)
+}
+
+func (w hlsTrackWriter) Write(b []byte) (int, error) {
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.muxer.WriteRTP(w.index, &pkt.Header, pkt.Payload)
+}
@@ -0,0 +1,79 @@
+package sfu
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHLSServer_Muxer(t *testing.T) {
+	s := NewSFU(newTestConfig())
+	srv := NewHLSServer(s, HLSConfig{SegmentDuration: 100, PartDuration: 20, IdleTimeout: 200})
+	defer srv.Close()
+
+	in, err := NewPlainTransport(s, "hls", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer in.Close()
+	audio := plainTestTrack
+	audio.StreamID = "camera"
+	audio.SSRC = 5678
+	video := TrackParams{
+		TrackID:  "video",
+		StreamID: "camera",
+		Codec: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			PayloadType:        96,
+		},
+		SSRC: 1234,
+	}
+	assert.NoError(t, in.Publish(audio))
+	assert.NoError(t, in.Publish(video))
+	sender, err := net.DialUDP("udp", nil, in.LocalAddr())
+	assert.NoError(t, err)
+	defer sender.Close()
+	sn := uint16(1)
+	_, _ = sender.Write(plainTestPacket(sn))
+	session, _ := s.GetSession("hls")
+	recv := waitReceiver(session, "camera", "audio")
+	if !assert.NotNil(t, recv) {
+		return
+	}
+
+	_, err = srv.Muxer("hls", "missing")
+	assert.Equal(t, ErrHLSStreamNotFound, err)
+	_, err = srv.Muxer("missing", "camera")
+	assert.Equal(t, ErrHLSStreamNotFound, err)
+
+	// The VP8 track is not packaged
+	m, err := srv.Muxer("hls", "camera")
+	if !assert.NoError(t, err) {
+		return
+	}
+	same, _ := srv.Muxer("hls", "camera")
+	assert.True(t, m == same)
+	assert.Len(t, recv.(*WebRTCReceiver).downTracks[0].Load().([]*DownTrack), 1)
+
+	for i := 0; i < 20; i++ {
+		sn++
+		_, _ = sender.Write(plainTestPacket(sn))
+		time.Sleep(5 * time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hls/hls/camera/stream.m3u8", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "#EXTINF:"), w.Body.String())
+
+	// The stream stops when it is not requested
+	assert.Eventually(t, func() bool {
+		return len(recv.(*WebRTCReceiver).downTracks[0].Load().([]*DownTrack)) == 0
+	}, time.Second, 10*time.Millisecond)
+	next, err := srv.Muxer("hls", "camera")
+	assert.NoError(t, err)
+	assert.True(t, m != next)
+}
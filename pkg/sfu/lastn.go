@@ -0,0 +1,170 @@
+/*
+【ファイル概要: lastn.go】
+Last-N: サブスクライバーごとに、最近話したN人のストリームの映像だけを転送する機能。
+大人数の会議で下りの帯域を大幅に削減します。
+
+【主要な役割】
+1. 話者の順序
+   - セッションがAudioObserverの結果から最近話した順にストリームを並べる
+   - まだ話していないストリームはストリームID順で後ろに並べる
+
+2. 映像の一時停止
+   - 上位N個のストリームの映像ダウントラックを転送し、それ以外は一時停止
+   - ピン留めされたストリームは常に転送（Nに数えない）
+   - 一時停止はミュートとは別に管理し、サブスクライバーAPIなどで
+     ミュートされたトラックは再開しても転送しない
+   - Nが0の場合はLast-Nを無効にし、すべて転送
+
+3. 通知
+   - 転送するストリームが変わるとAPIデータチャネルで通知し、
+     クライアントは一時停止したストリームにプレースホルダーを表示できる
+   - APIデータチャネルが開く前の状態は、チャネルが開いた時点で送信
+
+【メッセージ形式】
+{"method": "lastN", "params": {"forwarded": ["..."], "paused": ["..."]}}
+*/
+package sfu
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const LastNMethod = "lastN"
+
+type lastNMessage struct {
+	Forwarded []string `json:"forwarded"`
+	Paused    []string `json:"paused"`
+}
+
+// SetLastN sets the number of video streams forwarded to the subscriber, the
+// streams of the most recent speakers first. Zero forwards all the streams.
+func (s *Subscriber) SetLastN(n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.lastNMu.Lock()
+	s.lastN = n
+	s.lastNMu.Unlock()
+	s.applyLastN()
+}
+
+// LastN returns the number of video streams forwarded, zero when Last-N is
+// disabled
+func (s *Subscriber) LastN() int {
+	s.lastNMu.Lock()
+	defer s.lastNMu.Unlock()
+	return s.lastN
+}
+
+// SetPinnedStreams sets the streams whose video is always forwarded, they are
+// not counted in the last N
+func (s *Subscriber) SetPinnedStreams(streamIDs []string) {
+	pinned := make(map[string]struct{}, len(streamIDs))
+	for _, id := range streamIDs {
+		pinned[id] = struct{}{}
+	}
+	s.lastNMu.Lock()
+	s.pinned = pinned
+	s.lastNMu.Unlock()
+	s.applyLastN()
+}
+
+// setLastNSpeakers updates the stream ids ordered by the most recent speakers
+func (s *Subscriber) setLastNSpeakers(streamIDs []string) {
+	s.lastNMu.Lock()
+	s.lastNSpeakers = streamIDs
+	s.lastNMu.Unlock()
+	s.applyLastN()
+}
+
+// applyLastN pauses and resumes the video down tracks, and notifies the
+// subscriber when the forwarded streams change
+func (s *Subscriber) applyLastN() {
+	s.lastNMu.Lock()
+	defer s.lastNMu.Unlock()
+	if s.lastN == 0 && s.lastNForwarded == nil {
+		return
+	}
+
+	videos := make(map[string][]*DownTrack)
+	s.RLock()
+	for streamID, dts := range s.tracks {
+		for _, dt := range dts {
+			if dt.Kind() == webrtc.RTPCodecTypeVideo {
+				videos[streamID] = append(videos[streamID], dt)
+			}
+		}
+	}
+	s.RUnlock()
+
+	rank := make(map[string]int, len(s.lastNSpeakers))
+	for i, id := range s.lastNSpeakers {
+		rank[id] = i
+	}
+	streamIDs := make([]string, 0, len(videos))
+	for id := range videos {
+		streamIDs = append(streamIDs, id)
+	}
+	sort.Slice(streamIDs, func(i, j int) bool {
+		ri, iok := rank[streamIDs[i]]
+		rj, jok := rank[streamIDs[j]]
+		if iok != jok {
+			return iok
+		}
+		if iok && ri != rj {
+			return ri < rj
+		}
+		return streamIDs[i] < streamIDs[j]
+	})
+
+	msg := lastNMessage{Forwarded: []string{}, Paused: []string{}}
+	n := 0
+	for _, id := range streamIDs {
+		_, pinned := s.pinned[id]
+		forward := s.lastN == 0 || pinned || n < s.lastN
+		if !pinned && forward {
+			n++
+		}
+		for _, dt := range videos[id] {
+			dt.setLastNPaused(!forward)
+		}
+		if forward {
+			msg.Forwarded = append(msg.Forwarded, id)
+		} else {
+			msg.Paused = append(msg.Paused, id)
+		}
+	}
+
+	if s.lastN == 0 {
+		s.lastNForwarded = nil
+	} else if s.lastNSent && strings.Join(msg.Forwarded, "\x00") == strings.Join(s.lastNForwarded, "\x00") {
+		return
+	} else {
+		s.lastNForwarded = msg.Forwarded
+	}
+	// Not sent before the API data channel opens, it is sent again then
+	s.lastNSent = s.sendLastN(msg)
+}
+
+// sendLastN notifies the subscriber, returns false when the API data channel
+// is not open
+func (s *Subscriber) sendLastN(msg lastNMessage) bool {
+	dc := s.DataChannel(APIChannelLabel)
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return false
+	}
+	b, err := json.Marshal(&ChannelAPIMessage{Method: LastNMethod, Params: msg})
+	if err != nil {
+		Logger.Error(err, "Marshaling last n err")
+		return false
+	}
+	if err = dc.SendText(string(b)); err != nil {
+		Logger.Error(err, "Sending last n err", "peer_id", s.id)
+		return false
+	}
+	return true
+}
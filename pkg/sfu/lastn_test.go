@@ -0,0 +1,120 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriber_applyLastN(t *testing.T) {
+	tests := []struct {
+		name          string
+		lastN         int
+		speakers      []string
+		pinned        []string
+		muted         string
+		wantForwarded []string
+	}{
+		{
+			name:          "Must forward all the video when disabled",
+			speakers:      []string{"c"},
+			wantForwarded: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:          "Must forward the most recent speakers",
+			lastN:         2,
+			speakers:      []string{"c", "a"},
+			wantForwarded: []string{"a", "c"},
+		},
+		{
+			name:          "Must forward the streams that did not speak by id",
+			lastN:         3,
+			speakers:      []string{"d"},
+			wantForwarded: []string{"a", "b", "d"},
+		},
+		{
+			name:          "Must forward the pinned streams outside of the last N",
+			lastN:         1,
+			speakers:      []string{"c", "a"},
+			pinned:        []string{"d"},
+			wantForwarded: []string{"c", "d"},
+		},
+		{
+			name:          "Must keep the streams muted by the subscriber muted",
+			lastN:         2,
+			speakers:      []string{"c", "a"},
+			muted:         "a",
+			wantForwarded: []string{"c"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Subscriber{tracks: make(map[string][]*DownTrack)}
+			audio := newTestDownTrack("a", webrtc.MimeTypeOpus)
+			s.AddDownTrack("a", audio)
+			for _, id := range []string{"a", "b", "c", "d"} {
+				dt := newTestDownTrack(id, webrtc.MimeTypeVP8)
+				if id == tt.muted {
+					dt.Mute(true)
+				}
+				s.AddDownTrack(id, dt)
+			}
+			// Start from the paused streams of another order
+			s.SetLastN(1)
+			s.setLastNSpeakers([]string{"b"})
+
+			s.SetPinnedStreams(tt.pinned)
+			s.setLastNSpeakers(tt.speakers)
+			s.SetLastN(tt.lastN)
+
+			var forwarded []string
+			for _, dt := range s.DownTracks() {
+				if dt.Kind() == webrtc.RTPCodecTypeVideo && dt.Enabled() {
+					forwarded = append(forwarded, dt.StreamID())
+				}
+			}
+			assert.ElementsMatch(t, tt.wantForwarded, forwarded)
+			assert.True(t, audio.Enabled())
+		})
+	}
+}
+
+func TestSubscriber_LastNBind(t *testing.T) {
+	s := &Subscriber{tracks: make(map[string][]*DownTrack)}
+	s.SetLastN(1)
+	s.setLastNSpeakers([]string{"a"})
+	s.AddDownTrack("a", newTestDownTrack("a", webrtc.MimeTypeVP8))
+
+	// A track paused before it is bound stays paused
+	dt := &DownTrack{
+		streamID: "b",
+		codec:    webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+		receiver: &testReceiver{},
+	}
+	s.AddDownTrack("b", dt)
+	dt.bindLocal(nil)
+	assert.False(t, dt.Enabled())
+
+	s.setLastNSpeakers([]string{"b", "a"})
+	assert.True(t, dt.Enabled())
+	assert.Equal(t, []string{"b"}, s.lastNForwarded)
+	// Sent again once the API data channel is open
+	assert.False(t, s.lastNSent)
+}
+
+func TestSessionLocal_updateSpeakers(t *testing.T) {
+	s := &SessionLocal{audioObs: NewAudioObserver(40, 1000, 20)}
+	for _, id := range []string{"a", "b", "c"} {
+		s.audioObs.addStream(id)
+	}
+	assert.Equal(t, []string{"b", "a"}, s.updateSpeakers([]string{"b", "a"}))
+	assert.Equal(t, []string{"c", "b", "a"}, s.updateSpeakers([]string{"c"}))
+	assert.Equal(t, []string{"a", "c", "b"}, s.updateSpeakers([]string{"a"}))
+
+	// The streams without audio are removed
+	s.audioObs.removeStream("c")
+	assert.Equal(t, []string{"a", "b"}, s.updateSpeakers(nil))
+	assert.Equal(t, []string{"a", "b"}, s.speakers())
+}
@@ -0,0 +1,191 @@
+/*
+【ファイル概要: layerselector.go】
+Simulcastレイヤー選択ポリシー（LayerSelector）。
+
+【主要な役割】
+1. レイヤー選択の抽象化
+  - LayerSelector interface: 受信側のロス率と利用可能帯域から次のレイヤーを決定
+  - ダウントラックはLayerSelectorの決定に従ってレイヤーを切り替える
+
+2. 組み込みポリシー
+  - default: 従来のhandleLayerChangeと同じ閾値による判定
+  - hysteresis: アップグレードとダウングレードで異なる閾値を使用し、
+    帯域の揺らぎによる頻繁な切り替えを防ぐ
+
+【設定方法】
+- config.tomlの[router.layerselection]でポリシーとパラメータを指定
+- RouterConfig.LayerSelectorでプログラムから独自の実装を指定
+- Subscriber.SetLayerSelectorでサブスクライバーごとに上書き
+*/
+package sfu
+
+import (
+	"time"
+)
+
+const (
+	DefaultLayerSelectorPolicy    = "default"
+	HysteresisLayerSelectorPolicy = "hysteresis"
+)
+
+// LayerState is the input of a LayerSelector
+type LayerState struct {
+	// Current layers of the down track
+	SpatialLayer  int32
+	TemporalLayer int32
+	// Max layers set for the down track
+	MaxSpatialLayer  int32
+	MaxTemporalLayer int32
+	// Bitrate and max temporal layer of every publisher spatial layer,
+	// zero bitrate means the layer is not available
+	Bitrates          [3]uint64
+	MaxTemporalLayers [3]int32
+	// FractionLost reported by the subscriber, in 1/256 units
+	FractionLost uint8
+	// AvailableBitrate estimated for the down track
+	AvailableBitrate uint64
+}
+
+// LayerDecision is the result of a LayerSelector
+type LayerDecision struct {
+	SpatialLayer  int32
+	TemporalLayer int32
+	// SwitchDelay is the minimum time before the next decision is requested
+	SwitchDelay time.Duration
+}
+
+// LayerSelector decides the simulcast layers a down track must switch to
+type LayerSelector interface {
+	SelectLayer(state LayerState) LayerDecision
+}
+
+// LayerSelectionConfig defines the layer selection policy configurations
+type LayerSelectionConfig struct {
+	Policy     string                   `mapstructure:"policy"`
+	Hysteresis HysteresisSelectorConfig `mapstructure:"hysteresis"`
+}
+
+// HysteresisSelectorConfig defines the hysteresis layer selector configurations
+type HysteresisSelectorConfig struct {
+	// Loss percentages under which the layers may go up and over which they go down
+	UpgradeLoss   uint8 `mapstructure:"upgradeloss"`
+	DowngradeLoss uint8 `mapstructure:"downgradeloss"`
+	// Ratio of the target layer bitrate required to go up
+	UpgradeRatio float64 `mapstructure:"upgraderatio"`
+	// Ratio of the current layer bitrate under which the layers go down
+	DowngradeRatio float64 `mapstructure:"downgraderatio"`
+	// Delays in [ms] after switching up and down
+	UpgradeDelay   int `mapstructure:"upgradedelay"`
+	DowngradeDelay int `mapstructure:"downgradedelay"`
+}
+
+func newLayerSelector(c LayerSelectionConfig) LayerSelector {
+	switch c.Policy {
+	case HysteresisLayerSelectorPolicy:
+		return NewHysteresisLayerSelector(c.Hysteresis)
+	case DefaultLayerSelectorPolicy, "":
+	default:
+		Logger.Info("Unknown layer selection policy, using default", "policy", c.Policy)
+	}
+	return &DefaultLayerSelector{}
+}
+
+// DefaultLayerSelector goes up when loss is under 2% and the bitrate allows it,
+// and goes down when loss is over 10%.
+type DefaultLayerSelector struct{}
+
+// SelectLayer implements LayerSelector
+func (s *DefaultLayerSelector) SelectLayer(st LayerState) LayerDecision {
+	d := LayerDecision{SpatialLayer: st.SpatialLayer, TemporalLayer: st.TemporalLayer}
+	cbr := st.Bitrates[st.SpatialLayer]
+	mctl := st.MaxTemporalLayers[st.SpatialLayer]
+
+	if st.FractionLost <= 5 {
+		if st.TemporalLayer < mctl && st.TemporalLayer+1 <= st.MaxTemporalLayer &&
+			st.AvailableBitrate >= 3*cbr/4 {
+			d.TemporalLayer = st.TemporalLayer + 1
+			d.SwitchDelay = 3 * time.Second
+		}
+		if st.TemporalLayer >= mctl && st.AvailableBitrate >= 3*cbr/2 && st.SpatialLayer+1 <= st.MaxSpatialLayer &&
+			st.SpatialLayer+1 <= 2 {
+			d.SpatialLayer = st.SpatialLayer + 1
+			d.TemporalLayer = 0
+			d.SwitchDelay = 5 * time.Second
+		}
+	}
+	if st.FractionLost >= 25 {
+		if (st.AvailableBitrate <= 5*cbr/8 || st.TemporalLayer == 0) &&
+			st.SpatialLayer > 0 &&
+			st.Bitrates[st.SpatialLayer-1] != 0 {
+			d.SpatialLayer = st.SpatialLayer - 1
+			d.SwitchDelay = 10 * time.Second
+		} else if st.TemporalLayer > 0 {
+			d.TemporalLayer = st.TemporalLayer - 1
+			d.SwitchDelay = 5 * time.Second
+		}
+	}
+	return d
+}
+
+// HysteresisLayerSelector uses separated thresholds to go up and down, so
+// a down track does not oscillate between layers when the bitrate changes.
+type HysteresisLayerSelector struct {
+	config HysteresisSelectorConfig
+}
+
+// NewHysteresisLayerSelector creates a HysteresisLayerSelector, zero values of
+// the config are replaced by defaults
+func NewHysteresisLayerSelector(c HysteresisSelectorConfig) *HysteresisLayerSelector {
+	if c.UpgradeLoss == 0 {
+		c.UpgradeLoss = 2
+	}
+	if c.DowngradeLoss == 0 {
+		c.DowngradeLoss = 10
+	}
+	if c.UpgradeRatio == 0 {
+		c.UpgradeRatio = 1.2
+	}
+	if c.DowngradeRatio == 0 {
+		c.DowngradeRatio = 0.8
+	}
+	if c.UpgradeDelay == 0 {
+		c.UpgradeDelay = 8000
+	}
+	if c.DowngradeDelay == 0 {
+		c.DowngradeDelay = 2000
+	}
+	return &HysteresisLayerSelector{config: c}
+}
+
+// SelectLayer implements LayerSelector
+func (s *HysteresisLayerSelector) SelectLayer(st LayerState) LayerDecision {
+	d := LayerDecision{SpatialLayer: st.SpatialLayer, TemporalLayer: st.TemporalLayer}
+	loss := uint64(st.FractionLost) * 100 / 256
+	cbr := st.Bitrates[st.SpatialLayer]
+
+	switch {
+	case loss >= uint64(s.config.DowngradeLoss) ||
+		float64(st.AvailableBitrate) < s.config.DowngradeRatio*float64(cbr):
+		if st.TemporalLayer > 0 {
+			d.TemporalLayer = st.TemporalLayer - 1
+		} else if st.SpatialLayer > 0 && st.Bitrates[st.SpatialLayer-1] != 0 {
+			d.SpatialLayer = st.SpatialLayer - 1
+			d.TemporalLayer = st.MaxTemporalLayers[d.SpatialLayer]
+			if d.TemporalLayer > st.MaxTemporalLayer {
+				d.TemporalLayer = st.MaxTemporalLayer
+			}
+		}
+		d.SwitchDelay = time.Duration(s.config.DowngradeDelay) * time.Millisecond
+	case loss <= uint64(s.config.UpgradeLoss):
+		if st.TemporalLayer < st.MaxTemporalLayers[st.SpatialLayer] && st.TemporalLayer < st.MaxTemporalLayer &&
+			st.AvailableBitrate >= cbr {
+			d.TemporalLayer = st.TemporalLayer + 1
+		} else if next := st.SpatialLayer + 1; next <= st.MaxSpatialLayer && next <= 2 && st.Bitrates[next] != 0 &&
+			float64(st.AvailableBitrate) >= s.config.UpgradeRatio*float64(st.Bitrates[next]) {
+			d.SpatialLayer = next
+			d.TemporalLayer = 0
+		}
+		d.SwitchDelay = time.Duration(s.config.UpgradeDelay) * time.Millisecond
+	}
+	return d
+}
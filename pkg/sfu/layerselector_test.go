@@ -0,0 +1,131 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultLayerSelector_SelectLayer(t *testing.T) {
+	bitrates := [3]uint64{150000, 500000, 1500000}
+	mtl := [3]int32{2, 2, 2}
+	tests := []struct {
+		name  string
+		state LayerState
+		want  LayerDecision
+	}{
+		{
+			name: "Must go up a temporal layer on low loss",
+			state: LayerState{
+				SpatialLayer: 0, TemporalLayer: 0, MaxSpatialLayer: 2, MaxTemporalLayer: 2,
+				Bitrates: bitrates, MaxTemporalLayers: mtl, FractionLost: 0, AvailableBitrate: 150000,
+			},
+			want: LayerDecision{SpatialLayer: 0, TemporalLayer: 1, SwitchDelay: 3e9},
+		},
+		{
+			name: "Must go up a spatial layer when temporal layers are exhausted",
+			state: LayerState{
+				SpatialLayer: 0, TemporalLayer: 2, MaxSpatialLayer: 2, MaxTemporalLayer: 2,
+				Bitrates: bitrates, MaxTemporalLayers: mtl, FractionLost: 5, AvailableBitrate: 300000,
+			},
+			want: LayerDecision{SpatialLayer: 1, TemporalLayer: 0, SwitchDelay: 5e9},
+		},
+		{
+			name: "Must not go over the max spatial layer",
+			state: LayerState{
+				SpatialLayer: 1, TemporalLayer: 2, MaxSpatialLayer: 1, MaxTemporalLayer: 2,
+				Bitrates: bitrates, MaxTemporalLayers: mtl, FractionLost: 0, AvailableBitrate: 5000000,
+			},
+			want: LayerDecision{SpatialLayer: 1, TemporalLayer: 2},
+		},
+		{
+			name: "Must go down a spatial layer on high loss",
+			state: LayerState{
+				SpatialLayer: 2, TemporalLayer: 2, MaxSpatialLayer: 2, MaxTemporalLayer: 2,
+				Bitrates: bitrates, MaxTemporalLayers: mtl, FractionLost: 30, AvailableBitrate: 500000,
+			},
+			want: LayerDecision{SpatialLayer: 1, TemporalLayer: 2, SwitchDelay: 10e9},
+		},
+		{
+			name: "Must go down a temporal layer on high loss with enough bitrate",
+			state: LayerState{
+				SpatialLayer: 2, TemporalLayer: 2, MaxSpatialLayer: 2, MaxTemporalLayer: 2,
+				Bitrates: bitrates, MaxTemporalLayers: mtl, FractionLost: 30, AvailableBitrate: 1500000,
+			},
+			want: LayerDecision{SpatialLayer: 2, TemporalLayer: 1, SwitchDelay: 5e9},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := &DefaultLayerSelector{}
+			assert.Equal(t, tt.want, s.SelectLayer(tt.state))
+		})
+	}
+}
+
+func TestHysteresisLayerSelector_SelectLayer(t *testing.T) {
+	bitrates := [3]uint64{150000, 500000, 1500000}
+	mtl := [3]int32{0, 0, 0}
+	tests := []struct {
+		name  string
+		state LayerState
+		want  LayerDecision
+	}{
+		{
+			name: "Must go up only with headroom over the next layer",
+			state: LayerState{
+				SpatialLayer: 0, MaxSpatialLayer: 2, Bitrates: bitrates, MaxTemporalLayers: mtl,
+				AvailableBitrate: 650000,
+			},
+			want: LayerDecision{SpatialLayer: 1, SwitchDelay: 8e9},
+		},
+		{
+			name: "Must stay inside the hysteresis band",
+			state: LayerState{
+				SpatialLayer: 1, MaxSpatialLayer: 2, Bitrates: bitrates, MaxTemporalLayers: mtl,
+				AvailableBitrate: 450000, FractionLost: 13,
+			},
+			want: LayerDecision{SpatialLayer: 1},
+		},
+		{
+			name: "Must go down under the downgrade ratio",
+			state: LayerState{
+				SpatialLayer: 1, MaxSpatialLayer: 2, Bitrates: bitrates, MaxTemporalLayers: mtl,
+				AvailableBitrate: 350000,
+			},
+			want: LayerDecision{SpatialLayer: 0, SwitchDelay: 2e9},
+		},
+		{
+			name: "Must go down on loss over the threshold",
+			state: LayerState{
+				SpatialLayer: 1, MaxSpatialLayer: 2, Bitrates: bitrates, MaxTemporalLayers: mtl,
+				AvailableBitrate: 5000000, FractionLost: 64,
+			},
+			want: LayerDecision{SpatialLayer: 0, SwitchDelay: 2e9},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewHysteresisLayerSelector(HysteresisSelectorConfig{})
+			assert.Equal(t, tt.want, s.SelectLayer(tt.state))
+		})
+	}
+}
+
+func TestSubscriber_SetLayerSelector(t *testing.T) {
+	router := NewHysteresisLayerSelector(HysteresisSelectorConfig{})
+	s := &Subscriber{tracks: make(map[string][]*DownTrack)}
+	dt := &DownTrack{routerSelector: router}
+	s.AddDownTrack("a", dt)
+	assert.Same(t, router, dt.LayerSelector())
+
+	custom := &DefaultLayerSelector{}
+	s.SetLayerSelector(custom)
+	assert.Same(t, custom, dt.LayerSelector())
+
+	// Nil restores the selector of the router
+	s.SetLayerSelector(nil)
+	assert.Same(t, router, dt.LayerSelector())
+}
@@ -0,0 +1,321 @@
+/*
+【ファイル概要: localpublisher.go】
+WebRTCのピアを使わずに、SFUと同じプロセスのGoのコードがメディアを公開するローカルパブリッシャー。
+保留音、ファイルの再生、音声合成の出力などを公開するボットが使用します。
+
+【主要な役割】
+1. トラックの公開
+   - コーデックなどのパラメータはAPI（TrackParams）で指定
+   - ピアを持たないルーターのレシーバーとしてセッションに公開し、
+     通常のパブリッシャーと同じくサブスクライバーへ配信
+
+2. 書き込み
+   - RTPパケット（WriteRTP、SSRCとペイロードタイプはトラックのものに置き換え）
+   - メディアサンプル（WriteSample、VP8・VP9・H.264・Opus・G.711・G.722を
+     パケット化）
+   - シーケンス番号とタイムスタンプはトラックの連続した値に変換し、
+     同じトラックでWriteRTPとWriteSampleを混在させてもギャップにならない
+
+3. キーフレーム要求
+   - サブスクライバーのPLI/FIRをトラックのコールバック（OnKeyFrameRequest）で通知
+*/
+package sfu
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	med "github.com/pion/webrtc/v3/pkg/media"
+)
+
+const localPublisherMTU = 1200
+
+var (
+	errLocalPublisherClosed   = errors.New("local publisher closed")
+	errLocalTrackClosed       = errors.New("local track closed")
+	errLocalSampleUnsupported = errors.New("samples of the codec can not be packetized")
+)
+
+// LocalPublisher publishes tracks written by the SFU process to a session,
+// without WebRTC
+type LocalPublisher struct {
+	sync.RWMutex
+	id      string
+	session Session
+	router  *router
+	tracks  map[uint32]*LocalTrack
+	closed  atomicBool
+}
+
+// NewLocalPublisher creates a local publisher of the session
+func NewLocalPublisher(provider SessionProvider, sid string) *LocalPublisher {
+	p := &LocalPublisher{
+		id:     cuid.New(),
+		tracks: make(map[uint32]*LocalTrack),
+	}
+	session, cfg := provider.GetSession(sid)
+	p.session = session
+	p.router = newRouter(p.id, session, &cfg).(*router)
+	p.router.SetRTCPWriter(p.writeRTCP)
+	session.AddRouter(p.router)
+
+	Logger.V(0).Info("Local publisher created", "publisher_id", p.id, "session_id", sid)
+	return p
+}
+
+// ID of the publisher, also the id of its router in the session
+func (p *LocalPublisher) ID() string {
+	return p.id
+}
+
+// AddTrack publishes a track to the session, a random SSRC is used when the
+// SSRC of the parameters is zero
+func (p *LocalPublisher) AddTrack(params TrackParams) (*LocalTrack, error) {
+	if p.closed.get() {
+		return nil, errLocalPublisherClosed
+	}
+	p.Lock()
+	for params.SSRC == 0 || p.tracks[params.SSRC] != nil {
+		params.SSRC = rand.Uint32()
+	}
+	recv, buff, err := p.router.addLocalReceiver(params)
+	if err != nil {
+		p.Unlock()
+		return nil, err
+	}
+	t := &LocalTrack{
+		params:   params,
+		receiver: recv,
+		buff:     buff,
+		sn:       uint16(rand.Uint32()),
+		ts:       rand.Uint32(),
+	}
+	if payloader := localPayloader(params.Codec.MimeType); payloader != nil {
+		t.packetizer = rtp.NewPacketizer(localPublisherMTU, uint8(params.Codec.PayloadType), params.SSRC,
+			payloader, rtp.NewRandomSequencer(), params.Codec.ClockRate)
+	}
+	p.tracks[params.SSRC] = t
+	buff.OnClose(func() {
+		t.closed.set(true)
+		p.Lock()
+		if p.tracks[params.SSRC] == t {
+			delete(p.tracks, params.SSRC)
+		}
+		p.Unlock()
+	})
+	p.Unlock()
+
+	p.session.Publish(p.router, recv)
+	Logger.V(0).Info("Local publisher track published", "publisher_id", p.id, "track_id", params.TrackID, "ssrc", params.SSRC)
+	return t, nil
+}
+
+// Close removes the tracks of the publisher from the session
+func (p *LocalPublisher) Close() error {
+	if !p.closed.set(true) {
+		return nil
+	}
+	p.RLock()
+	tracks := make([]*LocalTrack, 0, len(p.tracks))
+	for _, t := range p.tracks {
+		tracks = append(tracks, t)
+	}
+	p.RUnlock()
+
+	for _, t := range tracks {
+		t.Close()
+	}
+	p.router.Stop()
+	p.session.RemoveRouter(p.router)
+	return nil
+}
+
+// writeRTCP notifies the keyframe requests of the subscribers, the other
+// feedback is dropped
+func (p *LocalPublisher) writeRTCP(pkts []rtcp.Packet) error {
+	for _, pkt := range pkts {
+		var ssrc uint32
+		switch r := pkt.(type) {
+		case *rtcp.PictureLossIndication:
+			ssrc = r.MediaSSRC
+		case *rtcp.FullIntraRequest:
+			ssrc = r.MediaSSRC
+		default:
+			continue
+		}
+		p.RLock()
+		t := p.tracks[ssrc]
+		p.RUnlock()
+		if t == nil {
+			continue
+		}
+		if f, ok := t.onKeyFrameRequest.Load().(func()); ok && f != nil {
+			f()
+		}
+	}
+	return nil
+}
+
+// LocalTrack is a track of a local publisher, its packets are written by
+// the SFU process
+type LocalTrack struct {
+	sync.Mutex
+	params     TrackParams
+	receiver   *WebRTCReceiver
+	buff       *buffer.Buffer
+	packetizer rtp.Packetizer
+
+	// Sequence number and timestamp of the last packet written, the packets
+	// written with WriteRTP are shifted by the offsets
+	sn        uint16
+	ts        uint32
+	lastWrite time.Time
+	mode      int
+	nextTS    uint32
+	snOffset  uint16
+	tsOffset  uint32
+
+	onKeyFrameRequest atomic.Value
+	closed            atomicBool
+}
+
+// Params of the published track, with its SSRC
+func (t *LocalTrack) Params() TrackParams {
+	return t.params
+}
+
+// Receiver of the track in the session
+func (t *LocalTrack) Receiver() Receiver {
+	return t.receiver
+}
+
+// OnKeyFrameRequest sets the handler called when a subscriber requests a
+// keyframe, it must not block
+func (t *LocalTrack) OnKeyFrameRequest(f func()) {
+	t.onKeyFrameRequest.Store(f)
+}
+
+// Modes of the last writes of a local track
+const (
+	localTrackNone = iota
+	localTrackRTP
+	localTrackSamples
+)
+
+// WriteRTP publishes a packet, its SSRC and payload type are replaced by the
+// ones of the track. Its sequence number and timestamp are shifted to follow
+// the packets written before, the gaps between the packets are kept.
+func (t *LocalTrack) WriteRTP(pkt *rtp.Packet) error {
+	if t.closed.get() {
+		return errLocalTrackClosed
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.mode != localTrackRTP {
+		next := t.nextTimestamp()
+		t.snOffset = t.sn + 1 - pkt.SequenceNumber
+		t.tsOffset = next - pkt.Timestamp
+		t.mode = localTrackRTP
+	}
+	hdr := pkt.Header
+	hdr.SSRC = t.params.SSRC
+	hdr.PayloadType = uint8(t.params.Codec.PayloadType)
+	hdr.SequenceNumber += t.snOffset
+	hdr.Timestamp += t.tsOffset
+	raw, err := (&rtp.Packet{Header: hdr, Payload: pkt.Payload}).Marshal()
+	if err != nil {
+		return err
+	}
+	if diff := hdr.SequenceNumber - t.sn; diff != 0 && diff < 0x8000 {
+		t.sn = hdr.SequenceNumber
+		t.ts = hdr.Timestamp
+	}
+	t.lastWrite = time.Now()
+	_, err = t.buff.Write(raw)
+	return err
+}
+
+// WriteSample packetizes and publishes a sample, the duration of the sample
+// advances the timestamp of the next one
+func (t *LocalTrack) WriteSample(s med.Sample) error {
+	if t.packetizer == nil {
+		return errLocalSampleUnsupported
+	}
+	if t.closed.get() {
+		return errLocalTrackClosed
+	}
+	samples := uint32(s.Duration * time.Duration(t.params.Codec.ClockRate) / time.Second)
+	t.Lock()
+	defer t.Unlock()
+	ts := t.nextTimestamp()
+	t.mode = localTrackSamples
+	t.nextTS = ts + samples
+	t.lastWrite = time.Now()
+	for _, pkt := range t.packetizer.Packetize(s.Data, samples) {
+		t.sn++
+		pkt.SequenceNumber = t.sn
+		pkt.Timestamp = ts
+		t.ts = ts
+		raw, err := pkt.Marshal()
+		if err != nil {
+			return err
+		}
+		if _, err = t.buff.Write(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextTimestamp returns the timestamp following the last packet, after the
+// duration of the last sample or the time elapsed since the last packet
+func (t *LocalTrack) nextTimestamp() uint32 {
+	switch t.mode {
+	case localTrackSamples:
+		return t.nextTS
+	case localTrackRTP:
+		elapsed := uint32(time.Since(t.lastWrite) * time.Duration(t.params.Codec.ClockRate) / time.Second)
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		return t.ts + elapsed
+	}
+	return t.ts
+}
+
+// Close removes the track from the session
+func (t *LocalTrack) Close() {
+	if t.closed.set(true) {
+		_ = t.buff.Close()
+	}
+}
+
+// localPayloader returns the payloader of the samples of a codec, nil when
+// they can not be packetized
+func localPayloader(mimeType string) rtp.Payloader {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return &codecs.VP8Payloader{EnablePictureID: true}
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return &codecs.VP9Payloader{}
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return &codecs.H264Payloader{}
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return &codecs.OpusPayloader{}
+	case strings.ToLower(webrtc.MimeTypePCMU), strings.ToLower(webrtc.MimeTypePCMA):
+		return &codecs.G711Payloader{}
+	case strings.ToLower(webrtc.MimeTypeG722):
+		return &codecs.G722Payloader{}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	med "github.com/pion/webrtc/v3/pkg/media"
+	"github.com/stretchr/testify/assert"
+)
+
+// testOggPage returns an Ogg page of packets without checksum, the last
+// packet is continued on the next page when open
+func testOggPage(headerType byte, open bool, packets ...[]byte) []byte {
+	h := make([]byte, 27)
+	copy(h, "OggS")
+	h[5] = headerType
+	binary.LittleEndian.PutUint32(h[14:], 1)
+	var table, payload []byte
+	for i, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			table = append(table, 255)
+		}
+		if !open || i < len(packets)-1 {
+			table = append(table, byte(n))
+		}
+		payload = append(payload, p...)
+	}
+	h[26] = byte(len(table))
+	return append(append(h, table...), payload...)
+}
+
+func testOggHeaders() []byte {
+	head := append([]byte("OpusHead"), 1, 2, 0, 0, 0x80, 0xbb, 0, 0, 0, 0, 0)
+	return append(testOggPage(0x02, false, head), testOggPage(0, false, []byte("OpusTags"))...)
+}
+
+// testIVFFile returns a VP8 IVF file of 30 frames per second
+func testIVFFile(frames int) []byte {
+	h := make([]byte, 32)
+	copy(h, "DKIF")
+	binary.LittleEndian.PutUint16(h[6:], 32)
+	copy(h[8:], "VP80")
+	binary.LittleEndian.PutUint32(h[16:], 30)
+	binary.LittleEndian.PutUint32(h[20:], 1)
+	binary.LittleEndian.PutUint32(h[24:], uint32(frames))
+	for i := 0; i < frames; i++ {
+		frame := []byte{0x00, 0x00, 0x9d, 0x01, 0x2a, byte(i)}
+		f := make([]byte, 12)
+		binary.LittleEndian.PutUint32(f, uint32(len(frame)))
+		binary.LittleEndian.PutUint64(f[4:], uint64(i))
+		h = append(append(h, f...), frame...)
+	}
+	return h
+}
+
+func TestLocalPublisher_Write(t *testing.T) {
+	s := NewSFU(newTestConfig())
+	pub := NewLocalPublisher(s, "local")
+	defer pub.Close()
+	session, _ := s.GetSession("local")
+
+	audio, err := pub.AddTrack(TrackParams{TrackID: "audio", StreamID: "bot", Codec: plainTestTrack.Codec})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotZero(t, audio.Params().SSRC)
+	_, err = pub.AddTrack(TrackParams{TrackID: "audio", StreamID: "bot", Codec: plainTestTrack.Codec})
+	assert.Equal(t, errTrackExists, err)
+	assert.True(t, findReceiver(session, "bot", "audio") == audio.Receiver())
+
+	sub, err := session.NewLocalSubscriber(audio.Receiver(), LocalSubscriberConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, audio.WriteSample(med.Sample{Data: []byte{0xfc, byte(i)}, Duration: 20 * time.Millisecond}))
+	}
+	// The packets follow the samples, with the gaps between them
+	assert.NoError(t, audio.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1, SSRC: 1}, Payload: []byte{0xfc, 3}}))
+	assert.NoError(t, audio.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2, Timestamp: 960, SSRC: 1}, Payload: []byte{0xfc, 4}}))
+	assert.NoError(t, audio.WriteSample(med.Sample{Data: []byte{0xfc, 5}, Duration: 20 * time.Millisecond}))
+	var pkts []*rtp.Packet
+	for len(pkts) < 6 {
+		select {
+		case pkt := <-sub.Packets():
+			pkts = append(pkts, &pkt.Packet)
+		case <-time.After(time.Second):
+			t.Fatal("packets not received")
+		}
+	}
+	for i, pkt := range pkts {
+		assert.Equal(t, []byte{0xfc, byte(i)}, pkt.Payload)
+	}
+	for i := 1; i < len(pkts); i++ {
+		assert.Equal(t, pkts[i-1].SequenceNumber+1, pkts[i].SequenceNumber)
+	}
+	// The samples advance the timestamp by their duration
+	assert.Equal(t, uint32(960), pkts[1].Timestamp-pkts[0].Timestamp)
+	assert.Equal(t, uint32(960), pkts[3].Timestamp-pkts[2].Timestamp)
+	assert.Equal(t, uint32(960), pkts[4].Timestamp-pkts[3].Timestamp)
+	assert.Less(t, pkts[5].Timestamp-pkts[4].Timestamp, uint32(48000))
+
+	// The keyframe requests of the subscribers are notified
+	video, err := pub.AddTrack(TrackParams{TrackID: "video", StreamID: "bot", Codec: webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000},
+		PayloadType:        100,
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, errLocalSampleUnsupported, video.WriteSample(med.Sample{Data: []byte{1}}))
+	requested := make(chan struct{}, 1)
+	video.OnKeyFrameRequest(func() {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+	})
+	vsub, err := session.NewLocalSubscriber(video.Receiver(), LocalSubscriberConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer vsub.Close()
+	vsub.RequestKeyFrame()
+	select {
+	case <-requested:
+	case <-time.After(time.Second):
+		t.Fatal("keyframe request not notified")
+	}
+
+	// Closing the track unpublishes it
+	video.Close()
+	assert.Equal(t, errLocalTrackClosed, video.WriteRTP(&rtp.Packet{}))
+	select {
+	case <-vsub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("track not unpublished")
+	}
+	assert.NoError(t, pub.Close())
+	_, err = pub.AddTrack(TrackParams{TrackID: "other", StreamID: "bot", Codec: plainTestTrack.Codec})
+	assert.Equal(t, errLocalPublisherClosed, err)
+}
+
+func TestLocalPublisher_PublishFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localpublisher")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clip.ivf")
+	assert.NoError(t, ioutil.WriteFile(path, testIVFFile(3), 0600))
+	invalid := filepath.Join(dir, "clip.txt")
+	assert.NoError(t, ioutil.WriteFile(invalid, []byte("text file"), 0600))
+
+	s := NewSFU(newTestConfig())
+	pub := NewLocalPublisher(s, "local")
+	defer pub.Close()
+	session, _ := s.GetSession("local")
+
+	_, err = pub.PublishFile(invalid, FileSourceConfig{})
+	assert.Equal(t, errUnsupportedFile, err)
+	src, err := pub.PublishFile(path, FileSourceConfig{Loop: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "clip", src.Track().Params().TrackID)
+	assert.Equal(t, pub.ID(), src.Track().Params().StreamID)
+	sub, err := session.NewLocalSubscriber(src.Track().Receiver(), LocalSubscriberConfig{Frames: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The file is looped
+	var looped bool
+	for prev := byte(0); !looped; {
+		select {
+		case f := <-sub.Frames():
+			looped = f.Data[5] < prev
+			prev = f.Data[5]
+		case <-time.After(time.Second):
+			t.Fatal("file not looped")
+		}
+	}
+
+	src.Close()
+	assert.NoError(t, src.Err())
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("track not unpublished")
+	}
+}
+
+func Test_ivfFileReader(t *testing.T) {
+	r, codec, err := newFileReader(bytes.NewReader(testIVFFile(2)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, webrtc.MimeTypeVP8, codec.MimeType)
+	for i := 0; i < 2; i++ {
+		data, duration, err := r.next()
+		assert.NoError(t, err)
+		assert.Equal(t, byte(i), data[5])
+		assert.Equal(t, time.Second/30, duration)
+	}
+	_, _, err = r.next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_oggFileReader(t *testing.T) {
+	long := append([]byte{0x78}, make([]byte, 300)...)
+	// A packet continued on the next page, and two packets of a page
+	b := append(testOggHeaders(), testOggPage(0, true, []byte{0xf8, 1}, long[:255])...)
+	b = append(b, testOggPage(0x01, false, long[255:], []byte{0x7b, 0x03, 0x02})...)
+	r, codec, err := newFileReader(bytes.NewReader(b))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, webrtc.MimeTypeOpus, codec.MimeType)
+	tests := []struct {
+		data     []byte
+		duration time.Duration
+	}{
+		{data: []byte{0xf8, 1}, duration: 20 * time.Millisecond},
+		{data: long, duration: 20 * time.Millisecond},
+		{data: []byte{0x7b, 0x03, 0x02}, duration: 60 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		data, duration, err := r.next()
+		assert.NoError(t, err)
+		assert.Equal(t, tt.data, data)
+		assert.Equal(t, tt.duration, duration)
+	}
+	_, _, err = r.next()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,303 @@
+/*
+【ファイル概要: localsubscriber.go】
+WebRTCのピアを使わずに、SFUと同じプロセスのGoのコードがトラックを受信するローカルサブスクライバー。
+音声認識やモデレーションのモデルなど、SFUの横で動く処理が使用します。
+
+【主要な役割】
+1. レシーバーへの接続
+   - ダウントラックをローカルに接続（SSRC、シーケンス番号、タイムスタンプの書き換えと
+     キーフレームからの開始は通常のダウントラックと同じ）
+   - サイマルキャストとSVCは指定された空間レイヤーを受信
+
+2. 配信
+   - パケットをシーケンス番号順に並べ替えてExtPacketとして配信
+   - またはフレームに組み立てて配信（録画と同じ形式）
+   - 並べ替えとフレームの組み立ては録画と共通（recorder.JitterBuffer、recorder.FrameAssembler）
+   - 配信先はチャネル（Packets、Frames）またはコールバック（OnPacket、OnFrame）
+
+3. バックプレッシャー
+   - ダウントラックから受け取ったパケットは固定長のキューに入れ、
+     キューが一杯の場合は破棄してレシーバーのwriteRTPをブロックしない
+   - 破棄したパケットのシーケンス番号を記録し、並べ替えで待たずに損失として扱う
+   - 損失の後、映像はキーフレームを要求し、フレームは次のキーフレームまで破棄
+*/
+package sfu
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/ion-sfu/pkg/recorder"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultLocalQueueSize = 512
+	defaultLocalMaxLate   = 50
+)
+
+// LocalSubscriberConfig defines the delivery of the track of a local subscriber
+type LocalSubscriberConfig struct {
+	// SpatialLayer of the simulcast and SVC tracks, 0 is the lowest
+	SpatialLayer int
+	// Frames delivers the depacketized frames instead of the packets, VP8,
+	// VP9, AV1, H.264, H.265 and Opus tracks only
+	Frames bool
+	// OnPacket is called with the packets instead of sending them to Packets
+	OnPacket func(pkt *buffer.ExtPacket)
+	// OnFrame is called with the frames instead of sending them to Frames, it
+	// implies Frames
+	OnFrame func(f recorder.Frame)
+	// QueueSize is the number of packets waiting for the consumer before they
+	// are dropped, 512 when zero
+	QueueSize int
+	// MaxLate is the number of packets to wait for a missing packet, 50 when zero
+	MaxLate uint16
+}
+
+// LocalSubscriber receives a track in the SFU process, without WebRTC. The
+// packets are queued without blocking the receiver and delivered in order,
+// on a channel or to a callback, by the goroutine of the subscriber.
+type LocalSubscriber struct {
+	// 64-bit atomic first for the alignment on 32-bit platforms
+	dropped uint64
+
+	id        string
+	config    LocalSubscriberConfig
+	downTrack *DownTrack
+	mime      string
+	video     bool
+	queue     chan *buffer.ExtPacket
+	packets   chan *buffer.ExtPacket
+	frames    chan recorder.Frame
+	assembler *recorder.FrameAssembler
+	closeCh   chan struct{}
+	closed    atomicBool
+
+	// Sequence numbers of the packets dropped when the queue was full
+	dropMu sync.Mutex
+	drops  map[uint16]struct{}
+
+	// The reordering and the depacketization run on the subscriber goroutine
+	jitter  *recorder.JitterBuffer
+	started bool
+}
+
+// newLocalSubscriber attaches a local subscriber to a receiver
+func newLocalSubscriber(recv Receiver, c LocalSubscriberConfig) (*LocalSubscriber, error) {
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultLocalQueueSize
+	}
+	if c.MaxLate == 0 {
+		c.MaxLate = defaultLocalMaxLate
+	}
+	if c.OnFrame != nil {
+		c.Frames = true
+	}
+	codec := recv.Codec()
+	s := &LocalSubscriber{
+		id:      cuid.New(),
+		config:  c,
+		mime:    strings.ToLower(codec.MimeType),
+		video:   recv.Kind() == webrtc.RTPCodecTypeVideo,
+		queue:   make(chan *buffer.ExtPacket, c.QueueSize),
+		closeCh: make(chan struct{}),
+		drops:   make(map[uint16]struct{}),
+		jitter:  recorder.NewJitterBuffer(c.MaxLate),
+	}
+	s.jitter.OnMissing(s.takeDrop)
+	if s.mime == mimeTypeRED {
+		// The down track unwraps the primary Opus encoding
+		s.mime = strings.ToLower(webrtc.MimeTypeOpus)
+	}
+	if c.Frames {
+		a, err := recorder.NewFrameAssembler(webrtc.RTPCodecCapability{MimeType: s.mime})
+		if err != nil {
+			return nil, err
+		}
+		s.assembler = a
+		if c.OnFrame == nil {
+			s.frames = make(chan recorder.Frame)
+		}
+	} else if c.OnPacket == nil {
+		s.packets = make(chan *buffer.ExtPacket)
+	}
+
+	downTrack, err := newLocalDownTrack(recv, localTrackWriter{s}, "local-"+s.id, 0, func() { _ = s.Close() })
+	if err != nil {
+		return nil, err
+	}
+	s.downTrack = downTrack
+
+	go s.run()
+	recv.AddDownTrack(downTrack, c.SpatialLayer > 0)
+	if downTrack.trackType != SimpleDownTrack && int32(c.SpatialLayer) != atomic.LoadInt32(&downTrack.targetSpatialLayer) {
+		_ = downTrack.SwitchSpatialLayer(int32(c.SpatialLayer), true)
+	}
+	return s, nil
+}
+
+// ID of the subscriber
+func (s *LocalSubscriber) ID() string {
+	return s.id
+}
+
+// Packets returns the channel of the packets, closed when the subscriber is
+// closed. It is nil when the frames or a callback are delivered.
+func (s *LocalSubscriber) Packets() <-chan *buffer.ExtPacket {
+	return s.packets
+}
+
+// Frames returns the channel of the frames, closed when the subscriber is
+// closed. It is nil when the packets or a callback are delivered.
+func (s *LocalSubscriber) Frames() <-chan recorder.Frame {
+	return s.frames
+}
+
+// Done is closed when the subscriber is closed, by Close or when the track
+// is unpublished
+func (s *LocalSubscriber) Done() <-chan struct{} {
+	return s.closeCh
+}
+
+// Dropped returns the number of packets dropped because the consumer was late
+func (s *LocalSubscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// SwitchSpatialLayer changes the spatial layer of a simulcast or SVC track
+func (s *LocalSubscriber) SwitchSpatialLayer(layer int) error {
+	return s.downTrack.SwitchSpatialLayer(int32(layer), true)
+}
+
+// RequestKeyFrame sends a PLI to the publisher of a video track
+func (s *LocalSubscriber) RequestKeyFrame() {
+	s.downTrack.requestKeyFrame()
+}
+
+// Close detaches the subscriber from the receiver
+func (s *LocalSubscriber) Close() error {
+	if !s.closed.set(true) {
+		return nil
+	}
+	close(s.closeCh)
+	s.downTrack.receiver.DeleteDownTrack(s.downTrack.CurrentSpatialLayer(), s.downTrack.id)
+	return nil
+}
+
+// write queues a packet, the packet is dropped when the queue is full
+func (s *LocalSubscriber) write(raw []byte) error {
+	ext := &buffer.ExtPacket{Arrival: time.Now().UnixNano()}
+	if err := ext.Packet.Unmarshal(raw); err != nil {
+		return err
+	}
+	ext.KeyFrame = buffer.IsKeyFrame(s.mime, ext.Packet.Payload)
+	select {
+	case s.queue <- ext:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		// Past the queue size, the gaps wait for MaxLate packets
+		s.dropMu.Lock()
+		if len(s.drops) < s.config.QueueSize {
+			s.drops[ext.Packet.SequenceNumber] = struct{}{}
+		}
+		s.dropMu.Unlock()
+	}
+	return nil
+}
+
+// takeDrop reports whether the packet was dropped by the queue, and forgets it
+func (s *LocalSubscriber) takeDrop(sn uint16) bool {
+	s.dropMu.Lock()
+	defer s.dropMu.Unlock()
+	if _, ok := s.drops[sn]; ok {
+		delete(s.drops, sn)
+		return true
+	}
+	return false
+}
+
+// run delivers the queued packets until the subscriber is closed
+func (s *LocalSubscriber) run() {
+	defer func() {
+		if s.packets != nil {
+			close(s.packets)
+		}
+		if s.frames != nil {
+			close(s.frames)
+		}
+	}()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case ext := <-s.queue:
+			s.push(ext)
+		}
+	}
+}
+
+// push reorders the packets, a missing packet is lost when it was dropped by
+// the queue or when MaxLate newer packets are received
+func (s *LocalSubscriber) push(ext *buffer.ExtPacket) {
+	if !s.started {
+		s.started = true
+		// The packets dropped before the first one are never waited for
+		s.dropMu.Lock()
+		s.drops = make(map[uint16]struct{})
+		s.dropMu.Unlock()
+	}
+	s.jitter.Push(ext, s.deliver)
+}
+
+func (s *LocalSubscriber) deliver(ext *buffer.ExtPacket, lost bool) {
+	if lost && s.video {
+		s.RequestKeyFrame()
+	}
+	if !s.config.Frames {
+		if s.config.OnPacket != nil {
+			s.config.OnPacket(ext)
+			return
+		}
+		select {
+		case s.packets <- ext:
+		case <-s.closeCh:
+		}
+		return
+	}
+
+	// The video frames are dropped until the next keyframe after a loss
+	s.assembler.Push(&ext.Packet, lost, func(f recorder.Frame) {
+		if s.config.OnFrame != nil {
+			s.config.OnFrame(f)
+			return
+		}
+		select {
+		case s.frames <- f:
+		case <-s.closeCh:
+		}
+	})
+}
+
+// localTrackWriter writes the packets of a down track to a local subscriber
+type localTrackWriter struct {
+	s *LocalSubscriber
+}
+
+func (w localTrackWriter) WriteRTP(hdr *rtp.Header, payload []byte) (int, error) {
+	// The payload and the extensions are in the buffer of the receiver
+	raw, err := (&rtp.Packet{Header: *hdr, Payload: payload}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return len(payload), w.s.write(raw)
+}
+
+func (w localTrackWriter) Write(b []byte) (int, error) {
+	return len(b), w.s.write(append([]byte(nil), b...))
+}
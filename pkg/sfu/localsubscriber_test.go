@@ -0,0 +1,204 @@
+package sfu
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/ion-sfu/pkg/recorder"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalSubscriber_Packets(t *testing.T) {
+	s := NewSFU(newTestConfig())
+	in, err := NewPlainTransport(s, "local", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer in.Close()
+	assert.NoError(t, in.Publish(plainTestTrack))
+	sender, err := net.DialUDP("udp", nil, in.LocalAddr())
+	assert.NoError(t, err)
+	defer sender.Close()
+	_, _ = sender.Write(plainTestPacket(1))
+	session, _ := s.GetSession("local")
+	defer session.(*SessionLocal).Close()
+	recv := waitReceiver(session, "ffmpeg", "audio")
+	if !assert.NotNil(t, recv) {
+		return
+	}
+
+	sub, err := session.NewLocalSubscriber(recv, LocalSubscriberConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+	assert.Nil(t, sub.Frames())
+	// Packet 3 is received before packet 2
+	for _, sn := range []uint16{1, 3, 2, 4} {
+		_, _ = sender.Write(plainTestPacket(sn + 1))
+		time.Sleep(5 * time.Millisecond)
+	}
+	var pkts []*buffer.ExtPacket
+	for len(pkts) < 4 {
+		select {
+		case pkt := <-sub.Packets():
+			pkts = append(pkts, pkt)
+		case <-time.After(time.Second):
+			t.Fatal("packets not received")
+		}
+	}
+	for i, pkt := range pkts {
+		assert.Equal(t, pkts[0].Packet.SequenceNumber+uint16(i), pkt.Packet.SequenceNumber)
+		assert.NotEqual(t, uint32(5678), pkt.Packet.SSRC)
+		assert.Equal(t, []byte{0xfc, 0x01, 0x02}, pkt.Packet.Payload)
+	}
+	// Packet 3 arrived after packet 4
+	assert.False(t, pkts[1].Head)
+	assert.True(t, pkts[2].Head)
+
+	// The subscriber is closed when the track is unpublished
+	assert.NoError(t, in.Close())
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscriber not closed")
+	}
+	assert.Eventually(t, func() bool {
+		_, ok := <-sub.Packets()
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLocalSubscriber_Frames(t *testing.T) {
+	s := NewSFU(newTestConfig())
+	in, err := NewPlainTransport(s, "local", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer in.Close()
+	assert.NoError(t, in.Publish(TrackParams{
+		TrackID:  "video",
+		StreamID: "camera",
+		Codec: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			PayloadType:        96,
+		},
+		SSRC: 1234,
+	}))
+	sender, err := net.DialUDP("udp", nil, in.LocalAddr())
+	assert.NoError(t, err)
+	defer sender.Close()
+	send := func(sn uint16) {
+		b, _ := (&rtp.Packet{
+			Header:  rtp.Header{Version: 2, Marker: true, PayloadType: 96, SequenceNumber: sn, Timestamp: uint32(sn) * 3000, SSRC: 1234},
+			Payload: []byte{0x10, 0x00, 0x00, 0x9d, 0x01, 0x2a, byte(sn)},
+		}).Marshal()
+		_, _ = sender.Write(b)
+		time.Sleep(5 * time.Millisecond)
+	}
+	send(1)
+	session, _ := s.GetSession("local")
+	defer session.(*SessionLocal).Close()
+	recv := waitReceiver(session, "camera", "video")
+	if !assert.NotNil(t, recv) {
+		return
+	}
+
+	frames := make(chan recorder.Frame, 10)
+	sub, err := session.NewLocalSubscriber(recv, LocalSubscriberConfig{OnFrame: func(f recorder.Frame) { frames <- f }})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+	assert.Nil(t, sub.Packets())
+	assert.Nil(t, sub.Frames())
+	for sn := uint16(2); sn < 5; sn++ {
+		send(sn)
+	}
+	// The first packet may still be forwarded by the receiver
+	for last := byte(0); last < 4; {
+		select {
+		case f := <-frames:
+			assert.True(t, f.KeyFrame)
+			assert.Equal(t, []byte{0x00, 0x00, 0x9d, 0x01, 0x2a}, f.Data[:5])
+			if last > 0 {
+				assert.Equal(t, last+1, f.Data[5])
+			}
+			last = f.Data[5]
+		case <-time.After(time.Second):
+			t.Fatal("frame not received")
+		}
+	}
+}
+
+func TestLocalSubscriber_BackPressure(t *testing.T) {
+	s := NewSFU(newTestConfig())
+	in, err := NewPlainTransport(s, "local", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer in.Close()
+	assert.NoError(t, in.Publish(plainTestTrack))
+	sender, err := net.DialUDP("udp", nil, in.LocalAddr())
+	assert.NoError(t, err)
+	defer sender.Close()
+	_, _ = sender.Write(plainTestPacket(1))
+	session, _ := s.GetSession("local")
+	defer session.(*SessionLocal).Close()
+	recv := waitReceiver(session, "ffmpeg", "audio")
+	if !assert.NotNil(t, recv) {
+		return
+	}
+
+	// The consumer does not read, the receiver is not blocked
+	sub, err := session.NewLocalSubscriber(recv, LocalSubscriberConfig{QueueSize: 2, MaxLate: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Close()
+	for sn := uint16(2); sn < 12; sn++ {
+		_, _ = sender.Write(plainTestPacket(sn))
+	}
+	assert.Eventually(t, func() bool { return sub.Dropped() > 0 }, time.Second, 10*time.Millisecond)
+
+	other, err := session.NewLocalSubscriber(recv, LocalSubscriberConfig{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer other.Close()
+	_, _ = sender.Write(plainTestPacket(12))
+	select {
+	case pkt := <-other.Packets():
+		assert.NotNil(t, pkt)
+	case <-time.After(time.Second):
+		t.Fatal("packet not received")
+	}
+	assert.NoError(t, sub.Close())
+	assert.NoError(t, other.Close())
+	assert.Empty(t, recv.(*WebRTCReceiver).downTracks[0].Load().([]*DownTrack))
+}
+
+func TestLocalSubscriber_push(t *testing.T) {
+	var delivered []uint16
+	s := &LocalSubscriber{
+		config: LocalSubscriberConfig{QueueSize: 1, MaxLate: 50, OnPacket: func(pkt *buffer.ExtPacket) {
+			delivered = append(delivered, pkt.Packet.SequenceNumber)
+		}},
+		queue:  make(chan *buffer.ExtPacket, 1),
+		drops:  make(map[uint16]struct{}),
+		jitter: recorder.NewJitterBuffer(50),
+	}
+	s.jitter.OnMissing(s.takeDrop)
+	write := func(sn uint16) {
+		assert.NoError(t, s.write(plainTestPacket(sn)))
+	}
+	write(1)
+	s.push(<-s.queue)
+	// Packet 3 is dropped by the full queue, the gap is not waited for
+	write(2)
+	write(3)
+	s.push(<-s.queue)
+	write(4)
+	s.push(<-s.queue)
+	assert.Equal(t, []uint16{1, 2, 4}, delivered)
+	assert.Equal(t, uint64(1), s.Dropped())
+	assert.Empty(t, s.drops)
+}
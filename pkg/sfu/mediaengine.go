@@ -2,13 +2,17 @@
 【ファイル概要: mediaengine.go】
 MediaEngineの設定と初期化。
 
-サポートするコーデック（Opus、VP8、VP9、H264）と
-RTPヘッダー拡張（TWCC、AudioLevel、StreamIDなど）を登録します。
+サポートするコーデック（Opus、Opus RED、VP8、VP9、H264、H265、AV1とそれぞれのRTX）と
+RTPヘッダー拡張（TWCC、AudioLevel、StreamID、AV1 Dependency Descriptorなど）を登録します。
 パブリッシャーとサブスクライバーで異なる設定を使用します。
+サブスクライバーには設定に応じてFlexFECを登録します。
 */
 package sfu
 
 import (
+	"fmt"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
 	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 )
@@ -29,6 +33,9 @@ func getPublisherMediaEngine() (*webrtc.MediaEngine, error) {
 	}, webrtc.RTPCodecTypeAudio); err != nil {
 		return nil, err
 	}
+	if err := me.RegisterCodec(redCodec(111), webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
 
 	videoRTCPFeedback := []webrtc.RTCPFeedback{
 		{Type: webrtc.TypeRTCPFBGoogREMB, Parameter: ""},
@@ -69,17 +76,39 @@ func getPublisherMediaEngine() (*webrtc.MediaEngine, error) {
 			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: videoRTCPFeedback},
 			PayloadType:        123,
 		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, SDPFmtpLine: "profile-id=1", RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        116,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        35,
+		},
 	} {
 		if err := me.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
 		}
 	}
+	// RTX (RFC 4588) of every video codec
+	for _, rtx := range []struct{ pt, apt webrtc.PayloadType }{
+		{97, 96}, {99, 98}, {101, 100}, {121, 102}, {120, 127},
+		{107, 125}, {109, 108}, {118, 123}, {117, 116}, {36, 35},
+	} {
+		if err := me.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRTX, ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", rtx.apt)},
+			PayloadType:        rtx.pt,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
 
 	for _, extension := range []string{
 		sdp.SDESMidURI,
 		sdp.SDESRTPStreamIDURI,
+		repairedRTPStreamIDURI,
 		sdp.TransportCCURI,
 		frameMarking,
+		buffer.DependencyDescriptorURI,
 	} {
 		if err := me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
@@ -98,7 +127,23 @@ func getPublisherMediaEngine() (*webrtc.MediaEngine, error) {
 	return me, nil
 }
 
-func getSubscriberMediaEngine() (*webrtc.MediaEngine, error) {
+func getSubscriberMediaEngine(transportCC, fec bool) (*webrtc.MediaEngine, error) {
 	me := &webrtc.MediaEngine{}
+	if fec {
+		if err := me.RegisterCodec(flexFECCodec(), webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+	// Layers of AV1 streams are described by the dependency descriptor
+	if err := me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: buffer.DependencyDescriptorURI}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	if transportCC {
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			if err := me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return me, nil
 }
@@ -0,0 +1,144 @@
+/*
+【ファイル概要: packetmiddleware.go】
+RTPパケットのミドルウェアチェーンの実装。
+
+データチャネルのミドルウェア（datachannel.go）と同じパターンをRTPパケットに適用し、
+転送経路の2か所にフックを提供します。
+
+【フック】
+1. Ingress
+   - パブリッシャーのBufferから読み出したパケット（ReadExtendedの後）
+   - 全ダウントラックへの書き込みの前に実行
+   - GOPキャッシュはバッファから読み直すため、ミドルウェアを使う場合は無効
+   - パケットの変更は全サブスクライバーに反映される
+   - NACKによる再送はバッファのパケットを送るため、ミドルウェアの変更は反映されない
+
+2. Egress
+   - ダウントラックがサブスクライバーに書き込むパケット
+     （SSRC・シーケンス番号の書き換え後、transport-cc付与の前）
+   - RTX、パディング、パラメータセットのパケットも含む（FECパケットは含まない）
+   - ペイロードは他のダウントラックと共有されるため、変更する場合はコピーが必要
+
+【ミドルウェアの動作】
+- next.ProcessPacketを呼ばない: パケットを破棄
+  （破棄したパケットの分だけダウントラックのシーケンス番号をずらし、
+  サブスクライバーにギャップを残さない）
+- 引数を変更して呼ぶ: パケットを変更
+- 複数回呼ぶ: パケットを複製（Egressのみ。Ingressでは同じシーケンス番号の
+  パケットになるため、2回目以降の呼び出しは無視）
+
+【スレッドセーフティ】
+Ingressはレイヤーごとのゴルーチン、Egressは各ダウントラックの書き込みから並行して呼ばれます。
+*/
+package sfu
+
+import (
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+)
+
+type (
+	// PacketArgs is the RTP packet processed by the packet middlewares
+	PacketArgs struct {
+		// Receiver of the published track
+		Receiver Receiver
+		// DownTrack writing the packet, nil on ingress
+		DownTrack *DownTrack
+		// Layer of the published track the packet was read from, on ingress
+		Layer int
+		// Packet read from the publisher, on ingress
+		Packet *buffer.ExtPacket
+		// Header and Payload written to the subscriber, on egress
+		Header  *rtp.Header
+		Payload []byte
+
+		// written is set when the packet reaches the end of the chain, the
+		// middlewares must pass the args they received to next, modified or not
+		written *bool
+	}
+
+	PacketProcessor interface {
+		ProcessPacket(args PacketArgs) error
+	}
+
+	PacketProcessFunc func(args PacketArgs) error
+
+	// PacketMiddleware wraps the processing of the RTP packets forwarded by the
+	// SFU. A middleware can inspect or modify the packet, drop it by not calling
+	// next, or duplicate it on egress by calling next more than once.
+	PacketMiddleware interface {
+		// Ingress wraps the packets read from the publisher buffers, next
+		// forwards a packet once. Retransmissions are read from the buffers
+		// without the changes of the middlewares.
+		Ingress(next PacketProcessor) PacketProcessor
+		// Egress wraps the packets written by the down tracks
+		Egress(next PacketProcessor) PacketProcessor
+	}
+
+	// PacketMiddlewareFuncs implements a PacketMiddleware with functions, a nil
+	// function leaves the hook untouched.
+	PacketMiddlewareFuncs struct {
+		IngressFunc func(next PacketProcessor) PacketProcessor
+		EgressFunc  func(next PacketProcessor) PacketProcessor
+	}
+)
+
+func (p PacketProcessFunc) ProcessPacket(args PacketArgs) error {
+	return p(args)
+}
+
+func (m PacketMiddlewareFuncs) Ingress(next PacketProcessor) PacketProcessor {
+	if m.IngressFunc == nil {
+		return next
+	}
+	return m.IngressFunc(next)
+}
+
+func (m PacketMiddlewareFuncs) Egress(next PacketProcessor) PacketProcessor {
+	if m.EgressFunc == nil {
+		return next
+	}
+	return m.EgressFunc(next)
+}
+
+// chainIngress returns the ingress processor of the middlewares, the first
+// middleware processes the packets first. Returns nil without middlewares.
+func chainIngress(mws []PacketMiddleware, last PacketProcessor) PacketProcessor {
+	if len(mws) == 0 {
+		return nil
+	}
+	h := last
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i].Ingress(h)
+	}
+	return h
+}
+
+// chainEgress returns the egress processor of the middlewares, the first
+// middleware processes the packets first. Returns nil without middlewares.
+func chainEgress(mws []PacketMiddleware, last PacketProcessor) PacketProcessor {
+	if len(mws) == 0 {
+		return nil
+	}
+	h := last
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i].Egress(h)
+	}
+	return h
+}
+
+// UsePacketMiddlewares processes the packets read from the publisher buffers
+// with the middlewares, must be called before the up tracks are added. The
+// GOP cache is disabled with middlewares.
+func (w *WebRTCReceiver) UsePacketMiddlewares(mws ...PacketMiddleware) {
+	w.ingress = chainIngress(mws, PacketProcessFunc(w.forwardRTP))
+	if w.ingress != nil {
+		w.gopCaches = [3]*gopCache{}
+	}
+}
+
+// UsePacketMiddlewares processes the packets written by the down track with
+// the middlewares, must be called before the down track is bound.
+func (d *DownTrack) UsePacketMiddlewares(mws ...PacketMiddleware) {
+	d.egress = chainEgress(mws, PacketProcessFunc(d.sendRTP))
+}
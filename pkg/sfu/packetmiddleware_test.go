@@ -0,0 +1,164 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownTrack_UsePacketMiddlewares(t *testing.T) {
+	var order []string
+	trace := func(name string) PacketMiddleware {
+		return PacketMiddlewareFuncs{
+			EgressFunc: func(next PacketProcessor) PacketProcessor {
+				return PacketProcessFunc(func(args PacketArgs) error {
+					order = append(order, name)
+					return next.ProcessPacket(args)
+				})
+			},
+		}
+	}
+	// Drops odd sequence numbers and duplicates marker packets
+	filter := PacketMiddlewareFuncs{
+		EgressFunc: func(next PacketProcessor) PacketProcessor {
+			return PacketProcessFunc(func(args PacketArgs) error {
+				if args.Header.SequenceNumber%2 == 1 {
+					return nil
+				}
+				if args.Header.Marker {
+					dup := *args.Header
+					if err := next.ProcessPacket(PacketArgs{DownTrack: args.DownTrack, Header: &dup, Payload: args.Payload}); err != nil {
+						return err
+					}
+				}
+				return next.ProcessPacket(args)
+			})
+		},
+	}
+	rewrite := PacketMiddlewareFuncs{
+		EgressFunc: func(next PacketProcessor) PacketProcessor {
+			return PacketProcessFunc(func(args PacketArgs) error {
+				args.Payload = append([]byte{0xff}, args.Payload...)
+				return next.ProcessPacket(args)
+			})
+		},
+	}
+
+	w := &probeTestWriter{}
+	d := &DownTrack{ssrc: 1234, writeStream: w}
+	d.UsePacketMiddlewares(trace("first"), trace("second"), filter, rewrite)
+
+	for sn := uint16(10); sn < 13; sn++ {
+		hdr := rtp.Header{SequenceNumber: sn, SSRC: 1234, Marker: sn == 12}
+		assert.NoError(t, d.writeRTP(&hdr, []byte{byte(sn)}))
+	}
+
+	assert.Equal(t, []string{"first", "second", "first", "second", "first", "second"}, order)
+	assert.Len(t, w.headers, 3)
+	assert.Equal(t, uint16(10), w.headers[0].SequenceNumber)
+	assert.Equal(t, uint16(12), w.headers[1].SequenceNumber)
+	assert.Equal(t, uint16(12), w.headers[2].SequenceNumber)
+	assert.Equal(t, []byte{0xff, 10}, w.payloads[0])
+	assert.Equal(t, []byte{0xff, 12}, w.payloads[2])
+}
+
+func TestDownTrack_PacketMiddlewareDrop(t *testing.T) {
+	// Drops the packets of the source sequence number 101
+	drop := PacketMiddlewareFuncs{
+		EgressFunc: func(next PacketProcessor) PacketProcessor {
+			return PacketProcessFunc(func(args PacketArgs) error {
+				if args.Payload[0] == 101 {
+					return nil
+				}
+				return next.ProcessPacket(args)
+			})
+		},
+	}
+	w := &probeTestWriter{}
+	d := &DownTrack{
+		ssrc:        1234,
+		mime:        "audio/opus",
+		codec:       webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		writeStream: w,
+		trackType:   SimpleDownTrack,
+	}
+	d.bound.set(true)
+	d.enabled.set(true)
+	d.UsePacketMiddlewares(drop)
+
+	pkt := func(sn uint16) *buffer.ExtPacket {
+		return &buffer.ExtPacket{
+			Head: true,
+			Packet: rtp.Packet{
+				Header:  rtp.Header{SequenceNumber: sn, SSRC: 5678},
+				Payload: []byte{byte(sn)},
+			},
+		}
+	}
+	assert.NoError(t, d.WriteRTP(pkt(100), 0))
+	assert.NoError(t, d.WriteRTP(pkt(101), 0))
+	assert.NoError(t, d.WriteRTP(pkt(102), 0))
+	// Dropped by an ingress middleware
+	d.skipRTP(pkt(103), 0)
+	assert.NoError(t, d.WriteRTP(pkt(104), 0))
+
+	var sns []uint16
+	for _, hdr := range w.headers {
+		sns = append(sns, hdr.SequenceNumber)
+	}
+	assert.Equal(t, []uint16{100, 101, 102}, sns)
+	assert.Equal(t, uint16(102), d.lastSN)
+}
+
+func TestWebRTCReceiver_UsePacketMiddlewares(t *testing.T) {
+	dup := PacketMiddlewareFuncs{
+		IngressFunc: func(next PacketProcessor) PacketProcessor {
+			return PacketProcessFunc(func(args PacketArgs) error {
+				if err := next.ProcessPacket(args); err != nil {
+					return err
+				}
+				return next.ProcessPacket(args)
+			})
+		},
+	}
+	w := &probeTestWriter{}
+	d := &DownTrack{
+		ssrc:        1234,
+		mime:        "audio/opus",
+		codec:       webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		writeStream: w,
+		trackType:   SimpleDownTrack,
+	}
+	d.bound.set(true)
+	d.enabled.set(true)
+	r := &WebRTCReceiver{}
+	r.downTracks[0].Store([]*DownTrack{d})
+	r.UsePacketMiddlewares(dup)
+
+	written := false
+	pkt := &buffer.ExtPacket{
+		Head:   true,
+		Packet: rtp.Packet{Header: rtp.Header{SequenceNumber: 100, SSRC: 5678}, Payload: []byte{0x01}},
+	}
+	assert.NoError(t, r.ingress.ProcessPacket(PacketArgs{Receiver: r, Packet: pkt, written: &written}))
+	// Ingress does not duplicate the packets
+	assert.True(t, written)
+	assert.Len(t, w.headers, 1)
+}
+
+func TestPacketMiddlewareFuncs(t *testing.T) {
+	var called bool
+	last := PacketProcessFunc(func(args PacketArgs) error {
+		called = true
+		return nil
+	})
+	assert.Nil(t, chainIngress(nil, last))
+
+	// Middlewares without an ingress hook pass the packets through
+	p := chainIngress([]PacketMiddleware{PacketMiddlewareFuncs{}}, last)
+	assert.NoError(t, p.ProcessPacket(PacketArgs{}))
+	assert.True(t, called)
+}
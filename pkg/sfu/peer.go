@@ -49,6 +49,8 @@ var (
 	ErrNoTransportEstablished = errors.New("no rtc transport exists for this Peer")
 	// ErrOfferIgnored if offer received in unstable state
 	ErrOfferIgnored = errors.New("offered ignored")
+	// ErrRemoteOfferNotAllowed subscriber offer from a peer not joined with RemoteSubscriberOffer
+	ErrRemoteOfferNotAllowed = errors.New("remote subscriber offer not allowed for this Peer")
 )
 
 type Peer interface {
@@ -71,6 +73,11 @@ type JoinConfig struct {
 	// to customize the subscrbe stream combination as needed.
 	// this parameter depends on NoSubscribe=false.
 	NoAutoSubscribe bool
+	// If true the peer creates the offers of the subscriber transport and the
+	// SFU answers them with AnswerSubscriber, as WHEP players expect. The SFU
+	// does not offer, so tracks added after the last offer are only sent after
+	// the next one. this parameter depends on NoSubscribe=false.
+	RemoteSubscriberOffer bool
 }
 
 // SessionProvider provides the SessionLocal to the sfu.Peer
@@ -99,8 +106,9 @@ type PeerLocal struct {
 	OnIceCandidate             func(*webrtc.ICECandidateInit, int)
 	OnICEConnectionStateChange func(webrtc.ICEConnectionState)
 
-	remoteAnswerPending bool
-	negotiationPending  bool
+	remoteAnswerPending   bool
+	negotiationPending    bool
+	remoteSubscriberOffer bool
 }
 
 // NewPeer creates a new PeerLocal for signaling with the given SFU
@@ -138,11 +146,17 @@ func (p *PeerLocal) Join(sid, uid string, config ...JoinConfig) error {
 		}
 
 		p.subscriber.noAutoSubscribe = conf.NoAutoSubscribe
+		p.remoteSubscriberOffer = conf.RemoteSubscriberOffer
 
 		p.subscriber.OnNegotiationNeeded(func() {
 			p.Lock()
 			defer p.Unlock()
 
+			if p.remoteSubscriberOffer {
+				Logger.V(1).Info("Negotiation needed, waiting for remote offer", "peer_id", p.id)
+				return
+			}
+
 			if p.remoteAnswerPending {
 				p.negotiationPending = true
 				return
@@ -173,6 +187,14 @@ func (p *PeerLocal) Join(sid, uid string, config ...JoinConfig) error {
 				p.OnIceCandidate(&json, subscriber)
 			}
 		})
+
+		if conf.NoPublish {
+			p.subscriber.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+				if p.OnICEConnectionStateChange != nil && !p.closed.get() {
+					p.OnICEConnectionStateChange(s)
+				}
+			})
+		}
 	}
 
 	if !conf.NoPublish {
@@ -239,6 +261,34 @@ func (p *PeerLocal) Answer(sdp webrtc.SessionDescription) (*webrtc.SessionDescri
 	return &answer, nil
 }
 
+// AnswerSubscriber answers an offer of the subscriber transport from remote,
+// for peers joined with RemoteSubscriberOffer
+func (p *PeerLocal) AnswerSubscriber(sdp webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if p.subscriber == nil {
+		return nil, ErrNoTransportEstablished
+	}
+	if !p.remoteSubscriberOffer {
+		return nil, ErrRemoteOfferNotAllowed
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	Logger.V(0).Info("PeerLocal got subscriber offer", "peer_id", p.id)
+
+	if p.subscriber.SignalingState() != webrtc.SignalingStateStable {
+		return nil, ErrOfferIgnored
+	}
+
+	answer, err := p.subscriber.Answer(sdp)
+	if err != nil {
+		return nil, fmt.Errorf("error creating answer: %v", err)
+	}
+
+	Logger.V(0).Info("PeerLocal send subscriber answer", "peer_id", p.id)
+
+	return &answer, nil
+}
+
 // SetRemoteDescription when receiving an answer from remote
 func (p *PeerLocal) SetRemoteDescription(sdp webrtc.SessionDescription) error {
 	if p.subscriber == nil {
@@ -0,0 +1,61 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerLocal_AnswerSubscriber(t *testing.T) {
+	s := NewSFU(newTestConfig())
+
+	viewer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.NoError(t, err)
+	defer viewer.Close()
+	_, err = viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	assert.NoError(t, err)
+	offer, err := viewer.CreateOffer(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, viewer.SetLocalDescription(offer))
+
+	p := NewPeer(s)
+	assert.NoError(t, p.Join("session", "peer", JoinConfig{NoPublish: true}))
+	_, err = p.AnswerSubscriber(offer)
+	assert.Equal(t, ErrRemoteOfferNotAllowed, err)
+	assert.NoError(t, p.Close())
+
+	p = NewPeer(s)
+	p.OnOffer = func(*webrtc.SessionDescription) {
+		t.Error("unexpected offer from the SFU")
+	}
+	assert.NoError(t, p.Join("session", "viewer", JoinConfig{NoPublish: true, RemoteSubscriberOffer: true}))
+	defer p.Close()
+	_, err = p.Answer(offer)
+	assert.Equal(t, ErrNoTransportEstablished, err)
+
+	// Down track of a published track, added the way the router does
+	sub := p.Subscriber()
+	recv := newRecorderTestReceiver()
+	assert.NoError(t, sub.me.RegisterCodec(recv.Codec(), webrtc.RTPCodecTypeAudio))
+	dt, err := NewDownTrack(recv.Codec().RTPCodecCapability, recv, buffer.NewBufferFactory(100, Logger), sub.id, 100)
+	assert.NoError(t, err)
+	dt.transceiver, err = sub.pc.AddTransceiverFromTrack(dt, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	assert.NoError(t, err)
+	sub.AddDownTrack(recv.StreamID(), dt)
+
+	answer, err := p.AnswerSubscriber(offer)
+	assert.NoError(t, err)
+	if assert.NotNil(t, answer) {
+		assert.Equal(t, webrtc.SDPTypeAnswer, answer.Type)
+		assert.Contains(t, answer.SDP, "a=sendonly")
+		assert.NoError(t, viewer.SetRemoteDescription(*answer))
+	}
+	assert.Equal(t, webrtc.SignalingStateStable, sub.SignalingState())
+	assert.Equal(t, sub.pc.GetTransceivers()[0], dt.transceiver)
+}
@@ -0,0 +1,662 @@
+/*
+【ファイル概要: plaintransport.go】
+ICE/DTLSを使わないプレーンなRTP/UDPトランスポート（mediasoupのPlainTransport相当）。
+同じホストのFFmpeg/GStreamerパイプラインとのメディアの受け渡しに使用します。
+
+【主要な役割】
+1. 取り込み（Publish）
+   - UDPポートで暗号化なし、またはSDES-SRTPのRTPを受信
+   - コーデックなどのパラメータはSDPではなくAPI（TrackParams）で指定
+   - SSRCでトラックを振り分け（SSRC未指定のトラックは最初のパケットの
+     ペイロードタイプで対応付け）
+   - ピアを持たないルーターのレシーバーとしてセッションに公開
+
+2. 送出（Forward）
+   - セッションのトラックのダウントラックを作成し、接続先のホスト:ポートへ送信
+   - SSRC、シーケンス番号、タイムスタンプの書き換えとキーフレームからの開始は
+     通常のダウントラックと同じ
+
+3. RTCP
+   - RTCP多重化（rtcp-mux）、または別ソケットのRTCP
+   - 取り込みトラックのNACK・PLIなどを送信し、Sender Reportを受信
+   - 送出トラックのPLI・NACK・Receiver Reportをダウントラックで処理し、
+     Sender Reportを定期的に送信
+
+4. 接続先
+   - Connectで指定したアドレス、またはComediaでは取り込みトラック（または待機中の
+     トラック）に一致した最初のパケットの送信元
+   - 接続先が決まった後は、接続先以外から届いたRTP/RTCPを破棄
+*/
+package sfu
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// SRTP crypto suites of the plain transports
+const (
+	SRTPCryptoSuiteAESCM128HMACSHA180 = "AES_CM_128_HMAC_SHA1_80"
+	SRTPCryptoSuiteAEADAES128GCM      = "AEAD_AES_128_GCM"
+)
+
+const (
+	plainReceiveMTU     = 1500
+	plainReportInterval = 5 * time.Second
+)
+
+var (
+	errUnsupportedCryptoSuite = errors.New("unsupported srtp crypto suite")
+	errInvalidSRTPKey         = errors.New("invalid srtp key length")
+	errMissingSRTPParameters  = errors.New("srtp parameters of the remote endpoint required")
+	errPlainTransportClosed   = errors.New("plain transport closed")
+	errPlainTrackExists       = errors.New("ssrc or payload type already published on the plain transport")
+)
+
+// PlainTransportConfig defines a plain RTP transport
+type PlainTransportConfig struct {
+	// ListenIP of the UDP sockets, all the interfaces when empty
+	ListenIP string
+	// Port of the RTP socket, a random port when zero
+	Port int
+	// NoRTCPMux receives and sends RTCP on a second socket instead of the RTP one
+	NoRTCPMux bool
+	// RTCPPort of the RTCP socket with NoRTCPMux, a random port when zero
+	RTCPPort int
+	// Comedia sends to the address of the first packets received instead of
+	// the address of Connect
+	Comedia bool
+	// SRTPCryptoSuite enables SDES-SRTP, plain RTP when empty
+	SRTPCryptoSuite string
+}
+
+// SRTPParameters are the SDES keying of an endpoint
+type SRTPParameters struct {
+	CryptoSuite string `json:"cryptoSuite"`
+	// KeyBase64 is the master key followed by the master salt
+	KeyBase64 string `json:"keyBase64"`
+}
+
+// PlainConnectConfig is the remote endpoint of a plain transport
+type PlainConnectConfig struct {
+	IP   string
+	Port int
+	// RTCPPort of the remote endpoint with NoRTCPMux, Port + 1 when zero
+	RTCPPort int
+	// SRTP keying of the remote endpoint, required when SRTP is enabled
+	SRTP *SRTPParameters
+}
+
+// PlainTransport sends and receives the RTP packets of a session on UDP
+// sockets, without ICE and DTLS
+type PlainTransport struct {
+	sync.RWMutex
+	id      string
+	session Session
+	router  *router
+	config  PlainTransportConfig
+
+	conn       *net.UDPConn
+	rtcpConn   *net.UDPConn
+	remote     *net.UDPAddr
+	remoteRTCP *net.UDPAddr
+
+	srtpMu    sync.Mutex
+	localSRTP *SRTPParameters
+	encrypt   *srtp.Context
+	decrypt   *srtp.Context
+
+	// ingress buffers by SSRC, and the tracks waiting for their first packet by payload type
+	ingress map[uint32]*buffer.Buffer
+	pending map[uint8]TrackParams
+	egress  map[uint32]*DownTrack
+
+	closed atomicBool
+}
+
+// NewPlainTransport creates a plain transport publishing to and forwarding
+// from the session
+func NewPlainTransport(provider SessionProvider, sid string, c PlainTransportConfig) (*PlainTransport, error) {
+	t := &PlainTransport{
+		id:      cuid.New(),
+		config:  c,
+		ingress: make(map[uint32]*buffer.Buffer),
+		pending: make(map[uint8]TrackParams),
+		egress:  make(map[uint32]*DownTrack),
+	}
+
+	if c.SRTPCryptoSuite != "" {
+		profile, keyLen, err := srtpProfile(c.SRTPCryptoSuite)
+		if err != nil {
+			return nil, err
+		}
+		key := make([]byte, keyLen)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if t.encrypt, err = newSRTPContext(key, profile); err != nil {
+			return nil, err
+		}
+		t.localSRTP = &SRTPParameters{CryptoSuite: c.SRTPCryptoSuite, KeyBase64: base64.StdEncoding.EncodeToString(key)}
+	}
+
+	ip := net.ParseIP(c.ListenIP)
+	var err error
+	if t.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: c.Port}); err != nil {
+		return nil, err
+	}
+	if c.NoRTCPMux {
+		if t.rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: c.RTCPPort}); err != nil {
+			_ = t.conn.Close()
+			return nil, err
+		}
+	}
+
+	session, cfg := provider.GetSession(sid)
+	t.session = session
+	t.router = newRouter(t.id, session, &cfg).(*router)
+	t.router.SetRTCPWriter(t.writeRTCP)
+	session.AddRouter(t.router)
+
+	go t.readLoop(t.conn, false)
+	if t.rtcpConn != nil {
+		go t.readLoop(t.rtcpConn, true)
+	}
+	go t.sendReports()
+
+	Logger.V(0).Info("Plain transport created", "transport_id", t.id, "session_id", sid, "addr", t.conn.LocalAddr().String())
+	return t, nil
+}
+
+// ID of the transport, also the id of its router in the session
+func (t *PlainTransport) ID() string {
+	return t.id
+}
+
+// LocalAddr of the RTP socket
+func (t *PlainTransport) LocalAddr() *net.UDPAddr {
+	return t.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// LocalRTCPAddr of the RTCP socket, the RTP one with RTCP multiplexing
+func (t *PlainTransport) LocalRTCPAddr() *net.UDPAddr {
+	if t.rtcpConn != nil {
+		return t.rtcpConn.LocalAddr().(*net.UDPAddr)
+	}
+	return t.LocalAddr()
+}
+
+// SRTPParameters returns the keying of the transport for the remote endpoint,
+// nil without SRTP
+func (t *PlainTransport) SRTPParameters() *SRTPParameters {
+	return t.localSRTP
+}
+
+// Connect sets the remote endpoint the packets are sent to, and its SRTP keying
+func (t *PlainTransport) Connect(c PlainConnectConfig) error {
+	if t.closed.get() {
+		return errPlainTransportClosed
+	}
+	if t.localSRTP != nil {
+		if c.SRTP == nil {
+			return errMissingSRTPParameters
+		}
+		profile, keyLen, err := srtpProfile(c.SRTP.CryptoSuite)
+		if err != nil {
+			return err
+		}
+		key, err := base64.StdEncoding.DecodeString(c.SRTP.KeyBase64)
+		if err != nil {
+			return err
+		}
+		if len(key) != keyLen {
+			return errInvalidSRTPKey
+		}
+		ctx, err := newSRTPContext(key, profile)
+		if err != nil {
+			return err
+		}
+		t.srtpMu.Lock()
+		t.decrypt = ctx
+		t.srtpMu.Unlock()
+	}
+
+	if c.IP == "" {
+		return nil
+	}
+	ip := net.ParseIP(c.IP)
+	t.Lock()
+	t.remote = &net.UDPAddr{IP: ip, Port: c.Port}
+	if t.rtcpConn == nil {
+		t.remoteRTCP = t.remote
+	} else if c.RTCPPort != 0 {
+		t.remoteRTCP = &net.UDPAddr{IP: ip, Port: c.RTCPPort}
+	} else {
+		t.remoteRTCP = &net.UDPAddr{IP: ip, Port: c.Port + 1}
+	}
+	t.Unlock()
+	return nil
+}
+
+// Publish publishes a track received on the transport to the session. The
+// track is published with its first packet when its SSRC is zero, the packets
+// are matched by the payload type of the codec.
+func (t *PlainTransport) Publish(p TrackParams) error {
+	if t.closed.get() {
+		return errPlainTransportClosed
+	}
+	t.Lock()
+	if p.SSRC == 0 {
+		pt := uint8(p.Codec.PayloadType)
+		if _, ok := t.pending[pt]; ok {
+			t.Unlock()
+			return errPlainTrackExists
+		}
+		t.pending[pt] = p
+		t.Unlock()
+		return nil
+	}
+	if _, ok := t.ingress[p.SSRC]; ok {
+		t.Unlock()
+		return errPlainTrackExists
+	}
+	recv, err := t.addReceiver(p)
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+	t.session.Publish(t.router, recv)
+	return nil
+}
+
+// addReceiver adds the receiver of a published track, the transport lock must be held
+func (t *PlainTransport) addReceiver(p TrackParams) (Receiver, error) {
+	recv, buff, err := t.router.addLocalReceiver(p)
+	if err != nil {
+		return nil, err
+	}
+	t.ingress[p.SSRC] = buff
+	buff.OnClose(func() {
+		t.Lock()
+		if t.ingress[p.SSRC] == buff {
+			delete(t.ingress, p.SSRC)
+		}
+		t.Unlock()
+	})
+	Logger.V(0).Info("Plain transport track published", "transport_id", t.id, "track_id", p.TrackID, "ssrc", p.SSRC)
+	return recv, nil
+}
+
+// Forward sends a track of the session to the remote endpoint, the returned
+// parameters describe the packets sent
+func (t *PlainTransport) Forward(streamID, trackID string) (TrackParams, error) {
+	if t.closed.get() {
+		return TrackParams{}, errPlainTransportClosed
+	}
+	recv := findReceiver(t.session, streamID, trackID)
+	if recv == nil {
+		return TrackParams{}, errNoReceiverFound
+	}
+
+	codec := recv.Codec()
+	var downTrack *DownTrack
+	downTrack, err := newLocalDownTrack(recv, plainTrackWriter{t}, t.id, t.router.config.MaxPacketTrack, func() {
+		t.Lock()
+		delete(t.egress, downTrack.ssrc)
+		t.Unlock()
+	})
+	if err != nil {
+		return TrackParams{}, err
+	}
+
+	t.Lock()
+	t.egress[downTrack.ssrc] = downTrack
+	t.Unlock()
+	recv.AddDownTrack(downTrack, t.router.config.Simulcast.BestQualityFirst)
+
+	sent := webrtc.RTPCodecParameters{
+		RTPCodecCapability: downTrack.codec,
+		PayloadType:        webrtc.PayloadType(downTrack.payloadType),
+	}
+	if downTrack.redUnwrap {
+		sent.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: codec.ClockRate, Channels: codec.Channels}
+	}
+	Logger.V(0).Info("Plain transport forwarding track", "transport_id", t.id, "track_id", trackID, "ssrc", downTrack.ssrc)
+	return TrackParams{
+		TrackID:  recv.TrackID(),
+		StreamID: recv.StreamID(),
+		Codec:    sent,
+		SSRC:     downTrack.ssrc,
+	}, nil
+}
+
+// Close stops the published and forwarded tracks and closes the sockets
+func (t *PlainTransport) Close() error {
+	if !t.closed.set(true) {
+		return nil
+	}
+	t.Lock()
+	buffers := make([]*buffer.Buffer, 0, len(t.ingress))
+	for _, buff := range t.ingress {
+		buffers = append(buffers, buff)
+	}
+	downTracks := make([]*DownTrack, 0, len(t.egress))
+	for _, dt := range t.egress {
+		downTracks = append(downTracks, dt)
+	}
+	t.Unlock()
+
+	for _, dt := range downTracks {
+		dt.receiver.DeleteDownTrack(dt.CurrentSpatialLayer(), dt.id)
+	}
+	for _, buff := range buffers {
+		_ = buff.Close()
+	}
+	t.router.Stop()
+	t.session.RemoveRouter(t.router)
+
+	err := t.conn.Close()
+	if t.rtcpConn != nil {
+		if rerr := t.rtcpConn.Close(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (t *PlainTransport) readLoop(conn *net.UDPConn, rtcpOnly bool) {
+	b := make([]byte, plainReceiveMTU)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			if !t.closed.get() {
+				Logger.Error(err, "Plain transport read err", "transport_id", t.id)
+			}
+			return
+		}
+		if rtcpOnly || isRTCPPacket(b[:n]) {
+			t.handleRTCP(b[:n], addr, rtcpOnly)
+		} else {
+			t.handleRTP(b[:n], addr)
+		}
+	}
+}
+
+func (t *PlainTransport) handleRTP(pkt []byte, addr *net.UDPAddr) {
+	t.RLock()
+	remote := t.remote
+	t.RUnlock()
+	if remote != nil && !sameUDPAddr(remote, addr) {
+		return
+	}
+	if t.localSRTP != nil {
+		t.srtpMu.Lock()
+		if t.decrypt == nil {
+			t.srtpMu.Unlock()
+			return
+		}
+		decrypted, err := t.decrypt.DecryptRTP(nil, pkt, nil)
+		t.srtpMu.Unlock()
+		if err != nil {
+			Logger.V(1).Info("Plain transport srtp decrypt err", "err", err)
+			return
+		}
+		pkt = decrypted
+	}
+	var hdr rtp.Header
+	if _, err := hdr.Unmarshal(pkt); err != nil {
+		return
+	}
+
+	t.Lock()
+	if t.remote != nil && !sameUDPAddr(t.remote, addr) {
+		// Latched by a packet from another source meanwhile
+		t.Unlock()
+		return
+	}
+	buff := t.ingress[hdr.SSRC]
+	var recv Receiver
+	if buff == nil {
+		p, ok := t.pending[hdr.PayloadType]
+		if !ok {
+			t.Unlock()
+			return
+		}
+		delete(t.pending, hdr.PayloadType)
+		p.SSRC = hdr.SSRC
+		var err error
+		if recv, err = t.addReceiver(p); err != nil {
+			t.Unlock()
+			Logger.Error(err, "Plain transport publish err", "transport_id", t.id, "track_id", p.TrackID)
+			return
+		}
+		buff = t.ingress[hdr.SSRC]
+	}
+	// The packets of unknown tracks do not latch the remote address
+	if t.config.Comedia && t.remote == nil {
+		t.remote = addr
+		if t.rtcpConn == nil {
+			t.remoteRTCP = addr
+		}
+	}
+	t.Unlock()
+
+	if recv != nil {
+		t.session.Publish(t.router, recv)
+	}
+	_, _ = buff.Write(pkt)
+}
+
+func (t *PlainTransport) handleRTCP(pkt []byte, addr *net.UDPAddr, rtcpSocket bool) {
+	if t.localSRTP != nil {
+		t.srtpMu.Lock()
+		if t.decrypt == nil {
+			t.srtpMu.Unlock()
+			return
+		}
+		decrypted, err := t.decrypt.DecryptRTCP(nil, pkt, nil)
+		t.srtpMu.Unlock()
+		if err != nil {
+			Logger.V(1).Info("Plain transport srtcp decrypt err", "err", err)
+			return
+		}
+		pkt = decrypted
+	}
+	pkts, err := rtcp.Unmarshal(pkt)
+	if err != nil {
+		return
+	}
+
+	t.Lock()
+	if t.config.Comedia && rtcpSocket && t.remoteRTCP == nil && (t.remote == nil || t.remote.IP.Equal(addr.IP)) &&
+		t.knownRTCP(pkts) {
+		t.remoteRTCP = addr
+	}
+	remote := t.remote
+	if rtcpSocket {
+		remote = t.remoteRTCP
+	}
+	t.Unlock()
+	if remote != nil && !sameUDPAddr(remote, addr) {
+		return
+	}
+
+	for _, p := range pkts {
+		if sr, ok := p.(*rtcp.SenderReport); ok {
+			t.RLock()
+			buff := t.ingress[sr.SSRC]
+			t.RUnlock()
+			if buff != nil {
+				buff.SetSenderReportData(sr.RTPTime, sr.NTPTime)
+			}
+		}
+		// Every down track of the packet handles it once
+		var raw []byte
+		handled := make(map[*DownTrack]bool)
+		for _, ssrc := range p.DestinationSSRC() {
+			t.RLock()
+			dt := t.egress[ssrc]
+			t.RUnlock()
+			if dt == nil || handled[dt] {
+				continue
+			}
+			handled[dt] = true
+			if raw == nil {
+				if raw, err = p.Marshal(); err != nil {
+					break
+				}
+			}
+			dt.handleRTCP(raw)
+		}
+	}
+}
+
+// knownRTCP reports if the packets are about the tracks of the transport, it
+// must be called with the lock held
+func (t *PlainTransport) knownRTCP(pkts []rtcp.Packet) bool {
+	for _, p := range pkts {
+		if sr, ok := p.(*rtcp.SenderReport); ok && t.ingress[sr.SSRC] != nil {
+			return true
+		}
+		for _, ssrc := range p.DestinationSSRC() {
+			if t.egress[ssrc] != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeRTCP sends the feedback of the published tracks, it is dropped until
+// the remote address is known
+func (t *PlainTransport) writeRTCP(pkts []rtcp.Packet) error {
+	raw, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	if t.encrypt != nil {
+		t.srtpMu.Lock()
+		raw, err = t.encrypt.EncryptRTCP(nil, raw, nil)
+		t.srtpMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	t.RLock()
+	addr := t.remoteRTCP
+	t.RUnlock()
+	if addr == nil {
+		return nil
+	}
+	conn := t.conn
+	if t.rtcpConn != nil {
+		conn = t.rtcpConn
+	}
+	_, err = conn.WriteToUDP(raw, addr)
+	return err
+}
+
+func (t *PlainTransport) writeRTP(hdr *rtp.Header, payload []byte) (int, error) {
+	t.RLock()
+	addr := t.remote
+	t.RUnlock()
+	if addr == nil {
+		return 0, nil
+	}
+	raw, err := (&rtp.Packet{Header: *hdr, Payload: payload}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+	if t.encrypt != nil {
+		t.srtpMu.Lock()
+		raw, err = t.encrypt.EncryptRTP(nil, raw, nil)
+		t.srtpMu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return t.conn.WriteToUDP(raw, addr)
+}
+
+// sendReports sends the sender reports of the forwarded tracks
+func (t *PlainTransport) sendReports() {
+	ticker := time.NewTicker(plainReportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if t.closed.get() {
+			return
+		}
+		var pkts []rtcp.Packet
+		var chunks []rtcp.SourceDescriptionChunk
+		t.RLock()
+		for _, dt := range t.egress {
+			if sr := dt.CreateSenderReport(); sr != nil {
+				pkts = append(pkts, sr)
+			}
+			chunks = append(chunks, dt.CreateSourceDescriptionChunks()...)
+		}
+		t.RUnlock()
+		if len(pkts) == 0 {
+			continue
+		}
+		if len(chunks) > 0 {
+			pkts = append(pkts, &rtcp.SourceDescription{Chunks: chunks})
+		}
+		if err := t.writeRTCP(pkts); err != nil {
+			Logger.Error(err, "Plain transport sending reports err", "transport_id", t.id)
+		}
+	}
+}
+
+// plainTrackWriter writes the packets of the forwarded down tracks
+type plainTrackWriter struct {
+	t *PlainTransport
+}
+
+func (w plainTrackWriter) WriteRTP(hdr *rtp.Header, payload []byte) (int, error) {
+	return w.t.writeRTP(hdr, payload)
+}
+
+func (w plainTrackWriter) Write(b []byte) (int, error) {
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.t.writeRTP(&pkt.Header, pkt.Payload)
+}
+
+// sameUDPAddr reports whether the packets are from the remote endpoint
+func sameUDPAddr(remote, addr *net.UDPAddr) bool {
+	return remote.Port == addr.Port && remote.IP.Equal(addr.IP)
+}
+
+// isRTCPPacket demultiplexes RTP and RTCP on a single port (RFC 5761)
+func isRTCPPacket(b []byte) bool {
+	return len(b) >= 2 && b[1] >= 192 && b[1] <= 223
+}
+
+func srtpProfile(suite string) (srtp.ProtectionProfile, int, error) {
+	switch suite {
+	case SRTPCryptoSuiteAESCM128HMACSHA180:
+		return srtp.ProtectionProfileAes128CmHmacSha1_80, 16 + 14, nil
+	case SRTPCryptoSuiteAEADAES128GCM:
+		return srtp.ProtectionProfileAeadAes128Gcm, 16 + 12, nil
+	}
+	return 0, 0, errUnsupportedCryptoSuite
+}
+
+// newSRTPContext creates a context of a SDES key, the master key followed by the master salt
+func newSRTPContext(key []byte, profile srtp.ProtectionProfile) (*srtp.Context, error) {
+	return srtp.CreateContext(key[:16], key[16:], profile)
+}
@@ -0,0 +1,233 @@
+package sfu
+
+import (
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var plainTestTrack = TrackParams{
+	TrackID:  "audio",
+	StreamID: "ffmpeg",
+	Codec: webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        100,
+	},
+}
+
+func plainTestPacket(sn uint16) []byte {
+	b, _ := (&rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 100, SequenceNumber: sn, Timestamp: uint32(sn) * 960, SSRC: 5678},
+		Payload: []byte{0xfc, 0x01, 0x02},
+	}).Marshal()
+	return b
+}
+
+func waitReceiver(s Session, streamID, trackID string) Receiver {
+	for i := 0; i < 100; i++ {
+		if recv := findReceiver(s, streamID, trackID); recv != nil {
+			return recv
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestPlainTransport_PublishForward(t *testing.T) {
+	s := NewSFU(newTestConfig())
+
+	in, err := NewPlainTransport(s, "plain", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer in.Close()
+	assert.Equal(t, in.LocalAddr(), in.LocalRTCPAddr())
+	assert.Nil(t, in.SRTPParameters())
+	assert.NoError(t, in.Publish(plainTestTrack))
+	assert.Equal(t, errPlainTrackExists, in.Publish(plainTestTrack))
+
+	sender, err := net.DialUDP("udp", nil, in.LocalAddr())
+	assert.NoError(t, err)
+	defer sender.Close()
+	_, err = sender.Write(plainTestPacket(1))
+	assert.NoError(t, err)
+
+	session, _ := s.GetSession("plain")
+	recv := waitReceiver(session, "ffmpeg", "audio")
+	if !assert.NotNil(t, recv) {
+		return
+	}
+	assert.Equal(t, uint32(5678), recv.SSRC(0))
+	assert.Len(t, session.Routers(), 1)
+
+	out, err := NewPlainTransport(s, "plain", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer out.Close()
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer receiver.Close()
+	assert.NoError(t, out.Connect(PlainConnectConfig{IP: "127.0.0.1", Port: receiver.LocalAddr().(*net.UDPAddr).Port}))
+
+	_, err = out.Forward("ffmpeg", "unknown")
+	assert.Equal(t, errNoReceiverFound, err)
+	params, err := out.Forward("ffmpeg", "audio")
+	assert.NoError(t, err)
+	assert.Equal(t, webrtc.PayloadType(100), params.Codec.PayloadType)
+	assert.NotZero(t, params.SSRC)
+
+	for sn := uint16(2); sn < 5; sn++ {
+		_, err = sender.Write(plainTestPacket(sn))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, receiver.SetReadDeadline(time.Now().Add(2*time.Second)))
+	b := make([]byte, 1500)
+	n, err := receiver.Read(b)
+	if assert.NoError(t, err) {
+		var pkt rtp.Packet
+		assert.NoError(t, pkt.Unmarshal(b[:n]))
+		assert.Equal(t, params.SSRC, pkt.SSRC)
+		assert.Equal(t, uint8(100), pkt.PayloadType)
+		assert.Equal(t, []byte{0xfc, 0x01, 0x02}, pkt.Payload)
+	}
+
+	// Closing the publishing transport removes its tracks
+	assert.NoError(t, in.Close())
+	assert.Equal(t, errPlainTransportClosed, in.Publish(plainTestTrack))
+	assert.Len(t, session.Routers(), 1)
+}
+
+func TestPlainTransport_SRTP(t *testing.T) {
+	s := NewSFU(newTestConfig())
+
+	_, err := NewPlainTransport(s, "srtp", PlainTransportConfig{SRTPCryptoSuite: "NULL"})
+	assert.Equal(t, errUnsupportedCryptoSuite, err)
+
+	tr, err := NewPlainTransport(s, "srtp", PlainTransportConfig{ListenIP: "127.0.0.1", SRTPCryptoSuite: SRTPCryptoSuiteAESCM128HMACSHA180})
+	assert.NoError(t, err)
+	defer tr.Close()
+	if local := tr.SRTPParameters(); assert.NotNil(t, local) {
+		key, err := base64.StdEncoding.DecodeString(local.KeyBase64)
+		assert.NoError(t, err)
+		assert.Len(t, key, 30)
+	}
+
+	key := make([]byte, 30)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	assert.Equal(t, errMissingSRTPParameters, tr.Connect(PlainConnectConfig{}))
+	assert.Equal(t, errInvalidSRTPKey, tr.Connect(PlainConnectConfig{SRTP: &SRTPParameters{
+		CryptoSuite: SRTPCryptoSuiteAESCM128HMACSHA180,
+		KeyBase64:   base64.StdEncoding.EncodeToString(key[:16]),
+	}}))
+	assert.NoError(t, tr.Connect(PlainConnectConfig{SRTP: &SRTPParameters{
+		CryptoSuite: SRTPCryptoSuiteAESCM128HMACSHA180,
+		KeyBase64:   base64.StdEncoding.EncodeToString(key),
+	}}))
+	assert.NoError(t, tr.Publish(plainTestTrack))
+
+	ctx, err := srtp.CreateContext(key[:16], key[16:], srtp.ProtectionProfileAes128CmHmacSha1_80)
+	assert.NoError(t, err)
+	encrypted, err := ctx.EncryptRTP(nil, plainTestPacket(1), nil)
+	assert.NoError(t, err)
+	sender, err := net.DialUDP("udp", nil, tr.LocalAddr())
+	assert.NoError(t, err)
+	defer sender.Close()
+	_, err = sender.Write(encrypted)
+	assert.NoError(t, err)
+
+	session, _ := s.GetSession("srtp")
+	assert.NotNil(t, waitReceiver(session, "ffmpeg", "audio"))
+}
+
+func TestPlainTransport_RemoteSource(t *testing.T) {
+	s := NewSFU(newTestConfig())
+
+	tr, err := NewPlainTransport(s, "remote", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer tr.Close()
+	assert.NoError(t, tr.Publish(plainTestTrack))
+
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer remote.Close()
+	assert.NoError(t, tr.Connect(PlainConnectConfig{IP: "127.0.0.1", Port: remote.LocalAddr().(*net.UDPAddr).Port}))
+
+	// Packets from other sources are dropped
+	other, err := net.DialUDP("udp", nil, tr.LocalAddr())
+	assert.NoError(t, err)
+	defer other.Close()
+	_, err = other.Write(plainTestPacket(1))
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	session, _ := s.GetSession("remote")
+	assert.Nil(t, findReceiver(session, "ffmpeg", "audio"))
+
+	_, err = remote.WriteToUDP(plainTestPacket(2), tr.LocalAddr())
+	assert.NoError(t, err)
+	assert.NotNil(t, waitReceiver(session, "ffmpeg", "audio"))
+}
+
+func TestPlainTransport_Comedia(t *testing.T) {
+	s := NewSFU(newTestConfig())
+
+	tr, err := NewPlainTransport(s, "comedia", PlainTransportConfig{ListenIP: "127.0.0.1", Comedia: true})
+	assert.NoError(t, err)
+	defer tr.Close()
+	assert.NoError(t, tr.Publish(plainTestTrack))
+
+	// A packet of an unknown track does not latch the remote address
+	other, err := net.DialUDP("udp", nil, tr.LocalAddr())
+	assert.NoError(t, err)
+	defer other.Close()
+	stray, err := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111, SSRC: 1}, Payload: []byte{0x01}}).Marshal()
+	assert.NoError(t, err)
+	_, err = other.Write(stray)
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	tr.RLock()
+	assert.Nil(t, tr.remote)
+	tr.RUnlock()
+
+	sender, err := net.DialUDP("udp", nil, tr.LocalAddr())
+	assert.NoError(t, err)
+	defer sender.Close()
+	_, err = sender.Write(plainTestPacket(1))
+	assert.NoError(t, err)
+	session, _ := s.GetSession("comedia")
+	assert.NotNil(t, waitReceiver(session, "ffmpeg", "audio"))
+	tr.RLock()
+	assert.True(t, sameUDPAddr(tr.remote, sender.LocalAddr().(*net.UDPAddr)))
+	tr.RUnlock()
+}
+
+func TestPlainTransport_handleRTCP(t *testing.T) {
+	tr := &PlainTransport{ingress: make(map[uint32]*buffer.Buffer), egress: make(map[uint32]*DownTrack)}
+	feedbacks := make(map[uint32]int)
+	for _, ssrc := range []uint32{1, 2} {
+		ssrc := ssrc
+		dt := &DownTrack{ssrc: ssrc, lastSSRC: 5678, trackType: SimulcastDownTrack}
+		dt.enabled.set(true)
+		dt.onReceiverFeedback = func(_ uint8, _ uint64) { feedbacks[ssrc]++ }
+		tr.egress[ssrc] = dt
+	}
+
+	// A REMB of both tracks is handled by both down tracks
+	b, err := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{SenderSSRC: 9, Bitrate: 500000, SSRCs: []uint32{1, 2, 1}}})
+	assert.NoError(t, err)
+	tr.handleRTCP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}, false)
+	assert.Equal(t, map[uint32]int{1: 1, 2: 1}, feedbacks)
+}
+
+func Test_isRTCPPacket(t *testing.T) {
+	assert.True(t, isRTCPPacket([]byte{0x80, 200}))
+	assert.True(t, isRTCPPacket([]byte{0x81, 205}))
+	assert.False(t, isRTCPPacket([]byte{0x80, 100}))
+	assert.False(t, isRTCPPacket([]byte{0x80, 0xe4}))
+}
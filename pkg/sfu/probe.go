@@ -0,0 +1,218 @@
+/*
+【ファイル概要: probe.go】
+空間レイヤーのアップグレード前に行う帯域プローブ。
+
+【主要な役割】
+1. プローブの開始と判定
+   - アップグレード候補のレイヤーが見つかった時点でプローブを開始
+   - プローブ期間中は目標レイヤーのビットレートに達するまでパディングを送信
+   - 期間終了後、帯域推定値が目標レイヤーのビットレートを維持していれば切り替え
+   - プローブ中でもダウングレードの判定やロスの増加ではプローブを終了し、
+     ダウングレードを適用
+
+2. パディングパケットの送信
+   - ダウントラックのSSRCでパディングのみのRTPパケットを送信
+   - メディアパケットの書き込みと同じゴルーチンで、フレーム末尾（マーカー）の後に送信
+   - パディングにはシーケンス番号を割り当てるが、sequencerには登録しない
+     （NACKされてもsequencerに対応が無いため再送されない）
+
+【シーケンス番号の扱い】
+パディングを送信するたびにsnOffsetを1つ減らし、
+以降のメディアパケットのシーケンス番号がパディングの後に続くようにします。
+*/
+package sfu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// maxPaddingSize is the max payload of a padding only packet
+	maxPaddingSize = 255
+	// maxPaddingBurst limits the padding packets sent after a frame
+	maxPaddingBurst = 10
+	// defaultProbeDuration in [ms]
+	defaultProbeDuration = 1000
+	// probeBackoff is the delay before probing again after a failed probe
+	probeBackoff = 10 * time.Second
+	// probeMaxLoss is the fraction lost over which probes are not started, and
+	// running probes end
+	probeMaxLoss = 5
+)
+
+var paddingPayload = func() []byte {
+	p := make([]byte, maxPaddingSize)
+	p[maxPaddingSize-1] = maxPaddingSize
+	return p
+}()
+
+type bandwidthProber struct {
+	sync.Mutex
+	duration time.Duration
+
+	active        bool
+	spatialLayer  int32
+	temporalLayer int32
+	switchDelay   time.Duration
+	bitrate       uint64
+	padRate       uint64
+	start         time.Time
+	sentBytes     uint64
+	next          time.Time
+}
+
+func newBandwidthProber(durationMs int) *bandwidthProber {
+	if durationMs <= 0 {
+		durationMs = defaultProbeDuration
+	}
+	return &bandwidthProber{duration: time.Duration(durationMs) * time.Millisecond}
+}
+
+// begin starts probing the target bitrate, sending padding over the current bitrate
+func (p *bandwidthProber) begin(d LayerDecision, target, current uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	if p.active || now.Before(p.next) || target <= current {
+		return false
+	}
+	p.active = true
+	p.spatialLayer = d.SpatialLayer
+	p.temporalLayer = d.TemporalLayer
+	p.switchDelay = d.SwitchDelay
+	p.bitrate = target
+	p.padRate = target - current
+	p.start = now
+	p.sentBytes = 0
+	return true
+}
+
+// result returns the probed decision once the probe is finished
+func (p *bandwidthProber) result() (d LayerDecision, bitrate uint64, done bool) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.active || time.Since(p.start) < p.duration {
+		return
+	}
+	return LayerDecision{
+		SpatialLayer:  p.spatialLayer,
+		TemporalLayer: p.temporalLayer,
+		SwitchDelay:   p.switchDelay,
+	}, p.bitrate, true
+}
+
+func (p *bandwidthProber) isActive() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.active
+}
+
+// end finishes the probe, failed probes delay the next one
+func (p *bandwidthProber) end(success bool) {
+	p.Lock()
+	p.active = false
+	if !success {
+		p.next = time.Now().Add(probeBackoff)
+	}
+	p.Unlock()
+}
+
+// paddingBytes returns the bytes of padding to send now to keep the probe rate
+func (p *bandwidthProber) paddingBytes() uint64 {
+	p.Lock()
+	defer p.Unlock()
+	if !p.active {
+		return 0
+	}
+	elapsed := time.Since(p.start)
+	if elapsed >= p.duration {
+		return 0
+	}
+	expected := p.padRate * uint64(elapsed) / uint64(time.Second) / 8
+	if expected <= p.sentBytes {
+		return 0
+	}
+	return expected - p.sentBytes
+}
+
+func (p *bandwidthProber) onPaddingSent(n int) {
+	p.Lock()
+	p.sentBytes += uint64(n)
+	p.Unlock()
+}
+
+// writePadding sends padding only packets after the last written packet.
+// Must be called from the packet writer goroutine after a frame is complete.
+func (d *DownTrack) writePadding() {
+	n := d.prober.paddingBytes()
+	for i := 0; n > 0 && i < maxPaddingBurst; i++ {
+		d.lastSN++
+		d.snOffset--
+		hdr := rtp.Header{
+			Version:        2,
+			Padding:        true,
+			PayloadType:    d.payloadType,
+			SequenceNumber: d.lastSN,
+			Timestamp:      d.lastTS,
+			SSRC:           d.ssrc,
+		}
+		if err := d.writeRTP(&hdr, paddingPayload); err != nil {
+			Logger.Error(err, "Writing padding packet err")
+			return
+		}
+		d.prober.onPaddingSent(maxPaddingSize)
+		if n <= maxPaddingSize {
+			return
+		}
+		n -= maxPaddingSize
+	}
+}
+
+// probeLayer decides if the up switch proposed by the layer selector must be
+// probed first. It returns true when the switch is handled by the prober.
+// Downgrades and losses end the probe and leave the decision to the caller.
+func (d *DownTrack) probeLayer(st LayerState, decision LayerDecision) bool {
+	if d.prober == nil {
+		return false
+	}
+	downgrade := decision.SpatialLayer < st.SpatialLayer || st.FractionLost > probeMaxLoss ||
+		decision.SpatialLayer == st.SpatialLayer && decision.TemporalLayer < st.TemporalLayer
+	if pd, bitrate, done := d.prober.result(); done {
+		success := !downgrade && st.AvailableBitrate >= bitrate && st.SpatialLayer < pd.SpatialLayer
+		d.prober.end(success)
+		if success {
+			if err := d.SwitchSpatialLayer(pd.SpatialLayer, false); err == nil {
+				d.SwitchTemporalLayer(pd.TemporalLayer, false)
+			}
+			d.simulcast.switchDelay = time.Now().Add(pd.SwitchDelay)
+		}
+		return !downgrade
+	}
+	if d.prober.isActive() {
+		if !downgrade {
+			return true
+		}
+		d.prober.end(false)
+		return false
+	}
+
+	// Up switch candidates: proposed by the selector, or the next layer when
+	// the link looks healthy but the estimate is not high enough to go up.
+	next := st.SpatialLayer + 1
+	if decision.SpatialLayer > st.SpatialLayer {
+		next = decision.SpatialLayer
+	} else if decision != (LayerDecision{SpatialLayer: st.SpatialLayer, TemporalLayer: st.TemporalLayer}) ||
+		downgrade || st.TemporalLayer < st.MaxTemporalLayers[st.SpatialLayer] {
+		return false
+	}
+	if next > st.MaxSpatialLayer || next > 2 || st.Bitrates[next] == 0 {
+		return false
+	}
+	if decision.SpatialLayer != next {
+		decision = LayerDecision{SpatialLayer: next, SwitchDelay: 5 * time.Second}
+	}
+	return d.prober.begin(decision, st.Bitrates[next], st.Bitrates[st.SpatialLayer])
+}
@@ -0,0 +1,108 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+type probeTestWriter struct {
+	headers  []rtp.Header
+	payloads [][]byte
+}
+
+func (w *probeTestWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.headers = append(w.headers, *header)
+	w.payloads = append(w.payloads, append([]byte(nil), payload...))
+	return header.MarshalSize() + len(payload), nil
+}
+
+func (w *probeTestWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestBandwidthProber(t *testing.T) {
+	p := newBandwidthProber(50)
+	assert.False(t, p.begin(LayerDecision{SpatialLayer: 1}, 100000, 200000))
+	assert.True(t, p.begin(LayerDecision{SpatialLayer: 1}, 600000, 200000))
+	assert.False(t, p.begin(LayerDecision{SpatialLayer: 2}, 1500000, 200000))
+
+	_, _, done := p.result()
+	assert.False(t, done)
+	time.Sleep(20 * time.Millisecond)
+	assert.NotZero(t, p.paddingBytes())
+
+	time.Sleep(40 * time.Millisecond)
+	assert.Zero(t, p.paddingBytes())
+	d, bitrate, done := p.result()
+	assert.True(t, done)
+	assert.Equal(t, int32(1), d.SpatialLayer)
+	assert.Equal(t, uint64(600000), bitrate)
+
+	p.end(false)
+	assert.False(t, p.isActive())
+	assert.False(t, p.begin(LayerDecision{SpatialLayer: 1}, 600000, 200000))
+}
+
+func TestDownTrack_writePadding(t *testing.T) {
+	w := &probeTestWriter{}
+	d := &DownTrack{
+		ssrc:        1234,
+		payloadType: 96,
+		writeStream: w,
+		sequencer:   newSequencer(500),
+		prober:      newBandwidthProber(1000),
+		lastSN:      100,
+		lastTS:      9000,
+		snOffset:    10,
+	}
+	d.sequencer.push(110, 100, 9000, 0, true)
+	assert.True(t, d.prober.begin(LayerDecision{SpatialLayer: 1}, 10000000, 0))
+	time.Sleep(10 * time.Millisecond)
+
+	d.writePadding()
+	assert.NotEmpty(t, w.headers)
+	for i, hdr := range w.headers {
+		assert.True(t, hdr.Padding)
+		assert.Equal(t, uint16(101+i), hdr.SequenceNumber)
+		assert.Equal(t, uint32(9000), hdr.Timestamp)
+		assert.Equal(t, uint32(1234), hdr.SSRC)
+	}
+	n := uint16(len(w.headers))
+	assert.Equal(t, 100+n, d.lastSN)
+	// Next media packet must follow the padding
+	assert.Equal(t, 100+n+1, uint16(111)-d.snOffset)
+	// Padding is not nackable
+	assert.Empty(t, d.sequencer.getSeqNoPairs([]uint16{101}))
+	assert.Len(t, d.sequencer.getSeqNoPairs([]uint16{100}), 1)
+}
+
+func TestDownTrack_probeLayer(t *testing.T) {
+	d := &DownTrack{prober: newBandwidthProber(1000)}
+	st := LayerState{
+		SpatialLayer:      1,
+		TemporalLayer:     2,
+		MaxSpatialLayer:   2,
+		MaxTemporalLayers: [3]int32{2, 2, 2},
+		Bitrates:          [3]uint64{150000, 500000, 1500000},
+	}
+	up := LayerDecision{SpatialLayer: 2}
+	assert.True(t, d.probeLayer(st, up))
+	assert.True(t, d.prober.isActive())
+	// Up switches wait for the probe
+	assert.True(t, d.probeLayer(st, up))
+	assert.True(t, d.probeLayer(st, LayerDecision{SpatialLayer: 1, TemporalLayer: 2}))
+
+	// A downgrade ends the probe and is applied
+	assert.False(t, d.probeLayer(st, LayerDecision{SpatialLayer: 0, TemporalLayer: 2}))
+	assert.False(t, d.prober.isActive())
+
+	// So does the loss
+	d.prober.next = time.Time{}
+	assert.True(t, d.probeLayer(st, up))
+	st.FractionLost = 30
+	assert.False(t, d.probeLayer(st, LayerDecision{SpatialLayer: 1, TemporalLayer: 2}))
+	assert.False(t, d.prober.isActive())
+}
@@ -56,6 +56,7 @@ type Publisher struct {
 	relayed    atomicBool
 	relayPeers []*relayPeer
 	candidates []webrtc.ICECandidateInit
+	rtx        *rtxLinker
 
 	onICEConnectionStateChangeHandler atomic.Value // func(webrtc.ICEConnectionState)
 	onPublisherTrack                  atomic.Value // func(PublisherTrack)
@@ -87,7 +88,22 @@ func NewPublisher(id string, session Session, cfg *WebRTCTransportConfig) (*Publ
 		return nil, errPeerConnectionInitFailed
 	}
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(cfg.Setting))
+	rtx := newRTXLinker(cfg.BufferFactory)
+	se := cfg.Setting
+	if newBuffer := se.BufferFactory; newBuffer != nil {
+		// RTX streams are found with the first packets of the buffers of this peer connection
+		se.BufferFactory = func(packetType packetio.BufferPacketType, ssrc uint32) io.ReadWriteCloser {
+			rw := newBuffer(packetType, ssrc)
+			if b, ok := rw.(*buffer.Buffer); ok {
+				b.OnPendingPacket(func(pkt []byte) {
+					rtx.link(b, pkt)
+				})
+			}
+			return rw
+		}
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(se))
 	pc, err := api.NewPeerConnection(cfg.Configuration)
 
 	if err != nil {
@@ -101,6 +117,7 @@ func NewPublisher(id string, session Session, cfg *WebRTCTransportConfig) (*Publ
 		cfg:     cfg,
 		router:  newRouter(id, session, cfg),
 		session: session,
+		rtx:     rtx,
 	}
 
 	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
@@ -112,6 +129,15 @@ func NewPublisher(id string, session Session, cfg *WebRTCTransportConfig) (*Publ
 			"stream_id", track.StreamID(),
 		)
 
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			for _, t := range p.pc.GetTransceivers() {
+				if t.Receiver() == receiver {
+					p.rtx.addTrack(t.Mid(), track, receiver.GetParameters())
+					break
+				}
+			}
+		}
+
 		r, pub := p.router.AddReceiver(receiver, track, track.ID(), track.StreamID())
 		if pub {
 			p.session.Publish(p.router, r)
@@ -163,6 +189,7 @@ func NewPublisher(id string, session Session, cfg *WebRTCTransportConfig) (*Publ
 }
 
 func (p *Publisher) Answer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	p.rtx.setRemoteDescription(offer)
 	if err := p.pc.SetRemoteDescription(offer); err != nil {
 		return webrtc.SessionDescription{}, err
 	}
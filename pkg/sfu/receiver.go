@@ -33,6 +33,7 @@ package sfu
 import (
 	"io"
 	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -45,6 +46,9 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
+// pliThrottle is the minimum interval between the PLIs sent to a publisher
+const pliThrottle = 500 * time.Millisecond
+
 // Receiver defines a interface for a track receivers
 type Receiver interface {
 	TrackID() string
@@ -83,7 +87,7 @@ type WebRTCReceiver struct {
 	codec          webrtc.RTPCodecParameters
 	rtcpCh         chan []rtcp.Packet
 	buffers        [3]*buffer.Buffer
-	upTracks       [3]*webrtc.TrackRemote
+	ssrcs          [3]uint32
 	stats          [3]*stats.Stream
 	available      [3]atomicBool
 	downTracks     [3]atomic.Value // []*DownTrack
@@ -91,11 +95,25 @@ type WebRTCReceiver struct {
 	pendingTracks  [3][]*DownTrack
 	nackWorker     *workerpool.WorkerPool
 	isSimulcast    bool
+	ddExtID        uint8
+	rtxPayloadType webrtc.PayloadType
+	gopCaches      [3]*gopCache
+	dynacast       *dynacastState
+	// ingress processes the packets read from the buffers with the packet middlewares
+	ingress        PacketProcessor
 	onCloseHandler func()
 }
 
 // NewWebRTCReceiver creates a new webrtc track receivers
 func NewWebRTCReceiver(receiver *webrtc.RTPReceiver, track *webrtc.TrackRemote, pid string) Receiver {
+	var ddExtID uint8
+	params := receiver.GetParameters()
+	for _, ext := range params.HeaderExtensions {
+		if ext.URI == buffer.DependencyDescriptorURI {
+			ddExtID = uint8(ext.ID)
+		}
+	}
+	rtxPT, _ := getRTXPayloadType(params.Codecs, track.PayloadType())
 	return &WebRTCReceiver{
 		peerID:      pid,
 		receiver:    receiver,
@@ -105,6 +123,52 @@ func NewWebRTCReceiver(receiver *webrtc.RTPReceiver, track *webrtc.TrackRemote,
 		kind:        track.Kind(),
 		nackWorker:  workerpool.New(1),
 		isSimulcast: len(track.RID()) > 0,
+		ddExtID:     ddExtID,
+		// Down tracks negotiate RTX with the payload type of the publisher
+		rtxPayloadType: rtxPT,
+	}
+}
+
+// TrackParams describes a track published without a peer connection, the
+// parameters replace the SDP negotiation of the publishers
+type TrackParams struct {
+	TrackID  string
+	StreamID string
+	// Codec of the packets, with its payload type and RTCP feedback
+	Codec webrtc.RTPCodecParameters
+	// HeaderExtensions of the packets
+	HeaderExtensions []webrtc.RTPHeaderExtensionParameter
+	// SSRC of the packets
+	SSRC uint32
+}
+
+func (t TrackParams) kind() webrtc.RTPCodecType {
+	switch mime := strings.ToLower(t.Codec.MimeType); {
+	case strings.HasPrefix(mime, "audio/"):
+		return webrtc.RTPCodecTypeAudio
+	case strings.HasPrefix(mime, "video/"):
+		return webrtc.RTPCodecTypeVideo
+	}
+	return 0
+}
+
+// newLocalReceiver creates a receiver of a track received outside of a peer
+// connection, the layers are added with addLayer
+func newLocalReceiver(t TrackParams, pid string) *WebRTCReceiver {
+	var ddExtID uint8
+	for _, ext := range t.HeaderExtensions {
+		if ext.URI == buffer.DependencyDescriptorURI {
+			ddExtID = uint8(ext.ID)
+		}
+	}
+	return &WebRTCReceiver{
+		peerID:     pid,
+		trackID:    t.TrackID,
+		streamID:   t.StreamID,
+		codec:      t.Codec,
+		kind:       t.kind(),
+		nackWorker: workerpool.New(1),
+		ddExtID:    ddExtID,
 	}
 }
 
@@ -122,10 +186,7 @@ func (w *WebRTCReceiver) TrackID() string {
 }
 
 func (w *WebRTCReceiver) SSRC(layer int) uint32 {
-	if track := w.upTracks[layer]; track != nil {
-		return uint32(track.SSRC())
-	}
-	return 0
+	return w.ssrcs[layer]
 }
 
 func (w *WebRTCReceiver) Codec() webrtc.RTPCodecParameters {
@@ -137,10 +198,6 @@ func (w *WebRTCReceiver) Kind() webrtc.RTPCodecType {
 }
 
 func (w *WebRTCReceiver) AddUpTrack(track *webrtc.TrackRemote, buff *buffer.Buffer, bestQualityFirst bool) {
-	if w.closed.get() {
-		return
-	}
-
 	var layer int
 	switch track.RID() {
 	case fullResolution:
@@ -150,9 +207,17 @@ func (w *WebRTCReceiver) AddUpTrack(track *webrtc.TrackRemote, buff *buffer.Buff
 	default:
 		layer = 0
 	}
+	w.addLayer(layer, uint32(track.SSRC()), buff, bestQualityFirst)
+}
+
+// addLayer starts forwarding the packets of the layer read from the buffer
+func (w *WebRTCReceiver) addLayer(layer int, ssrc uint32, buff *buffer.Buffer, bestQualityFirst bool) {
+	if w.closed.get() {
+		return
+	}
 
 	w.Lock()
-	w.upTracks[layer] = track
+	w.ssrcs[layer] = ssrc
 	w.buffers[layer] = buff
 	w.available[layer].set(true)
 	w.downTracks[layer].Store(make([]*DownTrack, 0, 10))
@@ -221,9 +286,17 @@ func (w *WebRTCReceiver) AddDownTrack(track *DownTrack, bestQualityFirst bool) {
 		if w.isDownTrackSubscribed(layer, track) {
 			return
 		}
-		track.SetInitialLayers(0, 0)
-		track.trackType = SimpleDownTrack
+		if strings.EqualFold(w.codec.MimeType, webrtc.MimeTypeVP9) || strings.EqualFold(w.codec.MimeType, webrtc.MimeTypeAV1) {
+			track.SetInitialLayers(2, 2)
+			track.maxSpatialLayer = 2
+			track.maxTemporalLayer = 2
+			track.trackType = SVCDownTrack
+		} else {
+			track.SetInitialLayers(0, 0)
+			track.trackType = SimpleDownTrack
+		}
 	}
+	track.ddUpstreamExtID = w.ddExtID
 	w.Lock()
 	w.storeDownTrack(layer, track)
 	w.Unlock()
@@ -243,11 +316,19 @@ func (w *WebRTCReceiver) SwitchDownTrack(track *DownTrack, layer int) error {
 	return errNoReceiverFound
 }
 
+// GetBitrate returns the bitrates of the simulcast layers, or of the spatial
+// layers of a SVC stream
 func (w *WebRTCReceiver) GetBitrate() [3]uint64 {
+	if brs, ok := w.svcBitrates(); ok {
+		return brs
+	}
 	var br [3]uint64
 	for i, buff := range w.buffers {
 		if buff != nil {
 			br[i] = buff.Bitrate()
+			if pbr, ok := w.pausedBitrate(i); ok {
+				br[i] = pbr
+			}
 		}
 	}
 	return br
@@ -255,6 +336,16 @@ func (w *WebRTCReceiver) GetBitrate() [3]uint64 {
 
 func (w *WebRTCReceiver) GetMaxTemporalLayer() [3]int32 {
 	var tls [3]int32
+	if brs, ok := w.svcBitrates(); ok {
+		// The spatial layers of a SVC stream share its temporal layers
+		mtl := w.buffers[0].MaxTemporalLayer()
+		for i, br := range brs {
+			if br != 0 {
+				tls[i] = mtl
+			}
+		}
+		return tls
+	}
 	for i, a := range w.available {
 		if a.get() {
 			tls[i] = w.buffers[i].MaxTemporalLayer()
@@ -263,6 +354,16 @@ func (w *WebRTCReceiver) GetMaxTemporalLayer() [3]int32 {
 	return tls
 }
 
+// svcBitrates returns the bitrates of the spatial layers of a SVC stream,
+// ok is false when the stream has no spatial layers
+func (w *WebRTCReceiver) svcBitrates() (brs [3]uint64, ok bool) {
+	if w.isSimulcast || w.buffers[0] == nil {
+		return brs, false
+	}
+	brs = w.buffers[0].SpatialBitrates()
+	return brs, brs != [3]uint64{}
+}
+
 // OnCloseHandler method to be called on remote tracked removed
 func (w *WebRTCReceiver) OnCloseHandler(fn func()) {
 	w.onCloseHandler = fn
@@ -293,7 +394,7 @@ func (w *WebRTCReceiver) deleteDownTrack(layer int, id string) {
 
 func (w *WebRTCReceiver) SendRTCP(p []rtcp.Packet) {
 	if _, ok := p[0].(*rtcp.PictureLossIndication); ok {
-		if time.Now().UnixNano()-atomic.LoadInt64(&w.lastPli) < 500e6 {
+		if time.Now().UnixNano()-atomic.LoadInt64(&w.lastPli) < int64(pliThrottle) {
 			return
 		}
 		atomic.StoreInt64(&w.lastPli, time.Now().UnixNano())
@@ -318,6 +419,12 @@ func (w *WebRTCReceiver) RetransmitPackets(track *DownTrack, packets []packetMet
 	w.nackWorker.Submit(func() {
 		src := packetFactory.Get().(*[]byte)
 		for _, meta := range packets {
+			if meta.parameterSets {
+				if err := track.retransmitParameterSets(meta); err != nil {
+					Logger.Error(err, "Writing rtx packet err")
+				}
+				continue
+			}
 			pktBuff := *src
 			buff := w.buffers[meta.layer]
 			if buff == nil {
@@ -350,7 +457,7 @@ func (w *WebRTCReceiver) RetransmitPackets(track *DownTrack, packets []packetMet
 				}
 			}
 
-			if _, err = track.writeStream.WriteRTP(&pkt.Header, pkt.Payload); err != nil {
+			if err = track.writeRTX(&pkt.Header, pkt.Payload); err != nil {
 				Logger.Error(err, "Writing rtx packet err")
 			} else {
 				track.UpdateStats(uint32(i))
@@ -398,18 +505,53 @@ func (w *WebRTCReceiver) writeRTP(layer int) {
 			}
 		}
 
-		for _, dt := range w.downTracks[layer].Load().([]*DownTrack) {
-			if err = dt.WriteRTP(pkt, layer); err != nil {
-				if err == io.EOF || err == io.ErrClosedPipe {
-					w.Lock()
-					w.deleteDownTrack(layer, dt.id)
-					w.Unlock()
-				}
-				Logger.Error(err, "Error writing to down track", "id", dt.id)
+		if w.ingress != nil {
+			written := false
+			_ = w.ingress.ProcessPacket(PacketArgs{Receiver: w, Layer: layer, Packet: pkt, written: &written})
+			if !written {
+				w.skipRTP(layer, pkt)
 			}
+		} else {
+			_ = w.forwardRTP(PacketArgs{Receiver: w, Layer: layer, Packet: pkt})
+		}
+	}
+
+}
+
+// forwardRTP writes a packet of the layer to the down tracks, once per packet
+// read from the buffer
+func (w *WebRTCReceiver) forwardRTP(args PacketArgs) error {
+	if args.written != nil {
+		// The packet keeps its sequence number, it is not duplicated
+		if *args.written {
+			return nil
+		}
+		*args.written = true
+	}
+	layer, pkt := args.Layer, args.Packet
+	for _, dt := range w.downTracks[layer].Load().([]*DownTrack) {
+		if err := dt.WriteRTP(pkt, layer); err != nil {
+			if err == io.EOF || err == io.ErrClosedPipe {
+				w.Lock()
+				w.deleteDownTrack(layer, dt.id)
+				w.Unlock()
+			}
+			Logger.Error(err, "Error writing to down track", "id", dt.id)
 		}
 	}
 
+	if g := w.gopCaches[layer]; g != nil {
+		g.push(pkt)
+	}
+	return nil
+}
+
+// skipRTP shifts the sequence numbers of the down tracks of the layer over a
+// packet dropped by the packet middlewares
+func (w *WebRTCReceiver) skipRTP(layer int, pkt *buffer.ExtPacket) {
+	for _, dt := range w.downTracks[layer].Load().([]*DownTrack) {
+		dt.skipRTP(pkt, layer)
+	}
 }
 
 // closeTracks close all tracks from Receiver
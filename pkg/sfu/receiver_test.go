@@ -1,11 +1,83 @@
 package sfu
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
 	"github.com/stretchr/testify/assert"
 )
 
+// testReceiver is a Receiver stub for the down track tests, the methods that
+// are not implemented panic
+type testReceiver struct {
+	Receiver
+	streamID string
+	trackID  string
+	codec    webrtc.RTPCodecParameters
+	// bitrate and maxTemporalLayer of the spatial layers
+	bitrate          [3]uint64
+	maxTemporalLayer [3]int32
+	srRTP            uint32
+	srNTP            uint64
+	// downTrack is the last down track added
+	downTrack *DownTrack
+	plis      int
+}
+
+func (r *testReceiver) StreamID() string                          { return r.streamID }
+func (r *testReceiver) TrackID() string                           { return r.trackID }
+func (r *testReceiver) Codec() webrtc.RTPCodecParameters          { return r.codec }
+func (r *testReceiver) GetBitrate() [3]uint64                     { return r.bitrate }
+func (r *testReceiver) GetMaxTemporalLayer() [3]int32             { return r.maxTemporalLayer }
+func (r *testReceiver) SwitchDownTrack(_ *DownTrack, _ int) error { return nil }
+func (r *testReceiver) GetSenderReportTime(_ int) (uint32, uint64) {
+	return r.srRTP, r.srNTP
+}
+func (r *testReceiver) Kind() webrtc.RTPCodecType {
+	if strings.HasPrefix(strings.ToLower(r.codec.MimeType), "audio/") {
+		return webrtc.RTPCodecTypeAudio
+	}
+	return webrtc.RTPCodecTypeVideo
+}
+func (r *testReceiver) AddDownTrack(track *DownTrack, _ bool) {
+	track.trackType = SimpleDownTrack
+	r.downTrack = track
+}
+func (r *testReceiver) DeleteDownTrack(_ int, id string) {
+	if r.downTrack != nil && r.downTrack.id == id {
+		r.downTrack.Close()
+	}
+}
+func (r *testReceiver) SendRTCP(pkts []rtcp.Packet) {
+	for _, pkt := range pkts {
+		if _, ok := pkt.(*rtcp.PictureLossIndication); ok {
+			r.plis++
+		}
+	}
+}
+
+// newTestDownTrack returns a bound and enabled down track of a stream, with a
+// testReceiver
+func newTestDownTrack(streamID, mime string) *DownTrack {
+	codec := webrtc.RTPCodecCapability{MimeType: mime}
+	dt := &DownTrack{
+		id:       streamID,
+		streamID: streamID,
+		codec:    codec,
+		mime:     strings.ToLower(mime),
+		receiver: &testReceiver{
+			streamID: streamID,
+			trackID:  streamID,
+			codec:    webrtc.RTPCodecParameters{RTPCodecCapability: codec},
+		},
+	}
+	dt.bound.set(true)
+	dt.enabled.set(true)
+	return dt
+}
+
 func TestWebRTCReceiver_OnCloseHandler(t *testing.T) {
 	type args struct {
 		fn func()
@@ -0,0 +1,332 @@
+/*
+【ファイル概要: recorder.go】
+セッションの録画（サーバー側でのトラックのファイル保存）。
+
+【主要な役割】
+1. 録画の制御
+   - SessionのStartRecording/StopRecordingで開始・停止
+   - 開始時に公開中のトラックと、録画中に公開されたトラックを録画
+   - 録画はRecorderConfig.Path/<セッションID>/<開始時刻>/に保存
+
+2. 仮想ダウントラック
+   - レシーバーにピア接続を持たないダウントラックを追加し、書き込み先をファイルにする
+   - キーフレームからの開始（PLIの送信を含む）、Simulcastのレイヤー選択、
+     シーケンス番号・タイムスタンプの書き換えは通常のダウントラックと同じ
+   - パブリッシャーのREDは取り出したOpusを録画
+
+3. 書き込み
+   - ダウントラックから受け取ったパケットは固定長のキューに入れ、
+     トラックごとのゴルーチンがファイルに書き込む
+   - キューが一杯の場合は破棄してレシーバーのwriteRTPをブロックしない
+     （破棄したパケットはジッターバッファで損失として扱われる）
+
+4. サイドカー
+   - トラックのファイルごとに同名の.jsonを書き込み
+   - 最初のパケットのRTPタイムスタンプをパブリッシャーのSender Report
+     （GetSenderReportTime）で壁時計時刻に変換し、トラック間の同期に使用
+
+ファイルの書き込みはpkg/recorderを参照。
+*/
+package sfu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/recorder"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	errRecordingStarted    = errors.New("session recording already started")
+	errRecordingNotStarted = errors.New("session recording not started")
+	errRecorderNotEnabled  = errors.New("recorder path not configured")
+	errRecordingClosed     = errors.New("track recording closed")
+)
+
+const defaultRecorderQueueSize = 512
+
+// RecorderConfig defines the session recordings
+type RecorderConfig struct {
+	// Path of the directory of the recordings, recording is disabled when empty
+	Path string `mapstructure:"path"`
+	// VideoContainer of the VP8, VP9 and AV1 tracks, ivf or webm
+	VideoContainer string `mapstructure:"videocontainer"`
+	// MaxLate is the number of packets to wait for a missing packet, zero means default
+	MaxLate uint16 `mapstructure:"maxlate"`
+	// QueueSize is the number of packets waiting for the file writes before
+	// they are dropped, 512 when zero
+	QueueSize int `mapstructure:"queuesize"`
+}
+
+type sessionRecorder struct {
+	sync.Mutex
+	sessionID string
+	dir       string
+	options   recorder.Options
+	queueSize int
+	tracks    map[Receiver]*trackRecording
+	stopped   bool
+}
+
+func newSessionRecorder(sessionID string, c RecorderConfig) (*sessionRecorder, error) {
+	if c.Path == "" {
+		return nil, errRecorderNotEnabled
+	}
+	dir := filepath.Join(c.Path, sessionID, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultRecorderQueueSize
+	}
+	return &sessionRecorder{
+		sessionID: sessionID,
+		dir:       dir,
+		options:   recorder.Options{VideoContainer: c.VideoContainer, MaxLate: c.MaxLate},
+		queueSize: c.QueueSize,
+		tracks:    make(map[Receiver]*trackRecording),
+	}, nil
+}
+
+// addReceiver starts recording a track published by the peer
+func (r *sessionRecorder) addReceiver(peerID string, recv Receiver) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.tracks[recv]; ok || r.stopped {
+		return
+	}
+
+	codec := recv.Codec()
+	capability := webrtc.RTPCodecCapability{
+		MimeType:  codec.MimeType,
+		ClockRate: codec.ClockRate,
+		Channels:  codec.Channels,
+	}
+	if strings.EqualFold(codec.MimeType, mimeTypeRED) {
+		// The primary encoding of RED is recorded
+		capability.MimeType = webrtc.MimeTypeOpus
+	}
+	name := sanitizeFileName(peerID + "_" + recv.StreamID() + "_" + recv.TrackID())
+	writer, err := recorder.NewTrackWriter(filepath.Join(r.dir, name), capability, r.options)
+	if err != nil {
+		Logger.Error(err, "Error recording track", "track_id", recv.TrackID(), "mime", codec.MimeType)
+		return
+	}
+
+	t := &trackRecording{
+		recorder:     r,
+		receiver:     recv,
+		writer:       writer,
+		metadataPath: filepath.Join(r.dir, name+".json"),
+		queue:        make(chan []byte, r.queueSize),
+		closeCh:      make(chan struct{}),
+		doneCh:       make(chan struct{}),
+		metadata: recorder.Metadata{
+			SessionID: r.sessionID,
+			PeerID:    peerID,
+			StreamID:  recv.StreamID(),
+			TrackID:   recv.TrackID(),
+			Kind:      recv.Kind().String(),
+			MimeType:  capability.MimeType,
+			ClockRate: codec.ClockRate,
+			File:      filepath.Base(writer.Path()),
+		},
+	}
+	if t.downTrack, err = newLocalDownTrack(recv, t, "recorder", 0, t.close); err != nil {
+		_ = writer.Close()
+		Logger.Error(err, "Error recording track", "track_id", recv.TrackID())
+		return
+	}
+	r.tracks[recv] = t
+	go t.run()
+	recv.AddDownTrack(t.downTrack, true)
+}
+
+// stop finishes the recordings of all the tracks
+func (r *sessionRecorder) stop() {
+	r.Lock()
+	r.stopped = true
+	tracks := make([]*trackRecording, 0, len(r.tracks))
+	for _, t := range r.tracks {
+		tracks = append(tracks, t)
+	}
+	r.Unlock()
+
+	for _, t := range tracks {
+		t.downTrack.bound.set(false)
+		t.receiver.DeleteDownTrack(t.layer(), t.downTrack.id)
+		t.close()
+	}
+}
+
+func (r *sessionRecorder) removeTrack(t *trackRecording) {
+	r.Lock()
+	if r.tracks[t.receiver] == t {
+		delete(r.tracks, t.receiver)
+	}
+	r.Unlock()
+}
+
+// trackRecording is the writer of the down track recording a receiver, the
+// packets are queued and written to the file by the goroutine of the track
+type trackRecording struct {
+	// 64-bit atomic first for the alignment on 32-bit platforms
+	dropped uint64
+
+	sync.Mutex
+	closeOnce    sync.Once
+	recorder     *sessionRecorder
+	receiver     Receiver
+	downTrack    *DownTrack
+	writer       *recorder.TrackWriter
+	metadataPath string
+	metadata     recorder.Metadata
+	queue        chan []byte
+	closeCh      chan struct{}
+	doneCh       chan struct{}
+	// failed is only accessed by the writer goroutine
+	failed bool
+
+	started bool
+	// srLayer and upstreamTS are the upstream layer and timestamp of the first packet
+	srLayer    int
+	upstreamTS uint32
+}
+
+// WriteRTP is called by the down track with the rewritten packets
+func (t *trackRecording) WriteRTP(hdr *rtp.Header, payload []byte) (int, error) {
+	t.Lock()
+	if !t.started {
+		t.started = true
+		t.metadata.FirstTimestamp = hdr.Timestamp
+		t.metadata.ArrivalTime = time.Now()
+		// Called from the down track writer, the offset is the one of the packet
+		t.upstreamTS = hdr.Timestamp + t.downTrack.tsOffset
+		t.srLayer = t.layer()
+	}
+	if t.metadata.StartTime == nil {
+		t.resolveStartTime()
+	}
+	t.Unlock()
+	// The payload and the extensions are in the buffer of the receiver
+	raw, err := (&rtp.Packet{Header: *hdr, Payload: payload}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return len(payload), t.enqueue(raw)
+}
+
+func (t *trackRecording) Write(b []byte) (int, error) {
+	return len(b), t.enqueue(append([]byte(nil), b...))
+}
+
+// enqueue queues a packet for the writer goroutine, the packet is dropped when
+// the queue is full
+func (t *trackRecording) enqueue(raw []byte) error {
+	select {
+	case <-t.closeCh:
+		return errRecordingClosed
+	default:
+	}
+	select {
+	case t.queue <- raw:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+	return nil
+}
+
+// run writes the queued packets until the recording is closed, the packets
+// left in the queue are written before returning
+func (t *trackRecording) run() {
+	defer close(t.doneCh)
+	for {
+		select {
+		case raw := <-t.queue:
+			t.write(raw)
+		case <-t.closeCh:
+			for {
+				select {
+				case raw := <-t.queue:
+					t.write(raw)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *trackRecording) write(raw []byte) {
+	if _, err := t.writer.Write(raw); err != nil && !t.failed {
+		// The writer keeps failing with the same error
+		t.failed = true
+		Logger.Error(err, "Error writing track recording", "file", t.writer.Path())
+	}
+}
+
+// resolveStartTime maps the first packet timestamp to the publisher wall clock
+// with the last sender report of its layer
+func (t *trackRecording) resolveStartTime() {
+	srRTP, srNTP := t.receiver.GetSenderReportTime(t.srLayer)
+	if srNTP == 0 || t.metadata.ClockRate == 0 {
+		return
+	}
+	diff := int64(int32(t.upstreamTS-srRTP)) * int64(time.Second) / int64(t.metadata.ClockRate)
+	start := ntpTime(srNTP).Time().Add(time.Duration(diff))
+	t.metadata.StartTime = &start
+}
+
+func (t *trackRecording) layer() int {
+	if t.downTrack.trackType == SimulcastDownTrack {
+		return int(t.downTrack.CurrentSpatialLayer())
+	}
+	return 0
+}
+
+// close finishes the file and writes the sidecar, when the recording is
+// stopped or the track is unpublished.
+func (t *trackRecording) close() {
+	t.closeOnce.Do(func() {
+		t.recorder.removeTrack(t)
+		close(t.closeCh)
+		<-t.doneCh
+		if dropped := atomic.LoadUint64(&t.dropped); dropped > 0 {
+			Logger.Info("Track recording dropped packets", "file", t.writer.Path(), "dropped", dropped)
+		}
+		if err := t.writer.Close(); err != nil {
+			Logger.Error(err, "Error closing track recording", "file", t.writer.Path())
+		}
+		t.Lock()
+		started := t.started
+		if started && t.metadata.StartTime == nil {
+			t.resolveStartTime()
+		}
+		t.metadata.EndTime = time.Now()
+		metadata := t.metadata
+		t.Unlock()
+		if !started {
+			return
+		}
+		if err := recorder.WriteMetadata(t.metadataPath, metadata); err != nil {
+			Logger.Error(err, "Error writing track recording metadata", "file", t.metadataPath)
+		}
+	})
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
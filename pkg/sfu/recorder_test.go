@@ -0,0 +1,119 @@
+package sfu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/ion-sfu/pkg/recorder"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRecorderTestReceiver returns a receiver of an Opus track
+func newRecorderTestReceiver() *testReceiver {
+	return &testReceiver{
+		streamID: "stream",
+		trackID:  "audio",
+		codec: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+			PayloadType:        111,
+		},
+	}
+}
+
+func TestSessionRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = newSessionRecorder("session", RecorderConfig{})
+	assert.Equal(t, errRecorderNotEnabled, err)
+
+	r, err := newSessionRecorder("session", RecorderConfig{Path: dir})
+	assert.NoError(t, err)
+
+	srTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	recv := newRecorderTestReceiver()
+	recv.srRTP, recv.srNTP = 48000, uint64(toNtpTime(srTime))
+	r.addReceiver("peer", recv)
+	assert.NotNil(t, recv.downTrack)
+
+	// First packet one second after the sender report
+	for i := uint16(0); i < 3; i++ {
+		assert.NoError(t, recv.downTrack.WriteRTP(&buffer.ExtPacket{
+			Head: true,
+			Packet: rtp.Packet{
+				Header:  rtp.Header{SequenceNumber: 100 + i, Timestamp: 96000 + 960*uint32(i), SSRC: 1234},
+				Payload: []byte{0xfc, 0x01, 0x02},
+			},
+		}, 0))
+	}
+	r.stop()
+	assert.Empty(t, r.tracks)
+
+	base := filepath.Join(r.dir, "peer_stream_audio")
+	info, err := os.Stat(base + ".ogg")
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Size())
+
+	b, err := ioutil.ReadFile(base + ".json")
+	assert.NoError(t, err)
+	var m recorder.Metadata
+	assert.NoError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, "peer", m.PeerID)
+	assert.Equal(t, webrtc.MimeTypeOpus, m.MimeType)
+	assert.Equal(t, "peer_stream_audio.ogg", m.File)
+	assert.Equal(t, uint32(96000), m.FirstTimestamp)
+	if assert.NotNil(t, m.StartTime) {
+		assert.WithinDuration(t, srTime.Add(time.Second), *m.StartTime, time.Millisecond)
+	}
+}
+
+func TestTrackRecording_queue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	r, err := newSessionRecorder("session", RecorderConfig{Path: dir})
+	assert.NoError(t, err)
+	writer, err := recorder.NewTrackWriter(filepath.Join(r.dir, "track"), webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, r.options)
+	assert.NoError(t, err)
+	tr := &trackRecording{
+		recorder: r,
+		writer:   writer,
+		queue:    make(chan []byte, 1),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	raw := func(sn uint16) []byte {
+		b, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: sn, Timestamp: 960 * uint32(sn)}, Payload: []byte{0xfc}}).Marshal()
+		assert.NoError(t, err)
+		return b
+	}
+
+	// The writer goroutine is not running, the second packet is dropped
+	_, err = tr.Write(raw(1))
+	assert.NoError(t, err)
+	_, err = tr.Write(raw(2))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&tr.dropped))
+
+	// The queued packet is written before the file is closed
+	go tr.run()
+	tr.close()
+	info, err := os.Stat(writer.Path())
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Size())
+	_, err = tr.Write(raw(3))
+	assert.Equal(t, errRecordingClosed, err)
+}
+
+func Test_sanitizeFileName(t *testing.T) {
+	assert.Equal(t, "peer_stream__track_", sanitizeFileName("peer_stream/{track}"))
+}
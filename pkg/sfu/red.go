@@ -0,0 +1,214 @@
+/*
+【ファイル概要: red.go】
+Opus RED（RFC 2198）のサーバー側でのカプセル化と取り出し。
+
+【主要な役割】
+1. REDのカプセル化
+   - audio/redをネゴシエーションしたサブスクライバーの損失率が閾値を超えた場合、
+     各Opusパケットに直前の1つまたは2つのペイロードを冗長データとして付与
+   - デコードは行わず、ペイロードをそのまま連結
+   - 損失率が閾値の半分を下回ると冗長データの付与を停止（通常のOpusで送信）
+   - 損失率が閾値の2倍以上の場合は2つ前まで付与
+
+2. REDの取り出し
+   - パブリッシャーがREDを送信し、サブスクライバーが通常のOpusのみをネゴシエーションした場合、
+     プライマリのペイロードだけを取り出して送信
+
+【REDペイロード形式】
+  冗長ブロックヘッダー（F=1、PT 7ビット、タイムスタンプオフセット14ビット、長さ10ビット）の繰り返し、
+  プライマリブロックヘッダー（F=0、PT 7ビット）、冗長データ（古い順）、プライマリデータ
+*/
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mimeTypeRED    = "audio/red"
+	redPayloadType = 63
+
+	redMaxDistance          = 2
+	redMaxBlockLength       = 1<<10 - 1
+	redMaxTimestampOffset   = 1<<14 - 1
+	defaultREDLossThreshold = 5
+)
+
+var errInvalidRED = errors.New("invalid red payload")
+
+// REDConfig defines the audio redundancy sent to subscribers
+type REDConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// LossThreshold in percent over which the redundancy is added, zero means default
+	LossThreshold uint8 `mapstructure:"lossthreshold"`
+}
+
+func redCodec(primary webrtc.PayloadType) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    mimeTypeRED,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: fmt.Sprintf("%d/%d", primary, primary),
+		},
+		PayloadType: redPayloadType,
+	}
+}
+
+// getREDPrimaryPayloadType returns the payload type of the blocks of a RED codec
+func getREDPrimaryPayloadType(codec webrtc.RTPCodecParameters) (webrtc.PayloadType, bool) {
+	pt, err := strconv.Atoi(strings.Split(codec.SDPFmtpLine, "/")[0])
+	if err != nil {
+		return 0, false
+	}
+	return webrtc.PayloadType(pt), true
+}
+
+// getREDPayloadType returns the payload type of the RED codec with blocks of the payload type
+func getREDPayloadType(codecs []webrtc.RTPCodecParameters, primary webrtc.PayloadType) (webrtc.PayloadType, bool) {
+	for _, c := range codecs {
+		if !strings.EqualFold(c.MimeType, mimeTypeRED) {
+			continue
+		}
+		if pt, ok := getREDPrimaryPayloadType(c); ok && pt == primary {
+			return c.PayloadType, true
+		}
+	}
+	return 0, false
+}
+
+type redBlock struct {
+	timestamp uint32
+	payload   []byte
+}
+
+type redEncoder struct {
+	payloadType uint8
+	// threshold of the loss fraction, scaled to 255
+	threshold uint8
+	// distance is the number of previous payloads added, zero sends plain packets
+	distance int32
+	history  []redBlock
+}
+
+func newREDEncoder(payloadType uint8, lossThreshold uint8) *redEncoder {
+	if lossThreshold == 0 {
+		lossThreshold = defaultREDLossThreshold
+	}
+	threshold := uint32(lossThreshold) * 256 / 100
+	if threshold > 255 {
+		threshold = 255
+	}
+	return &redEncoder{
+		payloadType: payloadType,
+		threshold:   uint8(threshold),
+	}
+}
+
+// setLossFraction adapts the redundancy to the loss fraction of a receiver report
+func (e *redEncoder) setLossFraction(fractionLost uint8) {
+	distance := atomic.LoadInt32(&e.distance)
+	switch {
+	case uint32(fractionLost) >= 2*uint32(e.threshold):
+		distance = redMaxDistance
+	case fractionLost >= e.threshold:
+		distance = 1
+	case fractionLost < e.threshold/2:
+		distance = 0
+	case distance > 1:
+		distance = 1
+	}
+	atomic.StoreInt32(&e.distance, distance)
+}
+
+// encode returns the RED payload of the packet, ok is false when no redundancy is added
+func (e *redEncoder) encode(timestamp uint32, pt uint8, payload []byte) (red []byte, ok bool) {
+	distance := int(atomic.LoadInt32(&e.distance))
+	var blocks []redBlock
+	for i := len(e.history) - distance; distance > 0 && i < len(e.history); i++ {
+		if i < 0 {
+			continue
+		}
+		b := e.history[i]
+		if offset := timestamp - b.timestamp; offset == 0 || offset > redMaxTimestampOffset || len(b.payload) > redMaxBlockLength {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+
+	e.history = append(e.history, redBlock{timestamp: timestamp, payload: append([]byte(nil), payload...)})
+	if len(e.history) > redMaxDistance {
+		e.history = e.history[len(e.history)-redMaxDistance:]
+	}
+	if len(blocks) == 0 {
+		return nil, false
+	}
+
+	size := 1 + len(payload)
+	for _, b := range blocks {
+		size += 4 + len(b.payload)
+	}
+	red = make([]byte, 0, size)
+	for _, b := range blocks {
+		offset := timestamp - b.timestamp
+		red = append(red,
+			0x80|pt,
+			byte(offset>>6),
+			byte(offset<<2)|byte(len(b.payload)>>8),
+			byte(len(b.payload)),
+		)
+	}
+	red = append(red, pt&0x7f)
+	for _, b := range blocks {
+		red = append(red, b.payload...)
+	}
+	return append(red, payload...), true
+}
+
+// getREDPrimary returns the primary encoding of a RED payload
+func getREDPrimary(payload []byte) ([]byte, error) {
+	offset, length := 0, 0
+	for {
+		if offset >= len(payload) {
+			return nil, errInvalidRED
+		}
+		if payload[offset]&0x80 == 0 {
+			offset++
+			break
+		}
+		if offset+4 > len(payload) {
+			return nil, errInvalidRED
+		}
+		length += int(payload[offset+2]&0x03)<<8 | int(payload[offset+3])
+		offset += 4
+	}
+	if offset+length > len(payload) {
+		return nil, errInvalidRED
+	}
+	return payload[offset+length:], nil
+}
+
+// writeRED writes an audio packet wrapping it with the previous payloads, or
+// unwrapping the primary encoding for subscribers without RED.
+func (d *DownTrack) writeRED(hdr *rtp.Header, payload []byte) error {
+	if d.redUnwrap {
+		primary, err := getREDPrimary(payload)
+		if err != nil {
+			d.dropRTP(hdr)
+			return nil
+		}
+		return d.writeRTP(hdr, primary)
+	}
+	if red, ok := d.red.encode(hdr.Timestamp, hdr.PayloadType, payload); ok {
+		hdr.PayloadType = d.red.payloadType
+		return d.writeRTP(hdr, red)
+	}
+	return d.writeRTP(hdr, payload)
+}
@@ -0,0 +1,88 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestREDEncoder_setLossFraction(t *testing.T) {
+	e := newREDEncoder(63, 10)
+	tests := []struct {
+		name         string
+		fractionLost uint8
+		want         int32
+	}{
+		{name: "Must not add redundancy under the threshold", fractionLost: 20, want: 0},
+		{name: "Must add a payload over the threshold", fractionLost: 26, want: 1},
+		{name: "Must keep the redundancy over half the threshold", fractionLost: 13, want: 1},
+		{name: "Must add two payloads over twice the threshold", fractionLost: 60, want: 2},
+		{name: "Must keep a payload under the threshold", fractionLost: 13, want: 1},
+		{name: "Must stop under half the threshold", fractionLost: 11, want: 0},
+	}
+	for _, tt := range tests {
+		e.setLossFraction(tt.fractionLost)
+		assert.Equal(t, tt.want, e.distance, tt.name)
+	}
+}
+
+func TestREDEncoder_encode(t *testing.T) {
+	e := newREDEncoder(63, 0)
+	_, ok := e.encode(960, 111, []byte{0x01, 0x02})
+	assert.False(t, ok)
+
+	e.setLossFraction(255)
+	red, ok := e.encode(1920, 111, []byte{0x03})
+	assert.True(t, ok)
+	// Only one previous payload is known
+	assert.Equal(t, []byte{
+		0x80 | 111, 0x0f, 0x00, 0x02,
+		111,
+		0x01, 0x02,
+		0x03,
+	}, red)
+	primary, err := getREDPrimary(red)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x03}, primary)
+
+	red, ok = e.encode(2880, 111, []byte{0x04, 0x05})
+	assert.True(t, ok)
+	assert.Equal(t, []byte{
+		0x80 | 111, 0x1e, 0x00, 0x02,
+		0x80 | 111, 0x0f, 0x00, 0x01,
+		111,
+		0x01, 0x02,
+		0x03,
+		0x04, 0x05,
+	}, red)
+	primary, err = getREDPrimary(red)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x04, 0x05}, primary)
+
+	_, err = getREDPrimary([]byte{0x80 | 111, 0x0f, 0x00, 0x08, 111, 0x01})
+	assert.Error(t, err)
+}
+
+func TestDownTrack_writeRED(t *testing.T) {
+	w := &probeTestWriter{}
+	d := &DownTrack{
+		ssrc:        1234,
+		payloadType: 111,
+		writeStream: w,
+		redUnwrap:   true,
+	}
+	hdr := rtp.Header{SequenceNumber: 1, Timestamp: 1920, SSRC: 1234, PayloadType: 111}
+	assert.NoError(t, d.writeRED(&hdr, []byte{0x80 | 111, 0x0f, 0x00, 0x01, 111, 0x01, 0x02, 0x03}))
+	assert.Len(t, w.payloads, 1)
+	assert.Equal(t, []byte{0x02, 0x03}, w.payloads[0])
+	assert.Equal(t, uint8(111), w.headers[0].PayloadType)
+
+	// An invalid RED payload is dropped without leaving a gap
+	d.lastSN = 2
+	hdr = rtp.Header{SequenceNumber: 2, Timestamp: 2880, SSRC: 1234, PayloadType: 111}
+	assert.NoError(t, d.writeRED(&hdr, []byte{0x80 | 111, 0x0f}))
+	assert.Len(t, w.payloads, 1)
+	assert.Equal(t, uint16(1), d.lastSN)
+	assert.Equal(t, uint16(1), d.snOffset)
+}
@@ -7,6 +7,7 @@
    - RTPReceiverからReceiverオブジェクトへの変換
    - トラックIDによるReceiver検索
    - 同じトラックの複数レイヤー（Simulcast）のサポート
+   - PeerConnectionを持たないローカルReceiver（プレーンRTPなど）の登録
 
 2. DownTrack作成と管理
    - Receiverからサブスクライバーへのダウントラックの作成
@@ -30,6 +31,9 @@
 package sfu
 
 import (
+	"fmt"
+	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -55,13 +59,25 @@ type Router interface {
 
 // RouterConfig defines Router configurations
 type RouterConfig struct {
-	WithStats           bool            `mapstructure:"withstats"`
-	MaxBandwidth        uint64          `mapstructure:"maxbandwidth"`
-	MaxPacketTrack      int             `mapstructure:"maxpackettrack"`
-	AudioLevelInterval  int             `mapstructure:"audiolevelinterval"`
-	AudioLevelThreshold uint8           `mapstructure:"audiolevelthreshold"`
-	AudioLevelFilter    int             `mapstructure:"audiolevelfilter"`
-	Simulcast           SimulcastConfig `mapstructure:"simulcast"`
+	WithStats           bool   `mapstructure:"withstats"`
+	MaxBandwidth        uint64 `mapstructure:"maxbandwidth"`
+	MaxPacketTrack      int    `mapstructure:"maxpackettrack"`
+	AudioLevelInterval  int    `mapstructure:"audiolevelinterval"`
+	AudioLevelThreshold uint8  `mapstructure:"audiolevelthreshold"`
+	AudioLevelFilter    int    `mapstructure:"audiolevelfilter"`
+	// LastN forwards to each subscriber the video of the N most recent
+	// speakers only, all the video is forwarded when zero
+	LastN          int                  `mapstructure:"lastn"`
+	Simulcast      SimulcastConfig      `mapstructure:"simulcast"`
+	BWE            BWEConfig            `mapstructure:"bwe"`
+	LayerSelection LayerSelectionConfig `mapstructure:"layerselection"`
+	GOPCache       GOPCacheConfig       `mapstructure:"gopcache"`
+	FEC            FECConfig            `mapstructure:"fec"`
+	RED            REDConfig            `mapstructure:"red"`
+	// LayerSelector overrides the policy set in LayerSelection
+	LayerSelector LayerSelector `mapstructure:"-"`
+	// PacketMiddlewares process the RTP packets of every receiver and down track
+	PacketMiddlewares []PacketMiddleware `mapstructure:"-"`
 }
 
 type router struct {
@@ -73,6 +89,7 @@ type router struct {
 	stopCh        chan struct{}
 	config        RouterConfig
 	session       Session
+	layerSelector LayerSelector
 	receivers     map[string]Receiver
 	bufferFactory *buffer.Factory
 	writeRTCP     func([]rtcp.Packet) error
@@ -94,6 +111,10 @@ func newRouter(id string, session Session, config *WebRTCTransportConfig) Router
 		bufferFactory: config.BufferFactory,
 	}
 
+	if r.layerSelector = config.Router.LayerSelector; r.layerSelector == nil {
+		r.layerSelector = newLayerSelector(config.Router.LayerSelection)
+	}
+
 	if config.Router.WithStats {
 		stats.Peers.Inc()
 	}
@@ -101,8 +122,15 @@ func newRouter(id string, session Session, config *WebRTCTransportConfig) Router
 	return r
 }
 
+// GetReceiver returns a copy of the receivers of the router by track id
 func (r *router) GetReceiver() map[string]Receiver {
-	return r.receivers
+	r.RLock()
+	defer r.RUnlock()
+	receivers := make(map[string]Receiver, len(r.receivers))
+	for id, recv := range r.receivers {
+		receivers[id] = recv
+	}
+	return receivers
 }
 
 func (r *router) OnAddReceiverTrack(f func(receiver Receiver)) {
@@ -132,32 +160,7 @@ func (r *router) AddReceiver(receiver *webrtc.RTPReceiver, track *webrtc.TrackRe
 	publish := false
 
 	buff, rtcpReader := r.bufferFactory.GetBufferPair(uint32(track.SSRC()))
-
-	buff.OnFeedback(func(fb []rtcp.Packet) {
-		r.rtcpCh <- fb
-	})
-
-	if track.Kind() == webrtc.RTPCodecTypeAudio {
-		buff.OnAudioLevel(func(level uint8) {
-			r.session.AudioObserver().observe(streamID, level)
-		})
-		r.session.AudioObserver().addStream(streamID)
-
-	} else if track.Kind() == webrtc.RTPCodecTypeVideo {
-		if r.twcc == nil {
-			r.twcc = twcc.NewTransportWideCCResponder(uint32(track.SSRC()))
-			r.twcc.OnFeedback(func(p rtcp.RawPacket) {
-				r.rtcpCh <- []rtcp.Packet{&p}
-			})
-		}
-		buff.OnTransportWideCC(func(sn uint16, timeNS int64, marker bool) {
-			r.twcc.Push(sn, timeNS, marker)
-		})
-	}
-
-	if r.config.WithStats {
-		r.stats[uint32(track.SSRC())] = stats.NewStream(buff)
-	}
+	r.hookBuffer(buff, track.Kind(), uint32(track.SSRC()), streamID)
 
 	rtcpReader.OnPacket(func(bytes []byte) {
 		pkts, err := rtcp.Unmarshal(bytes)
@@ -205,9 +208,23 @@ func (r *router) AddReceiver(receiver *webrtc.RTPReceiver, track *webrtc.TrackRe
 			}
 			if recv.Kind() == webrtc.RTPCodecTypeAudio {
 				r.session.AudioObserver().removeStream(track.StreamID())
+				r.session.DominantSpeakerDetector().removeStream(track.StreamID())
 			}
 			r.deleteReceiver(trackID, uint32(track.SSRC()))
 		})
+		if wr, ok := recv.(*WebRTCReceiver); ok && len(r.config.PacketMiddlewares) > 0 {
+			wr.UsePacketMiddlewares(r.config.PacketMiddlewares...)
+		}
+		if wr, ok := recv.(*WebRTCReceiver); ok && recv.Kind() == webrtc.RTPCodecTypeVideo {
+			if r.config.Simulcast.Dynacast {
+				wr.EnableDynacast(func(active [3]bool) {
+					r.sendDynacast(wr, active)
+				})
+			}
+			if r.config.GOPCache.Enabled {
+				wr.EnableGOPCache(r.config.GOPCache)
+			}
+		}
 		publish = true
 
 		if handler, ok := r.onAddTrack.Load().(func(Receiver)); ok && handler != nil {
@@ -232,6 +249,102 @@ func (r *router) AddReceiver(receiver *webrtc.RTPReceiver, track *webrtc.TrackRe
 	return recv, publish
 }
 
+// addLocalReceiver adds the receiver of a track received outside of a peer
+// connection, the packets of the track are written to the returned buffer
+func (r *router) addLocalReceiver(t TrackParams) (*WebRTCReceiver, *buffer.Buffer, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.receivers[t.TrackID]; ok {
+		return nil, nil, errTrackExists
+	}
+	kind := t.kind()
+	if kind == 0 {
+		return nil, nil, errUnsupportedTrackKind
+	}
+
+	buff := r.bufferFactory.NewBuffer(t.SSRC)
+	r.hookBuffer(buff, kind, t.SSRC, t.StreamID)
+
+	recv := newLocalReceiver(t, r.id)
+	r.receivers[t.TrackID] = recv
+	recv.SetRTCPCh(r.rtcpCh)
+	recv.OnCloseHandler(func() {
+		if r.config.WithStats {
+			if kind == webrtc.RTPCodecTypeVideo {
+				stats.VideoTracks.Dec()
+			} else {
+				stats.AudioTracks.Dec()
+			}
+		}
+		if kind == webrtc.RTPCodecTypeAudio {
+			r.session.AudioObserver().removeStream(t.StreamID)
+			r.session.DominantSpeakerDetector().removeStream(t.StreamID)
+		}
+		r.deleteReceiver(t.TrackID, t.SSRC)
+	})
+	if len(r.config.PacketMiddlewares) > 0 {
+		recv.UsePacketMiddlewares(r.config.PacketMiddlewares...)
+	}
+	if kind == webrtc.RTPCodecTypeVideo && r.config.GOPCache.Enabled {
+		recv.EnableGOPCache(r.config.GOPCache)
+	}
+	if handler, ok := r.onAddTrack.Load().(func(Receiver)); ok && handler != nil {
+		handler(recv)
+	}
+
+	recv.addLayer(0, t.SSRC, buff, r.config.Simulcast.BestQualityFirst)
+	buff.Bind(webrtc.RTPParameters{
+		HeaderExtensions: t.HeaderExtensions,
+		Codecs:           []webrtc.RTPCodecParameters{t.Codec},
+	}, buffer.Options{
+		MaxBitRate: r.config.MaxBandwidth,
+	})
+
+	if r.config.WithStats {
+		if kind == webrtc.RTPCodecTypeVideo {
+			stats.VideoTracks.Inc()
+		} else {
+			stats.AudioTracks.Inc()
+		}
+	}
+	return recv, buff, nil
+}
+
+// hookBuffer sends the feedback of the buffer to the publisher, and its audio
+// levels and transport wide sequence numbers to the session and router
+func (r *router) hookBuffer(buff *buffer.Buffer, kind webrtc.RTPCodecType, ssrc uint32, streamID string) {
+	buff.OnFeedback(func(fb []rtcp.Packet) {
+		r.rtcpCh <- fb
+	})
+
+	if kind == webrtc.RTPCodecTypeAudio {
+		buff.OnAudioLevel(func(level uint8) {
+			r.session.AudioObserver().observe(streamID, level)
+		})
+		buff.OnVoiceActivity(func(level uint8, voice bool) {
+			r.session.DominantSpeakerDetector().observe(streamID, level, voice)
+		})
+		r.session.AudioObserver().addStream(streamID)
+		r.session.DominantSpeakerDetector().addStream(streamID)
+
+	} else if kind == webrtc.RTPCodecTypeVideo {
+		if r.twcc == nil {
+			r.twcc = twcc.NewTransportWideCCResponder(ssrc)
+			r.twcc.OnFeedback(func(p rtcp.RawPacket) {
+				r.rtcpCh <- []rtcp.Packet{&p}
+			})
+		}
+		buff.OnTransportWideCC(func(sn uint16, timeNS int64, marker bool) {
+			r.twcc.Push(sn, timeNS, marker)
+		})
+	}
+
+	if r.config.WithStats {
+		r.stats[ssrc] = stats.NewStream(buff)
+	}
+}
+
 func (r *router) AddDownTracks(s *Subscriber, recv Receiver) error {
 	r.Lock()
 	defer r.Unlock()
@@ -276,17 +389,69 @@ func (r *router) AddDownTrack(sub *Subscriber, recv Receiver) (*DownTrack, error
 	if err := sub.me.RegisterCodec(codec, recv.Kind()); err != nil {
 		return nil, err
 	}
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) && r.config.RED.Enabled:
+		if err := sub.me.RegisterCodec(redCodec(codec.PayloadType), recv.Kind()); err != nil {
+			return nil, err
+		}
+	case strings.EqualFold(codec.MimeType, mimeTypeRED):
+		// Plain Opus for the subscribers without RED
+		if pt, ok := getREDPrimaryPayloadType(codec); ok {
+			if err := sub.me.RegisterCodec(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+				PayloadType:        pt,
+			}, recv.Kind()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if wr, ok := recv.(*WebRTCReceiver); ok && wr.rtxPayloadType != 0 {
+		if err := sub.me.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeTypeRTX,
+				ClockRate:   codec.ClockRate,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", codec.PayloadType),
+			},
+			PayloadType: wr.rtxPayloadType,
+		}, recv.Kind()); err != nil {
+			return nil, err
+		}
+	}
 
+	feedback := []webrtc.RTCPFeedback{{"goog-remb", ""}, {"nack", ""}, {"nack", "pli"}}
+	if sub.bwe != nil {
+		feedback = append(feedback, webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC})
+	}
 	downTrack, err := NewDownTrack(webrtc.RTPCodecCapability{
 		MimeType:     codec.MimeType,
 		ClockRate:    codec.ClockRate,
 		Channels:     codec.Channels,
 		SDPFmtpLine:  codec.SDPFmtpLine,
-		RTCPFeedback: []webrtc.RTCPFeedback{{"goog-remb", ""}, {"nack", ""}, {"nack", "pli"}},
+		RTCPFeedback: feedback,
 	}, recv, r.bufferFactory, sub.id, r.config.MaxPacketTrack)
 	if err != nil {
 		return nil, err
 	}
+	downTrack.bwe = sub.bwe
+	if r.config.RED.Enabled {
+		downTrack.redLossThreshold = r.config.RED.LossThreshold
+		if downTrack.redLossThreshold == 0 {
+			downTrack.redLossThreshold = defaultREDLossThreshold
+		}
+	}
+	if r.config.FEC.Enabled && recv.Kind() == webrtc.RTPCodecTypeVideo {
+		downTrack.fecSSRC = rand.Uint32()
+		downTrack.fecMaxOverhead = r.config.FEC.MaxOverhead
+	}
+	if len(r.config.PacketMiddlewares) > 0 {
+		downTrack.UsePacketMiddlewares(r.config.PacketMiddlewares...)
+	}
+	downTrack.onReceiverFeedback = sub.handleReceiverFeedback
+	if r.config.Simulcast.EnableProbing {
+		downTrack.prober = newBandwidthProber(r.config.Simulcast.ProbeDuration)
+	}
+	downTrack.routerSelector = r.layerSelector
+	downTrack.SetLayerSelector(sub.getLayerSelector())
 	// Create webrtc sender for the peer we are sending track to
 	if downTrack.transceiver, err = sub.pc.AddTransceiverFromTrack(downTrack, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionSendonly,
@@ -0,0 +1,343 @@
+/*
+【ファイル概要: rtspserver.go】
+セッションで公開されたストリームをRTSPで配信する組み込みサーバー。
+VMSやffplayなどのRTSPクライアントが rtsp://host/<session>/<stream> で再生できます。
+
+【主要な役割】
+1. DESCRIBE
+   - セッションのルーター（パブリッシャー、リレー、ピアを持たないルーター）から
+     ストリームIDのレシーバーを検索し、映像、音声の順にメディアとして記述
+   - REDの音声はOpusとして記述（ダウントラックがREDを外して送信）
+
+2. PLAY
+   - SETUPされたメディアごとにダウントラックを作成し、レシーバーに接続
+   - SSRC、シーケンス番号、タイムスタンプの書き換えとキーフレームからの開始は
+     通常のダウントラックと同じ
+   - 映像のキーフレームを要求（PLI）
+
+3. サイマルキャストのレイヤー選択
+   - URLのクエリパラメータ layer（0〜2、またはq/h/f）で空間レイヤーを固定
+   - 指定がない場合はReceiver Reportの損失率でレイヤーを切り替え
+
+4. RTCP
+   - クライアントのPLI・NACK・Receiver Reportをダウントラックで処理し、
+     Sender Reportを定期的に送信
+*/
+package sfu
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/rtsp"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const rtspReportInterval = 5 * time.Second
+
+// RTSPServerConfig defines the RTSP server of the session streams
+type RTSPServerConfig struct {
+	// Address the server listens on, like ":8554", the server is disabled when empty
+	Address string `mapstructure:"address"`
+}
+
+// RTSPServer serves the streams of the sessions at rtsp://host/<session>/<stream>,
+// the spatial layer of simulcast and SVC tracks is selected with the layer
+// query parameter (0 to 2, or q, h and f)
+type RTSPServer struct {
+	sfu    *SFU
+	server *rtsp.Server
+	ln     net.Listener
+	closed atomicBool
+}
+
+// NewRTSPServer starts serving the streams of the sessions
+func NewRTSPServer(s *SFU, c RTSPServerConfig) (*RTSPServer, error) {
+	ln, err := net.Listen("tcp", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	srv := &RTSPServer{sfu: s, ln: ln}
+	srv.server = rtsp.NewServer(rtspHandler{srv})
+	go func() {
+		if err := srv.server.Serve(ln); err != nil && !srv.closed.get() {
+			Logger.Error(err, "RTSP server err")
+		}
+	}()
+	Logger.V(0).Info("RTSP server listening", "address", ln.Addr().String())
+	return srv, nil
+}
+
+// Addr returns the address the server listens on
+func (s *RTSPServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close stops the server and the playing clients
+func (s *RTSPServer) Close() error {
+	if !s.closed.set(true) {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// rtspHandler provides the session streams to the RTSP server
+type rtspHandler struct {
+	s *RTSPServer
+}
+
+func (h rtspHandler) Describe(u *url.URL) ([]rtsp.Media, error) {
+	session, streamID, _, err := parseRTSPPath(u)
+	if err != nil {
+		return nil, err
+	}
+	s := h.s.sfu.getSession(session)
+	if s == nil {
+		return nil, rtsp.ErrStreamNotFound
+	}
+	receivers := streamReceivers(s, streamID)
+	if len(receivers) == 0 {
+		return nil, rtsp.ErrStreamNotFound
+	}
+	medias := make([]rtsp.Media, 0, len(receivers))
+	for _, recv := range receivers {
+		medias = append(medias, rtspMedia(recv))
+	}
+	return medias, nil
+}
+
+func (h rtspHandler) Play(u *url.URL, session *rtsp.ServerSession) (rtsp.Player, error) {
+	sid, streamID, layer, err := parseRTSPPath(u)
+	if err != nil {
+		return nil, err
+	}
+	s := h.s.sfu.getSession(sid)
+	if s == nil {
+		return nil, rtsp.ErrStreamNotFound
+	}
+	receivers := make(map[string]Receiver)
+	for _, recv := range streamReceivers(s, streamID) {
+		receivers[recv.TrackID()] = recv
+	}
+
+	p := &rtspPlayer{
+		id:         cuid.New(),
+		session:    session,
+		downTracks: make(map[int]*DownTrack),
+		closeCh:    make(chan struct{}),
+	}
+	for i, m := range session.Medias() {
+		if !session.IsSetup(i) {
+			continue
+		}
+		recv := receivers[m.TrackID]
+		if recv == nil {
+			_ = p.Close()
+			return nil, rtsp.ErrStreamNotFound
+		}
+		if err = p.addDownTrack(h.s.sfu.webrtc, recv, i, layer); err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+	}
+	p.RLock()
+	for _, dt := range p.downTracks {
+		dt.requestKeyFrame()
+	}
+	p.RUnlock()
+	go p.sendReports()
+	Logger.V(0).Info("RTSP client playing", "session_id", sid, "stream_id", streamID, "tracks", len(p.downTracks))
+	return p, nil
+}
+
+// rtspPlayer forwards the tracks of a stream to a RTSP client
+type rtspPlayer struct {
+	sync.RWMutex
+	id         string
+	session    *rtsp.ServerSession
+	downTracks map[int]*DownTrack
+	closeCh    chan struct{}
+	closed     atomicBool
+}
+
+// addDownTrack forwards a receiver to a media of the session, at a spatial
+// layer or adapted to the loss of the client when layer is negative
+func (p *rtspPlayer) addDownTrack(c WebRTCTransportConfig, recv Receiver, media, layer int) error {
+	downTrack, err := newLocalDownTrack(recv, rtspTrackWriter{session: p.session, media: media}, p.id, c.Router.MaxPacketTrack, func() {
+		p.Lock()
+		delete(p.downTracks, media)
+		done := len(p.downTracks) == 0
+		p.Unlock()
+		// The client is disconnected when the stream is unpublished
+		if done && !p.closed.get() {
+			_ = p.session.Close()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	p.downTracks[media] = downTrack
+	p.Unlock()
+
+	if layer < 0 {
+		recv.AddDownTrack(downTrack, c.Router.Simulcast.BestQualityFirst)
+		return nil
+	}
+	recv.AddDownTrack(downTrack, layer > 0)
+	if int32(layer) != atomic.LoadInt32(&downTrack.targetSpatialLayer) {
+		_ = downTrack.SwitchSpatialLayer(int32(layer), true)
+	}
+	// The layer of the URL is kept whatever the loss of the client
+	downTrack.onReceiverFeedback = func(uint8, uint64) {}
+	return nil
+}
+
+func (p *rtspPlayer) HandleRTCP(media int, pkt []byte) {
+	p.RLock()
+	dt := p.downTracks[media]
+	p.RUnlock()
+	if dt != nil {
+		dt.handleRTCP(pkt)
+	}
+}
+
+func (p *rtspPlayer) Close() error {
+	if !p.closed.set(true) {
+		return nil
+	}
+	close(p.closeCh)
+	p.RLock()
+	downTracks := make([]*DownTrack, 0, len(p.downTracks))
+	for _, dt := range p.downTracks {
+		downTracks = append(downTracks, dt)
+	}
+	p.RUnlock()
+	for _, dt := range downTracks {
+		dt.receiver.DeleteDownTrack(dt.CurrentSpatialLayer(), dt.id)
+	}
+	return nil
+}
+
+// sendReports sends the sender reports of the down tracks
+func (p *rtspPlayer) sendReports() {
+	ticker := time.NewTicker(rtspReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		case <-ticker.C:
+			p.RLock()
+			for media, dt := range p.downTracks {
+				sr := dt.CreateSenderReport()
+				if sr == nil {
+					continue
+				}
+				pkts := []rtcp.Packet{sr}
+				if chunks := dt.CreateSourceDescriptionChunks(); len(chunks) > 0 {
+					pkts = append(pkts, &rtcp.SourceDescription{Chunks: chunks})
+				}
+				if raw, err := rtcp.Marshal(pkts); err == nil {
+					_ = p.session.WriteRTCP(media, raw)
+				}
+			}
+			p.RUnlock()
+		}
+	}
+}
+
+// rtspTrackWriter writes the packets of a down track to a media of a RTSP session
+type rtspTrackWriter struct {
+	session *rtsp.ServerSession
+	media   int
+}
+
+func (w rtspTrackWriter) WriteRTP(hdr *rtp.Header, payload []byte) (int, error) {
+	raw, err := (&rtp.Packet{Header: *hdr, Payload: payload}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return len(raw), w.session.WriteRTP(w.media, raw)
+}
+
+func (w rtspTrackWriter) Write(b []byte) (int, error) {
+	return len(b), w.session.WriteRTP(w.media, append([]byte(nil), b...))
+}
+
+// parseRTSPPath returns the session, the stream and the spatial layer (-1
+// when not selected) of a RTSP URL
+func parseRTSPPath(u *url.URL) (string, string, int, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", 0, rtsp.ErrInvalidURL
+	}
+	layer := -1
+	switch u.Query().Get("layer") {
+	case "":
+	case "0", "q":
+		layer = 0
+	case "1", "h":
+		layer = 1
+	case "2", "f":
+		layer = 2
+	default:
+		return "", "", 0, rtsp.ErrInvalidURL
+	}
+	return parts[0], parts[1], layer, nil
+}
+
+// streamReceivers returns the receivers of a stream of a session, the video
+// tracks first and then by track id
+func streamReceivers(s Session, streamID string) []Receiver {
+	var receivers []Receiver
+	for _, r := range sessionRouters(s) {
+		for _, recv := range r.GetReceiver() {
+			if recv.StreamID() == streamID {
+				receivers = append(receivers, recv)
+			}
+		}
+	}
+	sort.Slice(receivers, func(i, j int) bool {
+		if receivers[i].Kind() != receivers[j].Kind() {
+			return receivers[i].Kind() == webrtc.RTPCodecTypeVideo
+		}
+		return receivers[i].TrackID() < receivers[j].TrackID()
+	})
+	return receivers
+}
+
+// rtspMedia describes the packets of the down tracks of a receiver
+func rtspMedia(recv Receiver) rtsp.Media {
+	codec := recv.Codec()
+	m := rtsp.Media{
+		Type:        recv.Kind().String(),
+		PayloadType: uint8(codec.PayloadType),
+		Codec:       strings.ToUpper(codec.MimeType[strings.Index(codec.MimeType, "/")+1:]),
+		ClockRate:   codec.ClockRate,
+		Channels:    codec.Channels,
+		TrackID:     recv.TrackID(),
+	}
+	if strings.EqualFold(codec.MimeType, mimeTypeRED) {
+		// The down tracks unwrap the primary Opus encoding
+		m.Codec = "OPUS"
+		return m
+	}
+	for _, param := range strings.Split(codec.SDPFmtpLine, ";") {
+		if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 {
+			if m.Fmtp == nil {
+				m.Fmtp = make(map[string]string)
+			}
+			m.Fmtp[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+	return m
+}
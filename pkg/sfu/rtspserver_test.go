@@ -0,0 +1,167 @@
+package sfu
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/rtsp"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTSPServer_Play(t *testing.T) {
+	s := NewSFU(newTestConfig())
+	srv, err := NewRTSPServer(s, RTSPServerConfig{Address: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	defer srv.Close()
+
+	in, err := NewPlainTransport(s, "rtsp", PlainTransportConfig{ListenIP: "127.0.0.1"})
+	assert.NoError(t, err)
+	defer in.Close()
+	camera, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer camera.Close()
+	assert.NoError(t, in.Connect(PlainConnectConfig{IP: "127.0.0.1", Port: camera.LocalAddr().(*net.UDPAddr).Port}))
+
+	audio := plainTestTrack
+	audio.StreamID = "camera"
+	audio.SSRC = 5678
+	video := TrackParams{
+		TrackID:  "video",
+		StreamID: "camera",
+		Codec: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			PayloadType:        96,
+		},
+		SSRC: 1234,
+	}
+	assert.NoError(t, in.Publish(audio))
+	assert.NoError(t, in.Publish(video))
+
+	sn := uint16(1)
+	send := func() {
+		vp8, _ := (&rtp.Packet{
+			Header:  rtp.Header{Version: 2, Marker: true, PayloadType: 96, SequenceNumber: sn, Timestamp: uint32(sn) * 3000, SSRC: 1234},
+			Payload: []byte{0x10, 0x00, 0x00, 0x9d, 0x01, 0x2a},
+		}).Marshal()
+		_, _ = camera.WriteToUDP(vp8, in.LocalAddr())
+		_, _ = camera.WriteToUDP(plainTestPacket(sn), in.LocalAddr())
+		sn++
+	}
+	send()
+	session, _ := s.GetSession("rtsp")
+	if !assert.NotNil(t, waitReceiver(session, "camera", "video")) || !assert.NotNil(t, waitReceiver(session, "camera", "audio")) {
+		return
+	}
+
+	base := "rtsp://" + srv.Addr().String()
+	missing, err := rtsp.Dial(base+"/rtsp/missing", rtsp.ClientConfig{Timeout: time.Second})
+	assert.NoError(t, err)
+	_, err = missing.Describe()
+	if assert.IsType(t, &rtsp.StatusError{}, err) {
+		assert.Equal(t, rtsp.StatusNotFound, err.(*rtsp.StatusError).StatusCode)
+	}
+	_ = missing.Close()
+
+	c, err := rtsp.Dial(base+"/rtsp/camera?layer=f", rtsp.ClientConfig{Timeout: time.Second})
+	assert.NoError(t, err)
+	defer c.Close()
+	medias, err := c.Describe()
+	assert.NoError(t, err)
+	if !assert.Len(t, medias, 2) {
+		return
+	}
+	assert.Equal(t, "video", medias[0].Type)
+	assert.Equal(t, "VP8", medias[0].Codec)
+	assert.Equal(t, uint8(96), medias[0].PayloadType)
+	assert.Equal(t, "OPUS", medias[1].Codec)
+	assert.Equal(t, uint16(2), medias[1].Channels)
+	for _, m := range medias {
+		assert.NoError(t, c.Setup(m))
+	}
+
+	received := make(chan rtp.Packet, 100)
+	assert.NoError(t, c.Play(func(track int, isRTCP bool, b []byte) {
+		var pkt rtp.Packet
+		if isRTCP || pkt.Unmarshal(b) != nil {
+			return
+		}
+		select {
+		case received <- pkt:
+		default:
+		}
+	}))
+
+	// A keyframe is requested to the publisher on PLAY
+	pli := false
+	buf := make([]byte, 1500)
+	_ = camera.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for !pli {
+		n, _, err := camera.ReadFromUDP(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		pkts, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, p := range pkts {
+			if p, ok := p.(*rtcp.PictureLossIndication); ok && p.MediaSSRC == 1234 {
+				pli = true
+			}
+		}
+	}
+
+	types := make(map[uint8]uint32)
+	deadline := time.After(2 * time.Second)
+	for len(types) < 2 {
+		send()
+		select {
+		case pkt := <-received:
+			types[pkt.PayloadType] = pkt.SSRC
+		case <-deadline:
+			t.Fatal("no media received")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	assert.NotEqual(t, uint32(1234), types[96])
+	assert.NotEqual(t, uint32(5678), types[100])
+
+	recv := findReceiver(session, "camera", "video").(*WebRTCReceiver)
+	assert.Len(t, recv.downTracks[0].Load().([]*DownTrack), 1)
+	assert.NoError(t, c.Close())
+	assert.Eventually(t, func() bool {
+		return len(recv.downTracks[0].Load().([]*DownTrack)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_parseRTSPPath(t *testing.T) {
+	tests := []struct {
+		url     string
+		session string
+		stream  string
+		layer   int
+		err     error
+	}{
+		{url: "rtsp://host/session/stream", session: "session", stream: "stream", layer: -1},
+		{url: "rtsp://host/test%20session/stream/?layer=h", session: "test session", stream: "stream", layer: 1},
+		{url: "rtsp://host/session/stream?layer=0", session: "session", stream: "stream", layer: 0},
+		{url: "rtsp://host/session/stream?layer=3", err: rtsp.ErrInvalidURL},
+		{url: "rtsp://host/session", err: rtsp.ErrInvalidURL},
+		{url: "rtsp://host/session/stream/track", err: rtsp.ErrInvalidURL},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		session, stream, layer, err := parseRTSPPath(u)
+		assert.Equal(t, tt.err, err, tt.url)
+		if err == nil {
+			assert.Equal(t, tt.session, session)
+			assert.Equal(t, tt.stream, stream)
+			assert.Equal(t, tt.layer, layer)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+/*
+【ファイル概要: rtspsource.go】
+IPカメラなどのRTSPソースを取り込み、セッションの参加者として公開するワーカー。
+
+【主要な役割】
+1. 取り込み
+   - RTSPのURLをTCPインターリーブまたはUDPで受信（pkg/rtspのクライアント）
+   - H.264、H.265、G.711（PCMU/PCMA）、Opusのメディアを公開
+     （AACなどWebRTCのサブスクライバーが受信できないコーデックはスキップ）
+   - ピアを持たないルーターのレシーバーとしてセッションに公開し、
+     最初のパケットのSSRCでバッファを作成
+
+2. H.264/H.265のパラメータセット
+   - SDPのsprop-parameter-sets（H.265はsprop-vps/sps/pps）を保持し、
+     帯域内で送られないカメラのIDRフレームの前に集約パケットで挿入
+   - 挿入したパケットの分だけ以降のシーケンス番号をずらす
+
+3. キーフレーム要求
+   - サブスクライバーのPLI/FIRをRTCPでカメラに転送
+   - KeyframeTimeoutの間キーフレームが届かない場合はTEARDOWNして再接続
+     （多くのカメラは再生開始時にIDRフレームを送信する）
+
+4. 再接続
+   - 接続が切れた場合やメディアが届かない場合はトラックを削除し、
+     ReconnectDelayから倍にしながら最大30秒の間隔で再接続
+*/
+package sfu
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/ion-sfu/pkg/rtsp"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultRTSPReconnectDelay = 2 * time.Second
+	maxRTSPReconnectDelay     = 30 * time.Second
+)
+
+var (
+	errRTSPNoTracks         = errors.New("no supported track in the rtsp source")
+	errRTSPKeyframeTimeout  = errors.New("no keyframe received after a keyframe request")
+	errRTSPSourceNotStarted = errors.New("rtsp source url or session missing")
+)
+
+// RTSPConfig defines the RTSP sources published to the sessions and the
+// RTSP server of the session streams
+type RTSPConfig struct {
+	Sources []RTSPSourceConfig `mapstructure:"source"`
+	Server  RTSPServerConfig   `mapstructure:"server"`
+}
+
+// RTSPSourceConfig defines a RTSP source
+type RTSPSourceConfig struct {
+	// URL of the source, rtsp:// or rtsps://, with the credentials when required
+	URL string `mapstructure:"url"`
+	// Session the tracks are published to
+	Session string `mapstructure:"session"`
+	// StreamID of the tracks, the source id when empty
+	StreamID string `mapstructure:"streamid"`
+	// Transport of the media, "tcp" (default) or "udp"
+	Transport string `mapstructure:"transport"`
+	// Timeout in [ms] of the requests and of the reception of media, 10s when zero
+	Timeout int `mapstructure:"timeout"`
+	// ReconnectDelay in [ms] before reconnecting, doubled while the source
+	// fails up to 30s, 2s when zero
+	ReconnectDelay int `mapstructure:"reconnectdelay"`
+	// KeyframeTimeout in [ms] without keyframe after a keyframe request before
+	// the source is restarted, zero never restarts
+	KeyframeTimeout int `mapstructure:"keyframetimeout"`
+}
+
+// RTSPSource publishes the tracks of a RTSP source to a session, and
+// reconnects until it is closed
+type RTSPSource struct {
+	id       string
+	provider SessionProvider
+	config   RTSPSourceConfig
+	closeCh  chan struct{}
+	closed   atomicBool
+}
+
+// NewRTSPSource starts publishing a RTSP source
+func NewRTSPSource(provider SessionProvider, c RTSPSourceConfig) (*RTSPSource, error) {
+	if c.URL == "" || c.Session == "" {
+		return nil, errRTSPSourceNotStarted
+	}
+	s := &RTSPSource{
+		id:       cuid.New(),
+		provider: provider,
+		config:   c,
+		closeCh:  make(chan struct{}),
+	}
+	if s.config.StreamID == "" {
+		s.config.StreamID = s.id
+	}
+	go s.run()
+	return s, nil
+}
+
+// ID of the source, also the id of its router in the session
+func (s *RTSPSource) ID() string {
+	return s.id
+}
+
+// Close stops the source and removes its tracks
+func (s *RTSPSource) Close() {
+	if s.closed.set(true) {
+		close(s.closeCh)
+	}
+}
+
+func (s *RTSPSource) run() {
+	base := defaultRTSPReconnectDelay
+	if s.config.ReconnectDelay > 0 {
+		base = time.Duration(s.config.ReconnectDelay) * time.Millisecond
+	}
+	delay := base
+	for {
+		start := time.Now()
+		err := s.stream()
+		if s.closed.get() {
+			return
+		}
+		if err == errRTSPKeyframeTimeout {
+			Logger.V(0).Info("RTSP source restarted for a keyframe", "source_id", s.id)
+			continue
+		}
+		Logger.Error(err, "RTSP source err", "source_id", s.id, "session_id", s.config.Session)
+		if time.Since(start) > maxRTSPReconnectDelay {
+			delay = base
+		}
+		select {
+		case <-s.closeCh:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRTSPReconnectDelay {
+			delay = maxRTSPReconnectDelay
+		}
+	}
+}
+
+// stream publishes the tracks of a connection to the source until it fails
+// or the source is closed
+func (s *RTSPSource) stream() error {
+	client, err := rtsp.Dial(s.config.URL, rtsp.ClientConfig{
+		Transport: s.config.Transport,
+		Timeout:   time.Duration(s.config.Timeout) * time.Millisecond,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	medias, err := client.Describe()
+	if err != nil {
+		return err
+	}
+	ingest := &rtspIngest{source: s, client: client}
+	kinds := make(map[string]int)
+	for _, m := range medias {
+		codec, ok := rtspCodec(m)
+		if !ok {
+			Logger.V(0).Info("RTSP source media not supported", "source_id", s.id, "codec", m.Codec)
+			continue
+		}
+		if err = client.Setup(m); err != nil {
+			return err
+		}
+		trackID := s.config.StreamID + "-" + m.Type
+		if n := kinds[m.Type]; n > 0 {
+			trackID += strconv.Itoa(n)
+		}
+		kinds[m.Type]++
+		ingest.tracks = append(ingest.tracks, &rtspTrack{
+			params:    TrackParams{TrackID: trackID, StreamID: s.config.StreamID, Codec: codec},
+			paramSets: newParameterSets(m),
+		})
+	}
+	if len(ingest.tracks) == 0 {
+		return errRTSPNoTracks
+	}
+
+	session, cfg := s.provider.GetSession(s.config.Session)
+	ingest.session = session
+	ingest.router = newRouter(s.id, session, &cfg).(*router)
+	ingest.router.SetRTCPWriter(ingest.writeRTCP)
+	session.AddRouter(ingest.router)
+	defer ingest.close()
+
+	if err = client.Play(ingest.handlePacket); err != nil {
+		return err
+	}
+	Logger.V(0).Info("RTSP source playing", "source_id", s.id, "session_id", s.config.Session, "tracks", len(ingest.tracks))
+
+	var timeout <-chan time.Time
+	if s.config.KeyframeTimeout > 0 {
+		ticker := time.NewTicker(time.Duration(s.config.KeyframeTimeout) * time.Millisecond / 4)
+		defer ticker.Stop()
+		timeout = ticker.C
+	}
+	for {
+		select {
+		case <-s.closeCh:
+			return nil
+		case <-client.Done():
+			return client.Err()
+		case <-timeout:
+			if ingest.keyframeOverdue(time.Duration(s.config.KeyframeTimeout) * time.Millisecond) {
+				return errRTSPKeyframeTimeout
+			}
+		}
+	}
+}
+
+// rtspIngest publishes the tracks of a connection to a RTSP source
+type rtspIngest struct {
+	sync.Mutex
+	source  *RTSPSource
+	client  *rtsp.Client
+	session Session
+	router  *router
+	tracks  []*rtspTrack
+	// keyframeRequested is the time of the first keyframe request not
+	// followed by a keyframe
+	keyframeRequested time.Time
+}
+
+type rtspTrack struct {
+	params    TrackParams
+	buff      *buffer.Buffer
+	ssrc      uint32
+	paramSets *parameterSets
+	// snOffset is the number of packets inserted before the current one
+	snOffset uint16
+}
+
+func (i *rtspIngest) handlePacket(track int, isRTCP bool, b []byte) {
+	t := i.tracks[track]
+	if isRTCP {
+		pkts, err := rtcp.Unmarshal(b)
+		if err != nil {
+			return
+		}
+		i.Lock()
+		buff := t.buff
+		i.Unlock()
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok && buff != nil {
+				buff.SetSenderReportData(sr.RTPTime, sr.NTPTime)
+			}
+		}
+		return
+	}
+
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(b); err != nil {
+		return
+	}
+	i.Lock()
+	buff := t.buff
+	var recv Receiver
+	if buff == nil {
+		p := t.params
+		p.SSRC = pkt.SSRC
+		var err error
+		if recv, buff, err = i.router.addLocalReceiver(p); err != nil {
+			i.Unlock()
+			Logger.Error(err, "RTSP source publish err", "source_id", i.source.id, "track_id", p.TrackID)
+			return
+		}
+		t.buff = buff
+		t.ssrc = pkt.SSRC
+	}
+	i.Unlock()
+	if recv != nil {
+		i.session.Publish(i.router, recv)
+	}
+
+	if t.paramSets != nil {
+		key, sets := t.paramSets.process(pkt.Payload, pkt.Timestamp)
+		if key {
+			i.Lock()
+			i.keyframeRequested = time.Time{}
+			i.Unlock()
+		}
+		if sets != nil {
+			inserted := rtp.Packet{Header: pkt.Header, Payload: sets}
+			inserted.Marker = false
+			inserted.SequenceNumber += t.snOffset
+			if raw, err := inserted.Marshal(); err == nil {
+				_, _ = buff.Write(raw)
+				t.snOffset++
+			}
+		}
+	}
+	if t.snOffset != 0 {
+		pkt.SequenceNumber += t.snOffset
+		if raw, err := pkt.Marshal(); err == nil {
+			b = raw
+		}
+	}
+	_, _ = buff.Write(b)
+}
+
+// writeRTCP forwards the keyframe requests of the tracks to the source, the
+// other feedback is dropped as cameras ignore it
+func (i *rtspIngest) writeRTCP(pkts []rtcp.Packet) error {
+	for _, pkt := range pkts {
+		var ssrc uint32
+		switch p := pkt.(type) {
+		case *rtcp.PictureLossIndication:
+			ssrc = p.MediaSSRC
+		case *rtcp.FullIntraRequest:
+			ssrc = p.MediaSSRC
+		default:
+			continue
+		}
+		track := -1
+		i.Lock()
+		for n, t := range i.tracks {
+			if t.buff != nil && t.ssrc == ssrc {
+				track = n
+			}
+		}
+		if track >= 0 && i.keyframeRequested.IsZero() {
+			i.keyframeRequested = time.Now()
+		}
+		i.Unlock()
+		if track < 0 {
+			continue
+		}
+		raw, err := pkt.Marshal()
+		if err != nil {
+			return err
+		}
+		if err = i.client.WriteRTCP(track, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *rtspIngest) keyframeOverdue(timeout time.Duration) bool {
+	i.Lock()
+	defer i.Unlock()
+	return !i.keyframeRequested.IsZero() && time.Since(i.keyframeRequested) > timeout
+}
+
+// close removes the tracks of the connection from the session
+func (i *rtspIngest) close() {
+	_ = i.client.Close()
+	i.Lock()
+	for _, t := range i.tracks {
+		if t.buff != nil {
+			_ = t.buff.Close()
+		}
+	}
+	i.Unlock()
+	i.router.Stop()
+	i.session.RemoveRouter(i.router)
+}
+
+// rtspCodec returns the codec a RTSP media is published with, false when
+// WebRTC subscribers can not receive it
+func rtspCodec(m rtsp.Media) (webrtc.RTPCodecParameters, bool) {
+	codec := webrtc.RTPCodecParameters{PayloadType: webrtc.PayloadType(m.PayloadType)}
+	switch m.Codec {
+	case "H264":
+		// Cameras often omit the packetization mode while sending FU-A
+		mode := m.Fmtp["packetization-mode"]
+		if mode == "" {
+			mode = "1"
+		}
+		profile := m.Fmtp["profile-level-id"]
+		if profile == "" {
+			profile = "42e01f"
+			if sps := spropParameterSets(m.Fmtp["sprop-parameter-sets"]); len(sps) > 0 && len(sps[0]) >= 4 {
+				profile = hex.EncodeToString(sps[0][1:4])
+			}
+		}
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=" + mode + ";profile-level-id=" + profile,
+		}
+	case "H265":
+		profile := m.Fmtp["profile-id"]
+		if profile == "" {
+			profile = "1"
+		}
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH265,
+			ClockRate:   90000,
+			SDPFmtpLine: "profile-id=" + profile,
+		}
+	case "PCMU":
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}
+	case "PCMA":
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}
+	case "OPUS":
+		codec.RTPCodecCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+	default:
+		return codec, false
+	}
+	return codec, true
+}
+
+// parameterSets keeps the parameter sets of a H.264 or H.265 track, to insert
+// them before the keyframes of the sources sending them only in the SDP
+type parameterSets struct {
+	h265 bool
+	// sets by NAL unit type, SPS and PPS for H.264 and VPS, SPS and PPS for H.265
+	sets map[uint8][]byte
+	// inBand is true when the sets were received with the timestamp of lastTS
+	inBand bool
+	lastTS uint32
+}
+
+func newParameterSets(m rtsp.Media) *parameterSets {
+	p := &parameterSets{sets: make(map[uint8][]byte)}
+	switch m.Codec {
+	case "H264":
+		for _, nalu := range spropParameterSets(m.Fmtp["sprop-parameter-sets"]) {
+			p.store(nalu)
+		}
+	case "H265":
+		p.h265 = true
+		for _, name := range []string{"sprop-vps", "sprop-sps", "sprop-pps"} {
+			for _, nalu := range spropParameterSets(m.Fmtp[name]) {
+				p.store(nalu)
+			}
+		}
+	default:
+		return nil
+	}
+	return p
+}
+
+// process reads the NAL units of a packet, it returns whether the packet
+// starts a keyframe and the aggregation packet of the sets to send before it
+func (p *parameterSets) process(payload []byte, ts uint32) (key bool, sets []byte) {
+	if p.inBand && p.lastTS != ts {
+		p.inBand = false
+	}
+	p.forEachNALU(payload, func(nalType uint8, nalu []byte) {
+		switch {
+		case p.isParameterSet(nalType):
+			if nalu != nil {
+				p.store(nalu)
+			}
+			p.inBand = true
+			p.lastTS = ts
+		case p.isKeyframe(nalType):
+			key = true
+		}
+	})
+	if !key || p.inBand || !p.complete() {
+		return key, nil
+	}
+	return true, p.aggregate()
+}
+
+func (p *parameterSets) nalType(b byte) uint8 {
+	if p.h265 {
+		return (b >> 1) & 0x3f
+	}
+	return b & 0x1f
+}
+
+func (p *parameterSets) isParameterSet(t uint8) bool {
+	if p.h265 {
+		return t >= 32 && t <= 34
+	}
+	return t == 7 || t == 8
+}
+
+func (p *parameterSets) isKeyframe(t uint8) bool {
+	if p.h265 {
+		return t >= 16 && t <= 21
+	}
+	return t == 5
+}
+
+func (p *parameterSets) store(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+	if t := p.nalType(nalu[0]); p.isParameterSet(t) {
+		p.sets[t] = append([]byte(nil), nalu...)
+	}
+}
+
+func (p *parameterSets) complete() bool {
+	if p.h265 {
+		return len(p.sets) == 3
+	}
+	return len(p.sets) == 2
+}
+
+// forEachNALU calls fn with the NAL units of a single NAL unit, aggregation or
+// starting fragment packet, the data of fragments is nil
+func (p *parameterSets) forEachNALU(payload []byte, fn func(t uint8, nalu []byte)) {
+	hdrLen, aggregation, fragment := 1, uint8(24), uint8(28)
+	if p.h265 {
+		hdrLen, aggregation, fragment = 2, 48, 49
+	}
+	if len(payload) <= hdrLen {
+		return
+	}
+	switch t := p.nalType(payload[0]); t {
+	case aggregation:
+		for i := hdrLen; i+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[i:]))
+			i += 2
+			if size == 0 || i+size > len(payload) {
+				return
+			}
+			fn(p.nalType(payload[i]), payload[i:i+size])
+			i += size
+		}
+	case fragment:
+		fu := payload[hdrLen]
+		if fu&0x80 == 0 {
+			return
+		}
+		if p.h265 {
+			fn(fu&0x3f, nil)
+		} else {
+			fn(fu&0x1f, nil)
+		}
+	default:
+		fn(t, payload)
+	}
+}
+
+// aggregate returns the STAP-A (H.264) or AP (H.265) packet of the sets
+func (p *parameterSets) aggregate() []byte {
+	var b []byte
+	order := []uint8{7, 8}
+	if p.h265 {
+		b = []byte{48 << 1, 1}
+		order = []uint8{32, 33, 34}
+	} else {
+		b = []byte{0x78}
+	}
+	for _, t := range order {
+		nalu := p.sets[t]
+		b = append(b, byte(len(nalu)>>8), byte(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// spropParameterSets decodes the base64 NAL units of a sprop fmtp parameter
+func spropParameterSets(v string) [][]byte {
+	var nalus [][]byte
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if nalu, err := base64.StdEncoding.DecodeString(s); err == nil && len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+	}
+	return nalus
+}
@@ -0,0 +1,418 @@
+package sfu
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/rtsp"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// testRTSPServer is a camera stand-in sending H.264 and PCMU, with an AAC
+// media the sources must skip
+type testRTSPServer struct {
+	sync.Mutex
+	ln       net.Listener
+	password string
+	// keyframes sends IDR frames, non IDR frames only otherwise
+	keyframes bool
+
+	describes int
+	teardowns int
+	plis      int
+	conns     []net.Conn
+}
+
+func newTestRTSPServer(t *testing.T, password string, keyframes bool) *testRTSPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &testRTSPServer{ln: ln, password: password, keyframes: keyframes}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.conns = append(s.conns, conn)
+			s.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testRTSPServer) url() string {
+	return "rtsp://admin:" + s.password + "@" + s.ln.Addr().String() + "/stream"
+}
+
+func (s *testRTSPServer) counts() (describes, teardowns, plis int) {
+	s.Lock()
+	defer s.Unlock()
+	return s.describes, s.teardowns, s.plis
+}
+
+// drop closes the connections of the clients
+func (s *testRTSPServer) drop() {
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testRTSPServer) close() {
+	_ = s.ln.Close()
+	s.drop()
+}
+
+func (s *testRTSPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var writeMu sync.Mutex
+	var transports []rtsp.Transport
+	var udp *net.UDPConn
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for {
+		interleaved, err := rtsp.IsInterleaved(br)
+		if err != nil {
+			return
+		}
+		if interleaved {
+			channel, pkt, err := rtsp.ReadInterleavedFrame(br, nil)
+			if err != nil {
+				return
+			}
+			if channel%2 == 1 {
+				s.countPLI(pkt)
+			}
+			continue
+		}
+		req, err := rtsp.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		res := rtsp.NewResponse(rtsp.StatusOK, req)
+		switch req.Method {
+		case rtsp.MethodDescribe:
+			s.Lock()
+			s.describes++
+			s.Unlock()
+			if !strings.HasPrefix(req.Header.Get("Authorization"), "Basic ") {
+				res.StatusCode = rtsp.StatusUnauthorized
+				res.Header.Set("WWW-Authenticate", `Basic realm="camera"`)
+				break
+			}
+			res.Header.Set("Content-Base", "rtsp://"+s.ln.Addr().String()+"/stream/")
+			res.Body = []byte("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=Camera\r\nt=0 0\r\n" +
+				"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+				"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=" +
+				base64.StdEncoding.EncodeToString(testSPS) + "," + base64.StdEncoding.EncodeToString(testPPS) + "\r\n" +
+				"a=control:trackID=0\r\n" +
+				"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 MPEG4-GENERIC/16000/1\r\na=control:trackID=1\r\n" +
+				"m=audio 0 RTP/AVP 0\r\na=control:trackID=2\r\n")
+		case rtsp.MethodSetup:
+			offers, _ := rtsp.ParseTransports(req.Header.Get("Transport"))
+			tr := offers[0]
+			if !tr.TCP {
+				if udp == nil {
+					udp, _ = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+					go s.readUDP(udp)
+				}
+				port := udp.LocalAddr().(*net.UDPAddr).Port
+				tr.ServerPort = [2]int{port, port}
+			}
+			transports = append(transports, tr)
+			res.Header.Set("Transport", tr.String())
+			res.Header.Set("Session", "1234;timeout=60")
+		case rtsp.MethodPlay:
+			go s.send(conn, &writeMu, udp, transports, stop)
+		case rtsp.MethodTeardown:
+			s.Lock()
+			s.teardowns++
+			s.Unlock()
+		}
+		writeMu.Lock()
+		err = res.Write(conn)
+		writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *testRTSPServer) readUDP(conn *net.UDPConn) {
+	b := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		s.countPLI(b[:n])
+	}
+}
+
+func (s *testRTSPServer) countPLI(b []byte) {
+	pkts, err := rtcp.Unmarshal(b)
+	if err != nil {
+		return
+	}
+	for _, p := range pkts {
+		if _, ok := p.(*rtcp.PictureLossIndication); ok {
+			s.Lock()
+			s.plis++
+			s.Unlock()
+		}
+	}
+}
+
+// send sends a frame of each media every 20ms
+func (s *testRTSPServer) send(conn net.Conn, writeMu *sync.Mutex, udp *net.UDPConn, transports []rtsp.Transport, stop chan struct{}) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for sn := uint16(0); ; sn++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		nalu := []byte{0x41, 0x9a, 0x00}
+		if s.keyframes && sn%10 == 0 {
+			nalu = []byte{0x65, 0x88, 0x84}
+		}
+		pkts := []rtp.Packet{
+			{Header: rtp.Header{Version: 2, Marker: true, PayloadType: 96, SequenceNumber: sn, Timestamp: uint32(sn) * 1800, SSRC: 1111}, Payload: nalu},
+			{Header: rtp.Header{Version: 2, PayloadType: 97, SequenceNumber: sn, Timestamp: uint32(sn) * 320, SSRC: 2222}, Payload: []byte{0x00, 0x10, 0x01, 0x00, 0xaa}},
+			{Header: rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: sn, Timestamp: uint32(sn) * 160, SSRC: 3333}, Payload: make([]byte, 160)},
+		}
+		// The AAC media is not set up
+		for i, tr := range transports {
+			pkt := pkts[0]
+			if i == 1 {
+				pkt = pkts[2]
+			}
+			raw, _ := pkt.Marshal()
+			var err error
+			if tr.TCP {
+				writeMu.Lock()
+				err = rtsp.WriteInterleavedFrame(conn, uint8(tr.Interleaved[0]), raw)
+				writeMu.Unlock()
+			} else {
+				_, err = udp.WriteToUDP(raw, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: tr.ClientPort[0]})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 300; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRTSPSource_Publish(t *testing.T) {
+	for _, transport := range []string{rtsp.TransportTCP, rtsp.TransportUDP} {
+		transport := transport
+		t.Run(transport, func(t *testing.T) {
+			server := newTestRTSPServer(t, "secret", true)
+			defer server.close()
+			s := NewSFU(newTestConfig())
+
+			_, err := NewRTSPSource(s, RTSPSourceConfig{URL: server.url()})
+			assert.Equal(t, errRTSPSourceNotStarted, err)
+			src, err := NewRTSPSource(s, RTSPSourceConfig{
+				URL:            server.url(),
+				Session:        "cameras",
+				StreamID:       "cam",
+				Transport:      transport,
+				ReconnectDelay: 50,
+			})
+			assert.NoError(t, err)
+
+			session, _ := s.GetSession("cameras")
+			video := waitReceiver(session, "cam", "cam-video")
+			if !assert.NotNil(t, video) {
+				return
+			}
+			assert.Equal(t, webrtc.MimeTypeH264, video.Codec().MimeType)
+			assert.Equal(t, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c01f", video.Codec().SDPFmtpLine)
+			assert.Equal(t, uint32(1111), video.SSRC(0))
+			audio := waitReceiver(session, "cam", "cam-audio")
+			if assert.NotNil(t, audio) {
+				assert.Equal(t, webrtc.MimeTypePCMU, audio.Codec().MimeType)
+			}
+			assert.Nil(t, findReceiver(session, "cam", "cam-audio1"))
+
+			// Keyframe requests are sent to the camera
+			video.SendRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: video.SSRC(0)}})
+			assert.True(t, waitFor(func() bool {
+				_, _, plis := server.counts()
+				return plis > 0
+			}))
+
+			// The source reconnects and publishes its tracks again
+			server.drop()
+			assert.True(t, waitFor(func() bool {
+				describes, _, _ := server.counts()
+				return describes >= 4
+			}))
+			// The session without peers was closed with the source tracks
+			session, _ = s.GetSession("cameras")
+			assert.NotNil(t, waitReceiver(session, "cam", "cam-video"))
+
+			src.Close()
+			assert.True(t, waitFor(func() bool {
+				_, teardowns, _ := server.counts()
+				return teardowns > 0 && findReceiver(session, "cam", "cam-video") == nil
+			}))
+		})
+	}
+}
+
+func TestRTSPSource_KeyframeTimeout(t *testing.T) {
+	server := newTestRTSPServer(t, "secret", false)
+	defer server.close()
+	s := NewSFU(newTestConfig())
+
+	src, err := NewRTSPSource(s, RTSPSourceConfig{
+		URL:             server.url(),
+		Session:         "cameras",
+		StreamID:        "cam",
+		KeyframeTimeout: 100,
+	})
+	assert.NoError(t, err)
+	defer src.Close()
+
+	session, _ := s.GetSession("cameras")
+	video := waitReceiver(session, "cam", "cam-video")
+	if !assert.NotNil(t, video) {
+		return
+	}
+	// Without keyframe the source restarts at once
+	video.SendRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: video.SSRC(0)}})
+	assert.True(t, waitFor(func() bool {
+		describes, teardowns, _ := server.counts()
+		return teardowns > 0 && describes >= 4
+	}))
+}
+
+func Test_rtspCodec(t *testing.T) {
+	tests := []struct {
+		name  string
+		media rtsp.Media
+		want  webrtc.RTPCodecCapability
+		ok    bool
+	}{
+		{
+			name:  "h264 profile of the sprop sps",
+			media: rtsp.Media{Codec: "H264", Fmtp: map[string]string{"sprop-parameter-sets": base64.StdEncoding.EncodeToString(testSPS)}},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c01f"},
+			ok:    true,
+		},
+		{
+			name:  "h264",
+			media: rtsp.Media{Codec: "H264", Fmtp: map[string]string{"packetization-mode": "0", "profile-level-id": "4d0029"}},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d0029"},
+			ok:    true,
+		},
+		{
+			name:  "h265",
+			media: rtsp.Media{Codec: "H265", Fmtp: map[string]string{}},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, SDPFmtpLine: "profile-id=1"},
+			ok:    true,
+		},
+		{
+			name:  "pcma",
+			media: rtsp.Media{Codec: "PCMA", PayloadType: 8},
+			want:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+			ok:    true,
+		},
+		{
+			name:  "aac",
+			media: rtsp.Media{Codec: "MPEG4-GENERIC", PayloadType: 97},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			codec, ok := rtspCodec(tt.media)
+			assert.Equal(t, tt.ok, ok)
+			if ok {
+				assert.Equal(t, tt.want, codec.RTPCodecCapability)
+				assert.Equal(t, webrtc.PayloadType(tt.media.PayloadType), codec.PayloadType)
+			}
+		})
+	}
+}
+
+func Test_parameterSets(t *testing.T) {
+	sprop := base64.StdEncoding.EncodeToString(testSPS) + "," + base64.StdEncoding.EncodeToString(testPPS)
+	p := newParameterSets(rtsp.Media{Codec: "H264", Fmtp: map[string]string{"sprop-parameter-sets": sprop}})
+	stapA := append([]byte{0x78, 0x00, byte(len(testSPS))}, testSPS...)
+	stapA = append(append(stapA, 0x00, byte(len(testPPS))), testPPS...)
+
+	// Non IDR frame
+	key, sets := p.process([]byte{0x41, 0x9a}, 1)
+	assert.False(t, key)
+	assert.Nil(t, sets)
+	// IDR frame without parameter sets
+	key, sets = p.process([]byte{0x65, 0x88}, 2)
+	assert.True(t, key)
+	assert.Equal(t, stapA, sets)
+	// FU-A start of an IDR frame
+	key, sets = p.process([]byte{0x7c, 0x85, 0x88}, 3)
+	assert.True(t, key)
+	assert.Equal(t, stapA, sets)
+	// FU-A continuation
+	key, _ = p.process([]byte{0x7c, 0x05, 0x88}, 3)
+	assert.False(t, key)
+	// In band parameter sets are kept and not inserted again
+	sps := []byte{0x67, 0x4d, 0x00, 0x29}
+	_, sets = p.process(sps, 4)
+	assert.Nil(t, sets)
+	_, sets = p.process(testPPS, 4)
+	assert.Nil(t, sets)
+	key, sets = p.process([]byte{0x65, 0x88}, 4)
+	assert.True(t, key)
+	assert.Nil(t, sets)
+	_, sets = p.process([]byte{0x65, 0x88}, 5)
+	assert.Equal(t, append(append([]byte{0x78, 0x00, 0x04}, sps...), stapA[3+len(testSPS):]...), sets)
+
+	// H.265 aggregation packet of the VPS, SPS and PPS
+	vps, hsps, hpps := []byte{0x40, 0x01, 0x0c}, []byte{0x42, 0x01, 0x01}, []byte{0x44, 0x01, 0xc1}
+	p = newParameterSets(rtsp.Media{Codec: "H265", Fmtp: map[string]string{
+		"sprop-vps": base64.StdEncoding.EncodeToString(vps),
+		"sprop-sps": base64.StdEncoding.EncodeToString(hsps),
+		"sprop-pps": base64.StdEncoding.EncodeToString(hpps),
+	}})
+	key, sets = p.process([]byte{0x26, 0x01, 0xaf}, 1)
+	assert.True(t, key)
+	assert.Equal(t, []byte{0x60, 0x01, 0x00, 0x03, 0x40, 0x01, 0x0c, 0x00, 0x03, 0x42, 0x01, 0x01, 0x00, 0x03, 0x44, 0x01, 0xc1}, sets)
+	key, _ = p.process([]byte{0x02, 0x01, 0xaf}, 2)
+	assert.False(t, key)
+
+	assert.Nil(t, newParameterSets(rtsp.Media{Codec: "PCMU"}))
+}
@@ -0,0 +1,256 @@
+/*
+【ファイル概要: rtx.go】
+RTX（RFC 4588）による再送ストリームの処理。
+
+【主要な役割】
+1. パブリッシャーのRTXストリームの紐付け
+   - 非Simulcast: Offerのssrc-group:FIDでRTX SSRCと元のSSRCを対応付け
+   - Simulcast: RTXパケットのMIDとrepaired-rtp-stream-id拡張で元のレイヤーを特定
+   - RTXストリームのBufferを元のストリームのBufferに紐付け、復元したパケットを書き込み
+
+2. サブスクライバーへのRTX送信
+   - ダウントラックごとに専用のRTX SSRCとシーケンス番号空間を持つ
+   - NACKされたパケットはOSN（元のシーケンス番号）を先頭に付けてRTX SSRCで再送
+   - 受信側が再送を重複パケットとして数えず、帯域推定でも区別できる
+
+3. シグナリング
+   - video/rtxコーデック（apt=元のペイロードタイプ）をネゴシエーション
+   - pionは送信トラックのRTX SSRCをSDPに記述しないため、
+     サブスクライバーのOfferにssrc-group:FIDとRTX SSRCの属性を追加
+*/
+package sfu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mimeTypeRTX = "video/rtx"
+
+	repairedRTPStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+)
+
+// getRTXPayloadType returns the payload type of the RTX codec of the payload type
+func getRTXPayloadType(codecs []webrtc.RTPCodecParameters, pt webrtc.PayloadType) (webrtc.PayloadType, bool) {
+	apt := "apt=" + strconv.Itoa(int(pt))
+	for _, c := range codecs {
+		if !strings.EqualFold(c.MimeType, mimeTypeRTX) {
+			continue
+		}
+		for _, p := range strings.Split(c.SDPFmtpLine, ";") {
+			if strings.TrimSpace(p) == apt {
+				return c.PayloadType, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// rtxStream is an upstream track that can be repaired by a RTX stream
+type rtxStream struct {
+	mid            string
+	rid            string
+	ssrc           uint32
+	payloadType    uint8
+	rtxPayloadType uint8
+	midExtID       uint8
+	rridExtID      uint8
+}
+
+// rtxLinker binds the RTX streams of a publisher to the buffers of the
+// streams they repair
+type rtxLinker struct {
+	sync.RWMutex
+	factory *buffer.Factory
+	// ssrcs are the RTX SSRCs signaled with FID groups, to the repaired SSRC
+	ssrcs   map[uint32]uint32
+	streams []rtxStream
+}
+
+func newRTXLinker(factory *buffer.Factory) *rtxLinker {
+	return &rtxLinker{
+		factory: factory,
+		ssrcs:   make(map[uint32]uint32),
+	}
+}
+
+// setRemoteDescription reads the FID groups of the publisher offer
+func (l *rtxLinker) setRemoteDescription(desc webrtc.SessionDescription) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	for _, md := range parsed.MediaDescriptions {
+		for _, attr := range md.Attributes {
+			if attr.Key != sdp.AttrKeySSRCGroup {
+				continue
+			}
+			fields := strings.Fields(attr.Value)
+			if len(fields) != 3 || fields[0] != "FID" {
+				continue
+			}
+			ssrc, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				continue
+			}
+			rtxSSRC, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				continue
+			}
+			l.ssrcs[uint32(rtxSSRC)] = uint32(ssrc)
+		}
+	}
+}
+
+// addTrack registers a track of the publisher, only tracks with a negotiated RTX codec are kept
+func (l *rtxLinker) addTrack(mid string, track *webrtc.TrackRemote, params webrtc.RTPParameters) {
+	rtxPT, ok := getRTXPayloadType(params.Codecs, track.PayloadType())
+	if !ok {
+		return
+	}
+	s := rtxStream{
+		mid:            mid,
+		rid:            track.RID(),
+		ssrc:           uint32(track.SSRC()),
+		payloadType:    uint8(track.PayloadType()),
+		rtxPayloadType: uint8(rtxPT),
+	}
+	for _, ext := range params.HeaderExtensions {
+		switch ext.URI {
+		case sdp.SDESMidURI:
+			s.midExtID = uint8(ext.ID)
+		case repairedRTPStreamIDURI:
+			s.rridExtID = uint8(ext.ID)
+		}
+	}
+	l.Lock()
+	l.streams = append(l.streams, s)
+	l.Unlock()
+}
+
+// link is called with the packets of the buffers that are not bound to a
+// track, if the packet belongs to a RTX stream the buffer is bound to the repaired buffer.
+func (l *rtxLinker) link(b *buffer.Buffer, pkt []byte) {
+	var hdr rtp.Header
+	if _, err := hdr.Unmarshal(pkt); err != nil {
+		return
+	}
+	l.RLock()
+	repaired, ok := l.ssrcs[hdr.SSRC]
+	var stream *rtxStream
+	for i := range l.streams {
+		s := &l.streams[i]
+		if s.rtxPayloadType != hdr.PayloadType {
+			continue
+		}
+		if ok && s.ssrc == repaired {
+			stream = s
+			break
+		}
+		if !ok && s.rid != "" && s.rridExtID != 0 && string(hdr.GetExtension(s.rridExtID)) == s.rid &&
+			(s.midExtID == 0 || string(hdr.GetExtension(s.midExtID)) == s.mid) {
+			stream = s
+			break
+		}
+	}
+	l.RUnlock()
+	if stream == nil || l.factory == nil {
+		return
+	}
+	if buff := l.factory.GetBuffer(stream.ssrc); buff != nil {
+		b.BindRTX(buff, stream.payloadType)
+	}
+}
+
+// writeRTX writes a retransmission on the RTX stream of the down track, or on
+// the media stream when RTX was not negotiated. The header sequence number is
+// the one the subscriber asked for.
+func (d *DownTrack) writeRTX(hdr *rtp.Header, payload []byte) error {
+	if d.rtxPayloadType == 0 {
+		_, err := d.processRTP(hdr, payload)
+		return err
+	}
+	rtxPayload := make([]byte, 2+len(payload))
+	rtxPayload[0] = byte(hdr.SequenceNumber >> 8)
+	rtxPayload[1] = byte(hdr.SequenceNumber)
+	copy(rtxPayload[2:], payload)
+
+	hdr.SequenceNumber = uint16(atomic.AddUint32(&d.rtxSN, 1))
+	hdr.SSRC = d.rtxSSRC
+	hdr.PayloadType = d.rtxPayloadType
+	hdr.Padding = false
+	_, err := d.processRTP(hdr, rtxPayload)
+	return err
+}
+
+// addSSRCGroups signals the RTX or FEC SSRCs of the down tracks in the offer,
+// in the media sections with the codec. tracks is the media SSRC of every
+// down track to its repair SSRC.
+func addSSRCGroups(offer webrtc.SessionDescription, semantics, codec string, tracks map[uint32]uint32) (webrtc.SessionDescription, error) {
+	if len(tracks) == 0 {
+		return offer, nil
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return offer, err
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if !hasCodec(md, codec) {
+			continue
+		}
+		for ssrc, repairSSRC := range tracks {
+			prefix := strconv.FormatUint(uint64(ssrc), 10) + " "
+			first := -1
+			var repairAttrs []sdp.Attribute
+			for i, attr := range md.Attributes {
+				if attr.Key != sdp.AttrKeySSRC || !strings.HasPrefix(attr.Value, prefix) {
+					continue
+				}
+				if first < 0 {
+					first = i
+				}
+				repairAttrs = append(repairAttrs, sdp.Attribute{
+					Key:   sdp.AttrKeySSRC,
+					Value: strconv.FormatUint(uint64(repairSSRC), 10) + " " + strings.TrimPrefix(attr.Value, prefix),
+				})
+			}
+			if first < 0 {
+				continue
+			}
+			attrs := make([]sdp.Attribute, 0, len(md.Attributes)+len(repairAttrs)+1)
+			attrs = append(attrs, md.Attributes[:first]...)
+			attrs = append(attrs, sdp.Attribute{
+				Key:   sdp.AttrKeySSRCGroup,
+				Value: fmt.Sprintf("%s %d %d", semantics, ssrc, repairSSRC),
+			})
+			attrs = append(attrs, md.Attributes[first:]...)
+			md.Attributes = append(attrs, repairAttrs...)
+		}
+	}
+	b, err := parsed.Marshal()
+	if err != nil {
+		return offer, err
+	}
+	offer.SDP = string(b)
+	return offer, nil
+}
+
+func hasCodec(md *sdp.MediaDescription, codec string) bool {
+	for _, attr := range md.Attributes {
+		if attr.Key == "rtpmap" && strings.Contains(strings.ToLower(attr.Value), " "+codec+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package sfu
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtp"
+	"github.com/pion/transport/packetio"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getRTXPayloadType(t *testing.T) {
+	codecs := []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRTX, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, PayloadType: 102},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/RTX", SDPFmtpLine: "rtx-time=3000; apt=102"}, PayloadType: 121},
+	}
+	tests := []struct {
+		name string
+		pt   webrtc.PayloadType
+		want webrtc.PayloadType
+		ok   bool
+	}{
+		{name: "Must find the rtx codec", pt: 96, want: 97, ok: true},
+		{name: "Must find the apt between other parameters", pt: 102, want: 121, ok: true},
+		{name: "Must not find codecs without rtx", pt: 98},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := getRTXPayloadType(codecs, tt.pt)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDownTrack_writeRTX(t *testing.T) {
+	w := &probeTestWriter{}
+	d := &DownTrack{
+		ssrc:        1234,
+		payloadType: 96,
+		writeStream: w,
+		rtxSSRC:     5678,
+		rtxSN:       65535,
+	}
+	payload := []byte{0x10, 0x00, 0x00}
+
+	// Not negotiated, sent on the media stream
+	hdr := rtp.Header{SequenceNumber: 10, SSRC: 1234, PayloadType: 96}
+	assert.NoError(t, d.writeRTX(&hdr, payload))
+
+	d.rtxPayloadType = 97
+	for _, sn := range []uint16{10, 11} {
+		hdr = rtp.Header{SequenceNumber: sn, SSRC: 1234, PayloadType: 96}
+		assert.NoError(t, d.writeRTX(&hdr, payload))
+	}
+
+	assert.Len(t, w.headers, 3)
+	assert.Equal(t, uint32(1234), w.headers[0].SSRC)
+	assert.Equal(t, uint16(10), w.headers[0].SequenceNumber)
+	assert.Equal(t, payload, w.payloads[0])
+	for i, hdr := range w.headers[1:] {
+		assert.Equal(t, uint32(5678), hdr.SSRC)
+		assert.Equal(t, uint8(97), hdr.PayloadType)
+		// Own sequence number space
+		assert.Equal(t, uint16(i), hdr.SequenceNumber)
+		assert.Equal(t, append([]byte{0x00, byte(10 + i)}, payload...), w.payloads[i+1])
+	}
+}
+
+func TestRTXLinker_link(t *testing.T) {
+	factory := buffer.NewBufferFactory(500, Logger)
+	l := newRTXLinker(factory)
+	l.streams = []rtxStream{
+		{ssrc: 1000, payloadType: 96, rtxPayloadType: 97},
+		{mid: "0", rid: "f", ssrc: 2000, payloadType: 96, rtxPayloadType: 97, midExtID: 1, rridExtID: 2},
+	}
+	l.ssrcs[1001] = 1000
+	params := webrtc.RTPParameters{Codecs: []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}}}
+	newBuffer := func(ssrc uint32) *buffer.Buffer {
+		b := factory.GetOrNew(packetio.RTPBufferPacket, ssrc).(*buffer.Buffer)
+		b.OnPendingPacket(func(pkt []byte) {
+			l.link(b, pkt)
+		})
+		return b
+	}
+	payload := []byte{0x10, 0x00, 0x00, 0x9d, 0x01, 0x2a}
+	write := func(b *buffer.Buffer, p rtp.Packet) {
+		raw, err := p.Marshal()
+		assert.NoError(t, err)
+		_, err = b.Write(raw)
+		assert.NoError(t, err)
+	}
+
+	for _, ssrc := range []uint32{1000, 2000} {
+		newBuffer(ssrc).Bind(params, buffer.Options{})
+		write(factory.GetBuffer(ssrc), rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: 10, Timestamp: 1000, SSRC: ssrc, PayloadType: 96},
+			Payload: payload,
+		})
+	}
+
+	// Signaled with a FID group
+	write(newBuffer(1001), rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: 1, Timestamp: 1000, SSRC: 1001, PayloadType: 97},
+		Payload: append([]byte{0x00, 0x0b}, payload...),
+	})
+	// Simulcast layer, found with the mid and repaired stream id
+	hdr := rtp.Header{SequenceNumber: 1, Timestamp: 1000, SSRC: 2001, PayloadType: 97}
+	assert.NoError(t, hdr.SetExtension(1, []byte("0")))
+	assert.NoError(t, hdr.SetExtension(2, []byte("f")))
+	write(newBuffer(2001), rtp.Packet{Header: hdr, Payload: append([]byte{0x00, 0x0c}, payload...)})
+	// Unknown streams stay pending
+	write(newBuffer(3001), rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: 1, Timestamp: 1000, SSRC: 3001, PayloadType: 97},
+		Payload: append([]byte{0x00, 0x0d}, payload...),
+	})
+
+	buf := make([]byte, 1500)
+	_, err := factory.GetBuffer(1000).GetPacket(buf, 11)
+	assert.NoError(t, err)
+	_, err = factory.GetBuffer(2000).GetPacket(buf, 12)
+	assert.NoError(t, err)
+	for _, ssrc := range []uint32{1000, 2000} {
+		_, err = factory.GetBuffer(ssrc).GetPacket(buf, 13)
+		assert.Error(t, err)
+	}
+}
+
+func Test_addSSRCGroups(t *testing.T) {
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP: "v=0\r\n" +
+			"o=- 0 0 IN IP4 0.0.0.0\r\n" +
+			"s=-\r\n" +
+			"t=0 0\r\n" +
+			"m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\n" +
+			"c=IN IP4 0.0.0.0\r\n" +
+			"a=mid:0\r\n" +
+			"a=rtpmap:96 VP8/90000\r\n" +
+			"a=rtpmap:97 rtx/90000\r\n" +
+			"a=fmtp:97 apt=96\r\n" +
+			"a=ssrc:1000 cname:stream\r\n" +
+			"a=ssrc:1000 msid:stream track\r\n" +
+			"a=sendonly\r\n" +
+			"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+			"c=IN IP4 0.0.0.0\r\n" +
+			"a=mid:1\r\n" +
+			"a=rtpmap:111 opus/48000/2\r\n" +
+			"a=ssrc:2000 cname:stream\r\n" +
+			"a=sendonly\r\n",
+	}
+	got, err := addSSRCGroups(offer, "FID", "rtx", map[uint32]uint32{1000: 1001, 2000: 2001})
+	assert.NoError(t, err)
+	assert.Contains(t, got.SDP, "a=ssrc-group:FID 1000 1001\r\na=ssrc:1000 cname:stream\r\n")
+	assert.Contains(t, got.SDP, "a=ssrc:1001 cname:stream\r\na=ssrc:1001 msid:stream track\r\n")
+	// No rtx codec in the audio section
+	assert.False(t, strings.Contains(got.SDP, "2001"))
+}
@@ -40,6 +40,9 @@ type packetMeta struct {
 	layer uint8
 	// Information that differs depending the codec
 	misc uint32
+	// The packet is the H.264 parameter sets injected before a keyframe, it
+	// is resent from the copy of the down track
+	parameterSets bool
 }
 
 func (p *packetMeta) setVP8PayloadMeta(tlz0Idx uint8, picID uint16) {
@@ -23,6 +23,8 @@
 5. 音声レベル監視
   - AudioObserverによる音声レベルの追跡
   - "誰が話しているか"機能の実装
+  - DominantSpeakerDetectorによるドミナントスピーカーの検出と変更の通知
+  - 最近話した順のストリームをサブスクライバーに渡し、Last-Nで転送する映像を決定
 
 【セッションのアーキテクチャ】
 - セッション内のすべてのパブリッシャーは、自動的にすべてのサブスクライバーに接続されます
@@ -52,7 +54,10 @@ Session はピアのセットを表すインターフェースです。
 - Subscribe: 新しいピアを既存のパブリッシャーにサブスクライブ
 - AddPeer/RemovePeer: ピアのライフサイクル管理
 - AddRelayPeer: リモートSFUからのリレーピアを追加
+- Routers/AddRouter/RemoveRouter: ピアを持たないパブリッシャー（プレーントランスポートなど）のルーターを管理
+- NewLocalSubscriber: WebRTCを使わずにプロセス内でレシーバーのトラックを受信
 - AudioObserver: 音声レベル監視へのアクセス
+- DominantSpeakerDetector: ドミナントスピーカー検出へのアクセス
 - GetDataChannels/FanOutMessage: データチャネル通信
 */
 type Session interface {
@@ -64,6 +69,7 @@ type Session interface {
 	RemovePeer(peer Peer)
 	AddRelayPeer(peerID string, signalData []byte) ([]byte, error)
 	AudioObserver() *AudioObserver
+	DominantSpeakerDetector() *DominantSpeakerDetector
 	AddDatachannel(owner string, dc *webrtc.DataChannel)
 	GetDCMiddlewares() []*Datachannel
 	GetFanOutDataChannelLabels() []string
@@ -71,6 +77,12 @@ type Session interface {
 	FanOutMessage(origin, label string, msg webrtc.DataChannelMessage)
 	Peers() []Peer
 	RelayPeers() []*RelayPeer
+	Routers() []Router
+	AddRouter(router Router)
+	RemoveRouter(router Router)
+	StartRecording() error
+	StopRecording() error
+	NewLocalSubscriber(recv Receiver, c LocalSubscriberConfig) (*LocalSubscriber, error)
 }
 
 /*
@@ -80,8 +92,11 @@ SessionLocal はSessionインターフェースの具体実装です。
 - id: セッションの一意識別子
 - peers: ピアIDをキーとしたピアマップ
 - relayPeers: リレーピアのマップ（SFU間通信用）
+- routers: ピアを持たないパブリッシャーのルーター（IDがキー）
 - closed: セッションが閉じられたかどうかのアトミックフラグ
 - audioObs: 音声レベル監視機能
+- dominant: ドミナントスピーカー検出
+- speakerOrder: 最近話した順のストリームID（Last-N用）
 - fanOutDCs: ファンアウト型データチャネルのラベルリスト
 - datachannels: 登録されたデータチャネルミドルウェア
 - onCloseHandler: セッションクローズ時のコールバック
@@ -95,19 +110,26 @@ type SessionLocal struct {
 	config         WebRTCTransportConfig
 	peers          map[string]Peer
 	relayPeers     map[string]*RelayPeer
+	routers        map[string]Router
 	closed         atomicBool
 	audioObs       *AudioObserver
+	dominant       *DominantSpeakerDetector
+	speakerOrder   []string
 	fanOutDCs      []string
 	datachannels   []*Datachannel
+	recorder       *sessionRecorder
 	onCloseHandler func()
 }
 
 /*
 AudioLevelsMethod はAPIデータチャネルで音声レベル情報を送信する際のメソッド名です。
 クライアント側はこのメソッド名を使って音声レベルメッセージを識別します。
+DominantSpeakerChangedMethod はドミナントスピーカーの変更（新しいスピーカーの
+ストリームID、いない場合はparamsなし）を送信する際のメソッド名です。
 */
 const (
-	AudioLevelsMethod = "audioLevels"
+	AudioLevelsMethod            = "audioLevels"
+	DominantSpeakerChangedMethod = "dominantSpeakerChanged"
 )
 
 // NewSession creates a new SessionLocal
@@ -116,11 +138,14 @@ func NewSession(id string, dcs []*Datachannel, cfg WebRTCTransportConfig) Sessio
 		id:           id,
 		peers:        make(map[string]Peer),
 		relayPeers:   make(map[string]*RelayPeer),
+		routers:      make(map[string]Router),
 		datachannels: dcs,
 		config:       cfg,
 		audioObs:     NewAudioObserver(cfg.Router.AudioLevelThreshold, cfg.Router.AudioLevelInterval, cfg.Router.AudioLevelFilter),
+		dominant:     NewDominantSpeakerDetector(),
 	}
 	go s.audioLevelObserver(cfg.Router.AudioLevelInterval)
+	go s.dominantSpeakerObserver()
 	return s
 }
 
@@ -133,6 +158,11 @@ func (s *SessionLocal) AudioObserver() *AudioObserver {
 	return s.audioObs
 }
 
+// DominantSpeakerDetector returns the dominant speaker detector of the session
+func (s *SessionLocal) DominantSpeakerDetector() *DominantSpeakerDetector {
+	return s.dominant
+}
+
 func (s *SessionLocal) GetDCMiddlewares() []*Datachannel {
 	return s.datachannels
 }
@@ -207,7 +237,7 @@ func (s *SessionLocal) RemovePeer(p Peer) {
 	if s.peers[pid] == p {
 		delete(s.peers, pid)
 	}
-	peerCount := len(s.peers) + len(s.relayPeers)
+	peerCount := len(s.peers) + len(s.relayPeers) + len(s.routers)
 	s.mu.Unlock()
 
 	// Close SessionLocal if no peers
@@ -216,6 +246,39 @@ func (s *SessionLocal) RemovePeer(p Peer) {
 	}
 }
 
+// AddRouter adds the router of a publisher without peer, its receivers are
+// published with Publish and subscribed by the peers joining the session
+func (s *SessionLocal) AddRouter(router Router) {
+	s.mu.Lock()
+	s.routers[router.ID()] = router
+	s.mu.Unlock()
+}
+
+// RemoveRouter removes the router of a publisher without peer
+func (s *SessionLocal) RemoveRouter(router Router) {
+	s.mu.Lock()
+	if s.routers[router.ID()] == router {
+		delete(s.routers, router.ID())
+	}
+	peerCount := len(s.peers) + len(s.relayPeers) + len(s.routers)
+	s.mu.Unlock()
+
+	if peerCount == 0 {
+		s.Close()
+	}
+}
+
+// Routers returns the routers of the publishers without peer
+func (s *SessionLocal) Routers() []Router {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	routers := make([]Router, 0, len(s.routers))
+	for _, r := range s.routers {
+		routers = append(routers, r)
+	}
+	return routers
+}
+
 func (s *SessionLocal) AddDatachannel(owner string, dc *webrtc.DataChannel) {
 	label := dc.Label()
 
@@ -281,6 +344,13 @@ func (s *SessionLocal) AddDatachannel(owner string, dc *webrtc.DataChannel) {
 // Publish will add a Sender to all peers in current SessionLocal from given
 // Receiver
 func (s *SessionLocal) Publish(router Router, r Receiver) {
+	s.mu.RLock()
+	rec := s.recorder
+	s.mu.RUnlock()
+	if rec != nil {
+		rec.addReceiver(router.ID(), r)
+	}
+
 	for _, p := range s.Peers() {
 		// Don't sub to self
 		if router.ID() == p.ID() || p.Subscriber() == nil {
@@ -338,6 +408,8 @@ func (s *SessionLocal) Subscribe(peer Peer) {
 		})
 	}
 
+	peer.Subscriber().setLastNSpeakers(s.speakers())
+
 	// Subscribe to publisher streams
 	for _, p := range peers {
 		err := p.Publisher().GetRouter().AddDownTracks(peer.Subscriber(), nil)
@@ -356,9 +428,44 @@ func (s *SessionLocal) Subscribe(peer Peer) {
 		}
 	}
 
+	// Subscribe to the publishers without peer
+	for _, r := range s.Routers() {
+		if err := r.AddDownTracks(peer.Subscriber(), nil); err != nil {
+			Logger.Error(err, "Subscribing to Router err")
+			continue
+		}
+	}
+
 	peer.Subscriber().negotiate()
 }
 
+// findReceiver returns the receiver of a track published in the session by a
+// peer, a relay peer or a publisher without peer
+func findReceiver(s Session, streamID, trackID string) Receiver {
+	for _, r := range sessionRouters(s) {
+		for _, recv := range r.GetReceiver() {
+			if recv.StreamID() == streamID && recv.TrackID() == trackID {
+				return recv
+			}
+		}
+	}
+	return nil
+}
+
+// sessionRouters returns the routers of the session, the publishers and the relay peers
+func sessionRouters(s Session) []Router {
+	routers := s.Routers()
+	for _, p := range s.Peers() {
+		if p.Publisher() != nil {
+			routers = append(routers, p.Publisher().GetRouter())
+		}
+	}
+	for _, p := range s.RelayPeers() {
+		routers = append(routers, p.GetRouter())
+	}
+	return routers
+}
+
 // Peers returns peers in this SessionLocal
 func (s *SessionLocal) Peers() []Peer {
 	s.mu.RLock()
@@ -390,11 +497,63 @@ func (s *SessionLocal) Close() {
 	if !s.closed.set(true) {
 		return
 	}
+	_ = s.StopRecording()
 	if s.onCloseHandler != nil {
 		s.onCloseHandler()
 	}
 }
 
+// StartRecording records the tracks published in the session until
+// StopRecording is called or the session is closed
+func (s *SessionLocal) StartRecording() error {
+	s.mu.Lock()
+	if s.recorder != nil {
+		s.mu.Unlock()
+		return errRecordingStarted
+	}
+	rec, err := newSessionRecorder(s.id, s.config.Recorder)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.recorder = rec
+	s.mu.Unlock()
+
+	for _, p := range s.Peers() {
+		if p.Publisher() == nil {
+			continue
+		}
+		for _, recv := range p.Publisher().GetRouter().GetReceiver() {
+			rec.addReceiver(p.ID(), recv)
+		}
+	}
+	for _, r := range s.Routers() {
+		for _, recv := range r.GetReceiver() {
+			rec.addReceiver(r.ID(), recv)
+		}
+	}
+	return nil
+}
+
+// StopRecording finishes the recordings of the session
+func (s *SessionLocal) StopRecording() error {
+	s.mu.Lock()
+	rec := s.recorder
+	s.recorder = nil
+	s.mu.Unlock()
+	if rec == nil {
+		return errRecordingNotStarted
+	}
+	rec.stop()
+	return nil
+}
+
+// NewLocalSubscriber attaches a subscriber of the SFU process to a receiver
+// of the session, the subscriber is closed when the track is unpublished
+func (s *SessionLocal) NewLocalSubscriber(recv Receiver, c LocalSubscriberConfig) (*LocalSubscriber, error) {
+	return newLocalSubscriber(recv, c)
+}
+
 func (s *SessionLocal) FanOutMessage(origin, label string, msg webrtc.DataChannelMessage) {
 	dcs := s.GetDataChannels(origin, label)
 	for _, dc := range dcs {
@@ -453,6 +612,14 @@ func (s *SessionLocal) audioLevelObserver(audioLevelInterval int) {
 			continue
 		}
 
+		order := s.updateSpeakers(levels)
+		for _, p := range s.Peers() {
+			if sub := p.Subscriber(); sub != nil {
+				sub.SetActiveSpeakers(levels)
+				sub.setLastNSpeakers(order)
+			}
+		}
+
 		msg := ChannelAPIMessage{
 			Method: AudioLevelsMethod,
 			Params: levels,
@@ -474,3 +641,61 @@ func (s *SessionLocal) audioLevelObserver(audioLevelInterval int) {
 		}
 	}
 }
+
+// dominantSpeakerObserver sends the changes of the dominant speaker on the API
+// data channels
+func (s *SessionLocal) dominantSpeakerObserver() {
+	ticker := time.NewTicker(dominantSpeakerInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if s.closed.get() {
+			return
+		}
+		streamID, changed := s.dominant.decide(now)
+		if !changed {
+			continue
+		}
+
+		l, err := json.Marshal(&ChannelAPIMessage{
+			Method: DominantSpeakerChangedMethod,
+			Params: streamID,
+		})
+		if err != nil {
+			Logger.Error(err, "Marshaling dominant speaker err")
+			continue
+		}
+		sl := string(l)
+		for _, ch := range s.GetDataChannels("", APIChannelLabel) {
+			if err = ch.SendText(sl); err != nil {
+				Logger.Error(err, "Sending dominant speaker err")
+			}
+		}
+	}
+}
+
+// speakers returns the stream ids ordered by the most recent speakers
+func (s *SessionLocal) speakers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.speakerOrder
+}
+
+// updateSpeakers moves the active speakers to the front of the speaker order,
+// the streams without audio are removed
+func (s *SessionLocal) updateSpeakers(levels []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := make(map[string]struct{}, len(levels))
+	order := make([]string, 0, len(levels)+len(s.speakerOrder))
+	for _, id := range levels {
+		active[id] = struct{}{}
+		order = append(order, id)
+	}
+	for _, id := range s.speakerOrder {
+		if _, ok := active[id]; !ok && s.audioObs.hasStream(id) {
+			order = append(order, id)
+		}
+	}
+	s.speakerOrder = order
+	return order
+}
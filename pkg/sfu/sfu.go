@@ -91,12 +91,14 @@ WebRTCTransportConfig はピア接続作成時に使用される完全な設定
 - Setting: Pionの詳細設定（ポート範囲、UDPマルチプレクサなど）
 - Router: メディアルーティングに関する設定
 - BufferFactory: RTP/RTCPバッファの作成ファクトリー
+- Recorder: セッションの録画設定
 */
 type WebRTCTransportConfig struct {
 	Configuration webrtc.Configuration
 	Setting       webrtc.SettingEngine
 	Router        RouterConfig
 	BufferFactory *buffer.Factory
+	Recorder      RecorderConfig
 }
 
 /*
@@ -140,6 +142,9 @@ Config はSFU全体の設定を定義するトップレベルの構造体です
 - WebRTC: WebRTC関連の設定
 - Router: メディアルーティング設定
 - Turn: TURNサーバーの設定
+- Recorder: セッションの録画設定
+- RTSP: セッションに取り込むRTSPソース（IPカメラなど）とストリームを配信するRTSPサーバー
+- HLS: シグナルサーバーがHTTPで配信するLow-Latency HLSのストリーム
 - BufferFactory: カスタムバッファファクトリー（オプション）
 - TurnAuth: カスタムTURN認証関数（オプション）
 */
@@ -148,9 +153,12 @@ type Config struct {
 		Ballast   int64 `mapstructure:"ballast"`
 		WithStats bool  `mapstructure:"withstats"`
 	} `mapstructure:"sfu"`
-	WebRTC        WebRTCConfig `mapstructure:"webrtc"`
-	Router        RouterConfig `mapstructure:"Router"`
-	Turn          TurnConfig   `mapstructure:"turn"`
+	WebRTC        WebRTCConfig   `mapstructure:"webrtc"`
+	Router        RouterConfig   `mapstructure:"Router"`
+	Turn          TurnConfig     `mapstructure:"turn"`
+	Recorder      RecorderConfig `mapstructure:"recorder"`
+	RTSP          RTSPConfig     `mapstructure:"rtsp"`
+	HLS           HLSConfig      `mapstructure:"hls"`
 	BufferFactory *buffer.Factory
 	TurnAuth      func(username string, realm string, srcAddr net.Addr) ([]byte, bool)
 }
@@ -281,6 +289,7 @@ func NewWebRTCTransportConfig(c Config) WebRTCTransportConfig {
 		Setting:       se,
 		Router:        c.Router,
 		BufferFactory: c.BufferFactory,
+		Recorder:      c.Recorder,
 	}
 
 	if len(c.WebRTC.Candidates.NAT1To1IPs) > 0 {
@@ -325,6 +334,7 @@ NewSFU は新しいSFUインスタンスを作成します。
 4. WebRTC Transport設定の構築
 5. セッションマップの初期化
 6. オプションのTURNサーバーの起動
+7. 設定されたRTSPソースの取り込みとRTSPサーバーの開始
 
 【バラストメモリについて】
 バラストは大きなメモリブロックを割り当てることでGCのヒューリスティックを調整します。
@@ -368,6 +378,17 @@ func NewSFU(c Config) *SFU {
 		sfu.turn = ts
 	}
 
+	for _, src := range c.RTSP.Sources {
+		if _, err := NewRTSPSource(sfu, src); err != nil {
+			Logger.Error(err, "Could not start rtsp source", "url", src.URL)
+		}
+	}
+	if c.RTSP.Server.Address != "" {
+		if _, err := NewRTSPServer(sfu, c.RTSP.Server); err != nil {
+			Logger.Error(err, "Could not start rtsp server", "address", c.RTSP.Server.Address)
+		}
+	}
+
 	runtime.KeepAlive(ballast)
 	return sfu
 }
@@ -484,6 +505,21 @@ func (s *SFU) NewDatachannel(label string) *Datachannel {
 	return dc
 }
 
+/*
+UsePacketMiddlewares はRTPパケットのミドルウェアをSFUに登録します。
+
+【用途】
+以降に作成されるすべてのレシーバーとダウントラックのRTPパケットに適用されます。
+パケットの検査、変更、破棄、複製などに使用します（packetmiddleware.goを参照）。
+セッションの作成前に呼び出す必要があります。
+
+【パラメータ】
+mws: 登録するミドルウェア（先頭から順にパケットを処理）
+*/
+func (s *SFU) UsePacketMiddlewares(mws ...PacketMiddleware) {
+	s.webrtc.Router.PacketMiddlewares = append(s.webrtc.Router.PacketMiddlewares, mws...)
+}
+
 /*
 GetSessions は現在アクティブなすべてのセッションを返します。
 
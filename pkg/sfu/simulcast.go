@@ -19,6 +19,9 @@ const (
 type SimulcastConfig struct {
 	BestQualityFirst    bool `mapstructure:"bestqualityfirst"`
 	EnableTemporalLayer bool `mapstructure:"enabletemporallayer"`
+	EnableProbing       bool `mapstructure:"enableprobing"`
+	ProbeDuration       int  `mapstructure:"probeduration"`
+	Dynacast            bool `mapstructure:"dynacast"`
 }
 
 type simulcastTrackHelpers struct {
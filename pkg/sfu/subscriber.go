@@ -7,6 +7,7 @@
    - 複数のDownTrackを保持（各パブリッシャーごと）
    - トラックの追加・削除
    - ストリームIDによるグループ化
+   - Last-Nによる映像の一時停止（lastn.go）
 
 2. データチャネル管理
    - データチャネルの作成とライフサイクル
@@ -15,6 +16,8 @@
 
 3. SDPネゴシエーション
    - Offerの作成（ダウントラック追加時）
+   - リモートからのOfferへのAnswer（WHEPプレイヤーなどクライアントがOfferする場合）
+   - ダウントラックのRTX・FEC SSRCをOfferに追加
    - リモートSDPの設定（Answerの受信）
    - デバウンスされたネゴシエーション（頻繁な変更の集約）
 
@@ -33,9 +36,11 @@ import (
 	"context"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bep/debounce"
+	"github.com/pion/ion-sfu/pkg/twcc"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
@@ -43,6 +48,9 @@ import (
 const APIChannelLabel = "ion-sfu"
 
 type Subscriber struct {
+	// 64-bit atomic first for the alignment on 32-bit platforms
+	lastREMB uint64
+
 	sync.RWMutex
 
 	id string
@@ -56,12 +64,28 @@ type Subscriber struct {
 	negotiate func()
 	closeOnce sync.Once
 
+	bwe      *twcc.Estimator
+	allocMu  sync.Mutex
+	speakers map[string]struct{}
+
+	lastNMu        sync.Mutex
+	lastN          int
+	pinned         map[string]struct{}
+	lastNSpeakers  []string
+	lastNForwarded []string
+	// lastNSent is set once the forwarded streams are sent to the subscriber
+	lastNSent bool
+
+	layerSelector LayerSelector
+
+	onICEConnectionStateChangeHandler atomic.Value // func(webrtc.ICEConnectionState)
+
 	noAutoSubscribe bool
 }
 
 // NewSubscriber creates a new Subscriber
 func NewSubscriber(id string, cfg WebRTCTransportConfig) (*Subscriber, error) {
-	me, err := getSubscriberMediaEngine()
+	me, err := getSubscriberMediaEngine(cfg.Router.BWE.Enabled, cfg.Router.FEC.Enabled)
 	if err != nil {
 		Logger.Error(err, "NewPeer error")
 		return nil, errPeerConnectionInitFailed
@@ -80,9 +104,15 @@ func NewSubscriber(id string, cfg WebRTCTransportConfig) (*Subscriber, error) {
 		pc:              pc,
 		tracks:          make(map[string][]*DownTrack),
 		channels:        make(map[string]*webrtc.DataChannel),
+		lastN:           cfg.Router.LastN,
 		noAutoSubscribe: false,
 	}
 
+	if cfg.Router.BWE.Enabled {
+		s.bwe = newSendSideEstimator(cfg.Router.BWE)
+		s.bwe.OnEstimate(s.allocateBitrate)
+	}
+
 	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		Logger.V(1).Info("ice connection status", "state", connectionState)
 		switch connectionState {
@@ -96,6 +126,9 @@ func NewSubscriber(id string, cfg WebRTCTransportConfig) (*Subscriber, error) {
 				}
 			})
 		}
+		if handler, ok := s.onICEConnectionStateChangeHandler.Load().(func(webrtc.ICEConnectionState)); ok && handler != nil {
+			handler(connectionState)
+		}
 	})
 
 	go s.downTracksReports()
@@ -123,6 +156,11 @@ func (s *Subscriber) AddDatachannel(peer Peer, dc *Datachannel) error {
 		})
 	})
 
+	if dc.Label == APIChannelLabel {
+		// Last-N is applied before the channel opens, on join
+		ndc.OnOpen(s.applyLastN)
+	}
+
 	s.channels[dc.Label] = ndc
 
 	return nil
@@ -148,6 +186,10 @@ func (s *Subscriber) CreateOffer() (webrtc.SessionDescription, error) {
 		return webrtc.SessionDescription{}, err
 	}
 
+	if offer, err = s.addRepairSSRCGroups(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
 	err = s.pc.SetLocalDescription(offer)
 	if err != nil {
 		return webrtc.SessionDescription{}, err
@@ -156,6 +198,53 @@ func (s *Subscriber) CreateOffer() (webrtc.SessionDescription, error) {
 	return offer, nil
 }
 
+// Answer an offer of the remote peer, for the peers creating the offers of
+// the subscriber transport. The down tracks are sent on the offered
+// transceivers of their kind, the ones left are sent after a later offer.
+func (s *Subscriber) Answer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if err := s.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	if answer, err = s.addRepairSSRCGroups(answer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	if err = s.pc.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	return answer, nil
+}
+
+// addRepairSSRCGroups signals the RTX and FEC streams of the down tracks,
+// pion does not signal them for the local tracks
+func (s *Subscriber) addRepairSSRCGroups(desc webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	rtxSSRCs := make(map[uint32]uint32)
+	fecSSRCs := make(map[uint32]uint32)
+	for _, dt := range s.DownTracks() {
+		if dt.transceiver == nil || dt.transceiver.Sender() == nil {
+			continue
+		}
+		for _, enc := range dt.transceiver.Sender().GetParameters().Encodings {
+			if dt.rtxSSRC != 0 {
+				rtxSSRCs[uint32(enc.SSRC)] = dt.rtxSSRC
+			}
+			if dt.fecSSRC != 0 {
+				fecSSRCs[uint32(enc.SSRC)] = dt.fecSSRC
+			}
+		}
+	}
+	desc, err := addSSRCGroups(desc, "FID", "rtx", rtxSSRCs)
+	if err != nil {
+		return desc, err
+	}
+	return addSSRCGroups(desc, "FEC-FR", "flexfec-03", fecSSRCs)
+}
+
 // OnICECandidate handler
 func (s *Subscriber) OnICECandidate(f func(c *webrtc.ICECandidate)) {
 	s.pc.OnICECandidate(f)
@@ -172,18 +261,18 @@ func (s *Subscriber) AddICECandidate(candidate webrtc.ICECandidateInit) error {
 
 func (s *Subscriber) AddDownTrack(streamID string, downTrack *DownTrack) {
 	s.Lock()
-	defer s.Unlock()
 	if dt, ok := s.tracks[streamID]; ok {
 		dt = append(dt, downTrack)
 		s.tracks[streamID] = dt
 	} else {
 		s.tracks[streamID] = []*DownTrack{downTrack}
 	}
+	s.Unlock()
+	s.applyLastN()
 }
 
 func (s *Subscriber) RemoveDownTrack(streamID string, downTrack *DownTrack) {
 	s.Lock()
-	defer s.Unlock()
 	if dts, ok := s.tracks[streamID]; ok {
 		idx := -1
 		for i, dt := range dts {
@@ -199,6 +288,8 @@ func (s *Subscriber) RemoveDownTrack(streamID string, downTrack *DownTrack) {
 			s.tracks[streamID] = dts
 		}
 	}
+	s.Unlock()
+	s.applyLastN()
 }
 
 func (s *Subscriber) AddDataChannel(label string) (*webrtc.DataChannel, error) {
@@ -263,6 +354,37 @@ func (s *Subscriber) GetDownTracks(streamID string) []*DownTrack {
 	return s.tracks[streamID]
 }
 
+// SetLayerSelector overrides the router layer selection policy for all
+// the down tracks of the subscriber, nil restores the policy of the routers
+func (s *Subscriber) SetLayerSelector(ls LayerSelector) {
+	s.Lock()
+	s.layerSelector = ls
+	for _, dts := range s.tracks {
+		for _, dt := range dts {
+			dt.SetLayerSelector(ls)
+		}
+	}
+	s.Unlock()
+}
+
+func (s *Subscriber) getLayerSelector() LayerSelector {
+	s.RLock()
+	defer s.RUnlock()
+	return s.layerSelector
+}
+
+func (s *Subscriber) OnICEConnectionStateChange(f func(connectionState webrtc.ICEConnectionState)) {
+	s.onICEConnectionStateChangeHandler.Store(f)
+}
+
+func (s *Subscriber) SignalingState() webrtc.SignalingState {
+	return s.pc.SignalingState()
+}
+
+func (s *Subscriber) PeerConnection() *webrtc.PeerConnection {
+	return s.pc
+}
+
 // Negotiate fires a debounced negotiation request
 func (s *Subscriber) Negotiate() {
 	s.negotiate()
@@ -0,0 +1,180 @@
+/*
+【ファイル概要: svc.go】
+VP9 SVC（Scalable Video Coding）とAV1 SVCのダウントラック処理。
+
+【主要な役割】
+1. レイヤーの選択的転送
+   - 1つの上りSSRCに含まれる空間・時間レイヤーから、サブスクライバーごとに
+     転送するレイヤーを選択
+   - 選択外のレイヤー（SID/TIDが現在のレイヤーより大きい）のパケットを破棄
+   - 破棄したパケット分シーケンス番号を詰めて書き換え
+   - VP9はペイロード記述子、AV1はDependency Descriptorからレイヤー情報を取得
+
+2. レイヤー切り替え
+   - 空間レイヤーのアップ: キーフレーム、または過去のフレームに依存しない
+     1つ上のレイヤーフレーム（VP9: P=0、AV1: DTIがSwitch）で切り替え
+     （待機中のPLIはダウントラックごとにpliThrottleの間隔で送信）
+   - 空間・時間レイヤーのダウン: ピクチャの先頭で切り替え
+   - 時間レイヤーのアップ: スイッチングアップポイント（VP9: U=1、AV1: DTIがSwitch）で切り替え
+
+3. マーカービット
+   - VP9のマーカービットはピクチャの最上位空間レイヤーの最終パケットに付与される
+   - 上位レイヤーを破棄した場合、転送する最上位レイヤーのフレーム終端（E=1）に付与
+*/
+package sfu
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtcp"
+)
+
+// svcFrame is the layer data of a packet
+type svcFrame struct {
+	spatialID  int32
+	temporalID int32
+	begin      bool
+	end        bool
+	// spatialSwitch is set when the frame does not depend on previous
+	// frames of its spatial layer
+	spatialSwitch bool
+	// temporalSwitch is set on switching up points to the frame temporal layer
+	temporalSwitch bool
+}
+
+func getSVCFrame(extPkt *buffer.ExtPacket) (f svcFrame, ok bool) {
+	switch pld := extPkt.Payload.(type) {
+	case buffer.VP9:
+		if !pld.LayerIndices {
+			return
+		}
+		return svcFrame{
+			spatialID:      int32(pld.SID),
+			temporalID:     int32(pld.TID),
+			begin:          pld.BeginOfFrame,
+			end:            pld.EndOfFrame,
+			spatialSwitch:  !pld.InterPicturePredicted,
+			temporalSwitch: pld.U,
+		}, true
+	case buffer.DependencyDescriptor:
+		sw := pld.DecodeTargetIndication(pld.SpatialID(), pld.TemporalID()) == buffer.DTISwitch
+		return svcFrame{
+			spatialID:      int32(pld.SpatialID()),
+			temporalID:     int32(pld.TemporalID()),
+			begin:          pld.StartOfFrame,
+			end:            pld.EndOfFrame,
+			spatialSwitch:  sw,
+			temporalSwitch: sw,
+		}, true
+	}
+	return
+}
+
+func (d *DownTrack) writeSVCRTP(extPkt *buffer.ExtPacket) error {
+	frame, ok := getSVCFrame(extPkt)
+	if !ok {
+		return d.writeSimpleRTP(extPkt)
+	}
+
+	if d.reSync.get() && !extPkt.KeyFrame {
+		if err := d.primeFromGOPCache(0, d.writeSVCRTP); err != nil {
+			return err
+		}
+	}
+
+	if d.reSync.get() {
+		if !extPkt.KeyFrame {
+			d.receiver.SendRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{SenderSSRC: d.ssrc, MediaSSRC: extPkt.Packet.SSRC},
+			})
+			return nil
+		}
+		if d.lastSN != 0 {
+			d.snOffset = extPkt.Packet.SequenceNumber - d.lastSN - 1
+			d.tsOffset = extPkt.Packet.Timestamp - d.lastTS - 1
+		}
+		atomic.StoreUint32(&d.lastSSRC, extPkt.Packet.SSRC)
+		d.reSync.set(false)
+	}
+
+	spatialLayer, temporalLayer := d.switchSVCLayers(extPkt, frame)
+	if frame.spatialID > spatialLayer || frame.temporalID > temporalLayer {
+		// Pkt not in the forwarded layers, update sequence number offset to avoid gaps
+		d.snOffset++
+		return nil
+	}
+
+	d.UpdateStats(uint32(len(extPkt.Packet.Payload)))
+
+	newSN := extPkt.Packet.SequenceNumber - d.snOffset
+	newTS := extPkt.Packet.Timestamp - d.tsOffset
+	if d.sequencer != nil {
+		d.sequencer.push(extPkt.Packet.SequenceNumber, newSN, newTS, 0, extPkt.Head)
+	}
+	if extPkt.Head {
+		d.lastSN = newSN
+		d.lastTS = newTS
+	}
+	hdr := extPkt.Packet.Header
+	hdr.PayloadType = d.payloadType
+	hdr.Timestamp = newTS
+	hdr.SequenceNumber = newSN
+	hdr.SSRC = d.ssrc
+	// The forwarded top layer ends the picture
+	if frame.end && frame.spatialID == spatialLayer {
+		hdr.Marker = true
+	}
+
+	return d.writeRTP(&hdr, extPkt.Packet.Payload)
+}
+
+// switchSVCLayers completes the pending layer switches the packet allows,
+// returning the layers to forward.
+func (d *DownTrack) switchSVCLayers(extPkt *buffer.ExtPacket, f svcFrame) (spatialLayer, temporalLayer int32) {
+	spatialLayer = atomic.LoadInt32(&d.currentSpatialLayer)
+	targetSpatialLayer := atomic.LoadInt32(&d.targetSpatialLayer)
+	tl := atomic.LoadInt32(&d.temporalLayer)
+	temporalLayer = tl & 0xffff
+	targetTemporalLayer := tl >> 16
+
+	pictureStart := f.begin && f.spatialID == 0
+
+	switch {
+	case targetSpatialLayer < spatialLayer && pictureStart:
+		spatialLayer = targetSpatialLayer
+		atomic.StoreInt32(&d.currentSpatialLayer, spatialLayer)
+	case targetSpatialLayer > spatialLayer:
+		// Key pictures carry every spatial layer, other pictures can only go up
+		// one layer if it does not depend on previous frames that were not forwarded
+		if pictureStart && extPkt.KeyFrame {
+			spatialLayer = targetSpatialLayer
+			atomic.StoreInt32(&d.currentSpatialLayer, spatialLayer)
+		} else if f.spatialID == spatialLayer+1 && f.begin && f.spatialSwitch {
+			spatialLayer = f.spatialID
+			atomic.StoreInt32(&d.currentSpatialLayer, spatialLayer)
+		} else if pictureStart && time.Since(d.svcPLI) >= pliThrottle {
+			d.svcPLI = time.Now()
+			d.receiver.SendRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{SenderSSRC: d.ssrc, MediaSSRC: extPkt.Packet.SSRC},
+			})
+		}
+	}
+
+	switch {
+	case targetTemporalLayer < temporalLayer && pictureStart:
+		temporalLayer = targetTemporalLayer
+	case targetTemporalLayer > temporalLayer && f.begin &&
+		(extPkt.KeyFrame || f.temporalSwitch && f.temporalID > temporalLayer && f.temporalID <= targetTemporalLayer):
+		if extPkt.KeyFrame {
+			temporalLayer = targetTemporalLayer
+		} else {
+			temporalLayer = f.temporalID
+		}
+	default:
+		return
+	}
+	atomic.StoreInt32(&d.temporalLayer, targetTemporalLayer<<16|temporalLayer)
+	return
+}
@@ -0,0 +1,160 @@
+package sfu
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/pion/ion-sfu/pkg/buffer"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func svcTestPacket(sn uint16, ts uint32, sid, tid uint8, p, marker bool) *buffer.ExtPacket {
+	vp9 := buffer.VP9{
+		LayerIndices:          true,
+		SID:                   sid,
+		TID:                   tid,
+		InterPicturePredicted: p,
+		BeginOfFrame:          true,
+		EndOfFrame:            true,
+	}
+	return &buffer.ExtPacket{
+		Head:     true,
+		KeyFrame: !p && sid == 0,
+		Payload:  vp9,
+		Packet: rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: sn, Timestamp: ts, Marker: marker, SSRC: 5678},
+			Payload: []byte{0x00},
+		},
+	}
+}
+
+func TestDownTrack_writeSVCRTP(t *testing.T) {
+	w := &probeTestWriter{}
+	r := &testReceiver{}
+	d := &DownTrack{
+		ssrc:        1234,
+		payloadType: 98,
+		mime:        "video/vp9",
+		writeStream: w,
+		receiver:    r,
+		trackType:   SVCDownTrack,
+	}
+	d.bound.set(true)
+	d.enabled.set(true)
+	d.reSync.set(true)
+	d.SetInitialLayers(1, 1)
+
+	write := func(pkts ...*buffer.ExtPacket) {
+		for _, p := range pkts {
+			assert.NoError(t, d.WriteRTP(p, 0))
+		}
+	}
+	// Waits for a keyframe
+	write(svcTestPacket(1, 0, 0, 0, true, false))
+	assert.Empty(t, w.headers)
+	write(
+		svcTestPacket(2, 1000, 0, 0, false, false),
+		svcTestPacket(3, 1000, 1, 0, false, true),
+	)
+	// Going down drops the upper layer and marks the new top layer
+	assert.NoError(t, d.SwitchSpatialLayer(0, false))
+	write(
+		svcTestPacket(4, 4000, 0, 1, true, false),
+		svcTestPacket(5, 4000, 1, 1, true, true),
+	)
+	// Going down a temporal layer drops TID 1
+	d.SwitchTemporalLayer(0, false)
+	write(
+		svcTestPacket(6, 7000, 0, 1, true, false),
+		svcTestPacket(7, 7000, 1, 1, true, true),
+		svcTestPacket(8, 10000, 0, 0, true, false),
+		svcTestPacket(9, 10000, 1, 0, true, true),
+	)
+	// Going up waits for a keyframe
+	assert.NoError(t, d.SwitchSpatialLayer(1, false))
+	write(
+		svcTestPacket(10, 13000, 0, 0, true, false),
+		svcTestPacket(11, 13000, 1, 0, true, true),
+	)
+	assert.Equal(t, 2, r.plis)
+	write(
+		svcTestPacket(12, 16000, 0, 0, false, false),
+		svcTestPacket(13, 16000, 1, 0, false, true),
+	)
+	assert.Equal(t, 1, d.CurrentSpatialLayer())
+
+	type out struct {
+		sn     uint16
+		ts     uint32
+		marker bool
+	}
+	want := []out{
+		{2, 1000, false}, {3, 1000, true},
+		{4, 4000, true},
+		{5, 10000, true},
+		{6, 13000, true},
+		{7, 16000, false}, {8, 16000, true},
+	}
+	var got []out
+	for _, h := range w.headers {
+		assert.Equal(t, uint32(1234), h.SSRC)
+		got = append(got, out{h.SequenceNumber, h.Timestamp, h.Marker})
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestDownTrack_switchSVCLayersPLI(t *testing.T) {
+	r := &testReceiver{}
+	d := &DownTrack{receiver: r, trackType: SVCDownTrack}
+	d.SetInitialLayers(0, 0)
+	d.targetSpatialLayer = 1
+
+	frame := svcFrame{begin: true, end: true}
+	for sn := uint16(1); sn < 30; sn++ {
+		d.switchSVCLayers(svcTestPacket(sn, uint32(sn)*3000, 0, 0, true, false), frame)
+	}
+	// The pending upgrade requests one keyframe per interval
+	assert.Equal(t, 1, r.plis)
+
+	d.svcPLI = d.svcPLI.Add(-pliThrottle)
+	d.switchSVCLayers(svcTestPacket(30, 90000, 0, 0, true, false), frame)
+	assert.Equal(t, 2, r.plis)
+
+	// No request once the upgrade is done
+	d.switchSVCLayers(svcTestPacket(31, 93000, 0, 0, false, false), frame)
+	assert.Equal(t, int32(1), d.currentSpatialLayer)
+	d.svcPLI = d.svcPLI.Add(-pliThrottle)
+	d.switchSVCLayers(svcTestPacket(32, 96000, 0, 0, true, false), frame)
+	assert.Equal(t, 2, r.plis)
+}
+
+func TestDownTrack_handleRTCPSVC(t *testing.T) {
+	d := &DownTrack{
+		ssrc:     1234,
+		lastSSRC: 5678,
+		mime:     "video/vp9",
+		receiver: &testReceiver{
+			// The spatial layers of a SVC stream include the lower layers
+			bitrate:          [3]uint64{150000, 650000, 2150000},
+			maxTemporalLayer: [3]int32{2, 2, 2},
+		},
+		trackType:        SVCDownTrack,
+		maxSpatialLayer:  2,
+		maxTemporalLayer: 2,
+	}
+	d.bound.set(true)
+	d.enabled.set(true)
+	d.SetInitialLayers(2, 2)
+
+	// High loss and a low estimate switch to a lower spatial layer
+	b, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{{SSRC: 1234, FractionLost: 100}}},
+		&rtcp.ReceiverEstimatedMaximumBitrate{SenderSSRC: 1, Bitrate: 500000, SSRCs: []uint32{1234}},
+	})
+	assert.NoError(t, err)
+	d.handleRTCP(b)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.targetSpatialLayer))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&d.currentSpatialLayer))
+}
@@ -0,0 +1,583 @@
+package twcc
+
+import (
+	"math"
+	"sync"
+
+	"github.com/pion/rtcp"
+)
+
+// 定数定義：送信側帯域推定（GCC: Google Congestion Control）のパラメータ
+// 値はlibwebrtcのGCC実装（TrendlineEstimator / OveruseDetector / AimdRateControl）に準拠する
+const (
+	// sendHistorySize: 送信済みパケット履歴のリングバッファサイズ
+	// 5Mbps・1200バイトのパケットで約8秒分を保持できる
+	sendHistorySize = 1 << 12
+
+	// burstInterval: 同一パケットグループとみなす送信時刻の幅（5ミリ秒）
+	burstInterval = 5e6
+
+	// trendlineWindow: 遅延トレンドの線形回帰に使用するサンプル数
+	trendlineWindow = 20
+	// trendlineSmoothing: 累積遅延の指数平滑化係数
+	trendlineSmoothing = 0.9
+	// trendlineGain: トレンド（傾き）に掛けるゲイン
+	trendlineGain = 4.0
+	// maxDeltas: トレンドに掛けるデルタ数の上限
+	maxDeltas = 60
+
+	// overuseTimeThreshold: 過負荷と判定するまでに閾値を超え続ける必要がある時間（ミリ秒）
+	overuseTimeThreshold = 10
+	// thresholdInitial / thresholdMin / thresholdMax: 適応閾値の初期値と範囲（ミリ秒）
+	thresholdInitial = 12.5
+	thresholdMin     = 6
+	thresholdMax     = 600
+	// thresholdUp / thresholdDown: 適応閾値の増加・減少係数
+	thresholdUp   = 0.0087
+	thresholdDown = 0.039
+	// maxAdaptOffset: 閾値の適応を行わないトレンドの外れ幅（ミリ秒）
+	maxAdaptOffset = 15
+
+	// ackedWindow: 受信確認済みビットレートを計算する時間窓（500ミリ秒）
+	ackedWindow = 500e6
+
+	// decreaseFactor: 過負荷検出時に受信確認済みビットレートに掛ける係数
+	decreaseFactor = 0.85
+	// increaseFactor: 1秒あたりの乗算的増加率
+	increaseFactor = 1.08
+
+	// lossLow / lossHigh: ロスベース推定の下限・上限ロス率
+	lossLow  = 0.02
+	lossHigh = 0.10
+	// lossIncreaseInterval / lossDecreaseInterval: ロスベース推定の更新間隔
+	lossIncreaseInterval = 200e6
+	lossDecreaseInterval = 300e6
+)
+
+// bandwidthUsage: 遅延ベースの過負荷検出器による帯域使用状態
+type bandwidthUsage int
+
+const (
+	usageNormal bandwidthUsage = iota
+	usageOverusing
+	usageUnderusing
+)
+
+// rateControlState: AIMDレート制御の状態
+type rateControlState int
+
+const (
+	rateHold rateControlState = iota
+	rateIncrease
+	rateDecrease
+)
+
+// sentPacket: 送信済みパケットの記録
+// フィードバック受信時に送信時刻とサイズを参照するために使用される
+type sentPacket struct {
+	sn       uint16
+	valid    bool
+	acked    bool
+	size     int
+	sendTime int64
+}
+
+// packetResult: フィードバックから得られたパケットごとの結果
+type packetResult struct {
+	size        int
+	sendTime    int64
+	arrivalTime int64
+	received    bool
+}
+
+// packetGroup: 送信時刻が近いパケットをまとめたグループ
+// 遅延変動はグループ単位で計算される
+type packetGroup struct {
+	firstSend   int64
+	lastSend    int64
+	lastArrival int64
+	complete    bool
+}
+
+// ackedPacket: 受信確認済みビットレート計算用の記録
+type ackedPacket struct {
+	arrivalTime int64
+	size        int
+}
+
+// Estimator: 送信側の帯域推定器（GCCスタイル、遅延ベース＋ロスベース）
+// サブスクライバーPeerConnectionごとに1つ生成され、送信パケットにTransport Wide
+// シーケンス番号を割り当てて送信履歴を記録し、サブスクライバーから返される
+// transport-ccフィードバックから利用可能なビットレートを推定する。
+//
+// 仕様に従う: https://tools.ietf.org/html/draft-ietf-rmcat-gcc-02
+type Estimator struct {
+	sync.Mutex
+
+	// seq: 次に割り当てるTransport Wideシーケンス番号
+	seq uint16
+	// history: 送信済みパケットのリングバッファ
+	history [sendHistorySize]sentPacket
+
+	// 遅延ベース推定の状態
+	group             packetGroup
+	prevGroup         packetGroup
+	firstArrival      int64
+	accumulatedDelay  float64
+	smoothedDelay     float64
+	trendX            []float64
+	trendY            []float64
+	numDeltas         int
+	trend             float64
+	prevTrend         float64
+	threshold         float64
+	lastThresholdTime int64
+	timeOverUsing     float64
+	overuseCounter    int
+	usage             bandwidthUsage
+
+	// AIMDレート制御の状態
+	state         rateControlState
+	lastChange    int64
+	avgMaxBitrate float64
+	varMaxBitrate float64
+
+	// 受信確認済みビットレート
+	acked      []ackedPacket
+	ackedBytes int
+
+	// lastLossUpdate: ロスベース推定を最後に更新した時刻
+	lastLossUpdate int64
+	fractionLost   uint8
+
+	minBitrate   uint64
+	maxBitrate   uint64
+	delayBitrate uint64
+	lossBitrate  uint64
+	estimate     uint64
+
+	// onEstimate: 推定値更新時のコールバック関数
+	onEstimate func(bitrate uint64, fractionLost uint8)
+}
+
+// NewSendSideEstimator: 送信側帯域推定器の生成
+//
+// 引数:
+//   - initialBitrate: 推定の初期値（bps）
+//   - minBitrate: 推定値の下限（bps）
+//   - maxBitrate: 推定値の上限（bps）、0の場合は上限なし
+//
+// 返り値: 初期化されたEstimatorインスタンスへのポインタ
+func NewSendSideEstimator(initialBitrate, minBitrate, maxBitrate uint64) *Estimator {
+	if maxBitrate == 0 {
+		maxBitrate = math.MaxUint64
+	}
+	if initialBitrate < minBitrate {
+		initialBitrate = minBitrate
+	}
+	if initialBitrate > maxBitrate {
+		initialBitrate = maxBitrate
+	}
+	return &Estimator{
+		threshold:     thresholdInitial,
+		timeOverUsing: -1,
+		state:         rateIncrease,
+		avgMaxBitrate: -1,
+		minBitrate:    minBitrate,
+		maxBitrate:    maxBitrate,
+		delayBitrate:  initialBitrate,
+		lossBitrate:   initialBitrate,
+		estimate:      initialBitrate,
+	}
+}
+
+// OnEstimate: 推定値更新時のコールバック関数を設定
+// フィードバックを処理するたびに、最新の推定ビットレートとロス率（RTCP
+// ReceptionReportのFractionLostと同じ1/256単位）が通知される。
+func (e *Estimator) OnEstimate(f func(bitrate uint64, fractionLost uint8)) {
+	e.Lock()
+	e.onEstimate = f
+	e.Unlock()
+}
+
+// Estimate: 現在の推定ビットレート（bps）を返す
+func (e *Estimator) Estimate() uint64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.estimate
+}
+
+// OnPacketSent: 送信するパケットにTransport Wideシーケンス番号を割り当てて記録
+// 呼び出し側は返されたシーケンス番号をtransport-cc拡張ヘッダに書き込んでから送信する。
+//
+// 引数:
+//   - size: ヘッダを含むRTPパケットのサイズ（バイト）
+//   - timeNS: 送信時刻（ナノ秒単位）
+//
+// 返り値: 割り当てられたTransport Wideシーケンス番号
+func (e *Estimator) OnPacketSent(size int, timeNS int64) uint16 {
+	e.Lock()
+	defer e.Unlock()
+
+	sn := e.seq
+	e.seq++
+	e.history[sn%sendHistorySize] = sentPacket{
+		sn:       sn,
+		valid:    true,
+		size:     size,
+		sendTime: timeNS,
+	}
+	return sn
+}
+
+// HandleFeedback: サブスクライバーから受信したtransport-ccフィードバックを処理
+// パケットごとの受信状況と到着時刻を送信履歴と突き合わせ、推定値を更新する。
+//
+// 引数:
+//   - fb: 受信したTransportLayerCC RTCPパケット
+//   - timeNS: フィードバック受信時刻（ナノ秒単位）
+func (e *Estimator) HandleFeedback(fb *rtcp.TransportLayerCC, timeNS int64) {
+	e.Lock()
+	results := e.parseFeedback(fb)
+	e.update(results, timeNS)
+	estimate, lost, handler := e.estimate, e.fractionLost, e.onEstimate
+	e.Unlock()
+
+	if handler != nil && len(results) > 0 {
+		handler(estimate, lost)
+	}
+}
+
+// parseFeedback: フィードバックのステータスチャンクと到着時刻デルタを展開し、
+// 送信履歴と結合したパケット結果をシーケンス番号順で返す
+func (e *Estimator) parseFeedback(fb *rtcp.TransportLayerCC) []packetResult {
+	statuses := make([]uint16, 0, fb.PacketStatusCount)
+	for _, chunk := range fb.PacketChunks {
+		switch c := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			for i := uint16(0); i < c.RunLength; i++ {
+				statuses = append(statuses, c.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			statuses = append(statuses, c.SymbolList...)
+		}
+	}
+	if len(statuses) > int(fb.PacketStatusCount) {
+		statuses = statuses[:fb.PacketStatusCount]
+	}
+
+	results := make([]packetResult, 0, len(statuses))
+	// 参照時刻は64ミリ秒単位、デルタはマイクロ秒単位
+	arrival := int64(fb.ReferenceTime) * 64e3
+	deltaIdx := 0
+	for i, status := range statuses {
+		sn := fb.BaseSequenceNumber + uint16(i)
+		received := status != rtcp.TypeTCCPacketNotReceived
+		if received && status != rtcp.TypeTCCPacketReceivedWithoutDelta && deltaIdx < len(fb.RecvDeltas) {
+			arrival += fb.RecvDeltas[deltaIdx].Delta
+			deltaIdx++
+		}
+
+		sent := &e.history[sn%sendHistorySize]
+		if !sent.valid || sent.sn != sn || sent.acked {
+			continue
+		}
+		if received {
+			sent.acked = true
+		}
+		results = append(results, packetResult{
+			size:        sent.size,
+			sendTime:    sent.sendTime,
+			arrivalTime: arrival * 1e3,
+			received:    received,
+		})
+	}
+	return results
+}
+
+// update: パケット結果から遅延ベース・ロスベースの推定値を更新
+func (e *Estimator) update(results []packetResult, now int64) {
+	if len(results) == 0 {
+		return
+	}
+
+	lost := 0
+	for _, r := range results {
+		if !r.received {
+			lost++
+			continue
+		}
+		e.updateAcked(r)
+		e.updateDelay(r)
+	}
+
+	lossRatio := float64(lost) / float64(len(results))
+	e.fractionLost = uint8(math.Min(lossRatio*256, 255))
+
+	e.updateRate(now)
+	e.updateLoss(lossRatio, now)
+
+	estimate := e.delayBitrate
+	if e.lossBitrate < estimate {
+		estimate = e.lossBitrate
+	}
+	e.estimate = e.clamp(estimate)
+}
+
+// updateAcked: 受信確認済みパケットを時間窓に追加し、窓外のパケットを取り除く
+func (e *Estimator) updateAcked(r packetResult) {
+	e.acked = append(e.acked, ackedPacket{arrivalTime: r.arrivalTime, size: r.size})
+	e.ackedBytes += r.size
+	idx := 0
+	for idx < len(e.acked) && r.arrivalTime-e.acked[idx].arrivalTime > ackedWindow {
+		e.ackedBytes -= e.acked[idx].size
+		idx++
+	}
+	e.acked = e.acked[idx:]
+}
+
+// ackedBitrate: 時間窓内で受信確認されたビットレート（bps）
+func (e *Estimator) ackedBitrate() uint64 {
+	if len(e.acked) < 2 {
+		return 0
+	}
+	return uint64(e.ackedBytes) * 8 * 1e9 / ackedWindow
+}
+
+// updateDelay: パケットグループを構築し、グループ間の遅延変動を
+// トレンドライン推定器と過負荷検出器に入力する
+func (e *Estimator) updateDelay(r packetResult) {
+	if !e.group.complete && e.group.firstSend == 0 {
+		e.group = packetGroup{firstSend: r.sendTime, lastSend: r.sendTime, lastArrival: r.arrivalTime}
+		return
+	}
+	if r.sendTime < e.group.firstSend {
+		// 順序が逆転したパケットは遅延計算に使用しない
+		return
+	}
+	if r.sendTime-e.group.firstSend <= burstInterval {
+		e.group.lastSend = r.sendTime
+		if r.arrivalTime > e.group.lastArrival {
+			e.group.lastArrival = r.arrivalTime
+		}
+		return
+	}
+
+	if e.prevGroup.complete {
+		sendDelta := float64(e.group.lastSend-e.prevGroup.lastSend) / 1e6
+		arrivalDelta := float64(e.group.lastArrival-e.prevGroup.lastArrival) / 1e6
+		e.updateTrendline(arrivalDelta-sendDelta, e.group.lastArrival)
+		e.detect(sendDelta, e.group.lastArrival)
+	}
+	e.group.complete = true
+	e.prevGroup = e.group
+	e.group = packetGroup{firstSend: r.sendTime, lastSend: r.sendTime, lastArrival: r.arrivalTime}
+}
+
+// updateTrendline: 累積遅延を平滑化し、線形回帰で遅延の傾きを求める
+func (e *Estimator) updateTrendline(delayVariation float64, arrivalTime int64) {
+	if e.firstArrival == 0 {
+		e.firstArrival = arrivalTime
+	}
+	if e.numDeltas < 1000 {
+		e.numDeltas++
+	}
+	e.accumulatedDelay += delayVariation
+	e.smoothedDelay = trendlineSmoothing*e.smoothedDelay + (1-trendlineSmoothing)*e.accumulatedDelay
+
+	e.trendX = append(e.trendX, float64(arrivalTime-e.firstArrival)/1e6)
+	e.trendY = append(e.trendY, e.smoothedDelay)
+	if len(e.trendX) > trendlineWindow {
+		e.trendX = e.trendX[1:]
+		e.trendY = e.trendY[1:]
+	}
+	if len(e.trendX) == trendlineWindow {
+		if slope, ok := linearFitSlope(e.trendX, e.trendY); ok {
+			e.trend = slope
+		}
+	}
+}
+
+// detect: トレンドと適応閾値を比較して帯域使用状態を判定
+func (e *Estimator) detect(sendDelta float64, now int64) {
+	deltas := e.numDeltas
+	if deltas > maxDeltas {
+		deltas = maxDeltas
+	}
+	modified := float64(deltas) * e.trend * trendlineGain
+
+	switch {
+	case modified > e.threshold:
+		if e.timeOverUsing == -1 {
+			e.timeOverUsing = sendDelta / 2
+		} else {
+			e.timeOverUsing += sendDelta
+		}
+		e.overuseCounter++
+		if e.timeOverUsing > overuseTimeThreshold && e.overuseCounter > 1 && modified >= e.prevTrend {
+			e.timeOverUsing = 0
+			e.overuseCounter = 0
+			e.usage = usageOverusing
+		}
+	case modified < -e.threshold:
+		e.timeOverUsing = -1
+		e.overuseCounter = 0
+		e.usage = usageUnderusing
+	default:
+		e.timeOverUsing = -1
+		e.overuseCounter = 0
+		e.usage = usageNormal
+	}
+	e.prevTrend = modified
+	e.updateThreshold(modified, now)
+}
+
+// updateThreshold: トレンドの大きさに応じて過負荷検出の閾値を適応的に更新
+func (e *Estimator) updateThreshold(modified float64, now int64) {
+	if e.lastThresholdTime == 0 {
+		e.lastThresholdTime = now
+	}
+	abs := math.Abs(modified)
+	if abs > e.threshold+maxAdaptOffset {
+		e.lastThresholdTime = now
+		return
+	}
+	k := thresholdUp
+	if abs < e.threshold {
+		k = thresholdDown
+	}
+	delta := math.Min(float64(now-e.lastThresholdTime)/1e6, 100)
+	e.threshold += k * (abs - e.threshold) * delta
+	e.threshold = math.Max(thresholdMin, math.Min(thresholdMax, e.threshold))
+	e.lastThresholdTime = now
+}
+
+// updateRate: 帯域使用状態に従ってAIMDで遅延ベースのビットレートを更新
+func (e *Estimator) updateRate(now int64) {
+	switch e.usage {
+	case usageNormal:
+		if e.state == rateHold {
+			e.state = rateIncrease
+			e.lastChange = now
+		}
+	case usageOverusing:
+		e.state = rateDecrease
+	case usageUnderusing:
+		e.state = rateHold
+	}
+
+	acked := e.ackedBitrate()
+	if e.lastChange == 0 {
+		e.lastChange = now
+	}
+
+	switch e.state {
+	case rateIncrease:
+		// 受信確認済みビットレートを大きく超える増加は行わない
+		if acked > 0 && float64(e.delayBitrate) > 1.5*float64(acked)+10000 {
+			e.lastChange = now
+			break
+		}
+		elapsed := math.Min(float64(now-e.lastChange)/1e9, 1)
+		if elapsed <= 0 {
+			break
+		}
+		var increase float64
+		if e.nearMax(acked) {
+			// 収束付近では1パケット（1200バイト）/200ミリ秒の加算的増加
+			increase = 1200 * 8 * elapsed / 0.2
+		} else {
+			increase = float64(e.delayBitrate) * (math.Pow(increaseFactor, elapsed) - 1)
+		}
+		if increase < 1000 {
+			increase = 1000
+		}
+		e.delayBitrate = e.clamp(e.delayBitrate + uint64(increase))
+		e.lastChange = now
+	case rateDecrease:
+		target := decreaseFactor * float64(acked)
+		if acked == 0 {
+			target = decreaseFactor * float64(e.delayBitrate)
+		}
+		if uint64(target) < e.delayBitrate {
+			e.delayBitrate = e.clamp(uint64(target))
+		}
+		if acked > 0 {
+			e.updateMax(float64(acked))
+		}
+		e.state = rateHold
+		e.lastChange = now
+	}
+}
+
+// nearMax: 受信確認済みビットレートが過去の最大ビットレート付近にあるか
+func (e *Estimator) nearMax(acked uint64) bool {
+	if e.avgMaxBitrate < 0 || acked == 0 {
+		return false
+	}
+	std := math.Sqrt(e.varMaxBitrate * e.avgMaxBitrate)
+	return math.Abs(float64(acked)-e.avgMaxBitrate) < 3*std
+}
+
+// updateMax: 過負荷検出時のビットレートの平均と分散を指数平滑化で更新
+func (e *Estimator) updateMax(bitrate float64) {
+	const alpha = 0.05
+	if e.avgMaxBitrate < 0 {
+		e.avgMaxBitrate = bitrate
+	} else {
+		e.avgMaxBitrate = (1-alpha)*e.avgMaxBitrate + alpha*bitrate
+	}
+	norm := math.Max(e.avgMaxBitrate, 1)
+	e.varMaxBitrate = (1-alpha)*e.varMaxBitrate + alpha*(e.avgMaxBitrate-bitrate)*(e.avgMaxBitrate-bitrate)/norm
+	e.varMaxBitrate = math.Max(0.4, math.Min(2.5, e.varMaxBitrate/1000)) * 1000
+}
+
+// updateLoss: フィードバック内のロス率からロスベースのビットレートを更新
+func (e *Estimator) updateLoss(lossRatio float64, now int64) {
+	switch {
+	case lossRatio < lossLow:
+		if now-e.lastLossUpdate >= lossIncreaseInterval {
+			e.lossBitrate = e.clamp(uint64(float64(e.lossBitrate)*1.05) + 1000)
+			e.lastLossUpdate = now
+		}
+	case lossRatio > lossHigh:
+		if now-e.lastLossUpdate >= lossDecreaseInterval {
+			e.lossBitrate = e.clamp(uint64(float64(e.lossBitrate) * (1 - 0.5*lossRatio)))
+			e.lastLossUpdate = now
+		}
+	}
+	// ロスベースの推定が遅延ベースの推定から大きく乖離しないよう制限する
+	if e.lossBitrate > 2*e.delayBitrate {
+		e.lossBitrate = 2 * e.delayBitrate
+	}
+}
+
+func (e *Estimator) clamp(bitrate uint64) uint64 {
+	if bitrate < e.minBitrate {
+		return e.minBitrate
+	}
+	if bitrate > e.maxBitrate {
+		return e.maxBitrate
+	}
+	return bitrate
+}
+
+// linearFitSlope: 最小二乗法による回帰直線の傾き
+func linearFitSlope(x, y []float64) (float64, bool) {
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	avgX := sumX / float64(len(x))
+	avgY := sumY / float64(len(y))
+	var num, den float64
+	for i := range x {
+		num += (x[i] - avgX) * (y[i] - avgY)
+		den += (x[i] - avgX) * (x[i] - avgX)
+	}
+	if den == 0 {
+		return 0, false
+	}
+	return num / den, true
+}
@@ -0,0 +1,139 @@
+package twcc
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildFeedback: 到着時刻（マイクロ秒）の列からtransport-ccフィードバックを組み立てる
+// 到着時刻が0のパケットは未受信として扱う
+func buildFeedback(base uint16, arrivals []int64) *rtcp.TransportLayerCC {
+	fb := &rtcp.TransportLayerCC{
+		BaseSequenceNumber: base,
+		PacketStatusCount:  uint16(len(arrivals)),
+	}
+	symbols := make([]uint16, 0, len(arrivals))
+	var last int64
+	for i, arrival := range arrivals {
+		if arrival == 0 {
+			symbols = append(symbols, rtcp.TypeTCCPacketNotReceived)
+			continue
+		}
+		if len(fb.RecvDeltas) == 0 {
+			fb.ReferenceTime = uint32(arrival / 64e3)
+			last = int64(fb.ReferenceTime) * 64e3
+		}
+		symbols = append(symbols, rtcp.TypeTCCPacketReceivedLargeDelta)
+		fb.RecvDeltas = append(fb.RecvDeltas, &rtcp.RecvDelta{
+			Type:  rtcp.TypeTCCPacketReceivedLargeDelta,
+			Delta: arrivals[i] - last,
+		})
+		last = arrival
+	}
+	for len(symbols) > 0 {
+		n := 7
+		if len(symbols) < n {
+			n = len(symbols)
+		}
+		fb.PacketChunks = append(fb.PacketChunks, &rtcp.StatusVectorChunk{
+			SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit,
+			SymbolList: symbols[:n],
+		})
+		symbols = symbols[n:]
+	}
+	return fb
+}
+
+// simulate: 一定間隔（ミリ秒）でパケットを送信し、指定した受信間隔で到着したとする
+// フィードバックを返す。lostに含まれるラウンド内インデックスのパケットは未受信とする
+func simulate(e *Estimator, rounds, perRound int, sendInterval, recvInterval int64, lost map[int]bool) {
+	now := int64(1e9)
+	arrival := int64(1e6)
+	for r := 0; r < rounds; r++ {
+		var base uint16
+		arrivals := make([]int64, perRound)
+		for i := 0; i < perRound; i++ {
+			sn := e.OnPacketSent(1200, now)
+			if i == 0 {
+				base = sn
+			}
+			now += sendInterval * 1e6
+			arrival += recvInterval * 1e3
+			if !lost[i] {
+				arrivals[i] = arrival
+			}
+		}
+		e.HandleFeedback(buildFeedback(base, arrivals), now)
+	}
+}
+
+func TestEstimator_OnPacketSent(t *testing.T) {
+	e := NewSendSideEstimator(300000, 100000, 0)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, uint16(i), e.OnPacketSent(1000, int64(i)))
+	}
+	assert.Equal(t, uint64(300000), e.Estimate())
+}
+
+func TestEstimator_HandleFeedback(t *testing.T) {
+	tests := []struct {
+		name         string
+		sendInterval int64
+		recvInterval int64
+		lost         map[int]bool
+		wantIncrease bool
+	}{
+		{
+			name:         "Must increase estimate when network is stable",
+			sendInterval: 10,
+			recvInterval: 10,
+			wantIncrease: true,
+		},
+		{
+			name:         "Must decrease estimate when delay grows",
+			sendInterval: 10,
+			recvInterval: 14,
+		},
+		{
+			name:         "Must decrease estimate on heavy loss",
+			sendInterval: 10,
+			recvInterval: 10,
+			lost:         map[int]bool{1: true, 3: true, 5: true, 7: true, 9: true},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			const initial = 1000000
+			e := NewSendSideEstimator(initial, 100000, 5000000)
+			var got uint64
+			var calls int
+			e.OnEstimate(func(bitrate uint64, _ uint8) {
+				got = bitrate
+				calls++
+			})
+			simulate(e, 50, 20, tt.sendInterval, tt.recvInterval, tt.lost)
+			assert.Equal(t, 50, calls)
+			assert.Equal(t, e.Estimate(), got)
+			if tt.wantIncrease {
+				assert.Greater(t, got, uint64(initial))
+			} else {
+				assert.Less(t, got, uint64(initial))
+			}
+			assert.GreaterOrEqual(t, got, uint64(100000))
+			assert.LessOrEqual(t, got, uint64(5000000))
+		})
+	}
+}
+
+func TestEstimator_FractionLost(t *testing.T) {
+	e := NewSendSideEstimator(1000000, 0, 0)
+	var lost uint8
+	e.OnEstimate(func(_ uint64, fractionLost uint8) {
+		lost = fractionLost
+	})
+	simulate(e, 1, 4, 10, 10, map[int]bool{0: true})
+	assert.Equal(t, uint8(64), lost)
+}